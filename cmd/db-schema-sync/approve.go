@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// Approval methods for --require-approval
+const (
+	// approvalMarker approves a version with the --approved-file marker in its directory
+	approvalMarker = "marker"
+	// approvalTag approves a version with the approved=true object tag on its schema file
+	approvalTag = "tag"
+)
+
+// ApproveCmd approves a schema version so that syncs with --require-approval apply it
+type ApproveCmd struct {
+	Version        string `help:"Version to approve" required:""`
+	ApprovalMethod string `name:"approval-method" help:"How to approve: marker (upload --approved-file into the version directory) or tag (add approved=true to the schema file's tags)" env:"APPROVAL_METHOD" enum:"marker,tag" default:"marker"`
+}
+
+// Run executes the approve command
+func (cmd *ApproveCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+	return cmd.approve(ctx, client, cli)
+}
+
+// approve marks the schema of Version as approved with ApprovalMethod
+func (cmd *ApproveCmd) approve(ctx context.Context, client schemastore.S3Client, cli *CLI) error {
+	schemaKey, err := schemastore.FindSchema(ctx, client, cli.S3Bucket, cli.PathPrefix, cli.SchemaFile, cmd.Version, cli.versioning)
+	if err != nil {
+		return err
+	}
+
+	switch cmd.ApprovalMethod {
+	case approvalTag:
+		if err := schemastore.TagApproved(ctx, client, cli.S3Bucket, schemaKey); err != nil {
+			return fmt.Errorf("failed to tag %s as approved: %w", schemaKey, err)
+		}
+		slog.Info("Version approved", "version", cmd.Version, "key", schemaKey, "tag", schemastore.ApprovedTagKey+"="+schemastore.ApprovedTagValue)
+	default:
+		hostname, _ := os.Hostname()
+		meta := &schemastore.ApprovalMetadata{ApprovedAt: time.Now().UTC(), Hostname: hostname, AppVersion: Version}
+		if err := schemastore.CreateApprovedMarker(ctx, client, cli.S3Bucket, schemaKey, cli.ApprovedFile, meta); err != nil {
+			return fmt.Errorf("failed to create approval marker: %w", err)
+		}
+		slog.Info("Version approved", "version", cmd.Version, "key", schemastore.ApprovedMarkerKey(schemaKey, cli.ApprovedFile))
+	}
+	return nil
+}
+
+// checkApproved reports whether version may be applied. Without --require-approval every version may;
+// otherwise an unapproved version is logged and counted as pending, and the next sync checks again.
+func (s *Syncer) checkApproved(ctx context.Context, schemaKey, version string) (bool, error) {
+	if s.ApprovalMethod == "" {
+		return true, nil
+	}
+	var approved bool
+	var err error
+	switch s.ApprovalMethod {
+	case approvalTag:
+		approved, err = schemastore.CheckApprovedTag(ctx, s.Client, s.S3Bucket, schemaKey)
+	default:
+		approved, err = schemastore.CheckApprovedMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.ApprovedFile)
+	}
+	if err != nil {
+		// Do not apply while the approval is unknown
+		recordS3FetchError()
+		return false, fmt.Errorf("failed to check approval of version %s: %w", version, err)
+	}
+	recordApprovalPending(s.Target, !approved)
+	if !approved {
+		s.logger().Info("Version is pending approval, skipping", "version", version, "approval_method", s.ApprovalMethod)
+	}
+	return approved, nil
+}
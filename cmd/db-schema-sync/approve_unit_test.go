@@ -0,0 +1,117 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withTags keeps object tags for the keys in the bucket
+func withTags(b *memoryBucket, c *mockS3Client) *mockS3Client {
+	var mu sync.Mutex
+	tags := make(map[string][]types.Tag)
+	c.getTaggingFunc = func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+		if !b.has(*params.Key) {
+			return nil, &types.NoSuchKey{}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return &s3.GetObjectTaggingOutput{TagSet: tags[*params.Key]}, nil
+	}
+	c.putTaggingFunc = func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		tags[*params.Key] = params.Tagging.TagSet
+		return &s3.PutObjectTaggingOutput{}, nil
+	}
+	return c
+}
+
+func TestSyncerRequireApproval(t *testing.T) {
+	for _, method := range []string{approvalMarker, approvalTag} {
+		t.Run(method, func(t *testing.T) {
+			applyLog := filepath.Join(t.TempDir(), "apply.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			client := withTags(bucket, bucket.client())
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", ApprovedFile: "approved", PsqldefPath: stub}
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			syncer.SkipLock = true
+			syncer.ApprovalMethod = method
+			syncer.Target = "approval-" + method
+
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if _, err := os.Stat(applyLog); !os.IsNotExist(err) {
+				t.Error("unapproved version was applied")
+			}
+			if got := testutil.ToFloat64(approvalPending.WithLabelValues(syncer.Target)); got != 1 {
+				t.Errorf("approval_pending = %v, want 1", got)
+			}
+
+			approve := &ApproveCmd{Version: "v1", ApprovalMethod: method}
+			if err := approve.approve(context.Background(), client, cli); err != nil {
+				t.Fatalf("approve() error = %v", err)
+			}
+			if got := bucket.has("schemas/v1/approved"); got != (method == approvalMarker) {
+				t.Errorf("approval marker exists = %v with --approval-method %s", got, method)
+			}
+
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if applied, _ := os.ReadFile(applyLog); string(applied) != "applied\n" {
+				t.Errorf("apply log = %q, want one apply after approval", applied)
+			}
+			if got := testutil.ToFloat64(approvalPending.WithLabelValues(syncer.Target)); got != 0 {
+				t.Errorf("approval_pending = %v, want 0", got)
+			}
+		})
+	}
+
+	t.Run("approval unknown", func(t *testing.T) {
+		bucket := newMemoryBucket("schemas/v1/schema.sql")
+		client := bucket.client()
+		client.getTaggingFunc = func(context.Context, *s3.GetObjectTaggingInput, ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+			return nil, errors.New("AccessDenied: GetObjectTagging")
+		}
+		cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: writeStubPsqldef(t, `exit 1`)}
+		syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		defer syncer.Close()
+		syncer.SkipLock = true
+		syncer.ApprovalMethod = approvalTag
+
+		err := syncer.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "failed to check approval of version v1") {
+			t.Fatalf("Run() error = %v, want an approval check failure", err)
+		}
+	})
+}
+
+func TestApproveUnknownVersion(t *testing.T) {
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", ApprovedFile: "approved"}
+	approve := &ApproveCmd{Version: "v2", ApprovalMethod: approvalMarker}
+	if err := approve.approve(context.Background(), bucket.client(), cli); err == nil {
+		t.Fatal("approve() error = nil, want an error for a version without a schema")
+	}
+	if bucket.has("schemas/v2/approved") {
+		t.Error("approval marker was created for a version without a schema")
+	}
+}
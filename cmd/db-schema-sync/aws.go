@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// awsOptions are the global AWS flags shared by the S3 and SQS clients
+type awsOptions struct {
+	Region                string
+	Profile               string
+	AssumeRoleARN         string
+	AssumeRoleExternalID  string
+	AssumeRoleSessionName string
+}
+
+func (c *CLI) awsOptions() awsOptions {
+	return awsOptions{
+		Region:                c.AWSRegion,
+		Profile:               c.AWSProfile,
+		AssumeRoleARN:         c.AssumeRoleARN,
+		AssumeRoleExternalID:  c.AssumeRoleExternalID,
+		AssumeRoleSessionName: c.AssumeRoleSessionName,
+	}
+}
+
+// loadOptions returns the config.LoadDefaultConfig options for the region and profile; empty values keep the SDK defaults
+func (o awsOptions) loadOptions() []func(*config.LoadOptions) error {
+	var opts []func(*config.LoadOptions) error
+	if o.Region != "" {
+		opts = append(opts, config.WithRegion(o.Region))
+	}
+	if o.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(o.Profile))
+	}
+	return opts
+}
+
+// assumeRoleOptions sets the external ID and session name on the assume-role provider
+func (o awsOptions) assumeRoleOptions(ro *stscreds.AssumeRoleOptions) {
+	if o.AssumeRoleExternalID != "" {
+		ro.ExternalID = aws.String(o.AssumeRoleExternalID)
+	}
+	if o.AssumeRoleSessionName != "" {
+		ro.RoleSessionName = o.AssumeRoleSessionName
+	}
+}
+
+// loadAWSConfig loads the default AWS config for the region and profile and, when a role ARN is set,
+// replaces its credentials with ones for the assumed role, refreshed before they expire
+func loadAWSConfig(ctx context.Context, o awsOptions) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx, o.loadOptions()...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	if o.AssumeRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), o.AssumeRoleARN, o.assumeRoleOptions)
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+		slog.Info("Assuming AWS role", "role_arn", o.AssumeRoleARN)
+	}
+	return cfg, nil
+}
+
+// logCallerIdentity logs the AWS identity the clients run as. It costs an STS call, so it is opt-in
+// (--log-aws-identity), and a failure is only logged: the S3 calls report missing permissions themselves.
+func logCallerIdentity(ctx context.Context, cfg aws.Config) {
+	out, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		slog.Warn("Failed to get AWS caller identity", "error", err)
+		return
+	}
+	slog.Info("Using AWS identity", "arn", aws.ToString(out.Arn), "account", aws.ToString(out.Account), "region", cfg.Region)
+}
@@ -0,0 +1,66 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/localstack"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+func TestLoadAWSConfigAssumeRoleLocalStack(t *testing.T) {
+	ctx := context.Background()
+
+	container, err := localstack.Run(ctx, "localstack/localstack:latest")
+	if err != nil {
+		t.Fatalf("failed to start localstack: %v", err)
+	}
+	defer func() {
+		if err := testcontainers.TerminateContainer(container); err != nil {
+			t.Logf("failed to terminate container: %v", err)
+		}
+	}()
+
+	endpoint, err := container.PortEndpoint(ctx, "4566/tcp", "http")
+	if err != nil {
+		t.Fatalf("failed to get endpoint: %v", err)
+	}
+	// Both the STS client behind the assume-role provider and the test's clients go to LocalStack
+	t.Setenv("AWS_ENDPOINT_URL", endpoint)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	cli := &CLI{
+		AWSRegion:             "us-east-1",
+		AssumeRoleARN:         "arn:aws:iam::000000000000:role/schema-sync",
+		AssumeRoleExternalID:  "ext-123",
+		AssumeRoleSessionName: "db-schema-sync-test",
+	}
+	cfg, err := loadAWSConfig(ctx, cli.awsOptions())
+	if err != nil {
+		t.Fatalf("loadAWSConfig() error = %v", err)
+	}
+
+	identity, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		t.Fatalf("GetCallerIdentity() error = %v", err)
+	}
+	if arn := aws.ToString(identity.Arn); !strings.Contains(arn, "assumed-role/schema-sync/db-schema-sync-test") {
+		t.Errorf("caller ARN = %q, want the assumed role session", arn)
+	}
+
+	client, err := schemastore.NewClient(cfg, schemastore.ClientOptions{})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if _, err := client.ListBuckets(ctx, &s3.ListBucketsInput{}); err != nil {
+		t.Errorf("ListBuckets() with the assumed role error = %v", err)
+	}
+}
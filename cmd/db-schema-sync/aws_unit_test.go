@@ -0,0 +1,179 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// isolateAWSConfig points the SDK at an empty credentials file and the given shared config,
+// with static base credentials, so the tests never read the developer's AWS setup
+func isolateAWSConfig(t *testing.T, sharedConfig string) {
+	t.Helper()
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config")
+	credentialsPath := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(configPath, []byte(sharedConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(credentialsPath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", configPath)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsPath)
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "base-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "base-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+}
+
+func TestLoadAWSConfigRegionAndProfile(t *testing.T) {
+	isolateAWSConfig(t, "[profile staging]\nregion = eu-west-1\n")
+
+	tests := []struct {
+		name string
+		opts awsOptions
+		want string
+	}{
+		{name: "defaults", opts: awsOptions{}, want: ""},
+		{name: "profile", opts: awsOptions{Profile: "staging"}, want: "eu-west-1"},
+		{name: "region overrides profile", opts: awsOptions{Region: "ap-northeast-1", Profile: "staging"}, want: "ap-northeast-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadAWSConfig(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatalf("loadAWSConfig() error = %v", err)
+			}
+			if cfg.Region != tt.want {
+				t.Errorf("Region = %q, want %q", cfg.Region, tt.want)
+			}
+		})
+	}
+
+	if _, err := loadAWSConfig(context.Background(), awsOptions{Profile: "missing"}); err == nil {
+		t.Error("loadAWSConfig() with an unknown profile should fail")
+	}
+}
+
+func TestLoadAWSConfigAssumeRole(t *testing.T) {
+	isolateAWSConfig(t, "")
+
+	var form map[string]string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm() error = %v", err)
+		}
+		form = map[string]string{}
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>role-key</AccessKeyId>
+      <SecretAccessKey>role-secret</SecretAccessKey>
+      <SessionToken>role-token</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`)
+	}))
+	defer sts.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+
+	cli := &CLI{
+		AWSRegion:             "us-east-1",
+		AssumeRoleARN:         "arn:aws:iam::123456789012:role/schema-sync",
+		AssumeRoleExternalID:  "ext-123",
+		AssumeRoleSessionName: "db-schema-sync",
+	}
+	cfg, err := loadAWSConfig(context.Background(), cli.awsOptions())
+	if err != nil {
+		t.Fatalf("loadAWSConfig() error = %v", err)
+	}
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if creds.AccessKeyID != "role-key" || creds.SessionToken != "role-token" {
+		t.Errorf("credentials = %q/%q, want the assumed role's", creds.AccessKeyID, creds.SessionToken)
+	}
+
+	want := map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         cli.AssumeRoleARN,
+		"ExternalId":      "ext-123",
+		"RoleSessionName": "db-schema-sync",
+	}
+	for key, value := range want {
+		if form[key] != value {
+			t.Errorf("AssumeRole %s = %q, want %q", key, form[key], value)
+		}
+	}
+}
+
+func TestCreateS3ClientKMSKeyRequiresKMS(t *testing.T) {
+	isolateAWSConfig(t, "")
+
+	for _, sse := range []string{"", "AES256"} {
+		cli := &CLI{AWSRegion: "us-east-1", S3SSE: sse, S3KMSKeyID: "alias/schemas"}
+		if _, err := createS3Client(context.Background(), cli); err == nil {
+			t.Errorf("createS3Client(--s3-sse %q --s3-kms-key-id) should fail", sse)
+		}
+	}
+
+	cli := &CLI{AWSRegion: "us-east-1", S3SSE: "aws:kms", S3KMSKeyID: "alias/schemas"}
+	if _, err := createS3Client(context.Background(), cli); err != nil {
+		t.Errorf("createS3Client(--s3-sse aws:kms --s3-kms-key-id) error = %v", err)
+	}
+}
+
+func TestCreateS3ClientPathStyle(t *testing.T) {
+	isolateAWSConfig(t, "")
+
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Host+r.URL.Path)
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = fmt.Fprint(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>schemas-bucket</Name></ListBucketResult>`)
+	}))
+	defer srv.Close()
+
+	// The SDK already uses path-style requests for an IP address endpoint; a host name needs the flag
+	endpoint := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	var cli CLI
+	parser, err := newParser(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parser.Parse([]string{"--aws-region", "us-east-1", "--s3-endpoint", endpoint, "--s3-use-path-style", "list-versions"}); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	client, err := createS3Client(context.Background(), &cli)
+	if err != nil {
+		t.Fatalf("createS3Client() error = %v", err)
+	}
+	if _, err := client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String("schemas-bucket")}); err != nil {
+		t.Fatalf("ListObjectsV2() error = %v", err)
+	}
+
+	want := strings.TrimPrefix(endpoint, "http://") + "/schemas-bucket"
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("requests = %v, want the bucket in the path of %s", requests, want)
+	}
+}
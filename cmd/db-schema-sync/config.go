@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigCmd groups the subcommands that work on the --config file
+type ConfigCmd struct {
+	Validate ConfigValidateCmd `cmd:"" help:"Parse the --config file and print the effective configuration (passwords and secrets redacted)"`
+}
+
+// ConfigValidateCmd prints the configuration merged from flags, environment variables and --config
+type ConfigValidateCmd struct{}
+
+// redactedValue replaces secrets in the config validate output
+const redactedValue = "<redacted>"
+
+// configFile is the --config flag. Unlike kong.ConfigFlag it does nothing when empty,
+// so it can also be set through its environment variable.
+type configFile string
+
+// BeforeResolve loads the file and adds its resolver
+func (c configFile) BeforeResolve(k *kong.Kong, ctx *kong.Context, trace *kong.Path) error {
+	path := string(ctx.FlagValue(trace.Flag).(configFile))
+	if path == "" {
+		return nil
+	}
+	resolver, err := k.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	ctx.AddResolver(resolver)
+	return nil
+}
+
+// configResolver resolves flags from the --config YAML file. Keys are flag names with '-' replaced by '_'
+// (db_host, on_apply_failed...). Flags and environment variables take precedence over the file.
+type configResolver struct {
+	values map[string]any
+}
+
+// loadYAMLConfig is the kong.ConfigurationLoader for --config
+func loadYAMLConfig(r io.Reader) (kong.Resolver, error) {
+	values := make(map[string]any)
+	if err := yaml.NewDecoder(r).Decode(&values); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	return &configResolver{values: values}, nil
+}
+
+// configKey returns the config file key of flag
+func configKey(flag *kong.Flag) string {
+	return strings.ReplaceAll(flag.Name, "-", "_")
+}
+
+// configAliasKeys returns the config file keys of the aliases of flag, such as target_version for max_version
+func configAliasKeys(flag *kong.Flag) []string {
+	keys := make([]string, len(flag.Aliases))
+	for i, alias := range flag.Aliases {
+		keys[i] = strings.ReplaceAll(alias, "-", "_")
+	}
+	return keys
+}
+
+// Validate rejects keys that match no flag of any command, so a typo is not silently ignored
+func (r *configResolver) Validate(app *kong.Application) error {
+	known := make(map[string]bool)
+	for _, flag := range allFlags(app.Node) {
+		known[configKey(flag)] = true
+		for _, key := range configAliasKeys(flag) {
+			known[key] = true
+		}
+	}
+	var unknown []string
+	for key := range r.values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("unknown keys in config file: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Resolve returns the file value of flag. kong asks resolvers only for flags not given on the command line,
+// but it applies environment variables before resolvers, so a flag whose variable is set is skipped here.
+func (r *configResolver) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+	if envSet(flag) {
+		return nil, nil
+	}
+	if value, ok := r.values[configKey(flag)]; ok {
+		return configValue(value), nil
+	}
+	for _, key := range configAliasKeys(flag) {
+		if value, ok := r.values[key]; ok {
+			return configValue(value), nil
+		}
+	}
+	return nil, nil
+}
+
+// configValue converts a decoded YAML value to the strings kong's mappers accept (db_port: 5432 is an int in YAML)
+func configValue(value any) any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return items
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// envSet reports whether one of the environment variables of flag is set
+func envSet(flag *kong.Flag) bool {
+	for _, env := range flag.Envs {
+		if _, ok := os.LookupEnv(env); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allFlags returns the flags of node and all of its subcommands
+func allFlags(node *kong.Node) []*kong.Flag {
+	flags := slices.Clone(node.Flags)
+	for _, child := range node.Children {
+		flags = append(flags, allFlags(child)...)
+	}
+	return flags
+}
+
+// Run parses --config and prints the effective configuration as YAML
+func (cmd *ConfigValidateCmd) Run(ctx *kong.Context, cli *CLI) error {
+	if cli.ConfigFile == "" {
+		return fmt.Errorf("missing flags: --config")
+	}
+	f, err := os.Open(string(cli.ConfigFile))
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	resolver, err := loadYAMLConfig(f)
+	if err != nil {
+		return err
+	}
+
+	config, err := effectiveConfig(ctx, resolver.(*configResolver))
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// effectiveConfig returns the non-empty value of every flag keyed like the config file.
+// Flags parsed for this invocation (the global ones) report their merged value; subcommand flags
+// report their environment variable, then the file value, then the default.
+func effectiveConfig(ctx *kong.Context, resolver *configResolver) (map[string]any, error) {
+	parsed := make(map[*kong.Flag]bool)
+	for _, p := range ctx.Path {
+		for _, flag := range p.Flags {
+			parsed[flag] = true
+		}
+	}
+
+	config := make(map[string]any)
+	for _, flag := range allFlags(ctx.Model.Node) {
+		key := configKey(flag)
+		if _, ok := config[key]; ok || key == "help" || key == "config" {
+			continue
+		}
+
+		var value, raw any
+		switch {
+		case parsed[flag]:
+			value = ctx.FlagValue(flag)
+		case envSet(flag):
+			for _, env := range flag.Envs {
+				if v, ok := os.LookupEnv(env); ok {
+					raw = v
+					break
+				}
+			}
+		case resolver.values[key] != nil:
+			raw = configValue(resolver.values[key])
+		case flag.HasDefault:
+			raw = flag.Default
+		default:
+			continue
+		}
+		if raw != nil {
+			// Decode with the flag's mapper so values print with their type, as for the parsed flags
+			target := reflect.New(flag.Target.Type()).Elem()
+			token := kong.Token{Type: kong.FlagValueToken, Value: raw}
+			if err := flag.Parse(kong.ScanFromTokens(token), target); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			value = target.Interface()
+		}
+		if v := reflect.ValueOf(value); !v.IsValid() || v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+			continue
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if isSecretKey(key) {
+			value = redactedValue
+		}
+		config[key] = value
+	}
+	return config, nil
+}
+
+// isSecretKey reports whether the value of key must not be printed: passwords, secrets, tokens and
+// Slack webhook URLs, which carry their token in the path
+func isSecretKey(key string) bool {
+	return strings.Contains(key, "password") || strings.Contains(key, "secret") || strings.Contains(key, "token") || key == "slack_webhook_url"
+}
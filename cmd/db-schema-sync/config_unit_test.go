@@ -0,0 +1,112 @@
+//go:build !integration
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+func parseWithConfig(t *testing.T, cli *CLI, content string, args ...string) (*kong.Context, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	parser, err := kong.New(cli, kong.Configuration(loadYAMLConfig), kong.Exit(func(int) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parser.Parse(append([]string{"--config", path}, args...))
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	t.Setenv("PATH_PREFIX", "env/")
+	t.Setenv("DB_NAME", "envdb")
+
+	var cli CLI
+	_, err := parseWithConfig(t, &cli, `s3_bucket: file-bucket
+path_prefix: file/
+engine: mysql
+statement_timeout: 30s
+db_host: db.internal
+db_port: 3306
+db_user: app
+db_password: secret
+db_name: filedb
+`, "--engine", "postgres", "history")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if cli.Engine != EnginePostgres {
+		t.Errorf("Engine = %q, want the flag value", cli.Engine)
+	}
+	if cli.PathPrefix != "env/" || cli.History.DBName != "envdb" {
+		t.Errorf("PathPrefix = %q, DBName = %q, want the environment values", cli.PathPrefix, cli.History.DBName)
+	}
+	if cli.S3Bucket != "file-bucket" || cli.StatementTimeout != 30*time.Second {
+		t.Errorf("S3Bucket = %q, StatementTimeout = %v, want the file values", cli.S3Bucket, cli.StatementTimeout)
+	}
+	// Subcommand database flags can come from the file
+	if cli.History.DBHost != "db.internal" || cli.History.DBPort != "3306" {
+		t.Errorf("DBHost = %q, DBPort = %q, want the file values", cli.History.DBHost, cli.History.DBPort)
+	}
+}
+
+func TestConfigFileUnknownKeys(t *testing.T) {
+	var cli CLI
+	_, err := parseWithConfig(t, &cli, "s3_bucket: b\ndb_hots: localhost\nintervall: 1m\n", "list-versions")
+	if err == nil || !strings.Contains(err.Error(), "unknown keys in config file: db_hots, intervall") {
+		t.Errorf("Parse() error = %v, want unknown keys", err)
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	t.Setenv("WEBHOOK_RETRIES", "5")
+
+	var cli CLI
+	content := `s3_bucket: file-bucket
+db_password: hunter2
+webhook_secret: s3cr3t
+webhook_events: [apply-failed, no-change]
+interval: 5m
+`
+	ctx, err := parseWithConfig(t, &cli, content, "--path-prefix", "flag/", "config", "validate")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	resolver, err := loadYAMLConfig(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := effectiveConfig(ctx, resolver.(*configResolver))
+	if err != nil {
+		t.Fatalf("effectiveConfig() error = %v", err)
+	}
+	want := map[string]any{
+		"s3_bucket":       "file-bucket",
+		"path_prefix":     "flag/",
+		"db_password":     redactedValue,
+		"webhook_secret":  redactedValue,
+		"webhook_events":  []string{"apply-failed", "no-change"},
+		"interval":        "5m0s",
+		"webhook_retries": 5,
+		"schema_file":     "schema.sql",
+	}
+	for key, value := range want {
+		if !reflect.DeepEqual(got[key], value) {
+			t.Errorf("effectiveConfig()[%q] = %#v, want %#v", key, got[key], value)
+		}
+	}
+	if _, ok := got["lock_timeout"]; ok {
+		t.Error("expected unset flags to be omitted")
+	}
+}
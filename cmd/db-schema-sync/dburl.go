@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sslModes are the --db-sslmode values, also accepted as the sslmode parameter of --db-url
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// applyDBURL returns db with the connection settings of a --db-url, which replaces the individual
+// --db-host, --db-port, --db-user, --db-password and --db-name flags
+func applyDBURL(rawURL, engine string, db DBConfig) (DBConfig, error) {
+	if engine != EnginePostgres {
+		return DBConfig{}, fmt.Errorf("--db-url is only supported with --engine %s", EnginePostgres)
+	}
+	if db.Host != "" || db.Port != "" || db.User != "" || db.Name != "" {
+		return DBConfig{}, fmt.Errorf("--db-url cannot be combined with --db-host, --db-port, --db-user or --db-name")
+	}
+	return parseDBURL(rawURL, db)
+}
+
+// parseDBURL parses a postgres:// connection URL into db. A URL without a password keeps db.Password,
+// e.g. from --db-password-file; one with a password cannot be combined with it. The sslmode, sslrootcert
+// and connect_timeout parameters override the --db-sslmode, --db-sslrootcert and --db-connect-timeout
+// flags. A Unix socket directory is given as a percent-encoded host (postgres://user:pass@%2Fvar%2Frun%2Fpostgresql/app)
+// or as the host parameter (postgres://user:pass@/app?host=/var/run/postgresql).
+func parseDBURL(rawURL string, db DBConfig) (DBConfig, error) {
+	socketHost, rawURL, err := cutSocketHost(rawURL)
+	if err != nil {
+		return DBConfig{}, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// url.Error repeats the URL, password included
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return DBConfig{}, fmt.Errorf("invalid --db-url: %w", err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return DBConfig{}, fmt.Errorf("invalid --db-url: scheme must be postgres:// or postgresql://, got %q", u.Scheme)
+	}
+
+	db.Host = u.Hostname()
+	if socketHost != "" {
+		db.Host = socketHost
+	}
+	db.Port = u.Port()
+	db.Name = strings.TrimPrefix(u.Path, "/")
+	if u.User != nil {
+		db.User = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			if db.Password != "" {
+				return DBConfig{}, fmt.Errorf("--db-url has a password, so it cannot be combined with --db-password, --db-password-file or --db-password-secret-arn")
+			}
+			db.Password = password
+		}
+	}
+
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "host":
+			db.Host = value
+		case "port":
+			db.Port = value
+		case "sslmode":
+			if !slices.Contains(sslModes, value) {
+				return DBConfig{}, fmt.Errorf("invalid --db-url: sslmode must be one of %s, got %q", strings.Join(sslModes, ", "), value)
+			}
+			db.SSLMode = value
+		case "sslrootcert":
+			db.SSLRootCert = value
+		case "connect_timeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return DBConfig{}, fmt.Errorf("invalid --db-url: connect_timeout must be a number of seconds, got %q", value)
+			}
+			db.ConnectTimeout = time.Duration(seconds) * time.Second
+		default:
+			return DBConfig{}, fmt.Errorf("invalid --db-url: unsupported parameter %q", key)
+		}
+	}
+
+	if db.Port == "" {
+		db.Port = "5432"
+	}
+	var missing []string
+	for _, f := range []struct{ part, value string }{
+		{"user", db.User},
+		{"password", db.Password},
+		{"host", db.Host},
+		{"database name", db.Name},
+	} {
+		if f.value == "" {
+			missing = append(missing, f.part)
+		}
+	}
+	if len(missing) > 0 {
+		return DBConfig{}, fmt.Errorf("invalid --db-url: missing %s", strings.Join(missing, ", "))
+	}
+	return db, nil
+}
+
+// cutSocketHost removes a percent-encoded Unix socket directory such as %2Fvar%2Frun%2Fpostgresql from
+// the host of rawURL, which url.Parse rejects, and returns it decoded
+func cutSocketHost(rawURL string) (string, string, error) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return "", rawURL, nil
+	}
+	authority := rest
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		authority = rest[:i]
+	}
+	userinfo, hostPort := "", authority
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, hostPort = authority[:i+1], authority[i+1:]
+	}
+	if !strings.HasPrefix(strings.ToUpper(hostPort), "%2F") {
+		return "", rawURL, nil
+	}
+
+	encodedHost, port, _ := strings.Cut(hostPort, ":")
+	host, err := url.PathUnescape(encodedHost)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid --db-url: socket directory: %w", err)
+	}
+	if port != "" {
+		port = ":" + port
+	}
+	return host, scheme + "://" + userinfo + "localhost" + port + rest[len(authority):], nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// defaultDenyDDL matches the destructive statements blocked unless --allow-destructive is set
+var defaultDenyDDL = []string{
+	`(?i)^DROP\s+TABLE\b`,
+	`(?i)\bDROP\s+COLUMN\b`,
+	`(?i)^TRUNCATE\b`,
+}
+
+// compileDenyDDL compiles the --deny-ddl patterns, falling back to defaultDenyDDL when none are given
+func compileDenyDDL(patterns []string) ([]*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		patterns = defaultDenyDDL
+	}
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --deny-ddl pattern %q: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// splitDDLStatements splits sqldef dry-run output into statements.
+// Comment lines such as "-- dry run --" and "-- Skipped: DROP TABLE ..." are not statements.
+func splitDDLStatements(ddl string) []string {
+	var statements []string
+	var current []string
+	for _, line := range strings.Split(ddl, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current = append(current, trimmed)
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.Join(current, " "))
+			current = nil
+		}
+	}
+	if len(current) > 0 {
+		statements = append(statements, strings.Join(current, " "))
+	}
+	return statements
+}
+
+// noChangeMarker is printed by sqldef --dry-run when the database already matches the desired schema
+const noChangeMarker = "-- Nothing is modified --"
+
+// isNoChange reports whether dry-run output says there is nothing to apply
+func isNoChange(dryRun string) bool {
+	return strings.Contains(dryRun, noChangeMarker)
+}
+
+// findDeniedStatements returns the statements of ddl matching any of the deny patterns
+func findDeniedStatements(ddl string, deny []*regexp.Regexp) []string {
+	var denied []string
+	for _, stmt := range splitDDLStatements(ddl) {
+		for _, re := range deny {
+			if re.MatchString(stmt) {
+				denied = append(denied, stmt)
+				break
+			}
+		}
+	}
+	return denied
+}
@@ -0,0 +1,108 @@
+//go:build !integration
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindDeniedStatements(t *testing.T) {
+	deny, err := compileDenyDDL(nil)
+	if err != nil {
+		t.Fatalf("compileDenyDDL() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		dryRun string
+		want   []string
+	}{
+		{
+			name:   "no changes",
+			dryRun: "-- dry run --\n-- Nothing is modified --\n",
+			want:   nil,
+		},
+		{
+			name: "additive changes",
+			dryRun: `-- dry run --
+BEGIN;
+ALTER TABLE "public"."users" ADD COLUMN "email" text;
+CREATE INDEX idx_users_email ON public.users (email);
+COMMIT;
+`,
+			want: nil,
+		},
+		{
+			name: "drop column",
+			dryRun: `-- dry run --
+BEGIN;
+ALTER TABLE "public"."users" DROP COLUMN "legacy_name";
+ALTER TABLE "public"."users" ADD COLUMN "name" text;
+COMMIT;
+`,
+			want: []string{`ALTER TABLE "public"."users" DROP COLUMN "legacy_name";`},
+		},
+		{
+			name: "drop table enabled with --enable-drop-table",
+			dryRun: `-- dry run --
+BEGIN;
+DROP TABLE "public"."sessions";
+COMMIT;
+`,
+			want: []string{`DROP TABLE "public"."sessions";`},
+		},
+		{
+			name: "skipped drops are comments",
+			dryRun: `-- dry run --
+-- Skipped: DROP TABLE "public"."sessions";
+`,
+			want: nil,
+		},
+		{
+			name: "multi-line statement",
+			dryRun: `-- dry run --
+CREATE TABLE "public"."audit" (
+    "id" bigint NOT NULL
+);
+TRUNCATE
+    "public"."audit_tmp";
+`,
+			want: []string{`TRUNCATE "public"."audit_tmp";`},
+		},
+		{
+			name:   "mysql backquoted identifiers",
+			dryRun: "-- dry run --\nALTER TABLE `users` DROP COLUMN `legacy_name`;\n",
+			want:   []string{"ALTER TABLE `users` DROP COLUMN `legacy_name`;"},
+		},
+		{
+			name:   "drop index is allowed by default",
+			dryRun: "-- dry run --\nDROP INDEX idx_users_email;\n",
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findDeniedStatements(tt.dryRun, deny)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findDeniedStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileDenyDDL(t *testing.T) {
+	deny, err := compileDenyDDL([]string{`(?i)^DROP\s+INDEX\b`})
+	if err != nil {
+		t.Fatalf("compileDenyDDL() error = %v", err)
+	}
+	// Custom patterns replace the defaults
+	if got := findDeniedStatements("DROP INDEX idx;\nDROP TABLE t;\n", deny); !reflect.DeepEqual(got, []string{"DROP INDEX idx;"}) {
+		t.Errorf("findDeniedStatements() = %q, want only the DROP INDEX statement", got)
+	}
+
+	if _, err := compileDenyDDL([]string{"("}); err == nil {
+		t.Error("compileDenyDDL() expected error for invalid pattern, got nil")
+	}
+}
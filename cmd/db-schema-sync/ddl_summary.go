@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// DDL statement types counted by ddlSummary and the db_schema_sync_ddl_statements_total type label
+const (
+	ddlCreate = "create"
+	ddlAlter  = "alter"
+	ddlDrop   = "drop"
+	ddlOther  = "other"
+)
+
+// ddlSummary counts the statements of sqldef output by type. Transaction control (BEGIN, COMMIT) is not counted.
+type ddlSummary struct {
+	Create int
+	Alter  int
+	Drop   int
+	Other  int
+}
+
+// summarizeDDL counts the statements in sqldef apply or dry-run output. Banners such as "-- Apply --" and
+// "-- dry run --" and other comment lines are skipped.
+func summarizeDDL(output string) ddlSummary {
+	var s ddlSummary
+	for _, stmt := range splitDDLStatements(output) {
+		switch classifyDDL(stmt) {
+		case ddlCreate:
+			s.Create++
+		case ddlAlter:
+			s.Alter++
+		case ddlDrop:
+			s.Drop++
+		case ddlOther:
+			s.Other++
+		}
+	}
+	return s
+}
+
+// classifyDDL returns the type of stmt, or "" for transaction control
+func classifyDDL(stmt string) string {
+	keyword, _, _ := strings.Cut(strings.TrimSuffix(stmt, ";"), " ")
+	switch strings.ToUpper(keyword) {
+	case "BEGIN", "COMMIT", "ROLLBACK", "START":
+		return ""
+	case "CREATE":
+		return ddlCreate
+	case "ALTER":
+		return ddlAlter
+	case "DROP":
+		return ddlDrop
+	default:
+		return ddlOther
+	}
+}
+
+// Total returns the number of counted statements
+func (s ddlSummary) Total() int {
+	return s.Create + s.Alter + s.Drop + s.Other
+}
+
+// String returns the compact summary passed to hooks, e.g. "create=1 alter=2 drop=0 other=0"
+func (s ddlSummary) String() string {
+	return fmt.Sprintf("create=%d alter=%d drop=%d other=%d", s.Create, s.Alter, s.Drop, s.Other)
+}
+
+// group returns the counts as a log attribute group
+func (s ddlSummary) group(name string) slog.Attr {
+	return slog.Group(name, "statements", s.Total(), ddlCreate, s.Create, ddlAlter, s.Alter, ddlDrop, s.Drop, ddlOther, s.Other)
+}
@@ -0,0 +1,97 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// describeDDL lists each statement of output with its type, then the summary, for the golden files
+func describeDDL(output string) string {
+	var b strings.Builder
+	for _, stmt := range splitDDLStatements(output) {
+		typ := classifyDDL(stmt)
+		if typ == "" {
+			typ = "-"
+		}
+		fmt.Fprintf(&b, "%-6s %s\n", typ, stmt)
+	}
+	fmt.Fprintf(&b, "summary: %s (%d statements)\n", summarizeDDL(output), summarizeDDL(output).Total())
+	return b.String()
+}
+
+func TestSummarizeDDL(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "ddl_summary", "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no inputs in testdata/ddl_summary")
+	}
+	for _, input := range inputs {
+		t.Run(strings.TrimSuffix(filepath.Base(input), ".sql"), func(t *testing.T) {
+			output, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := describeDDL(string(output))
+
+			golden := strings.TrimSuffix(input, ".sql") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("summary does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestDDLSummaryString(t *testing.T) {
+	if got := (ddlSummary{}).String(); got != "create=0 alter=0 drop=0 other=0" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (ddlSummary{Create: 2, Alter: 1, Drop: 1, Other: 3}).String(); got != "create=2 alter=1 drop=1 other=3" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestSyncerDDLSummary(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) printf -- '-- dry run --\nBEGIN;\nALTER TABLE users ADD COLUMN name text;\nCOMMIT;\n' ;;
+*) printf -- '-- Apply --\nBEGIN;\nCREATE TABLE orders (id integer);\nALTER TABLE users ADD COLUMN name text;\nCOMMIT;\n' ;;
+esac`)
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	defer syncer.Close()
+	syncer.SkipLock = true
+	syncer.Target = "ddl-summary"
+	syncer.Hooks.OnApplySucceeded = `echo "$DB_SCHEMA_SYNC_DDL_SUMMARY" >> ` + hookLog
+
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if hook, _ := os.ReadFile(hookLog); string(hook) != "create=1 alter=1 drop=0 other=0\n" {
+		t.Errorf("DB_SCHEMA_SYNC_DDL_SUMMARY = %q", hook)
+	}
+	for typ, want := range map[string]float64{ddlCreate: 1, ddlAlter: 1, ddlDrop: 0, ddlOther: 0} {
+		if got := testutil.ToFloat64(ddlStatementsTotal.WithLabelValues("ddl-summary", typ)); got != want {
+			t.Errorf("ddl_statements_total{type=%q} = %v, want %v", typ, got, want)
+		}
+	}
+}
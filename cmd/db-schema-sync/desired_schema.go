@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// stdinSchemaPath is the LOCAL_FILE argument that reads the desired schema from stdin
+const stdinSchemaPath = "-"
+
+// readDesiredSchema reads the desired schema from path, or from stdin when path is "-".
+// Stdin is limited to maxStdinBytes and must not be empty, so a broken pipe in CI cannot
+// turn into a plan that drops every table.
+func readDesiredSchema(path string, stdin io.Reader, maxStdinBytes int64) ([]byte, error) {
+	if path != stdinSchemaPath {
+		schema, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local file: %w", err)
+		}
+		slog.Info("Using local file as desired state", "file", path)
+		return schema, nil
+	}
+
+	schema, err := io.ReadAll(io.LimitReader(stdin, maxStdinBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema from stdin: %w", err)
+	}
+	if int64(len(schema)) > maxStdinBytes {
+		return nil, fmt.Errorf("schema from stdin exceeds %d bytes (raise --max-stdin-bytes)", maxStdinBytes)
+	}
+	if len(bytes.TrimSpace(schema)) == 0 {
+		return nil, fmt.Errorf("schema from stdin is empty")
+	}
+	slog.Info("Using stdin as desired state", "bytes", len(schema))
+	return schema, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// DoctorCmd checks the S3 prefix, the database and the sqldef tool, and prints a pass/fail report
+type DoctorCmd struct {
+	DBOptions
+
+	LockID  int64  `name:"lock-id" help:"Advisory lock ID to check (default: 0x4442534348454D41)" env:"LOCK_ID"`
+	LockKey string `name:"lock-key" help:"String hashed into the advisory lock ID to check; mutually exclusive with --lock-id" env:"LOCK_KEY"`
+	// SkipWriteCheck is for read-only credentials, e.g. a plan-only deployment
+	SkipWriteCheck bool `name:"skip-write-check" help:"Skip the PutObject and DeleteObjects probe, for read-only S3 credentials" env:"SKIP_WRITE_CHECK"`
+}
+
+// checkStatus is the outcome of one doctor check
+type checkStatus string
+
+const (
+	checkPass checkStatus = "PASS"
+	checkFail checkStatus = "FAIL"
+	checkSkip checkStatus = "SKIP"
+)
+
+// checkResult is one line of the doctor report
+type checkResult struct {
+	Name   string
+	Status checkStatus
+	Detail string
+}
+
+// newCheckResult passes the check with detail when err is nil, and fails it with err otherwise
+func newCheckResult(name string, err error, detail string) checkResult {
+	if err != nil {
+		return checkResult{Name: name, Status: checkFail, Detail: err.Error()}
+	}
+	return checkResult{Name: name, Status: checkPass, Detail: detail}
+}
+
+// doctorProbeFile is the object written and deleted under the path prefix by the S3 write check.
+// It is not inside a version directory, so a sync never mistakes it for a schema.
+const doctorProbeFile = ".db-schema-sync-doctor"
+
+// Run executes the doctor command
+func (cmd *DoctorCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	db, _, err := cmd.dbConfig(ctx, cli)
+	if err != nil {
+		return err
+	}
+	if err := db.validate(cli.Engine); err != nil {
+		return err
+	}
+	lockID, err := resolveLockID(cmd.LockID, cmd.LockKey)
+	if err != nil {
+		return err
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	syncer := NewSyncer(client, cli, db)
+	syncer.LockID = lockID
+	toolName, toolPath := cli.sqldefTool()
+	results := append([]checkResult{checkSqldefTool(ctx, toolName, toolPath)}, syncer.preflight(ctx, cmd.SkipWriteCheck)...)
+	if err := writeCheckReport(os.Stdout, results); err != nil {
+		return err
+	}
+	if failed := failedChecks(results); failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// checkSqldefTool checks that the sqldef tool runs and reports its version
+func checkSqldefTool(ctx context.Context, name, toolPath string) checkResult {
+	version, err := checkSqldef(ctx, name, toolPath)
+	return newCheckResult(name, err, version)
+}
+
+// preflight checks everything a sync needs from S3 and the database: listing the prefix, reading the latest
+// schema, writing a completion marker (unless skipWrite), connecting to the database and taking the lock.
+// It reports each problem instead of stopping at the first one.
+func (s *Syncer) preflight(ctx context.Context, skipWrite bool) []checkResult {
+	var results []checkResult
+
+	key, ver, _, err := s.findSchema(ctx)
+	switch {
+	case errors.Is(err, schemastore.ErrSchemaNotFound):
+		results = append(results,
+			checkResult{Name: "s3 list", Status: checkPass, Detail: "no schema versions under s3://" + s.S3Bucket + "/" + s.PathPrefix},
+			checkResult{Name: "s3 read", Status: checkSkip, Detail: "no schema to read"},
+		)
+	case err != nil:
+		results = append(results,
+			checkResult{Name: "s3 list", Status: checkFail, Detail: err.Error()},
+			checkResult{Name: "s3 read", Status: checkSkip, Detail: "listing failed"},
+		)
+	default:
+		results = append(results,
+			checkResult{Name: "s3 list", Status: checkPass, Detail: "latest version " + ver},
+			s.checkS3Read(ctx, key),
+		)
+	}
+
+	if skipWrite {
+		results = append(results, checkResult{Name: "s3 write", Status: checkSkip, Detail: "--skip-write-check"})
+	} else {
+		results = append(results, s.checkS3Write(ctx))
+	}
+
+	dbErr := s.pingDB(ctx)
+	results = append(results, newCheckResult("database", dbErr, s.DB.identity()))
+	switch {
+	case s.SkipLock:
+		results = append(results, checkResult{Name: "lock", Status: checkSkip, Detail: "--skip-lock"})
+	case dbErr != nil:
+		results = append(results, checkResult{Name: "lock", Status: checkSkip, Detail: "no database connection"})
+	default:
+		results = append(results, s.checkLock(ctx))
+	}
+	return results
+}
+
+// checkS3Read downloads the schema at key
+func (s *Syncer) checkS3Read(ctx context.Context, key string) checkResult {
+	out, err := s.Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s.S3Bucket), Key: aws.String(key)})
+	if err != nil {
+		return newCheckResult("s3 read", fmt.Errorf("GetObject %s: %w", key, err), "")
+	}
+	defer func() { _ = out.Body.Close() }()
+	n, err := io.Copy(io.Discard, out.Body)
+	if err != nil {
+		return newCheckResult("s3 read", fmt.Errorf("GetObject %s: %w", key, err), "")
+	}
+	return newCheckResult("s3 read", nil, fmt.Sprintf("%s (%d bytes)", key, n))
+}
+
+// checkS3Write uploads and deletes a probe object next to the version directories, as a sync does with
+// completion markers and exports
+func (s *Syncer) checkS3Write(ctx context.Context) checkResult {
+	key := s.PathPrefix + doctorProbeFile
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.S3Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("db-schema-sync doctor probe\n"),
+	})
+	if err != nil {
+		return newCheckResult("s3 write", fmt.Errorf("PutObject %s: %w", key, err), "")
+	}
+	if err := schemastore.DeleteObjects(ctx, s.Client, s.S3Bucket, []string{key}); err != nil {
+		return newCheckResult("s3 write", fmt.Errorf("put %s but could not delete it: %w", key, err), "")
+	}
+	return newCheckResult("s3 write", nil, "put and deleted "+key)
+}
+
+// checkLock takes and releases the lock. A lock held by another process passes, since taking it worked.
+func (s *Syncer) checkLock(ctx context.Context) checkResult {
+	locker, err := s.NewLocker(ctx, s.LockID)
+	if err != nil {
+		return newCheckResult("lock", err, "")
+	}
+	defer func() { _ = locker.Close() }()
+
+	acquired, err := locker.TryLockWithWait(ctx, 0)
+	if err != nil {
+		return newCheckResult("lock", err, "")
+	}
+	if !acquired {
+		return newCheckResult("lock", nil, fmt.Sprintf("lock %d is held by another process", s.LockID))
+	}
+	if err := locker.Unlock(ctx); err != nil {
+		return newCheckResult("lock", err, "")
+	}
+	return newCheckResult("lock", nil, fmt.Sprintf("acquired and released lock %d", s.LockID))
+}
+
+// writeCheckReport prints the results as a table
+func writeCheckReport(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "CHECK\tSTATUS\tDETAIL")
+	for _, r := range results {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+	}
+	return tw.Flush()
+}
+
+// logCheckReport logs the results of the watch --preflight, failures as warnings
+func logCheckReport(logger *slog.Logger, results []checkResult) {
+	for _, r := range results {
+		if r.Status == checkFail {
+			logger.Warn("Preflight check failed", "check", r.Name, "detail", r.Detail)
+		} else {
+			logger.Info("Preflight check", "check", r.Name, "status", string(r.Status), "detail", r.Detail)
+		}
+	}
+	if failed := failedChecks(results); failed > 0 {
+		logger.Warn("Preflight found problems, continuing anyway", "failed", failed, "checks", len(results))
+	} else {
+		logger.Info("Preflight passed", "checks", len(results))
+	}
+}
+
+// failedChecks returns the number of failed checks
+func failedChecks(results []checkResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Status == checkFail {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,205 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// heldLocker connects but finds the lock held by another process
+type heldLocker struct{ lostLocker }
+
+func (heldLocker) TryLockWithWait(context.Context, time.Duration) (bool, error) { return false, nil }
+
+// checkStatuses returns "name=STATUS" for each result, to compare whole reports
+func checkStatuses(results []checkResult) []string {
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Name+"="+string(r.Status))
+	}
+	return got
+}
+
+func TestSyncerPreflight(t *testing.T) {
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+	db := DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}
+	connected := func(context.Context, int64) (Locker, error) { return lostLocker{}, nil }
+
+	tests := []struct {
+		name      string
+		client    func(b *memoryBucket) *mockS3Client
+		locker    func(context.Context, int64) (Locker, error)
+		skipLock  bool
+		skipWrite bool
+		want      string
+		wantIn    string
+		probeLeft bool
+	}{
+		{
+			name:   "all pass",
+			locker: connected,
+			want:   "s3 list=PASS s3 read=PASS s3 write=PASS database=PASS lock=PASS",
+			wantIn: "acquired and released lock",
+		},
+		{
+			name: "list denied",
+			client: func(b *memoryBucket) *mockS3Client {
+				c := b.client()
+				c.listObjectsFunc = func(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return nil, errors.New("AccessDenied: list")
+				}
+				return c
+			},
+			locker: connected,
+			want:   "s3 list=FAIL s3 read=SKIP s3 write=PASS database=PASS lock=PASS",
+			wantIn: "AccessDenied: list",
+		},
+		{
+			name: "read denied",
+			client: func(b *memoryBucket) *mockS3Client {
+				c := b.client()
+				c.getObjectFunc = func(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					return nil, errors.New("AccessDenied: get")
+				}
+				return c
+			},
+			locker: connected,
+			want:   "s3 list=PASS s3 read=FAIL s3 write=PASS database=PASS lock=PASS",
+			wantIn: "GetObject schemas/v2/schema.sql: AccessDenied: get",
+		},
+		{
+			name: "write denied",
+			client: func(b *memoryBucket) *mockS3Client {
+				c := b.client()
+				c.putObjectFunc = func(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					return nil, errors.New("AccessDenied: put")
+				}
+				return c
+			},
+			locker: connected,
+			want:   "s3 list=PASS s3 read=PASS s3 write=FAIL database=PASS lock=PASS",
+			wantIn: "PutObject schemas/.db-schema-sync-doctor: AccessDenied: put",
+		},
+		{
+			name: "delete denied",
+			client: func(b *memoryBucket) *mockS3Client {
+				c := b.client()
+				c.deleteObjectsFunc = func(context.Context, *s3.DeleteObjectsInput, ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+					return nil, errors.New("AccessDenied: delete")
+				}
+				return c
+			},
+			locker:    connected,
+			want:      "s3 list=PASS s3 read=PASS s3 write=FAIL database=PASS lock=PASS",
+			wantIn:    "could not delete it",
+			probeLeft: true,
+		},
+		{
+			name:      "skip write",
+			skipWrite: true,
+			locker:    connected,
+			want:      "s3 list=PASS s3 read=PASS s3 write=SKIP database=PASS lock=PASS",
+		},
+		{
+			name: "database down",
+			locker: func(context.Context, int64) (Locker, error) {
+				return nil, errors.New("connection refused")
+			},
+			want:   "s3 list=PASS s3 read=PASS s3 write=PASS database=FAIL lock=SKIP",
+			wantIn: "connection refused",
+		},
+		{
+			name:   "lock held elsewhere",
+			locker: func(context.Context, int64) (Locker, error) { return heldLocker{}, nil },
+			want:   "s3 list=PASS s3 read=PASS s3 write=PASS database=PASS lock=PASS",
+			wantIn: "held by another process",
+		},
+		{
+			name:     "skip lock",
+			skipLock: true,
+			locker:   connected,
+			want:     "s3 list=PASS s3 read=PASS s3 write=PASS database=PASS lock=SKIP",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/v1/completed", "schemas/v2/schema.sql")
+			client := bucket.client()
+			if tt.client != nil {
+				client = tt.client(bucket)
+			}
+			syncer := NewSyncer(client, cli, db)
+			syncer.NewLocker = tt.locker
+			syncer.SkipLock = tt.skipLock
+
+			results := syncer.preflight(context.Background(), tt.skipWrite)
+			if got := strings.Join(checkStatuses(results), " "); got != tt.want {
+				t.Errorf("preflight() = %s, want %s", got, tt.want)
+			}
+			var report bytes.Buffer
+			if err := writeCheckReport(&report, results); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(report.String(), tt.wantIn) {
+				t.Errorf("report does not contain %q:\n%s", tt.wantIn, report.String())
+			}
+			if bucket.has("schemas/"+doctorProbeFile) != tt.probeLeft {
+				t.Errorf("S3 write probe left in the bucket = %v, want %v", !tt.probeLeft, tt.probeLeft)
+			}
+		})
+	}
+
+	t.Run("empty prefix", func(t *testing.T) {
+		syncer := NewSyncer(newMemoryBucket().client(), cli, db)
+		syncer.NewLocker = connected
+		results := syncer.preflight(context.Background(), false)
+		if got, want := strings.Join(checkStatuses(results), " "), "s3 list=PASS s3 read=SKIP s3 write=PASS database=PASS lock=PASS"; got != want {
+			t.Errorf("preflight() = %s, want %s", got, want)
+		}
+		if failedChecks(results) != 0 {
+			t.Errorf("failedChecks() = %d, want 0", failedChecks(results))
+		}
+	})
+}
+
+func TestCheckSqldefTool(t *testing.T) {
+	stub := writeStubPsqldef(t, `echo "psqldef v3.9.4"`)
+	if got := checkSqldefTool(context.Background(), "psqldef", stub); got.Status != checkPass || got.Detail != "psqldef v3.9.4" {
+		t.Errorf("checkSqldefTool() = %+v, want PASS with the version", got)
+	}
+	got := checkSqldefTool(context.Background(), "psqldef", filepath.Join(t.TempDir(), "psqldef"))
+	if got.Status != checkFail || !strings.Contains(got.Detail, "psqldef not found") {
+		t.Errorf("checkSqldefTool() = %+v, want FAIL with not found", got)
+	}
+}
+
+func TestWriteCheckReport(t *testing.T) {
+	results := []checkResult{
+		{Name: "psqldef", Status: checkPass, Detail: "psqldef v3.9.4"},
+		{Name: "s3 write", Status: checkSkip, Detail: "--skip-write-check"},
+		{Name: "database", Status: checkFail, Detail: "connection refused"},
+	}
+	var buf bytes.Buffer
+	if err := writeCheckReport(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	want := `CHECK     STATUS  DETAIL
+psqldef   PASS    psqldef v3.9.4
+s3 write  SKIP    --skip-write-check
+database  FAIL    connection refused
+`
+	if buf.String() != want {
+		t.Errorf("writeCheckReport() =\n%s\nwant\n%s", buf.String(), want)
+	}
+	if got := failedChecks(results); got != 1 {
+		t.Errorf("failedChecks() = %d, want 1", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// runDriftChecks calls CheckDrift every interval until ctx is done
+func runDriftChecks(ctx context.Context, s *Syncer, interval time.Duration) {
+	s.logger().Info("Drift detection enabled", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.CheckDrift(ctx); err != nil {
+				s.logger().Error("Drift check failed", "error", err)
+			}
+		}
+	}
+}
+
+// CheckDrift exports the live schema and compares it offline with the schema of the last applied version.
+// It never takes the advisory lock or modifies the database, and is skipped while Run is in progress.
+// on-drift-detected runs when drift is first seen or its DDL changes, not on every check.
+func (s *Syncer) CheckDrift(ctx context.Context) error {
+	if !s.running.TryLock() {
+		s.logger().Info("Sync in progress, skipping drift check")
+		return nil
+	}
+	defer s.running.Unlock()
+
+	version := s.lastAppliedVersion
+	if version == "" {
+		s.logger().Info("No version applied yet, skipping drift check")
+		return nil
+	}
+
+	schema, err := s.downloadAppliedSchema(ctx, schemastore.SchemaKey(s.PathPrefix, version, s.SchemaFile))
+	if err != nil {
+		return err
+	}
+	if err := s.loadPsqldefConfig(ctx, version); err != nil {
+		return err
+	}
+	live, err := s.export(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to export schema: %w", err)
+	}
+	_, cleanup, err := s.useWorkDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	diff, err := s.diff(ctx, live, schema)
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, diff)
+	}
+
+	statements := splitDDLStatements(diff)
+	if isNoChange(diff) {
+		statements = nil
+	}
+	recordDrift(s.Target, len(statements))
+
+	if len(statements) == 0 {
+		if s.lastDrift != "" {
+			s.logger().Info("Schema drift resolved", "version", version)
+		}
+		s.lastDrift = ""
+		return nil
+	}
+
+	s.logger().Warn("Schema drift detected", "version", version, "statements", len(statements))
+	if diff == s.lastDrift {
+		return nil
+	}
+	s.lastDrift = diff
+	hookEnv := HookEnv{
+		S3Bucket:      s.S3Bucket,
+		PathPrefix:    s.PathPrefix,
+		SchemaFile:    s.SchemaFile,
+		CompletedFile: s.CompletedFile,
+		Version:       version,
+		Drift:         diff,
+	}
+	s.identifyHookEnv(&hookEnv)
+	s.HookRunner.run(ctx, "on-drift-detected", s.Hooks.OnDriftDetected, &hookEnv)
+	return nil
+}
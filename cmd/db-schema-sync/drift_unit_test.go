@@ -0,0 +1,119 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSyncerCheckDrift(t *testing.T) {
+	const drift = "ALTER TABLE \"public\".\"users\" ADD COLUMN \"nickname\" text;\n"
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output")
+	exportLog := filepath.Join(dir, "export.log")
+	currentLog := filepath.Join(dir, "current.log")
+	desiredLog := filepath.Join(dir, "desired.log")
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--export*) echo export >> `+exportLog+`; echo 'CREATE TABLE users (id int);' ;;
+*) cat "$1" > `+currentLog+`; cat > `+desiredLog+`; cat `+output+` ;;
+esac`)
+	setOutput := func(s string) {
+		if err := os.WriteFile(output, []byte(s), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	countLines := func(path string) int {
+		b, _ := os.ReadFile(path)
+		return strings.Count(string(b), "\n")
+	}
+
+	objects := map[string]string{
+		"schemas/v2/schema.sql":   "-- v2",
+		"schemas/v2/exported.sql": "-- v2 exported",
+	}
+	client := &mockS3Client{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.Hooks.OnDriftDetected = `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_DRIFT" >> ` + hookLog
+
+	ctx := context.Background()
+
+	// Nothing to compare against before the first apply
+	if err := syncer.CheckDrift(ctx); err != nil {
+		t.Fatalf("CheckDrift() error = %v", err)
+	}
+	if countLines(exportLog) != 0 {
+		t.Fatal("expected no export before a version is applied")
+	}
+
+	syncer.lastAppliedVersion = "v2"
+	setOutput(drift)
+	if err := syncer.CheckDrift(ctx); err != nil {
+		t.Fatalf("CheckDrift() error = %v", err)
+	}
+	if current, _ := os.ReadFile(currentLog); string(current) != "CREATE TABLE users (id int);\n" {
+		t.Errorf("current schema = %q, want the exported live schema", current)
+	}
+	if desired, _ := os.ReadFile(desiredLog); string(desired) != "-- v2 exported" {
+		t.Errorf("desired schema = %q, want the applied exported.sql", desired)
+	}
+	if got := testutil.ToFloat64(driftDetected.WithLabelValues("")); got != 1 {
+		t.Errorf("drift_detected = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(driftStatements.WithLabelValues("")); got != 1 {
+		t.Errorf("drift_statements = %v, want 1", got)
+	}
+	if hook, _ := os.ReadFile(hookLog); string(hook) != "v2 "+drift+"\n" {
+		t.Errorf("on-drift-detected output = %q", hook)
+	}
+
+	// The same drift is not reported twice
+	if err := syncer.CheckDrift(ctx); err != nil {
+		t.Fatalf("CheckDrift() error = %v", err)
+	}
+	if n := countLines(hookLog); n != 2 {
+		t.Errorf("on-drift-detected ran again for unchanged drift (%d lines)", n)
+	}
+
+	setOutput("-- Nothing is modified --\n")
+	if err := syncer.CheckDrift(ctx); err != nil {
+		t.Fatalf("CheckDrift() error = %v", err)
+	}
+	if got := testutil.ToFloat64(driftDetected.WithLabelValues("")); got != 0 {
+		t.Errorf("drift_detected = %v, want 0", got)
+	}
+	if got := testutil.ToFloat64(driftStatements.WithLabelValues("")); got != 0 {
+		t.Errorf("drift_statements = %v, want 0", got)
+	}
+
+	// A sync in progress skips the check
+	exports := countLines(exportLog)
+	syncer.running.Lock()
+	err := syncer.CheckDrift(ctx)
+	syncer.running.Unlock()
+	if err != nil {
+		t.Fatalf("CheckDrift() error = %v", err)
+	}
+	if countLines(exportLog) != exports {
+		t.Error("expected drift check to be skipped while a sync is running")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Database engines selectable with --engine
+const (
+	EnginePostgres = "postgres"
+	EngineMySQL    = "mysql"
+	EngineSQLite3  = "sqlite3"
+)
+
+// SchemaApplier runs the sqldef tool of an engine against the target database.
+// The tool is killed when ctx is done.
+type SchemaApplier interface {
+	// DryRun returns the DDL that Apply would execute for the desired schema in schemaFile
+	DryRun(ctx context.Context, schemaFile string) (string, error)
+	// Apply applies the desired schema in schemaFile and returns the tool output
+	Apply(ctx context.Context, schemaFile string) (*ApplyResult, error)
+	// Export dumps the current schema of the database
+	Export(ctx context.Context) ([]byte, error)
+	// Diff compares two schema files offline and returns the DDL that turns current into desired
+	Diff(ctx context.Context, current, desired []byte) (string, error)
+	// SetConfig sets the sqldef config file contents passed with --config to DryRun, Apply and Diff; nil means none
+	SetConfig(config []byte)
+	// SetWorkDir sets the directory for the temporary files of DryRun, Apply and Diff; empty means the system one
+	SetWorkDir(dir string)
+}
+
+// Locker serializes schema application across processes sharing a database
+type Locker interface {
+	TryLockWithWait(ctx context.Context, wait time.Duration) (bool, error)
+	Unlock(ctx context.Context) error
+	// HeldCheck returns an error wrapping errLockLost when the lock acquired earlier has been lost
+	HeldCheck(ctx context.Context) error
+	Close() error
+}
+
+// newEngine returns the SchemaApplier and Locker constructor for engine.
+// This is the only place that switches on the engine. extraArgs are appended on apply and dry-run,
+// applyArgs on apply only.
+func newEngine(engine, toolPath string, extraArgs, applyArgs []string, db DBConfig) (SchemaApplier, func(ctx context.Context, lockID int64) (Locker, error)) {
+	switch engine {
+	case EngineSQLite3:
+		applier := &sqldefApplier{
+			path:      toolPath,
+			connArgs:  []string{db.File},
+			extraArgs: extraArgs,
+			applyArgs: applyArgs,
+		}
+		// There is no server to hold a lock, so serialize on a lock file next to the database
+		return applier, func(context.Context, int64) (Locker, error) {
+			return NewFileLocker(db.File + ".lock")
+		}
+	case EngineMySQL:
+		applier := &sqldefApplier{
+			path:      toolPath,
+			connArgs:  []string{"-u", db.User, "-h", db.Host, "-P", db.Port, "--password", db.Password, db.Name},
+			extraArgs: extraArgs,
+			applyArgs: applyArgs,
+		}
+		return applier, func(ctx context.Context, lockID int64) (Locker, error) {
+			return NewMySQLLocker(ctx, db.Host, db.Port, db.User, db.Password, db.Name, lockID)
+		}
+	default:
+		applier := &sqldefApplier{
+			path:      toolPath,
+			connArgs:  []string{"-U", db.User, "-h", db.Host, "-p", db.Port, "--password", db.Password, db.Name},
+			extraArgs: extraArgs,
+			applyArgs: applyArgs,
+		}
+		applier.env = db.postgresEnv()
+		if db.IAMAuthToken != nil {
+			// psqldef reads the token from PGPASSWORD, which also keeps it out of the process list
+			applier.connArgs = []string{"-U", db.User, "-h", db.Host, "-p", db.Port, db.Name}
+			applier.password = db.authToken
+		}
+		return applier, func(ctx context.Context, lockID int64) (Locker, error) {
+			return NewAdvisoryLocker(ctx, db, lockID)
+		}
+	}
+}
+
+// validate checks that the connection settings needed by engine are set
+func (c DBConfig) validate(engine string) error {
+	if engine == EngineSQLite3 {
+		if c.File == "" {
+			return fmt.Errorf("--db-file is required with --engine %s", engine)
+		}
+		return nil
+	}
+
+	var missing []string
+	for _, f := range []struct{ flag, value string }{
+		{"--db-host", c.Host},
+		{"--db-port", c.Port},
+		{"--db-user", c.User},
+		{"--db-password", c.Password},
+		{"--db-name", c.Name},
+	} {
+		if f.value == "" && (f.flag != "--db-password" || c.IAMAuthToken == nil) {
+			missing = append(missing, f.flag)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing flags required with --engine %s: %s", engine, strings.Join(missing, ", "))
+	}
+	if c.IAMAuthToken != nil {
+		if c.Password != "" {
+			return fmt.Errorf("--db-iam-auth cannot be combined with a database password")
+		}
+		// RDS only accepts IAM auth tokens over SSL
+		if c.SSLMode == "" || c.SSLMode == "disable" {
+			return fmt.Errorf("--db-iam-auth requires --db-sslmode require, verify-ca or verify-full")
+		}
+	}
+	return nil
+}
+
+// displayName returns the database name shown in notifications
+func (c DBConfig) displayName() string {
+	if c.File != "" {
+		return c.File
+	}
+	return c.Name
+}
+
+// identity returns host:port/dbname, or the file for sqlite3, to record which database an export came from
+func (c DBConfig) identity() string {
+	if c.File != "" {
+		return c.File
+	}
+	return c.Host + ":" + c.Port + "/" + c.Name
+}
+
+// postgresConnString returns the lib/pq connection string for the database. Every value is quoted,
+// so a password containing spaces, quotes or backslashes cannot end it early or add settings.
+func (c DBConfig) postgresConnString() string {
+	params := [][2]string{
+		{"host", c.Host},
+		{"port", c.Port},
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Name},
+		{"sslmode", cmp.Or(c.SSLMode, "disable")},
+	}
+	if c.SSLRootCert != "" {
+		params = append(params, [2]string{"sslrootcert", c.SSLRootCert})
+	}
+	if c.ConnectTimeout > 0 {
+		params = append(params, [2]string{"connect_timeout", c.connectTimeoutSeconds()})
+	}
+
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p[0] + "=" + quoteConnValue(p[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+// postgresEnv returns the libpq environment variables passing the SSL and timeout settings to psqldef,
+// which takes no flags for them. Without --db-sslmode, psqldef keeps the PGSSLMODE it inherits.
+func (c DBConfig) postgresEnv() []string {
+	var env []string
+	if c.SSLMode != "" {
+		env = append(env, "PGSSLMODE="+c.SSLMode)
+	}
+	if c.SSLRootCert != "" {
+		env = append(env, "PGSSLROOTCERT="+c.SSLRootCert)
+	}
+	if c.ConnectTimeout > 0 {
+		env = append(env, "PGCONNECT_TIMEOUT="+c.connectTimeoutSeconds())
+	}
+	return env
+}
+
+// authToken generates an IAM auth token for the user on host:port
+func (c DBConfig) authToken(ctx context.Context) (string, error) {
+	token, err := c.IAMAuthToken(ctx, net.JoinHostPort(c.Host, c.Port), c.User)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate RDS IAM auth token: %w", err)
+	}
+	return token, nil
+}
+
+// connectTimeoutSeconds returns ConnectTimeout in whole seconds, rounded up since libpq takes seconds
+func (c DBConfig) connectTimeoutSeconds() string {
+	return strconv.FormatInt(int64((c.ConnectTimeout+time.Second-1)/time.Second), 10)
+}
+
+// quoteConnValue single-quotes a connection string value, escaping backslashes and single quotes
+func quoteConnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// sqldefTool returns the binary name and configured path of the sqldef tool for the selected engine
+func (c *CLI) sqldefTool() (name, path string) {
+	switch c.Engine {
+	case EngineMySQL:
+		return "mysqldef", c.MysqldefPath
+	case EngineSQLite3:
+		return "sqlite3def", c.Sqlite3defPath
+	default:
+		return "psqldef", c.PsqldefPath
+	}
+}
+
+// withTimeout returns a context that expires after d, or just a cancelable ctx if d is 0
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// timeoutError replaces err with a "timed out after d" error when ctx hit its deadline, or a "canceled"
+// error when it was canceled, since the tool's own error is only "signal: killed"
+func timeoutError(ctx context.Context, d time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s: %w", d, ctx.Err())
+	case errors.Is(ctx.Err(), context.Canceled):
+		return fmt.Errorf("canceled: %w", ctx.Err())
+	}
+	return err
+}
+
+// Values of DB_SCHEMA_SYNC_FAILURE_REASON, so alerting can tell lock contention from bad SQL
+const (
+	failureStatementTimeout = "statement-timeout"
+	failureLockTimeout      = "lock-timeout"
+	failureTimeout          = "timeout"
+	failureChecksumMismatch = "checksum-mismatch"
+	failureChecksumMissing  = "checksum-missing"
+	failureDowngradeBlocked = "downgrade-blocked"
+	failureLockLost         = "lock-lost"
+	failureBackupFailed     = "backup-failed"
+	failureSyncTimeout      = "sync-timeout"
+)
+
+// failureReason classifies a failed sqldef run from its error and output; empty means any other failure
+func failureReason(err error, output string) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureTimeout
+	case strings.Contains(output, "canceling statement due to lock timeout"):
+		return failureLockTimeout
+	case strings.Contains(output, "canceling statement due to statement timeout"):
+		return failureStatementTimeout
+	default:
+		return ""
+	}
+}
+
+// ApplyResult contains the output from SchemaApplier.Apply
+type ApplyResult struct {
+	Stdout string
+	Stderr string
+}
+
+// sqldefApplier runs a sqldef binary (psqldef, mysqldef) with engine-specific connection arguments
+type sqldefApplier struct {
+	path      string
+	connArgs  []string
+	extraArgs []string
+	// applyArgs are only passed on apply, e.g. --before-apply, which sqldef would echo in the dry-run DDL
+	applyArgs []string
+	// env is added to the environment of the tool, e.g. PGSSLMODE for psqldef
+	env []string
+	// password, when set, generates the PGPASSWORD of each run instead of the --password in connArgs
+	password func(ctx context.Context) (string, error)
+	// config is written to a temporary file for --config, see SetConfig
+	config []byte
+	// workDir holds the temporary files, see SetWorkDir
+	workDir string
+}
+
+// SetConfig sets the sqldef config file contents; nil means no --config
+func (a *sqldefApplier) SetConfig(config []byte) {
+	a.config = config
+}
+
+// SetWorkDir sets the directory for temporary files; empty means the system temp directory
+func (a *sqldefApplier) SetWorkDir(dir string) {
+	a.workDir = dir
+}
+
+// configArgs writes the config to a temporary file and returns the --config argument for it,
+// or no arguments when there is no config. cleanup removes the file.
+func (a *sqldefApplier) configArgs() (args []string, cleanup func(), err error) {
+	if a.config == nil {
+		return nil, func() {}, nil
+	}
+	path, cleanup, err := writeTempFile(a.workDir, "sqldef-config-*.yml", a.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{"--config", path}, cleanup, nil
+}
+
+func (a *sqldefApplier) command(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	env := a.env
+	if a.password != nil {
+		password, err := a.password(ctx)
+		if err != nil {
+			return nil, err
+		}
+		env = append(slices.Clip(env), "PGPASSWORD="+password)
+	}
+	cmd := processGroupCommand(ctx, a.path, append(append([]string{}, a.connArgs...), args...)...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd, nil
+}
+
+// newWorkDir creates a private (0700) directory under parent, or the system temp directory if empty,
+// for the temporary files of one sync. cleanup removes it with everything in it.
+func newWorkDir(parent string) (dir string, cleanup func(), err error) {
+	dir, err = os.MkdirTemp(parent, "db-schema-sync-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	return dir, func() { _ = os.RemoveAll(dir) }, nil
+}
+
+// writeTempFile writes data to a new file in dir named after pattern, readable only by the owner (0600),
+// and closes it before returning so the sqldef tool reads complete contents. cleanup removes the file.
+func writeTempFile(dir, pattern string, data []byte) (path string, cleanup func(), err error) {
+	tmpFile, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { _ = os.Remove(tmpFile.Name()) }
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmpFile.Name(), cleanup, nil
+}
+
+// DryRun runs the tool with --dry-run to show what DDL would be applied
+func (a *sqldefApplier) DryRun(ctx context.Context, schemaFile string) (string, error) {
+	configArgs, cleanup, err := a.configArgs()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	args := append([]string{"--dry-run", "--file", schemaFile}, configArgs...)
+	cmd, err := a.command(ctx, append(args, a.extraArgs...)...)
+	if err != nil {
+		return "", err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("dry-run failed: %w", err)
+	}
+	return string(output), nil
+}
+
+// Apply runs the tool to apply the schema
+func (a *sqldefApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	configArgs, cleanup, err := a.configArgs()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	args := append(append([]string{"--file", schemaFile}, configArgs...), a.extraArgs...)
+	cmd, err := a.command(ctx, append(args, a.applyArgs...)...)
+	if err != nil {
+		return &ApplyResult{}, err
+	}
+
+	// Capture stdout/stderr while also writing to os.Stdout/os.Stderr
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &stdoutBuf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderrBuf)
+
+	err = cmd.Run()
+	result := &ApplyResult{
+		Stdout: stdoutBuf.String(),
+		Stderr: stderrBuf.String(),
+	}
+	return result, err
+}
+
+// Export exports the current schema from the database using --export
+func (a *sqldefApplier) Export(ctx context.Context) ([]byte, error) {
+	cmd, err := a.command(ctx, "--export")
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s --export failed: %w", a.path, err)
+	}
+	return output, nil
+}
+
+// Diff runs the tool in offline mode (tool current.sql < desired.sql) without connecting to the database
+func (a *sqldefApplier) Diff(ctx context.Context, current, desired []byte) (string, error) {
+	currentFile, removeCurrent, err := writeTempFile(a.workDir, "current-*.sql", current)
+	if err != nil {
+		return "", err
+	}
+	defer removeCurrent()
+
+	configArgs, cleanup, err := a.configArgs()
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	args := append(configArgs, a.extraArgs...)
+	cmd := processGroupCommand(ctx, a.path, append(args, currentFile)...)
+	cmd.Stdin = bytes.NewReader(desired)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("offline diff failed: %w", err)
+	}
+	return string(output), nil
+}
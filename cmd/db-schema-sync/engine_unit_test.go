@@ -0,0 +1,230 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// writeSchemaFile writes schema to a file for DryRun and Apply and returns its path
+func writeSchemaFile(t *testing.T, schema string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "schema.sql")
+	if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewEngineConnectionArgs(t *testing.T) {
+	db := DBConfig{Host: "db.example.com", Port: "3306", User: "app", Password: "secret", Name: "appdb", File: "/var/lib/app.db"}
+
+	tests := []struct {
+		engine   string
+		wantArgs string
+	}{
+		{EnginePostgres, "-U app -h db.example.com -p 3306 --password secret appdb"},
+		{EngineMySQL, "-u app -h db.example.com -P 3306 --password secret appdb"},
+		{EngineSQLite3, "/var/lib/app.db"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.engine, func(t *testing.T) {
+			stub := writeStubPsqldef(t, `echo "$@"`)
+			applier, _ := newEngine(tt.engine, stub, nil, nil, db)
+
+			output, err := applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+			if err != nil {
+				t.Fatalf("DryRun() error = %v", err)
+			}
+			if !strings.HasPrefix(output, tt.wantArgs+" --dry-run --file ") {
+				t.Errorf("DryRun() args = %q, want prefix %q", output, tt.wantArgs+" --dry-run --file ")
+			}
+
+			exported, err := applier.Export(context.Background())
+			if err != nil {
+				t.Fatalf("Export() error = %v", err)
+			}
+			if got := strings.TrimSpace(string(exported)); got != tt.wantArgs+" --export" {
+				t.Errorf("Export() args = %q, want %q", got, tt.wantArgs+" --export")
+			}
+		})
+	}
+}
+
+func TestApplyCapturesOutput(t *testing.T) {
+	stub := writeStubPsqldef(t, `echo "ALTER TABLE users ADD COLUMN name TEXT;"; echo "warning" >&2`)
+	applier, _ := newEngine(EngineMySQL, stub, nil, nil, DBConfig{})
+
+	result, err := applier.Apply(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT, name TEXT);"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if result.Stdout != "ALTER TABLE users ADD COLUMN name TEXT;\n" || result.Stderr != "warning\n" {
+		t.Errorf("Apply() = %+v", result)
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		output string
+		want   string
+	}{
+		{"lock timeout", errors.New("exit status 1"), "ERROR: canceling statement due to lock timeout (SQLSTATE 55P03)", failureLockTimeout},
+		{"statement timeout", errors.New("exit status 1"), "ERROR: canceling statement due to statement timeout (SQLSTATE 57014)", failureStatementTimeout},
+		{"killed after --apply-timeout", fmt.Errorf("timed out after 1s: %w", context.DeadlineExceeded), "", failureTimeout},
+		{"other failure", errors.New("exit status 1"), `ERROR: syntax error at or near "TABEL"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err, tt.output); got != tt.want {
+				t.Errorf("failureReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCLISqldefTool(t *testing.T) {
+	cli := &CLI{Engine: EnginePostgres, PsqldefPath: "/opt/psqldef", MysqldefPath: "/opt/mysqldef"}
+	if name, path := cli.sqldefTool(); name != "psqldef" || path != "/opt/psqldef" {
+		t.Errorf("sqldefTool() = %q, %q for postgres", name, path)
+	}
+
+	cli.Engine = EngineMySQL
+	if name, path := cli.sqldefTool(); name != "mysqldef" || path != "/opt/mysqldef" {
+		t.Errorf("sqldefTool() = %q, %q for mysql", name, path)
+	}
+
+	_, err := checkSqldef(context.Background(), "mysqldef", filepath.Join(t.TempDir(), "no-such-mysqldef"))
+	if err == nil || !strings.Contains(err.Error(), "set --mysqldef-path or MYSQLDEF_PATH") {
+		t.Errorf("checkSqldef() error = %v, want mysqldef flag hint", err)
+	}
+}
+
+func TestDBConfigValidate(t *testing.T) {
+	network := DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}
+
+	tests := []struct {
+		name    string
+		engine  string
+		db      DBConfig
+		wantErr string
+	}{
+		{"postgres with network flags", EnginePostgres, network, ""},
+		{"mysql with network flags", EngineMySQL, network, ""},
+		{"postgres missing flags", EnginePostgres, DBConfig{Host: "localhost", Name: "db"}, "--db-port, --db-user, --db-password"},
+		{"postgres with only db file", EnginePostgres, DBConfig{File: "app.db"}, "--db-host"},
+		{"sqlite3 with db file", EngineSQLite3, DBConfig{File: "app.db"}, ""},
+		{"sqlite3 without db file", EngineSQLite3, network, "--db-file is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.db.validate(tt.engine)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPostgresConnString(t *testing.T) {
+	base := DBConfig{Host: "db.internal", Port: "5432", User: "app", Password: "secret", Name: "appdb"}
+	tests := []struct {
+		name string
+		db   func(DBConfig) DBConfig
+		want string
+	}{
+		{
+			name: "defaults to sslmode disable",
+			db:   func(c DBConfig) DBConfig { return c },
+			want: `host='db.internal' port='5432' user='app' password='secret' dbname='appdb' sslmode='disable'`,
+		},
+		{
+			name: "ssl and timeout settings",
+			db: func(c DBConfig) DBConfig {
+				c.SSLMode, c.SSLRootCert, c.ConnectTimeout = "verify-full", "/etc/ssl/rds ca.pem", 1500*time.Millisecond
+				return c
+			},
+			want: `host='db.internal' port='5432' user='app' password='secret' dbname='appdb' sslmode='verify-full' sslrootcert='/etc/ssl/rds ca.pem' connect_timeout='2'`,
+		},
+		{
+			name: "password with spaces",
+			db:   func(c DBConfig) DBConfig { c.Password = "correct horse battery"; return c },
+			want: `host='db.internal' port='5432' user='app' password='correct horse battery' dbname='appdb' sslmode='disable'`,
+		},
+		{
+			name: "password that tries to override sslmode",
+			db:   func(c DBConfig) DBConfig { c.SSLMode = "verify-full"; c.Password = `x' sslmode='disable`; return c },
+			want: `host='db.internal' port='5432' user='app' password='x\' sslmode=\'disable' dbname='appdb' sslmode='verify-full'`,
+		},
+		{
+			name: "backslashes and empty values",
+			db:   func(c DBConfig) DBConfig { c.Password = `a\'b\\`; c.User = ""; return c },
+			want: `host='db.internal' port='5432' user='' password='a\\\'b\\\\' dbname='appdb' sslmode='disable'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.db(base).postgresConnString()
+			if got != tt.want {
+				t.Errorf("postgresConnString() =\n%s\nwant\n%s", got, tt.want)
+			}
+			// lib/pq must parse it back as a single set of settings
+			if _, err := pq.NewConnector(got); err != nil {
+				t.Errorf("pq.NewConnector() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestPostgresEnv(t *testing.T) {
+	db := DBConfig{SSLMode: "require", SSLRootCert: "/etc/ssl/ca.pem", ConnectTimeout: 10 * time.Second}
+	want := []string{"PGSSLMODE=require", "PGSSLROOTCERT=/etc/ssl/ca.pem", "PGCONNECT_TIMEOUT=10"}
+	if got := db.postgresEnv(); !slices.Equal(got, want) {
+		t.Errorf("postgresEnv() = %q, want %q", got, want)
+	}
+	if got := (DBConfig{}).postgresEnv(); len(got) != 0 {
+		t.Errorf("postgresEnv() without settings = %q, want none", got)
+	}
+
+	// psqldef gets the settings in its environment
+	stub := writeStubPsqldef(t, `echo "$PGSSLMODE $PGSSLROOTCERT"`)
+	applier, _ := newEngine(EnginePostgres, stub, nil, nil, db)
+	out, err := applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE t (id int);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if strings.TrimSpace(out) != "require /etc/ssl/ca.pem" {
+		t.Errorf("psqldef environment = %q", out)
+	}
+
+	// Without --db-sslmode, a PGSSLMODE exported by the operator reaches psqldef
+	t.Setenv("PGSSLMODE", "verify-full")
+	applier, _ = newEngine(EnginePostgres, stub, nil, nil, DBConfig{})
+	out, err = applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE t (id int);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if strings.TrimSpace(out) != "verify-full" {
+		t.Errorf("psqldef PGSSLMODE without --db-sslmode = %q, want the inherited verify-full", out)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// Exit statuses besides 0 (success) and 1 (failed)
+const (
+	// exitChangesPending is the status of plan --exit-code and verify when the database needs DDL
+	exitChangesPending = 2
+	exitLockSkipped    = 3
+	exitSchemaNotFound = 4
+	exitNoop           = 5
+)
+
+var (
+	// errLockSkipped is returned by apply when another process held the lock, so nothing was applied
+	errLockSkipped = errors.New("skipped: another process is applying the schema")
+	// errNoop is returned by apply --fail-on-noop when no version was applied
+	errNoop = errors.New("no new version to apply (--fail-on-noop)")
+)
+
+// exitError exits the process with code; kong's FatalIfErrorf reads it through kong.ExitCoder
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+func (e *exitError) ExitCode() int { return e.code }
+
+// applyExitError maps the outcome of apply to the error it exits with. A failure other than a missing schema
+// keeps status 1 even when another target was skipped. A version marked completed because its dry-run found
+// nothing to change counts as applied.
+func applyExitError(syncers []*Syncer, err error, failOnNoop bool) error {
+	if err != nil {
+		for _, targetErr := range targetErrors(err) {
+			if !errors.Is(targetErr, schemastore.ErrSchemaNotFound) {
+				return err
+			}
+		}
+		return &exitError{code: exitSchemaNotFound, err: err}
+	}
+	applied := false
+	for _, s := range syncers {
+		st := s.State().get()
+		if st.LockSkipped {
+			return &exitError{code: exitLockSkipped, err: errLockSkipped}
+		}
+		applied = applied || !st.LastApplyTime.IsZero()
+	}
+	if failOnNoop && !applied {
+		return &exitError{code: exitNoop, err: errNoop}
+	}
+	return nil
+}
+
+// targetErrors returns the errors joined by forEachTarget, or err alone
+func targetErrors(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,80 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+// exitCode returns the status kong's FatalIfErrorf exits with for err
+func exitCode(err error) int {
+	var coder kong.ExitCoder
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &coder):
+		return coder.ExitCode()
+	}
+	return 1
+}
+
+func TestApplyExitError(t *testing.T) {
+	tests := []struct {
+		name       string
+		keys       []string
+		dryRun     string
+		applyErr   error
+		locker     Locker
+		failOnNoop bool
+		want       int
+	}{
+		{name: "applied", keys: []string{"schemas/v1/schema.sql"}, want: 0},
+		{name: "applied with fail-on-noop", keys: []string{"schemas/v1/schema.sql"}, failOnNoop: true, want: 0},
+		{name: "already completed", keys: []string{"schemas/v1/schema.sql", "schemas/v1/completed"}, want: 0},
+		{name: "already completed with fail-on-noop", keys: []string{"schemas/v1/schema.sql", "schemas/v1/completed"}, failOnNoop: true, want: exitNoop},
+		{name: "nothing to change with fail-on-noop", keys: []string{"schemas/v1/schema.sql"}, dryRun: "-- Nothing is modified --\n", failOnNoop: true, want: 0},
+		{name: "lock held elsewhere", keys: []string{"schemas/v1/schema.sql"}, locker: heldLocker{}, want: exitLockSkipped},
+		{name: "no schema found", want: exitSchemaNotFound},
+		{name: "apply failed", keys: []string{"schemas/v1/schema.sql"}, applyErr: errors.New("syntax error"), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket(tt.keys...)
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			dryRun := tt.dryRun
+			if dryRun == "" {
+				dryRun = "CREATE TABLE users (id integer);\n"
+			}
+			syncer.Applier = &fakeApplier{dryRun: dryRun, applyErr: tt.applyErr}
+			syncer.SkipLock = tt.locker == nil
+			syncer.NewLocker = func(context.Context, int64) (Locker, error) { return tt.locker, nil }
+
+			err := applyExitError([]*Syncer{syncer}, syncer.Run(context.Background()), tt.failOnNoop)
+			if got := exitCode(err); got != tt.want {
+				t.Errorf("exit code = %d (%v), want %d", got, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("several targets", func(t *testing.T) {
+		missing := NewSyncer(newMemoryBucket().client(), &CLI{S3Bucket: "test-bucket", PathPrefix: "a/", SchemaFile: "schema.sql"}, DBConfig{})
+		failing := NewSyncer(newMemoryBucket("b/v1/schema.sql").client(), &CLI{S3Bucket: "test-bucket", PathPrefix: "b/", SchemaFile: "schema.sql"}, DBConfig{})
+		failing.Applier = &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n", applyErr: errors.New("syntax error")}
+		failing.SkipLock = true
+		syncers := []*Syncer{missing, failing}
+		err := forEachTarget(syncers, func(s *Syncer) error { return s.Run(context.Background()) })
+		if got := exitCode(applyExitError(syncers, err, false)); got != 1 {
+			t.Errorf("exit code = %d, want a failure to outrank a missing schema", got)
+		}
+		err = forEachTarget(syncers[:1], func(s *Syncer) error { return s.Run(context.Background()) })
+		if got := exitCode(applyExitError(syncers[:1], err, false)); got != exitSchemaNotFound {
+			t.Errorf("exit code = %d, want %d", got, exitSchemaNotFound)
+		}
+	})
+}
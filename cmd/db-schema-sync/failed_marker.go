@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// failedMarkerStderrBytes is how much of the end of the sqldef error output a failure marker keeps
+const failedMarkerStderrBytes = 4096
+
+// RetryCmd clears the failure marker of a version, so syncs with --skip-failed-versions apply it again
+type RetryCmd struct {
+	Version string `help:"Version whose failure marker to clear" required:""`
+}
+
+// Run executes the retry command
+func (cmd *RetryCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+	return cmd.retry(ctx, client, cli)
+}
+
+// retry deletes the --failed-file marker of Version, logging the failure it recorded
+func (cmd *RetryCmd) retry(ctx context.Context, client schemastore.S3Client, cli *CLI) error {
+	if cli.FailedFile == "" {
+		return fmt.Errorf("--failed-file is empty, so versions have no failure marker to clear")
+	}
+	schemaKey, err := schemastore.FindSchema(ctx, client, cli.S3Bucket, cli.PathPrefix, cli.SchemaFile, cmd.Version, cli.versioning)
+	if err != nil {
+		return err
+	}
+	markerKey := schemastore.FailedMarkerKey(schemaKey, cli.FailedFile)
+	meta, err := schemastore.ReadFailedMarker(ctx, client, cli.S3Bucket, schemaKey, cli.FailedFile)
+	if schemastore.IsNotFoundError(err) {
+		return fmt.Errorf("version %s has no failure marker %s", cmd.Version, markerKey)
+	}
+	if err != nil {
+		// An unreadable marker is still cleared
+		slog.Warn("Could not read failure marker", "key", markerKey, "error", err)
+		meta = &schemastore.FailureMetadata{}
+	}
+	if err := schemastore.DeleteObjects(ctx, client, cli.S3Bucket, []string{markerKey}); err != nil {
+		return fmt.Errorf("failed to delete failure marker: %w", err)
+	}
+	slog.Info("Failure marker cleared, the next sync applies the version again", "version", cmd.Version, "key", markerKey, "failed_at", meta.FailedAt, "hostname", meta.Hostname, "error", meta.Error)
+	return nil
+}
+
+// markFailed uploads the failure marker of version after its apply failed, so other environments and tooling
+// can see the version is broken. A failed upload is only logged, since the apply has already failed.
+func (s *Syncer) markFailed(ctx context.Context, schemaKey, version string, applyErr error, stderr, reason string) {
+	if s.FailedFile == "" || schemaKey == "" {
+		return
+	}
+	hostname, _ := os.Hostname()
+	if len(stderr) > failedMarkerStderrBytes {
+		cut := len(stderr) - failedMarkerStderrBytes
+		for cut < len(stderr) && !utf8.RuneStart(stderr[cut]) {
+			cut++
+		}
+		stderr = stderr[cut:]
+	}
+	meta := &schemastore.FailureMetadata{
+		Version:       version,
+		FailedAt:      time.Now().UTC(),
+		Hostname:      hostname,
+		Database:      s.DB.identity(),
+		AppVersion:    Version,
+		Error:         applyErr.Error(),
+		FailureReason: reason,
+		Stderr:        stderr,
+	}
+	markerKey := schemastore.FailedMarkerKey(schemaKey, s.FailedFile)
+	if err := schemastore.CreateFailedMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.FailedFile, meta); err != nil {
+		s.logger().Warn("Could not create failure marker", "version", version, "key", markerKey, "error", err)
+		return
+	}
+	s.logger().Info("Failure marker uploaded to S3", "version", version, "key", markerKey)
+}
+
+// checkFailed reports whether version has a failure marker and SkipFailedVersions skips it. Force applies it anyway.
+func (s *Syncer) checkFailed(ctx context.Context, schemaKey, version string) (bool, error) {
+	if !s.SkipFailedVersions || s.Force || s.FailedFile == "" {
+		return false, nil
+	}
+	failed, err := schemastore.CheckFailedMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.FailedFile)
+	if err != nil {
+		// Do not retry a version that may be known to be broken
+		recordS3FetchError()
+		return false, fmt.Errorf("failed to check failure marker of version %s: %w", version, err)
+	}
+	if failed {
+		recordFailedVersionSkipped(s.Target)
+		s.logger().Info("Version failed to apply before, skipping (--skip-failed-versions)", "version", version, "key", schemastore.FailedMarkerKey(schemaKey, s.FailedFile))
+	}
+	return failed, nil
+}
+
+// clearFailed deletes the failure marker of version once it has been applied, so a version that failed before
+// and then succeeded, e.g. with --force or after a transient error, is neither reported as failed nor skipped
+// by --skip-failed-versions. A failed check or delete is only logged, since the apply has already succeeded.
+func (s *Syncer) clearFailed(ctx context.Context, schemaKey, version string) {
+	if s.FailedFile == "" || schemaKey == "" {
+		return
+	}
+	markerKey := schemastore.FailedMarkerKey(schemaKey, s.FailedFile)
+	failed, err := schemastore.CheckFailedMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.FailedFile)
+	if err != nil {
+		s.logger().Warn("Could not check failure marker", "version", version, "key", markerKey, "error", err)
+		return
+	}
+	if !failed {
+		return
+	}
+	if err := schemastore.DeleteObjects(ctx, s.Client, s.S3Bucket, []string{markerKey}); err != nil {
+		s.logger().Warn("Could not delete failure marker", "version", version, "key", markerKey, "error", err)
+		return
+	}
+	s.logger().Info("Failure marker deleted after the version was applied", "version", version, "key", markerKey)
+}
@@ -0,0 +1,186 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+func TestSyncerMarksFailedVersion(t *testing.T) {
+	applyFailed := errors.New("ERROR: column \"name\" does not exist")
+	tests := []struct {
+		name       string
+		failedFile string
+		target     string
+		applyErr   error
+		wantKey    string
+	}{
+		{name: "apply failure", failedFile: "failed", applyErr: applyFailed, wantKey: "schemas/v1/failed"},
+		{name: "db target", failedFile: "failed", target: "prod", applyErr: applyFailed, wantKey: "schemas/v1/failed.prod"},
+		{name: "disabled", applyErr: applyFailed},
+		{name: "apply succeeds", failedFile: "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			client := bucket.client()
+			put := client.putObjectFunc
+			bodies := map[string][]byte{}
+			client.putObjectFunc = func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+				bodies[*params.Key], _ = io.ReadAll(params.Body)
+				return put(ctx, params, optFns...)
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", FailedFile: tt.failedFile}
+			target := dbTarget{Name: tt.target, DB: DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}}
+			syncer := newTargetSyncer(client, cli, target)
+			defer syncer.Close()
+			syncer.Applier = &fakeApplier{dryRun: "ALTER TABLE users ADD COLUMN email text;\n", applyErr: tt.applyErr}
+			syncer.SkipLock = true
+
+			err := syncer.Run(context.Background())
+			if (err != nil) != (tt.applyErr != nil) {
+				t.Fatalf("Run() error = %v, want failure %v", err, tt.applyErr != nil)
+			}
+			var markers []string
+			for key := range bodies {
+				if strings.HasPrefix(key, "schemas/v1/failed") {
+					markers = append(markers, key)
+				}
+			}
+			if tt.wantKey == "" {
+				if len(markers) > 0 {
+					t.Fatalf("uploaded failure markers %q, want none", markers)
+				}
+				return
+			}
+			if !reflect.DeepEqual(markers, []string{tt.wantKey}) {
+				t.Fatalf("uploaded failure markers %q, want %s", markers, tt.wantKey)
+			}
+			var meta schemastore.FailureMetadata
+			if err := json.Unmarshal(bodies[tt.wantKey], &meta); err != nil {
+				t.Fatalf("failure marker is not JSON: %v: %s", err, bodies[tt.wantKey])
+			}
+			if meta.Version != "v1" || meta.Error != applyFailed.Error() || meta.Stderr != applyFailed.Error() || meta.Database != "localhost:5432/db" || meta.FailedAt.IsZero() || meta.Hostname == "" {
+				t.Errorf("failure marker = %+v, want v1 with the error, stderr, database, time and host", meta)
+			}
+			if bucket.has("schemas/v1/completed") {
+				t.Error("completion marker was created for a failed version")
+			}
+		})
+	}
+}
+
+func TestSyncerSkipFailedVersions(t *testing.T) {
+	tests := []struct {
+		name        string
+		keys        []string
+		skip        bool
+		force       bool
+		wantApplied []string
+		wantSkipped float64
+	}{
+		{name: "failed version skipped", keys: []string{"schemas/v1/schema.sql", "schemas/v1/failed"}, skip: true, wantSkipped: 1},
+		{name: "force applies it", keys: []string{"schemas/v1/schema.sql", "schemas/v1/failed"}, skip: true, force: true, wantApplied: []string{"v1"}},
+		{name: "without the flag", keys: []string{"schemas/v1/schema.sql", "schemas/v1/failed"}, wantApplied: []string{"v1"}},
+		{name: "no marker", keys: []string{"schemas/v1/schema.sql"}, skip: true, wantApplied: []string{"v1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket(tt.keys...)
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", FailedFile: "failed"}
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			applier := &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}
+			syncer.Applier = applier
+			syncer.SkipLock = true
+			syncer.SkipFailedVersions = tt.skip
+			syncer.Force = tt.force
+			before := testutil.ToFloat64(failedVersionSkippedTotal.WithLabelValues(syncer.Target))
+
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if !reflect.DeepEqual(applier.applied, tt.wantApplied) {
+				t.Errorf("applied %q, want %q", applier.applied, tt.wantApplied)
+			}
+			if got := testutil.ToFloat64(failedVersionSkippedTotal.WithLabelValues(syncer.Target)) - before; got != tt.wantSkipped {
+				t.Errorf("db_schema_sync_failed_version_skipped_total grew by %v, want %v", got, tt.wantSkipped)
+			}
+			if got, want := syncer.LastAppliedVersion(), strings.Join(tt.wantApplied, ""); got != want {
+				t.Errorf("LastAppliedVersion() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSyncerClearsFailedMarker(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		marker     string
+		dryRun     string
+		applyErr   error
+		wantMarker bool
+	}{
+		{name: "applied", marker: "schemas/v1/failed", dryRun: "CREATE TABLE users (id integer);\n"},
+		{name: "no change", marker: "schemas/v1/failed", dryRun: "-- Nothing is modified --\n"},
+		{name: "db target", target: "prod", marker: "schemas/v1/failed.prod", dryRun: "CREATE TABLE users (id integer);\n"},
+		{name: "failed again", marker: "schemas/v1/failed", dryRun: "CREATE TABLE users (id integer);\n", applyErr: errors.New("ERROR: relation \"users\" already exists"), wantMarker: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket("schemas/v1/schema.sql", tt.marker)
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", FailedFile: "failed"}
+			target := dbTarget{Name: tt.target, DB: DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}}
+			syncer := newTargetSyncer(bucket.client(), cli, target)
+			defer syncer.Close()
+			syncer.Applier = &fakeApplier{dryRun: tt.dryRun, applyErr: tt.applyErr}
+			syncer.SkipLock = true
+			// --force applies the version even with --skip-failed-versions
+			syncer.SkipFailedVersions = true
+			syncer.Force = true
+
+			err := syncer.Run(context.Background())
+			if (err != nil) != (tt.applyErr != nil) {
+				t.Fatalf("Run() error = %v, want failure %v", err, tt.applyErr != nil)
+			}
+			if got := bucket.has(tt.marker); got != tt.wantMarker {
+				t.Errorf("failure marker %s exists = %v, want %v", tt.marker, got, tt.wantMarker)
+			}
+		})
+	}
+}
+
+func TestRetryCmd(t *testing.T) {
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", FailedFile: "failed"}
+	bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/v1/failed", "schemas/v2/schema.sql")
+	cmd := &RetryCmd{Version: "v1"}
+	if err := cmd.retry(context.Background(), bucket.client(), cli); err != nil {
+		t.Fatalf("retry() error = %v", err)
+	}
+	if bucket.has("schemas/v1/failed") {
+		t.Error("failure marker still exists after retry")
+	}
+	if !bucket.has("schemas/v1/schema.sql") {
+		t.Error("retry deleted the schema")
+	}
+
+	cmd = &RetryCmd{Version: "v2"}
+	if err := cmd.retry(context.Background(), bucket.client(), cli); err == nil || !strings.Contains(err.Error(), "has no failure marker") {
+		t.Errorf("retry() error = %v, want no failure marker", err)
+	}
+	cmd = &RetryCmd{Version: "v3"}
+	if err := cmd.retry(context.Background(), bucket.client(), cli); !errors.Is(err, schemastore.ErrSchemaNotFound) {
+		t.Errorf("retry() error = %v, want ErrSchemaNotFound", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Operations retried by retryFetch, as the operation label of db_schema_sync_s3_fetch_retries_total
+const (
+	fetchOperationList     = "list"
+	fetchOperationDownload = "download"
+)
+
+// isRetryableFetchError reports whether a failed S3 listing or download is worth retrying within the sync:
+// a timeout, a 5xx response or a dropped connection. A missing schema, a denied request or a sync that is
+// being canceled is not.
+func isRetryableFetchError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var status interface{ HTTPStatusCode() int }
+	if errors.As(err, &status) {
+		return status.HTTPStatusCode() >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryFetch calls fetch and retries a retryable failure up to FetchRetries times, waiting FetchRetryBackoff
+// before the first retry and doubling it for each further one. Only a failure that outlasts the retries is
+// returned, so a blip that clears within the sync never reaches fetchFailed and the on-s3-fetch-error hook.
+func (s *Syncer) retryFetch(ctx context.Context, operation string, fetch func(context.Context) error) error {
+	backoff := s.FetchRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fetch(ctx)
+		if err == nil || !isRetryableFetchError(ctx, err) {
+			return err
+		}
+		if attempt >= s.FetchRetries {
+			if attempt > 0 {
+				return fmt.Errorf("giving up after %d retries: %w", attempt, err)
+			}
+			return err
+		}
+		recordS3FetchRetry(operation)
+		s.logger().Warn("S3 fetch failed, retrying", "operation", operation, "retry", attempt+1, "retries", s.FetchRetries, "retry_in", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
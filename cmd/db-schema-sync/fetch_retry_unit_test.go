@@ -0,0 +1,189 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// statusError is an S3 error response with an HTTP status, as the SDK's ResponseError reports it
+type statusError struct{ code int }
+
+func (e statusError) Error() string       { return fmt.Sprintf("StatusCode: %d", e.code) }
+func (e statusError) HTTPStatusCode() int { return e.code }
+
+// netTimeoutError is a net.Error that timed out
+type netTimeoutError struct{}
+
+func (netTimeoutError) Error() string   { return "i/o timeout" }
+func (netTimeoutError) Timeout() bool   { return true }
+func (netTimeoutError) Temporary() bool { return true }
+
+func TestIsRetryableFetchError(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"5xx", context.Background(), fmt.Errorf("operation error S3: ListObjectsV2: %w", statusError{503}), true},
+		{"4xx", context.Background(), statusError{403}, false},
+		{"timeout", context.Background(), &os.SyscallError{Syscall: "read", Err: netTimeoutError{}}, true},
+		{"connection reset", context.Background(), fmt.Errorf("read tcp: %w", syscall.ECONNRESET), true},
+		{"truncated body", context.Background(), io.ErrUnexpectedEOF, true},
+		{"schema not found", context.Background(), schemastore.ErrSchemaNotFound, false},
+		{"other error", context.Background(), errors.New("AccessDenied"), false},
+		{"sync canceled", canceled, statusError{503}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableFetchError(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("isRetryableFetchError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncerRetriesTransientFetchErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		listErrs      []error
+		downloadErrs  []error
+		wantErr       string
+		wantApplied   []string
+		wantFailures  int
+		wantHook      string
+		wantRetries   float64
+		wantOperation string
+	}{
+		{
+			name:          "list recovers",
+			listErrs:      []error{statusError{503}, statusError{500}},
+			wantApplied:   []string{"v1"},
+			wantRetries:   2,
+			wantOperation: fetchOperationList,
+		},
+		{
+			name:          "download recovers",
+			downloadErrs:  []error{fmt.Errorf("read tcp: %w", syscall.ECONNRESET)},
+			wantApplied:   []string{"v1"},
+			wantRetries:   1,
+			wantOperation: fetchOperationDownload,
+		},
+		{
+			name:          "list retries exhausted",
+			listErrs:      []error{statusError{503}, statusError{503}, statusError{503}},
+			wantErr:       "giving up after 2 retries",
+			wantFailures:  1,
+			wantHook:      "1",
+			wantRetries:   2,
+			wantOperation: fetchOperationList,
+		},
+		{
+			name:          "not retryable",
+			listErrs:      []error{statusError{403}},
+			wantErr:       "StatusCode: 403",
+			wantFailures:  1,
+			wantHook:      "1",
+			wantOperation: fetchOperationList,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			client := bucket.client()
+			list, get := client.listObjectsFunc, client.getObjectFunc
+			listErrs, downloadErrs := tt.listErrs, tt.downloadErrs
+			client.listObjectsFunc = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+				if len(listErrs) > 0 {
+					err := listErrs[0]
+					listErrs = listErrs[1:]
+					return nil, err
+				}
+				return list(ctx, params, optFns...)
+			}
+			client.getObjectFunc = func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+				if path.Base(*params.Key) == "schema.sql" && len(downloadErrs) > 0 {
+					err := downloadErrs[0]
+					downloadErrs = downloadErrs[1:]
+					return nil, err
+				}
+				return get(ctx, params, optFns...)
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			applier := &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}
+			syncer.Applier = applier
+			syncer.SkipLock = true
+			syncer.FetchRetries = 2
+			syncer.FetchRetryBackoff = time.Millisecond
+			// 0 runs on-s3-fetch-error on every counted failure, so any failure that got through would show
+			syncer.MaxConsecutiveFailures = 0
+			syncer.Hooks.OnS3FetchError = `echo "$DB_SCHEMA_SYNC_FAILURE_COUNT" >> ` + hookLog
+			before := testutil.ToFloat64(s3FetchRetriesTotal.WithLabelValues(tt.wantOperation))
+
+			err := syncer.Run(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(applier.applied, tt.wantApplied) {
+				t.Errorf("applied %q, want %q", applier.applied, tt.wantApplied)
+			}
+			if got := syncer.ConsecutiveFailures(); got != tt.wantFailures {
+				t.Errorf("ConsecutiveFailures() = %d, want %d", got, tt.wantFailures)
+			}
+			content, _ := os.ReadFile(hookLog)
+			if got := strings.TrimSpace(string(content)); got != tt.wantHook {
+				t.Errorf("on-s3-fetch-error ran with counts %q, want %q", got, tt.wantHook)
+			}
+			if got := testutil.ToFloat64(s3FetchRetriesTotal.WithLabelValues(tt.wantOperation)) - before; got != tt.wantRetries {
+				t.Errorf("db_schema_sync_s3_fetch_retries_total{operation=%q} grew by %v, want %v", tt.wantOperation, got, tt.wantRetries)
+			}
+		})
+	}
+
+	t.Run("canceled during backoff", func(t *testing.T) {
+		calls := 0
+		client := &mockS3Client{
+			listObjectsFunc: func(context.Context, *s3.ListObjectsV2Input, ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+				calls++
+				return nil, statusError{503}
+			},
+		}
+		cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql"}
+		syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.FetchRetries = 5
+		syncer.FetchRetryBackoff = time.Hour
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := syncer.Run(ctx); err == nil {
+			t.Fatal("Run() succeeded, want the S3 error")
+		}
+		if calls != 1 {
+			t.Errorf("ListObjectsV2 called %d times, want 1 before the sync was canceled", calls)
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// HistoryCmd prints the applied-version history recorded with --history-table
+type HistoryCmd struct {
+	DBOptions
+
+	HistoryTable string `help:"Table holding the applied-version history" env:"HISTORY_TABLE" default:"db_schema_sync.history"`
+	Limit        int    `help:"Show only the most recent N entries (0 means all)" default:"20"`
+	Format       string `help:"Output format" enum:"text,json" default:"text"`
+}
+
+// HistoryRecord is a row of the applied-version history table
+type HistoryRecord struct {
+	Version    string    `json:"version"`
+	AppliedAt  time.Time `json:"applied_at"`
+	Hostname   string    `json:"hostname"`
+	AppVersion string    `json:"app_version"`
+	DurationMs int64     `json:"duration_ms"`
+	DDL        string    `json:"ddl"`
+}
+
+// Run executes the history command
+func (cmd *HistoryCmd) Run(ctx context.Context, cli *CLI) error {
+	if cli.Engine != EnginePostgres {
+		return fmt.Errorf("history is only supported with --engine %s", EnginePostgres)
+	}
+
+	table, err := quoteTableName(cmd.HistoryTable)
+	if err != nil {
+		return err
+	}
+
+	dbConfig, _, err := cmd.dbConfig(ctx, cli)
+	if err != nil {
+		return err
+	}
+	if err := dbConfig.validate(cli.Engine); err != nil {
+		return err
+	}
+	db, err := openDB(ctx, dbConfig)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	records, err := queryHistory(ctx, db, table, cmd.Limit)
+	if err != nil {
+		return err
+	}
+
+	return writeHistoryList(os.Stdout, records, cmd.Format)
+}
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// quoteTableName validates a (optionally schema-qualified) table name and quotes it for use in SQL
+func quoteTableName(name string) (string, error) {
+	if !tableNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid history table name %q", name)
+	}
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// sqlQuerier runs statements on a *sql.DB, or on the *sql.Conn an AdvisoryLocker pins
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// historySchema returns the quoted schema of a table name validated by quoteTableName, or "" when it has none
+func historySchema(name string) string {
+	schema, _, ok := strings.Cut(name, ".")
+	if !ok {
+		return ""
+	}
+	return pq.QuoteIdentifier(schema)
+}
+
+// ensureHistoryTable creates the history table, and its schema when the name has one, if they do not exist.
+// A schema of its own keeps the table out of the schemas psqldef manages.
+func ensureHistoryTable(ctx context.Context, db sqlQuerier, table, schema string) error {
+	if schema != "" {
+		if _, err := db.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+schema); err != nil {
+			return fmt.Errorf("failed to create history schema: %w", err)
+		}
+	}
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+	id BIGSERIAL PRIMARY KEY,
+	version TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL,
+	hostname TEXT NOT NULL,
+	app_version TEXT NOT NULL,
+	duration_ms BIGINT NOT NULL,
+	ddl_text TEXT NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("failed to create history table: %w", err)
+	}
+	return nil
+}
+
+// insertHistory inserts a history record, creating the table and its schema first if needed
+func insertHistory(ctx context.Context, db sqlQuerier, table, schema string, rec HistoryRecord) error {
+	if err := ensureHistoryTable(ctx, db, table, schema); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO `+table+` (version, applied_at, hostname, app_version, duration_ms, ddl_text) VALUES ($1, $2, $3, $4, $5, $6)`,
+		rec.Version, rec.AppliedAt, rec.Hostname, rec.AppVersion, rec.DurationMs, rec.DDL)
+	if err != nil {
+		return fmt.Errorf("failed to insert history record: %w", err)
+	}
+	return nil
+}
+
+// queryHistory returns history records, newest first
+func queryHistory(ctx context.Context, db sqlQuerier, table string, limit int) ([]HistoryRecord, error) {
+	query := `SELECT version, applied_at, hostname, app_version, duration_ms, ddl_text FROM ` + table + ` ORDER BY applied_at DESC, id DESC`
+	var args []any
+	if limit > 0 {
+		query += ` LIMIT $1`
+		args = append(args, limit)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query history table: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var records []HistoryRecord
+	for rows.Next() {
+		var rec HistoryRecord
+		if err := rows.Scan(&rec.Version, &rec.AppliedAt, &rec.Hostname, &rec.AppVersion, &rec.DurationMs, &rec.DDL); err != nil {
+			return nil, fmt.Errorf("failed to scan history record: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// dbQuerier returns the connection pinned by a PostgreSQL advisory locker, or opens a new one.
+// closeDB closes only a connection dbQuerier opened.
+func dbQuerier(ctx context.Context, locker Locker, dbConfig DBConfig) (db sqlQuerier, closeDB func(), err error) {
+	if advisoryLocker, ok := locker.(*AdvisoryLocker); ok && advisoryLocker != nil {
+		return advisoryLocker.conn, func() {}, nil
+	}
+	pool, err := openDB(ctx, dbConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, func() { _ = pool.Close() }, nil
+}
+
+// recordHistory writes a history record after a successful apply.
+// It reuses the PostgreSQL advisory lock connection when available. Failures are logged only.
+func recordHistory(ctx context.Context, locker Locker, dbConfig DBConfig, historyTable string, rec HistoryRecord) {
+	table, err := quoteTableName(historyTable)
+	if err != nil {
+		slog.Warn("Could not record apply history", "error", err)
+		return
+	}
+
+	db, closeDB, err := dbQuerier(ctx, locker, dbConfig)
+	if err != nil {
+		slog.Warn("Could not record apply history", "error", err)
+		return
+	}
+	defer closeDB()
+
+	if err := insertHistory(ctx, db, table, historySchema(historyTable), rec); err != nil {
+		slog.Warn("Could not record apply history", "error", err)
+		return
+	}
+	slog.Info("Recorded apply history", "table", historyTable, "version", rec.Version)
+}
+
+// writeHistoryList writes history records in the given format ("text" or "json")
+func writeHistoryList(w io.Writer, records []HistoryRecord, format string) error {
+	if format == "json" {
+		if records == nil {
+			records = []HistoryRecord{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tAPPLIED AT\tHOSTNAME\tAPP VERSION\tDURATION")
+	for _, rec := range records {
+		duration := time.Duration(rec.DurationMs) * time.Millisecond
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", rec.Version, rec.AppliedAt.UTC().Format(time.RFC3339), rec.Hostname, rec.AppVersion, duration)
+	}
+	return tw.Flush()
+}
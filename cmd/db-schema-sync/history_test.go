@@ -0,0 +1,76 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHistoryTable(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	locker, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker: %v", err)
+	}
+	defer locker.Close()
+
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	recordHistory(ctx, locker, testDBConfig(host, port), "db_schema_sync.history", HistoryRecord{
+		Version: "v1", AppliedAt: base, Hostname: "pod-1", AppVersion: "dev", DurationMs: 10, DDL: "CREATE TABLE t1 (id INT);",
+	})
+	// Without a locker, a separate connection is opened
+	recordHistory(ctx, nil, testDBConfig(host, port), "db_schema_sync.history", HistoryRecord{
+		Version: "v2", AppliedAt: base.Add(time.Hour), Hostname: "pod-2", AppVersion: "dev", DurationMs: 20, DDL: "CREATE TABLE t2 (id INT);",
+	})
+
+	table, err := quoteTableName("db_schema_sync.history")
+	if err != nil {
+		t.Fatalf("quoteTableName failed: %v", err)
+	}
+
+	// The table lives in its own schema, out of the public schema psqldef exports and diffs
+	var schemas []string
+	rows, err := locker.conn.QueryContext(ctx, `SELECT table_schema FROM information_schema.tables WHERE table_name = 'history'`)
+	if err != nil {
+		t.Fatalf("failed to look up the history table: %v", err)
+	}
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			t.Fatal(err)
+		}
+		schemas = append(schemas, schema)
+	}
+	_ = rows.Close()
+	if len(schemas) != 1 || schemas[0] != "db_schema_sync" {
+		t.Errorf("history table schemas = %v, want [db_schema_sync]", schemas)
+	}
+
+	records, err := queryHistory(ctx, locker.conn, table, 0)
+	if err != nil {
+		t.Fatalf("queryHistory failed: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if records[0].Version != "v2" || records[1].Version != "v1" {
+		t.Errorf("expected newest first, got %s, %s", records[0].Version, records[1].Version)
+	}
+	if records[1].DDL != "CREATE TABLE t1 (id INT);" || records[1].Hostname != "pod-1" {
+		t.Errorf("unexpected record: %+v", records[1])
+	}
+
+	limited, err := queryHistory(ctx, locker.conn, table, 1)
+	if err != nil {
+		t.Fatalf("queryHistory with limit failed: %v", err)
+	}
+	if len(limited) != 1 || limited[0].Version != "v2" {
+		t.Errorf("expected only the newest record, got %+v", limited)
+	}
+}
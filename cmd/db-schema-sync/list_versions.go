@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// ListVersionsCmd lists schema versions in S3 along with their completion status
+type ListVersionsCmd struct {
+	Format string `help:"Output format" enum:"text,json" default:"text"`
+	Limit  int    `help:"Show only the most recent N versions (0 means all)" default:"0"`
+}
+
+// Run executes the list-versions command
+func (cmd *ListVersionsCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	objects, err := schemastore.ListAllObjects(ctx, client, cli.S3Bucket, cli.PathPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	versions := orderVersions(schemastore.CollectVersions(objects, cli.PathPrefix, cli.SchemaFile, cli.CompletedFile, cli.versioning), cli.VersionOrder)
+	if cmd.Limit > 0 && len(versions) > cmd.Limit {
+		versions = versions[len(versions)-cmd.Limit:]
+	}
+
+	return writeVersionList(os.Stdout, versions, cmd.Format)
+}
+
+// writeVersionList writes versions in the given format ("text" or "json")
+func writeVersionList(w io.Writer, versions []schemastore.VersionInfo, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(versions)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tSCHEMA\tCOMPLETED\tEXPORTED\tROLLED BACK\tLAST MODIFIED")
+	for _, v := range versions {
+		lastModified := "-"
+		if !v.LastModified.IsZero() {
+			lastModified = v.LastModified.UTC().Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Version, yesNo(v.Schema), yesNo(v.Completed), yesNo(v.Exported), yesNo(v.RolledBack), lastModified)
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// orderVersions re-sorts versions oldest first by the last change in their directory with --version-order
+// last-modified; CollectVersions sorts them by name, which means nothing for names such as git SHAs
+func orderVersions(versions []schemastore.VersionInfo, order string) []schemastore.VersionInfo {
+	if order == versionOrderLastModified {
+		sort.SliceStable(versions, func(i, j int) bool {
+			return versions[i].LastModified.Before(versions[j].LastModified)
+		})
+	}
+	return versions
+}
@@ -0,0 +1,51 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+func TestWriteVersionList(t *testing.T) {
+	versions := []schemastore.VersionInfo{
+		{Version: "v1", Schema: true, Completed: true, LastModified: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{Version: "v2", Schema: true, Completed: true, RolledBack: true},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeVersionList(&buf, versions, "text"); err != nil {
+			t.Fatalf("writeVersionList() error = %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected 3 lines, got %d: %q", len(lines), buf.String())
+		}
+		if strings.Join(strings.Fields(lines[1]), " ") != "v1 yes yes no no 2024-01-01T12:00:00Z" {
+			t.Errorf("unexpected row: %q", lines[1])
+		}
+		if strings.Join(strings.Fields(lines[2]), " ") != "v2 yes yes no yes -" {
+			t.Errorf("unexpected row: %q", lines[2])
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeVersionList(&buf, versions, "json"); err != nil {
+			t.Fatalf("writeVersionList() error = %v", err)
+		}
+		var decoded []schemastore.VersionInfo
+		if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatalf("invalid JSON output: %v", err)
+		}
+		if len(decoded) != 2 || decoded[0].Version != "v1" || !decoded[0].Completed || !decoded[1].RolledBack {
+			t.Errorf("unexpected decoded output: %+v", decoded)
+		}
+	})
+}
@@ -3,54 +3,228 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
-// AdvisoryLockID is the lock ID used during schema application.
+// AdvisoryLockID is the default lock ID used during schema application.
 // It represents "DBSCHEMA" in hexadecimal.
 const AdvisoryLockID int64 = 0x4442534348454D41
 
+// resolveLockID determines the advisory lock ID from the --lock-id and --lock-key flags.
+// A non-empty lockKey is hashed with FNV-1a (64-bit); a non-zero lockID is used as is;
+// otherwise the default AdvisoryLockID is returned.
+func resolveLockID(lockID int64, lockKey string) (int64, error) {
+	if lockID != 0 && lockKey != "" {
+		return 0, fmt.Errorf("--lock-id and --lock-key are mutually exclusive")
+	}
+	if lockKey != "" {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(lockKey))
+		return int64(h.Sum64()), nil
+	}
+	if lockID != 0 {
+		return lockID, nil
+	}
+	return AdvisoryLockID, nil
+}
+
+// errLockLost is returned by HeldCheck when the lock is no longer held, for example because a proxy
+// closed the idle connection holding it during a long apply
+var errLockLost = errors.New("lock is no longer held")
+
 // AdvisoryLocker manages PostgreSQL Advisory Locks.
+// Advisory locks belong to a session, so every statement runs on one pinned connection.
 type AdvisoryLocker struct {
-	db *sql.DB
+	db     *sql.DB
+	conn   *sql.Conn
+	lockID int64
+	// pid is the backend process holding the lock, set when TryLock acquires it
+	pid int
+
+	// keepalive is how often the lock is checked while held, which also keeps its connection from going idle
+	keepalive     time.Duration
+	mu            sync.Mutex
+	stopKeepalive func()
 }
 
-// NewAdvisoryLocker creates a new AdvisoryLocker.
-func NewAdvisoryLocker(dbHost, dbPort, dbUser, dbPassword, dbName string) (*AdvisoryLocker, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		dbHost, dbPort, dbUser, dbPassword, dbName)
+// NewAdvisoryLocker creates a new AdvisoryLocker for the given lock ID.
+func NewAdvisoryLocker(ctx context.Context, dbConfig DBConfig, lockID int64) (*AdvisoryLocker, error) {
+	db, err := openDB(ctx, dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	// The pinned connection is the only one the locker needs; a second one would be a bug
+	db.SetMaxOpenConns(1)
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &AdvisoryLocker{db: db, conn: conn, lockID: lockID}, nil
+}
 
-	db, err := sql.Open("postgres", connStr)
+// openDB opens and verifies a PostgreSQL connection.
+func openDB(ctx context.Context, dbConfig DBConfig) (*sql.DB, error) {
+	if dbConfig.IAMAuthToken != nil {
+		token, err := dbConfig.authToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		dbConfig.Password = token
+	}
+	db, err := sql.Open("postgres", dbConfig.postgresConnString())
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
 
 	// Verify connection
-	if err := db.Ping(); err != nil {
+	if err := db.PingContext(ctx); err != nil {
 		_ = db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return &AdvisoryLocker{db: db}, nil
+	return db, nil
+}
+
+// SetKeepalive makes the locker check the lock every interval while it is held; 0 disables the check.
+// It must be called before the lock is acquired.
+func (l *AdvisoryLocker) SetKeepalive(interval time.Duration) {
+	l.keepalive = interval
 }
 
 // TryLock attempts to acquire the lock in a non-blocking manner.
 // Returns: acquired (true, nil) / already locked (false, nil) / error (false, error)
 func (l *AdvisoryLocker) TryLock(ctx context.Context) (bool, error) {
 	var acquired bool
-	err := l.db.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", AdvisoryLockID).Scan(&acquired)
+	var pid int
+	err := l.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1), pg_backend_pid()", l.lockID).Scan(&acquired, &pid)
 	if err != nil {
 		return false, fmt.Errorf("failed to acquire advisory lock: %w", err)
 	}
+	if acquired {
+		l.pid = pid
+		l.startKeepalive()
+	}
 	return acquired, nil
 }
 
+// HeldCheck returns an error wrapping errLockLost unless the backend that acquired the lock still holds it.
+// A broken connection means the session, and the lock with it, is gone.
+// pg_locks lists a bigint advisory lock with the high half of the key in classid and the low half in objid.
+func (l *AdvisoryLocker) HeldCheck(ctx context.Context) error {
+	if l.pid == 0 {
+		return fmt.Errorf("advisory lock %d: %w", l.lockID, errLockLost)
+	}
+	var held bool
+	err := l.conn.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND pid = $1 AND classid = $2 AND objid = $3 AND objsubid = 1)`,
+		l.pid, int64(uint32(l.lockID>>32)), int64(uint32(l.lockID))).Scan(&held)
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return fmt.Errorf("advisory lock %d: connection closed (%v): %w", l.lockID, err, errLockLost)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check advisory lock %d: %w", l.lockID, err)
+	}
+	if !held {
+		return fmt.Errorf("advisory lock %d held by backend %d: %w", l.lockID, l.pid, errLockLost)
+	}
+	return nil
+}
+
+// startKeepalive runs HeldCheck every keepalive interval until the lock is released, so the connection
+// holding it is not closed as idle by a proxy (pgbouncer, an NLB idle timeout) and a lost lock is logged
+// when it happens rather than at the end of the apply
+func (l *AdvisoryLocker) startKeepalive() {
+	if l.keepalive <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := l.HeldCheck(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Advisory lock keepalive failed", "lock_id", l.lockID, "error", err)
+				if errors.Is(err, errLockLost) {
+					return
+				}
+			}
+		}
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopKeepalive = func() {
+		cancel()
+		<-done
+	}
+}
+
+// endKeepalive stops the keepalive started when the lock was acquired, if any
+func (l *AdvisoryLocker) endKeepalive() {
+	l.mu.Lock()
+	stop := l.stopKeepalive
+	l.stopKeepalive = nil
+	l.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// lockRetryInterval is the delay between TryLock attempts while waiting for the lock.
+const lockRetryInterval = time.Second
+
+// TryLockWithWait attempts to acquire the lock, retrying until wait has elapsed.
+// With wait <= 0 it behaves like TryLock.
+func (l *AdvisoryLocker) TryLockWithWait(ctx context.Context, wait time.Duration) (bool, error) {
+	return retryTryLock(ctx, l.TryLock, wait, lockRetryInterval)
+}
+
+// retryTryLock calls tryLock until it succeeds, returns an error, or wait elapses.
+func retryTryLock(ctx context.Context, tryLock func(context.Context) (bool, error), wait, interval time.Duration) (bool, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		acquired, err := tryLock(ctx)
+		if err != nil || acquired {
+			return acquired, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false, nil
+		}
+
+		timer := time.NewTimer(min(interval, remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
 // Unlock releases the lock.
 func (l *AdvisoryLocker) Unlock(ctx context.Context) error {
+	l.endKeepalive()
 	var released bool
-	err := l.db.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", AdvisoryLockID).Scan(&released)
+	err := l.conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", l.lockID).Scan(&released)
 	if err != nil {
 		return fmt.Errorf("failed to release advisory lock: %w", err)
 	}
@@ -60,7 +234,14 @@ func (l *AdvisoryLocker) Unlock(ctx context.Context) error {
 	return nil
 }
 
+// LockID returns the advisory lock ID used by this locker.
+func (l *AdvisoryLocker) LockID() int64 {
+	return l.lockID
+}
+
 // Close closes the connection (lock is automatically released).
 func (l *AdvisoryLocker) Close() error {
+	l.endKeepalive()
+	_ = l.conn.Close()
 	return l.db.Close()
 }
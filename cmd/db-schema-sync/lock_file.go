@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileLocker manages an exclusive lock on a local lock file: flock(2), or LockFileEx on Windows.
+// It is used for SQLite, where there is no database server to hold a lock.
+type FileLocker struct {
+	file *os.File
+}
+
+// NewFileLocker opens (creating if needed) the lock file at path.
+func NewFileLocker(path string) (*FileLocker, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	return &FileLocker{file: file}, nil
+}
+
+// TryLock attempts to acquire the lock in a non-blocking manner.
+// Returns: acquired (true, nil) / already locked (false, nil) / error (false, error)
+func (l *FileLocker) TryLock(_ context.Context) (bool, error) {
+	acquired, err := tryLockFile(l.file)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire file lock: %w", err)
+	}
+	return acquired, nil
+}
+
+// TryLockWithWait attempts to acquire the lock, retrying until wait has elapsed.
+// With wait <= 0 it behaves like TryLock.
+func (l *FileLocker) TryLockWithWait(ctx context.Context, wait time.Duration) (bool, error) {
+	return retryTryLock(ctx, l.TryLock, wait, lockRetryInterval)
+}
+
+// Unlock releases the lock.
+func (l *FileLocker) Unlock(_ context.Context) error {
+	if err := unlockFile(l.file); err != nil {
+		return fmt.Errorf("failed to release file lock: %w", err)
+	}
+	return nil
+}
+
+// HeldCheck always succeeds: the lock lasts as long as the file stays open
+func (l *FileLocker) HeldCheck(_ context.Context) error {
+	return nil
+}
+
+// Close closes the lock file (lock is automatically released).
+func (l *FileLocker) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,48 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileLocker(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db.lock")
+
+	locker1, err := NewFileLocker(path)
+	if err != nil {
+		t.Fatalf("failed to create locker1: %v", err)
+	}
+	defer func() { _ = locker1.Close() }()
+
+	locker2, err := NewFileLocker(path)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer func() { _ = locker2.Close() }()
+
+	if acquired, err := locker1.TryLock(ctx); err != nil || !acquired {
+		t.Fatalf("locker1 TryLock() = %v, %v, want true", acquired, err)
+	}
+	if acquired, err := locker2.TryLock(ctx); err != nil || acquired {
+		t.Fatalf("locker2 TryLock() = %v, %v, want false while locker1 holds the lock", acquired, err)
+	}
+
+	if err := locker1.Unlock(ctx); err != nil {
+		t.Fatalf("locker1 Unlock() error = %v", err)
+	}
+	if acquired, err := locker2.TryLock(ctx); err != nil || !acquired {
+		t.Fatalf("locker2 TryLock() = %v, %v, want true after unlock", acquired, err)
+	}
+
+	// Closing the file releases the lock
+	if err := locker2.Close(); err != nil {
+		t.Fatalf("locker2 Close() error = %v", err)
+	}
+	if acquired, err := locker1.TryLock(ctx); err != nil || !acquired {
+		t.Errorf("locker1 TryLock() = %v, %v, want true after locker2 closed", acquired, err)
+	}
+}
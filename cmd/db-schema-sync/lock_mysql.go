@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQLLocker manages MySQL named locks (GET_LOCK/RELEASE_LOCK).
+// Named locks belong to a session, so the locker pins a single connection.
+type MySQLLocker struct {
+	db     *sql.DB
+	conn   *sql.Conn
+	lockID int64
+}
+
+// NewMySQLLocker creates a new MySQLLocker for the given lock ID.
+func NewMySQLLocker(ctx context.Context, dbHost, dbPort, dbUser, dbPassword, dbName string, lockID int64) (*MySQLLocker, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = dbUser
+	cfg.Passwd = dbPassword
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(dbHost, dbPort)
+	cfg.DBName = dbName
+
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	// Verify connection
+	if err := conn.PingContext(ctx); err != nil {
+		_ = conn.Close()
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	return &MySQLLocker{db: db, conn: conn, lockID: lockID}, nil
+}
+
+// lockName returns the MySQL named lock used for the lock ID
+func (l *MySQLLocker) lockName() string {
+	return fmt.Sprintf("db-schema-sync-%d", l.lockID)
+}
+
+// TryLock attempts to acquire the lock in a non-blocking manner.
+// Returns: acquired (true, nil) / already locked (false, nil) / error (false, error)
+func (l *MySQLLocker) TryLock(ctx context.Context) (bool, error) {
+	var result sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", l.lockName()).Scan(&result)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire named lock: %w", err)
+	}
+	if !result.Valid {
+		return false, fmt.Errorf("failed to acquire named lock: GET_LOCK returned NULL")
+	}
+	return result.Int64 == 1, nil
+}
+
+// TryLockWithWait attempts to acquire the lock, retrying until wait has elapsed.
+// With wait <= 0 it behaves like TryLock.
+func (l *MySQLLocker) TryLockWithWait(ctx context.Context, wait time.Duration) (bool, error) {
+	return retryTryLock(ctx, l.TryLock, wait, lockRetryInterval)
+}
+
+// Unlock releases the lock.
+func (l *MySQLLocker) Unlock(ctx context.Context) error {
+	var result sql.NullInt64
+	err := l.conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", l.lockName()).Scan(&result)
+	if err != nil {
+		return fmt.Errorf("failed to release named lock: %w", err)
+	}
+	if !result.Valid || result.Int64 != 1 {
+		return fmt.Errorf("lock was not held")
+	}
+	return nil
+}
+
+// HeldCheck returns an error wrapping errLockLost unless this locker's connection still holds the lock
+func (l *MySQLLocker) HeldCheck(ctx context.Context) error {
+	var held sql.NullBool
+	err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()", l.lockName()).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("failed to check named lock: %w", err)
+	}
+	if !held.Valid || !held.Bool {
+		return fmt.Errorf("named lock %s: %w", l.lockName(), errLockLost)
+	}
+	return nil
+}
+
+// LockID returns the lock ID used by this locker.
+func (l *MySQLLocker) LockID() int64 {
+	return l.lockID
+}
+
+// Close closes the connection (lock is automatically released).
+func (l *MySQLLocker) Close() error {
+	_ = l.conn.Close()
+	return l.db.Close()
+}
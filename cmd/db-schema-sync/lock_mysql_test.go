@@ -0,0 +1,147 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go/modules/mysql"
+)
+
+func setupMySQLContainer(t *testing.T) (host string, port string, cleanup func()) {
+	ctx := context.Background()
+
+	container, err := mysql.Run(ctx,
+		"mysql:8.0",
+		mysql.WithDatabase("testdb"),
+		mysql.WithUsername("testuser"),
+		mysql.WithPassword("testpass"),
+	)
+	if err != nil {
+		t.Fatalf("failed to start container: %v", err)
+	}
+
+	hostIP, err := container.Host(ctx)
+	if err != nil {
+		container.Terminate(ctx)
+		t.Fatalf("failed to get container host: %v", err)
+	}
+
+	mappedPort, err := container.MappedPort(ctx, "3306")
+	if err != nil {
+		container.Terminate(ctx)
+		t.Fatalf("failed to get container port: %v", err)
+	}
+
+	cleanup = func() {
+		container.Terminate(ctx)
+	}
+
+	return hostIP, mappedPort.Port(), cleanup
+}
+
+func TestMySQLLocker_ConcurrentLock(t *testing.T) {
+	host, port, cleanup := setupMySQLContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// First locker acquires the lock
+	locker1, err := NewMySQLLocker(context.Background(), host, port, "testuser", "testpass", "testdb", AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker1: %v", err)
+	}
+	defer locker1.Close()
+
+	acquired1, err := locker1.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker1 TryLock failed: %v", err)
+	}
+	if !acquired1 {
+		t.Error("expected locker1 to acquire lock")
+	}
+
+	// Second locker should fail to acquire the lock
+	locker2, err := NewMySQLLocker(context.Background(), host, port, "testuser", "testpass", "testdb", AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer locker2.Close()
+
+	acquired2, err := locker2.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker2 TryLock failed: %v", err)
+	}
+	if acquired2 {
+		t.Error("expected locker2 to fail acquiring lock")
+	}
+
+	// After locker1 releases, locker2 should be able to acquire
+	err = locker1.Unlock(ctx)
+	if err != nil {
+		t.Fatalf("locker1 Unlock failed: %v", err)
+	}
+
+	acquired2, err = locker2.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker2 TryLock (retry) failed: %v", err)
+	}
+	if !acquired2 {
+		t.Error("expected locker2 to acquire lock after locker1 released")
+	}
+
+	// Unlocking a lock held by another session fails
+	if err := locker1.Unlock(ctx); err == nil {
+		t.Error("expected locker1 Unlock to fail when the lock is held by locker2")
+	}
+
+	// Cleanup
+	locker2.Unlock(ctx)
+}
+
+func TestMySQLLocker_ConnectionClose_ReleasesLock(t *testing.T) {
+	host, port, cleanup := setupMySQLContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	// First locker acquires the lock and then closes connection
+	locker1, err := NewMySQLLocker(context.Background(), host, port, "testuser", "testpass", "testdb", AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker1: %v", err)
+	}
+
+	acquired1, err := locker1.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker1 TryLock failed: %v", err)
+	}
+	if !acquired1 {
+		t.Error("expected locker1 to acquire lock")
+	}
+
+	// Close connection without explicit unlock
+	locker1.Close()
+
+	// Wait a bit for MySQL to cleanup the session
+	time.Sleep(100 * time.Millisecond)
+
+	// Second locker should be able to acquire the lock
+	locker2, err := NewMySQLLocker(context.Background(), host, port, "testuser", "testpass", "testdb", AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer locker2.Close()
+
+	acquired2, err := locker2.TryLockWithWait(ctx, 5*time.Second)
+	if err != nil {
+		t.Fatalf("locker2 TryLockWithWait failed: %v", err)
+	}
+	if !acquired2 {
+		t.Error("expected locker2 to acquire lock after locker1 connection closed")
+	}
+
+	// Cleanup
+	locker2.Unlock(ctx)
+}
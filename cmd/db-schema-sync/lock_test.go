@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -50,6 +51,11 @@ func setupPostgresContainer(t *testing.T) (host string, port string, cleanup fun
 	return hostIP, mappedPort.Port(), cleanup
 }
 
+// testDBConfig returns the connection settings of the container started by setupPostgresContainer
+func testDBConfig(host, port string) DBConfig {
+	return DBConfig{Host: host, Port: port, User: "testuser", Password: "testpass", Name: "testdb"}
+}
+
 func TestAdvisoryLocker_TryLock(t *testing.T) {
 	host, port, cleanup := setupPostgresContainer(t)
 	defer cleanup()
@@ -57,7 +63,7 @@ func TestAdvisoryLocker_TryLock(t *testing.T) {
 	ctx := context.Background()
 
 	// Create locker
-	locker, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker: %v", err)
 	}
@@ -98,7 +104,7 @@ func TestAdvisoryLocker_ConcurrentLock(t *testing.T) {
 	ctx := context.Background()
 
 	// First locker acquires the lock
-	locker1, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker1, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker1: %v", err)
 	}
@@ -113,7 +119,7 @@ func TestAdvisoryLocker_ConcurrentLock(t *testing.T) {
 	}
 
 	// Second locker should fail to acquire the lock
-	locker2, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker2, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker2: %v", err)
 	}
@@ -152,7 +158,7 @@ func TestAdvisoryLocker_ConnectionClose_ReleasesLock(t *testing.T) {
 	ctx := context.Background()
 
 	// First locker acquires the lock and then closes connection
-	locker1, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker1, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker1: %v", err)
 	}
@@ -172,7 +178,7 @@ func TestAdvisoryLocker_ConnectionClose_ReleasesLock(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Second locker should be able to acquire the lock
-	locker2, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker2, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker2: %v", err)
 	}
@@ -209,7 +215,7 @@ func TestAdvisoryLocker_ParallelExecution(t *testing.T) {
 		go func(workerID int) {
 			defer wg.Done()
 
-			locker, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+			locker, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 			if err != nil {
 				t.Errorf("worker %d: failed to create locker: %v", workerID, err)
 				return
@@ -253,7 +259,7 @@ func TestAdvisoryLocker_Unlock_WithoutLock(t *testing.T) {
 
 	ctx := context.Background()
 
-	locker, err := NewAdvisoryLocker(host, port, "testuser", "testpass", "testdb")
+	locker, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
 	if err != nil {
 		t.Fatalf("failed to create locker: %v", err)
 	}
@@ -265,3 +271,191 @@ func TestAdvisoryLocker_Unlock_WithoutLock(t *testing.T) {
 		t.Error("expected error when unlocking without lock")
 	}
 }
+
+func TestAdvisoryLocker_DifferentKeysDoNotBlock(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	lockID1, err := resolveLockID(0, "service-a")
+	if err != nil {
+		t.Fatalf("resolveLockID failed: %v", err)
+	}
+	lockID2, err := resolveLockID(0, "service-b")
+	if err != nil {
+		t.Fatalf("resolveLockID failed: %v", err)
+	}
+
+	locker1, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), lockID1)
+	if err != nil {
+		t.Fatalf("failed to create locker1: %v", err)
+	}
+	defer locker1.Close()
+
+	locker2, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), lockID2)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer locker2.Close()
+
+	acquired1, err := locker1.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker1 TryLock failed: %v", err)
+	}
+	if !acquired1 {
+		t.Error("expected locker1 to acquire lock")
+	}
+
+	// A locker with a different key must not be blocked by locker1
+	acquired2, err := locker2.TryLock(ctx)
+	if err != nil {
+		t.Fatalf("locker2 TryLock failed: %v", err)
+	}
+	if !acquired2 {
+		t.Error("expected locker2 to acquire its own lock while locker1 holds a different one")
+	}
+
+	locker1.Unlock(ctx)
+	locker2.Unlock(ctx)
+}
+
+func TestAdvisoryLocker_TryLockWithWait(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	locker1, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker1: %v", err)
+	}
+	defer locker1.Close()
+
+	locker2, err := NewAdvisoryLocker(context.Background(), testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer locker2.Close()
+
+	if acquired, err := locker1.TryLock(ctx); err != nil || !acquired {
+		t.Fatalf("locker1 TryLock = %v, %v", acquired, err)
+	}
+
+	// Release the lock shortly after locker2 starts waiting
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		locker1.Unlock(ctx)
+	}()
+
+	acquired, err := locker2.TryLockWithWait(ctx, 5*time.Second)
+	if err != nil {
+		t.Fatalf("locker2 TryLockWithWait failed: %v", err)
+	}
+	if !acquired {
+		t.Error("expected locker2 to acquire lock after waiting")
+	}
+
+	locker2.Unlock(ctx)
+}
+
+func TestAdvisoryLocker_HeldCheck_LostLock(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	locker, err := NewAdvisoryLocker(ctx, testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker: %v", err)
+	}
+	defer locker.Close()
+	locker.SetKeepalive(50 * time.Millisecond)
+
+	acquired, err := locker.TryLock(ctx)
+	if err != nil || !acquired {
+		t.Fatalf("TryLock() = %v, %v; want the lock", acquired, err)
+	}
+	if err := locker.HeldCheck(ctx); err != nil {
+		t.Fatalf("HeldCheck() with the lock held = %v", err)
+	}
+
+	// Kill the backend holding the lock, as a proxy dropping the idle connection would
+	admin, err := openDB(ctx, testDBConfig(host, port))
+	if err != nil {
+		t.Fatalf("failed to open admin connection: %v", err)
+	}
+	defer admin.Close()
+	var terminated bool
+	if err := admin.QueryRowContext(ctx, "SELECT pg_terminate_backend($1)", locker.pid).Scan(&terminated); err != nil || !terminated {
+		t.Fatalf("pg_terminate_backend() = %v, %v", terminated, err)
+	}
+
+	// The first query on the killed connection fails with its termination error, later ones with a closed connection
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = locker.HeldCheck(ctx)
+		if errors.Is(err, errLockLost) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !errors.Is(err, errLockLost) {
+		t.Fatalf("HeldCheck() after the backend was terminated = %v, want errLockLost", err)
+	}
+
+	// The lock was released with the session, so another process can take it
+	locker2, err := NewAdvisoryLocker(ctx, testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker2: %v", err)
+	}
+	defer locker2.Close()
+	if acquired, err := locker2.TryLock(ctx); err != nil || !acquired {
+		t.Errorf("locker2 TryLock() = %v, %v; want the lost lock", acquired, err)
+	}
+}
+
+func TestAdvisoryLocker_PinnedConnection(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	locker, err := NewAdvisoryLocker(ctx, testDBConfig(host, port), AdvisoryLockID)
+	if err != nil {
+		t.Fatalf("failed to create locker: %v", err)
+	}
+	defer locker.Close()
+
+	acquired, err := locker.TryLock(ctx)
+	if err != nil || !acquired {
+		t.Fatalf("TryLock() = %v, %v; want the lock", acquired, err)
+	}
+
+	// Unrelated queries between TryLock and Unlock, some concurrent, as the history insert and keepalive make;
+	// with a connection pool they could open other sessions and leave Unlock on one without the lock
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var pid int
+			if err := locker.conn.QueryRowContext(ctx, "SELECT pg_backend_pid() FROM pg_sleep(0.05)").Scan(&pid); err != nil {
+				t.Errorf("query failed: %v", err)
+				return
+			}
+			if pid != locker.pid {
+				t.Errorf("query ran on backend %d, want the lock's backend %d", pid, locker.pid)
+			}
+		}()
+	}
+	recordHistory(ctx, locker, testDBConfig(host, port), "db_schema_sync_history", HistoryRecord{Version: "v1", AppliedAt: time.Now()})
+	wg.Wait()
+
+	if err := locker.HeldCheck(ctx); err != nil {
+		t.Errorf("HeldCheck() = %v", err)
+	}
+	if err := locker.Unlock(ctx); err != nil {
+		t.Errorf("Unlock() after unrelated queries = %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolveLockID(t *testing.T) {
+	tests := []struct {
+		name    string
+		lockID  int64
+		lockKey string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name: "defaults to AdvisoryLockID",
+			want: AdvisoryLockID,
+		},
+		{
+			name:   "explicit lock ID",
+			lockID: 12345,
+			want:   12345,
+		},
+		{
+			name:    "lock key is hashed with FNV-1a",
+			lockKey: "service-a",
+			want:    1291674632018861246,
+		},
+		{
+			name:    "lock ID and key are mutually exclusive",
+			lockID:  12345,
+			lockKey: "service-a",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveLockID(tt.lockID, tt.lockKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveLockID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("resolveLockID() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveLockID_DifferentKeysDiffer(t *testing.T) {
+	a, _ := resolveLockID(0, "service-a")
+	b, _ := resolveLockID(0, "service-b")
+	if a == b {
+		t.Errorf("expected different lock IDs for different keys, both were %d", a)
+	}
+	if a == AdvisoryLockID {
+		t.Error("expected hashed lock ID to differ from the default")
+	}
+}
+
+func TestRetryTryLock(t *testing.T) {
+	t.Run("acquires after contention clears", func(t *testing.T) {
+		attempts := 0
+		tryLock := func(context.Context) (bool, error) {
+			attempts++
+			return attempts >= 3, nil
+		}
+		acquired, err := retryTryLock(context.Background(), tryLock, time.Second, time.Millisecond)
+		if err != nil {
+			t.Fatalf("retryTryLock() error = %v", err)
+		}
+		if !acquired {
+			t.Error("expected lock to be acquired")
+		}
+		if attempts != 3 {
+			t.Errorf("expected 3 attempts, got %d", attempts)
+		}
+	})
+
+	t.Run("gives up after wait elapses", func(t *testing.T) {
+		tryLock := func(context.Context) (bool, error) { return false, nil }
+		start := time.Now()
+		acquired, err := retryTryLock(context.Background(), tryLock, 50*time.Millisecond, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("retryTryLock() error = %v", err)
+		}
+		if acquired {
+			t.Error("expected lock not to be acquired")
+		}
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("expected to wait at least 50ms, waited %v", elapsed)
+		}
+	})
+
+	t.Run("zero wait tries once", func(t *testing.T) {
+		attempts := 0
+		tryLock := func(context.Context) (bool, error) {
+			attempts++
+			return false, nil
+		}
+		acquired, err := retryTryLock(context.Background(), tryLock, 0, time.Millisecond)
+		if err != nil || acquired {
+			t.Fatalf("retryTryLock() = %v, %v; want false, nil", acquired, err)
+		}
+		if attempts != 1 {
+			t.Errorf("expected 1 attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("returns error immediately", func(t *testing.T) {
+		wantErr := errors.New("connection refused")
+		tryLock := func(context.Context) (bool, error) { return false, wantErr }
+		if _, err := retryTryLock(context.Background(), tryLock, time.Second, time.Millisecond); !errors.Is(err, wantErr) {
+			t.Errorf("retryTryLock() error = %v, want %v", err, wantErr)
+		}
+	})
+
+	t.Run("stops when context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tryLock := func(context.Context) (bool, error) { return false, nil }
+		if _, err := retryTryLock(ctx, tryLock, time.Second, time.Millisecond); !errors.Is(err, context.Canceled) {
+			t.Errorf("retryTryLock() error = %v, want context.Canceled", err)
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+)
+
+// configureLogging sets up the default logger for --log-format and --log-level, writing to w.
+// main calls it after parsing and before the subcommand runs, so every log line goes through it.
+func configureLogging(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: %w", level, err)
+	}
+
+	switch format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})))
+	case "text":
+		// The default handler keeps the existing "2006/01/02 15:04:05 INFO msg key=value" lines
+		log.SetOutput(w)
+		slog.SetLogLoggerLevel(lvl)
+	default:
+		return fmt.Errorf("invalid --log-format %q: want text or json", format)
+	}
+	return nil
+}
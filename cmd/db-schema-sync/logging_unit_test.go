@@ -0,0 +1,90 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// restoreLogging puts the default logger back after a test reconfigures it
+func restoreLogging(t *testing.T) {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+		log.SetOutput(os.Stderr)
+	})
+}
+
+func TestConfigureLoggingJSON(t *testing.T) {
+	restoreLogging(t)
+
+	var buf bytes.Buffer
+	if err := configureLogging(&buf, "json", "info"); err != nil {
+		t.Fatalf("configureLogging() error = %v", err)
+	}
+	s := &Syncer{PathPrefix: "schemas/", Target: "primary"}
+	s.logger().Info("Successfully applied schema", "version", "v2")
+	slog.Debug("Waiting before next poll")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines, want the debug line dropped:\n%s", len(lines), buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v\n%s", err, lines[0])
+	}
+	want := map[string]string{
+		"level":   "INFO",
+		"msg":     "Successfully applied schema",
+		"prefix":  "schemas/",
+		"target":  "primary",
+		"version": "v2",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %q", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("log line has no time")
+	}
+}
+
+func TestConfigureLoggingTextLevel(t *testing.T) {
+	restoreLogging(t)
+
+	var buf bytes.Buffer
+	if err := configureLogging(&buf, "text", "warn"); err != nil {
+		t.Fatalf("configureLogging() error = %v", err)
+	}
+	slog.Info("Finding latest schema...")
+	slog.Warn("Dry-run failed", "version", "v2")
+
+	out := buf.String()
+	if strings.Contains(out, "Finding latest schema") {
+		t.Errorf("info line written at --log-level warn:\n%s", out)
+	}
+	if !strings.Contains(out, "WARN Dry-run failed version=v2") {
+		t.Errorf("warn line missing:\n%s", out)
+	}
+}
+
+func TestConfigureLoggingInvalid(t *testing.T) {
+	restoreLogging(t)
+
+	if err := configureLogging(&bytes.Buffer{}, "json", "verbose"); err == nil {
+		t.Error("configureLogging() with an unknown level should fail")
+	}
+	if err := configureLogging(&bytes.Buffer{}, "logfmt", "info"); err == nil {
+		t.Error("configureLogging() with an unknown format should fail")
+	}
+}
@@ -4,22 +4,35 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
 )
 
-// mockS3Client implements S3Client interface for testing
+// mockS3Client implements schemastore.S3Client interface for testing
 type mockS3Client struct {
-	listObjectsFunc func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
-	getObjectFunc   func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
-	headObjectFunc  func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
-	putObjectFunc   func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	listObjectsFunc   func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	getObjectFunc     func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	headObjectFunc    func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	putObjectFunc     func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	deleteObjectsFunc func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	getTaggingFunc    func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	putTaggingFunc    func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
 }
 
 func (m *mockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
@@ -50,336 +63,29 @@ func (m *mockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput,
 	return nil, fmt.Errorf("not implemented")
 }
 
-// Ensure mockS3Client implements S3Client interface
-var _ S3Client = (*mockS3Client)(nil)
-
-func TestFindLatestVersion(t *testing.T) {
-	tests := []struct {
-		name           string
-		keys           []string
-		prefix         string
-		schemaFileName string
-		wantKey        string
-		wantVersion    string
-		wantErr        bool
-	}{
-		{
-			name: "finds latest version from multiple versions",
-			keys: []string{
-				"schemas/v1/schema.sql",
-				"schemas/v2/schema.sql",
-				"schemas/v3/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/v3/schema.sql",
-			wantVersion:    "v3",
-			wantErr:        false,
-		},
-		{
-			name: "handles v10 correctly (semver sorting)",
-			keys: []string{
-				"schemas/v1/schema.sql",
-				"schemas/v2/schema.sql",
-				"schemas/v10/schema.sql",
-				"schemas/v9/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/v10/schema.sql",
-			wantVersion:    "v10",
-			wantErr:        false,
-		},
-		{
-			name: "handles full semver versions",
-			keys: []string{
-				"schemas/1.0.0/schema.sql",
-				"schemas/1.1.0/schema.sql",
-				"schemas/2.0.0/schema.sql",
-				"schemas/1.10.0/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/2.0.0/schema.sql",
-			wantVersion:    "2.0.0",
-			wantErr:        false,
-		},
-		{
-			name: "handles semver with v prefix",
-			keys: []string{
-				"schemas/v1.0.0/schema.sql",
-				"schemas/v1.1.0/schema.sql",
-				"schemas/v2.0.0/schema.sql",
-				"schemas/v1.10.0/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/v2.0.0/schema.sql",
-			wantVersion:    "v2.0.0",
-			wantErr:        false,
-		},
-		{
-			name: "handles patch versions correctly",
-			keys: []string{
-				"schemas/v1.0.0/schema.sql",
-				"schemas/v1.0.1/schema.sql",
-				"schemas/v1.0.10/schema.sql",
-				"schemas/v1.0.2/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/v1.0.10/schema.sql",
-			wantVersion:    "v1.0.10",
-			wantErr:        false,
-		},
-		{
-			name: "handles timestamp versions",
-			keys: []string{
-				"schemas/20240101120000/schema.sql",
-				"schemas/20240102120000/schema.sql",
-				"schemas/20240103120000/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/20240103120000/schema.sql",
-			wantVersion:    "20240103120000",
-			wantErr:        false,
-		},
-		{
-			name: "ignores non-matching files",
-			keys: []string{
-				"schemas/v1/schema.sql",
-				"schemas/v2/other.sql",
-				"schemas/v3/schema.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "schemas/v3/schema.sql",
-			wantVersion:    "v3",
-			wantErr:        false,
-		},
-		{
-			name:           "returns error when no schema files found",
-			keys:           []string{},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantErr:        true,
-		},
-		{
-			name: "returns error when no matching schema files",
-			keys: []string{
-				"schemas/v1/other.sql",
-				"schemas/v2/other.sql",
-			},
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			wantErr:        true,
-		},
-		{
-			name: "handles single version",
-			keys: []string{
-				"prod/schemas/v1/schema.sql",
-			},
-			prefix:         "prod/schemas/",
-			schemaFileName: "schema.sql",
-			wantKey:        "prod/schemas/v1/schema.sql",
-			wantVersion:    "v1",
-			wantErr:        false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			gotKey, gotVersion, err := findLatestVersion(tt.keys, tt.prefix, tt.schemaFileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("findLatestVersion() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr {
-				if gotKey != tt.wantKey {
-					t.Errorf("findLatestVersion() gotKey = %v, want %v", gotKey, tt.wantKey)
-				}
-				if gotVersion != tt.wantVersion {
-					t.Errorf("findLatestVersion() gotVersion = %v, want %v", gotVersion, tt.wantVersion)
-				}
-			}
-		})
+func (m *mockS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if m.deleteObjectsFunc != nil {
+		return m.deleteObjectsFunc(ctx, params, optFns...)
 	}
+	return nil, fmt.Errorf("not implemented")
 }
 
-func TestFindMaxVersion(t *testing.T) {
-	tests := []struct {
-		name     string
-		versions []string
-		want     string
-		wantErr  bool
-	}{
-		{
-			name:     "simple versions",
-			versions: []string{"v1", "v2", "v3"},
-			want:     "v3",
-			wantErr:  false,
-		},
-		{
-			name:     "v10 is greater than v9",
-			versions: []string{"v1", "v9", "v10", "v2"},
-			want:     "v10",
-			wantErr:  false,
-		},
-		{
-			name:     "semver without v prefix",
-			versions: []string{"1.0.0", "1.1.0", "2.0.0", "1.10.0"},
-			want:     "2.0.0",
-			wantErr:  false,
-		},
-		{
-			name:     "semver with v prefix",
-			versions: []string{"v1.0.0", "v1.1.0", "v2.0.0", "v1.10.0"},
-			want:     "v2.0.0",
-			wantErr:  false,
-		},
-		{
-			name:     "patch versions",
-			versions: []string{"v1.0.1", "v1.0.10", "v1.0.2", "v1.0.9"},
-			want:     "v1.0.10",
-			wantErr:  false,
-		},
-		{
-			name:     "mixed major versions",
-			versions: []string{"v1.9.9", "v2.0.0", "v1.10.0"},
-			want:     "v2.0.0",
-			wantErr:  false,
-		},
-		{
-			name:     "timestamp format YYYYMMDDHHMMSS",
-			versions: []string{"20240101120000", "20240115093000", "20240102120000"},
-			want:     "20240115093000",
-			wantErr:  false,
-		},
-		{
-			name:     "timestamp format with different days",
-			versions: []string{"20240101000000", "20240131235959", "20240115120000"},
-			want:     "20240131235959",
-			wantErr:  false,
-		},
-		{
-			name:     "empty list",
-			versions: []string{},
-			wantErr:  true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, err := findMaxVersion(tt.versions)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("findMaxVersion() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr && got != tt.want {
-				t.Errorf("findMaxVersion() = %v, want %v", got, tt.want)
-			}
-		})
+func (m *mockS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if m.getTaggingFunc != nil {
+		return m.getTaggingFunc(ctx, params, optFns...)
 	}
+	return nil, fmt.Errorf("not implemented")
 }
 
-func TestCompareVersions(t *testing.T) {
-	tests := []struct {
-		name string
-		v1   string
-		v2   string
-		want int
-	}{
-		{
-			name: "v1 < v2",
-			v1:   "v1",
-			v2:   "v2",
-			want: -1,
-		},
-		{
-			name: "v2 > v1",
-			v1:   "v2",
-			v2:   "v1",
-			want: 1,
-		},
-		{
-			name: "v1 == v1",
-			v1:   "v1",
-			v2:   "v1",
-			want: 0,
-		},
-		{
-			name: "v9 < v10",
-			v1:   "v9",
-			v2:   "v10",
-			want: -1,
-		},
-		{
-			name: "v10 > v9",
-			v1:   "v10",
-			v2:   "v9",
-			want: 1,
-		},
-		{
-			name: "1.0.0 < 2.0.0",
-			v1:   "1.0.0",
-			v2:   "2.0.0",
-			want: -1,
-		},
-		{
-			name: "1.9.0 < 1.10.0",
-			v1:   "1.9.0",
-			v2:   "1.10.0",
-			want: -1,
-		},
-		{
-			name: "1.0.9 < 1.0.10",
-			v1:   "1.0.9",
-			v2:   "1.0.10",
-			want: -1,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := compareVersions(tt.v1, tt.v2)
-			if got != tt.want {
-				t.Errorf("compareVersions(%q, %q) = %v, want %v", tt.v1, tt.v2, got, tt.want)
-			}
-		})
+func (m *mockS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if m.putTaggingFunc != nil {
+		return m.putTaggingFunc(ctx, params, optFns...)
 	}
+	return nil, fmt.Errorf("not implemented")
 }
 
-func TestBuildCompletionMarkerKey(t *testing.T) {
-	tests := []struct {
-		name              string
-		schemaKey         string
-		completedFileName string
-		want              string
-	}{
-		{
-			name:              "builds marker key",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			want:              "schemas/v1/completed",
-		},
-		{
-			name:              "handles nested path",
-			schemaKey:         "prod/schemas/20240101/schema.sql",
-			completedFileName: ".done",
-			want:              "prod/schemas/20240101/.done",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := buildCompletionMarkerKey(tt.schemaKey, tt.completedFileName)
-			if got != tt.want {
-				t.Errorf("buildCompletionMarkerKey() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
+// Ensure mockS3Client implements schemastore.S3Client interface
+var _ schemastore.S3Client = (*mockS3Client)(nil)
 
 func TestHookEnvToEnvVars(t *testing.T) {
 	tests := []struct {
@@ -408,6 +114,19 @@ func TestHookEnvToEnvVars(t *testing.T) {
 				"DB_SCHEMA_SYNC_APP_VERSION":    "v0.0.8",
 			},
 		},
+		{
+			name: "recovery fields",
+			hookEnv: HookEnv{
+				S3Bucket:      "my-bucket",
+				FailureCount:  "4",
+				OutageSeconds: "300",
+			},
+			expected: map[string]string{
+				"DB_SCHEMA_SYNC_S3_BUCKET":      "my-bucket",
+				"DB_SCHEMA_SYNC_FAILURE_COUNT":  "4",
+				"DB_SCHEMA_SYNC_OUTAGE_SECONDS": "300",
+			},
+		},
 		{
 			name: "only S3 fields",
 			hookEnv: HookEnv{
@@ -432,6 +151,44 @@ func TestHookEnvToEnvVars(t *testing.T) {
 				"DB_SCHEMA_SYNC_ERROR":     "error: \"connection\" failed with code=123",
 			},
 		},
+		{
+			name: "database and timing fields",
+			hookEnv: HookEnv{
+				DBHost:          "db.internal",
+				DBPort:          "5432",
+				DBName:          "app",
+				Hostname:        "worker-1",
+				SyncAttempt:     "3",
+				StartedAt:       "2026-01-20T15:30:00Z",
+				FinishedAt:      "2026-01-20T15:30:45Z",
+				ApplyDurationMs: "1234",
+			},
+			expected: map[string]string{
+				"DB_SCHEMA_SYNC_DB_HOST":           "db.internal",
+				"DB_SCHEMA_SYNC_DB_PORT":           "5432",
+				"DB_SCHEMA_SYNC_DB_NAME":           "app",
+				"DB_SCHEMA_SYNC_HOSTNAME":          "worker-1",
+				"DB_SCHEMA_SYNC_SYNC_ATTEMPT":      "3",
+				"DB_SCHEMA_SYNC_STARTED_AT":        "2026-01-20T15:30:00Z",
+				"DB_SCHEMA_SYNC_FINISHED_AT":       "2026-01-20T15:30:45Z",
+				"DB_SCHEMA_SYNC_APPLY_DURATION_MS": "1234",
+			},
+		},
+		{
+			name: "apply output fields",
+			hookEnv: HookEnv{
+				Version: "v2",
+				DryRun:  "ALTER TABLE users ADD COLUMN name text;",
+				Stdout:  "-- Apply --\nALTER TABLE users ADD COLUMN name text;",
+				Stderr:  "NOTICE: relation \"users\" already exists",
+			},
+			expected: map[string]string{
+				"DB_SCHEMA_SYNC_VERSION": "v2",
+				"DB_SCHEMA_SYNC_DRY_RUN": "ALTER TABLE users ADD COLUMN name text;",
+				"DB_SCHEMA_SYNC_STDOUT":  "-- Apply --\nALTER TABLE users ADD COLUMN name text;",
+				"DB_SCHEMA_SYNC_STDERR":  "NOTICE: relation \"users\" already exists",
+			},
+		},
 		{
 			name:     "empty hook env",
 			hookEnv:  HookEnv{},
@@ -441,7 +198,7 @@ func TestHookEnvToEnvVars(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			envVars := tt.hookEnv.toEnvVars()
+			envVars := tt.hookEnv.toEnvVars(0)
 
 			// Create a map for easy lookup
 			envMap := make(map[string]string)
@@ -479,7 +236,7 @@ func TestHookEnvPreservesExistingEnv(t *testing.T) {
 		Version:  "v1.0.0",
 	}
 
-	envVars := hookEnv.toEnvVars()
+	envVars := hookEnv.toEnvVars(0)
 
 	// Check that existing environment variables are preserved (like PATH, HOME, etc.)
 	hasPath := false
@@ -495,580 +252,569 @@ func TestHookEnvPreservesExistingEnv(t *testing.T) {
 	}
 }
 
-func TestBuildExportedSchemaKey(t *testing.T) {
+func TestRunCommand(t *testing.T) {
 	tests := []struct {
-		name      string
-		schemaKey string
-		want      string
+		name    string
+		command string
+		wantErr bool
 	}{
 		{
-			name:      "basic schema key",
-			schemaKey: "schemas/v1/schema.sql",
-			want:      "schemas/v1/exported.sql",
+			name:    "successful command",
+			command: "true",
+			wantErr: false,
 		},
 		{
-			name:      "nested path",
-			schemaKey: "prod/schemas/v2.0.0/schema.sql",
-			want:      "prod/schemas/v2.0.0/exported.sql",
+			name:    "failing command",
+			command: "false",
+			wantErr: true,
 		},
 		{
-			name:      "timestamp version",
-			schemaKey: "db/20240101120000/schema.sql",
-			want:      "db/20240101120000/exported.sql",
+			name:    "echo command",
+			command: "echo hello",
+			wantErr: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := buildExportedSchemaKey(tt.schemaKey)
-			if got != tt.want {
-				t.Errorf("buildExportedSchemaKey() = %v, want %v", got, tt.want)
+			err := runCommandWithEnv(context.Background(), strings.Fields(defaultHookShell), tt.command, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runCommandWithEnv() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func TestDownloadSchemaFromS3(t *testing.T) {
+func TestRunCommandWithEnv(t *testing.T) {
 	tests := []struct {
-		name        string
-		bucket      string
-		key         string
-		mockContent string
-		mockErr     error
-		wantContent string
-		wantErr     bool
+		name    string
+		command string
+		hookEnv *HookEnv
+		wantErr bool
 	}{
 		{
-			name:        "successful download",
-			bucket:      "test-bucket",
-			key:         "schemas/v1/schema.sql",
-			mockContent: "CREATE TABLE users (id INT);",
-			wantContent: "CREATE TABLE users (id INT);",
-			wantErr:     false,
+			name:    "with nil hookEnv",
+			command: "true",
+			hookEnv: nil,
+			wantErr: false,
 		},
 		{
-			name:    "download error",
-			bucket:  "test-bucket",
-			key:     "schemas/v1/schema.sql",
-			mockErr: fmt.Errorf("access denied"),
-			wantErr: true,
+			name:    "with hookEnv",
+			command: "true",
+			hookEnv: &HookEnv{
+				S3Bucket: "test-bucket",
+				Version:  "v1.0.0",
+			},
+			wantErr: false,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockS3Client{
-				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
-					if tt.mockErr != nil {
-						return nil, tt.mockErr
-					}
-					return &s3.GetObjectOutput{
-						Body: io.NopCloser(strings.NewReader(tt.mockContent)),
-					}, nil
-				},
-			}
-
-			got, err := downloadSchemaFromS3(context.Background(), mock, tt.bucket, tt.key)
+			err := runCommandWithEnv(context.Background(), strings.Fields(defaultHookShell), tt.command, tt.hookEnv.toEnvVars(0), nil)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("downloadSchemaFromS3() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr && string(got) != tt.wantContent {
-				t.Errorf("downloadSchemaFromS3() = %v, want %v", string(got), tt.wantContent)
+				t.Errorf("runCommandWithEnv() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
-func TestCheckCompletionMarker(t *testing.T) {
+func TestRunCommandWithoutShell(t *testing.T) {
+	dir := t.TempDir()
+	argsLog := filepath.Join(dir, "args.log")
+	// The script prints each argument on its own line, then the version from the environment
+	script := filepath.Join(dir, "print-args")
+	if err := os.WriteFile(script, []byte(`#!/bin/sh
+for arg in "$@"; do echo "[$arg]"; done > `+argsLog+`
+echo "version=$DB_SCHEMA_SYNC_VERSION" >> `+argsLog+`
+`), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
 	tests := []struct {
-		name              string
-		bucket            string
-		schemaKey         string
-		completedFileName string
-		headErr           error
-		wantExists        bool
-		wantErr           bool
+		name    string
+		command string
+		want    string
+		wantErr string
 	}{
 		{
-			name:              "marker exists",
-			bucket:            "test-bucket",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			headErr:           nil,
-			wantExists:        true,
-			wantErr:           false,
+			name:    "plain arguments",
+			command: script + " notify v1",
+			want:    "[notify]\n[v1]\nversion=v2\n",
+		},
+		{
+			name:    "spaces and quotes",
+			command: script + ` "schema applied" 'say "hi"' it\'s`,
+			want:    "[schema applied]\n[say \"hi\"]\n[it's]\nversion=v2\n",
+		},
+		{
+			name:    "no variable expansion or redirects",
+			command: script + ` $DB_SCHEMA_SYNC_VERSION > out.log`,
+			want:    "[$DB_SCHEMA_SYNC_VERSION]\n[>]\n[out.log]\nversion=v2\n",
+		},
+		{
+			name:    "unterminated quote",
+			command: script + ` "schema applied`,
+			wantErr: "failed to parse hook command: unterminated double quote",
 		},
 		{
-			name:              "marker not found",
-			bucket:            "test-bucket",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			headErr:           fmt.Errorf("NotFound: The specified key does not exist"),
-			wantExists:        false,
-			wantErr:           false,
+			name:    "empty command",
+			command: " ",
+			wantErr: "no program to run",
 		},
 		{
-			name:              "other error",
-			bucket:            "test-bucket",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			headErr:           fmt.Errorf("access denied"),
-			wantExists:        false,
-			wantErr:           true,
+			name:    "failing command",
+			command: "false",
+			wantErr: "exit status 1",
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockS3Client{
-				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
-					if tt.headErr != nil {
-						return nil, tt.headErr
-					}
-					return &s3.HeadObjectOutput{}, nil
-				},
-			}
-
-			exists, err := checkCompletionMarker(context.Background(), mock, tt.bucket, tt.schemaKey, tt.completedFileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("checkCompletionMarker() error = %v, wantErr %v", err, tt.wantErr)
+			_ = os.Remove(argsLog)
+			err := runCommandWithEnv(context.Background(), nil, tt.command, (&HookEnv{Version: "v2"}).toEnvVars(0), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runCommandWithEnv() error = %v, want %q", err, tt.wantErr)
+				}
 				return
 			}
-			if exists != tt.wantExists {
-				t.Errorf("checkCompletionMarker() = %v, want %v", exists, tt.wantExists)
+			if err != nil {
+				t.Fatalf("runCommandWithEnv() error = %v", err)
+			}
+			got, err := os.ReadFile(argsLog)
+			if err != nil {
+				t.Fatalf("failed to read args log: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("hook got %q, want %q", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestCreateCompletionMarker(t *testing.T) {
+func TestNewHookRunnerShell(t *testing.T) {
 	tests := []struct {
-		name              string
-		bucket            string
-		schemaKey         string
-		completedFileName string
-		putErr            error
-		wantKey           string
-		wantErr           bool
+		shell   string
+		want    []string
+		wantErr string
 	}{
-		{
-			name:              "successful creation",
-			bucket:            "test-bucket",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			putErr:            nil,
-			wantKey:           "schemas/v1/completed",
-			wantErr:           false,
-		},
-		{
-			name:              "put error",
-			bucket:            "test-bucket",
-			schemaKey:         "schemas/v1/schema.sql",
-			completedFileName: "completed",
-			putErr:            fmt.Errorf("access denied"),
-			wantErr:           true,
-		},
+		{shell: "sh -c", want: []string{"sh", "-c"}},
+		{shell: "/bin/bash -e -c", want: []string{"/bin/bash", "-e", "-c"}},
+		{shell: "none", want: nil},
+		{shell: "", want: strings.Fields(defaultHookShell)},
+		{shell: "  ", wantErr: "must not be empty"},
+		{shell: "'sh -c", wantErr: "invalid --hook-shell"},
 	}
-
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			var gotKey string
-			mock := &mockS3Client{
-				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-					if tt.putErr != nil {
-						return nil, tt.putErr
-					}
-					gotKey = *params.Key
-					return &s3.PutObjectOutput{}, nil
-				},
-			}
-
-			err := createCompletionMarker(context.Background(), mock, tt.bucket, tt.schemaKey, tt.completedFileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("createCompletionMarker() error = %v, wantErr %v", err, tt.wantErr)
+		t.Run(tt.shell, func(t *testing.T) {
+			runner, err := newHookRunner(time.Minute, 1024, tt.shell)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("newHookRunner() error = %v, want %q", err, tt.wantErr)
+				}
 				return
 			}
-			if !tt.wantErr && gotKey != tt.wantKey {
-				t.Errorf("createCompletionMarker() put key = %v, want %v", gotKey, tt.wantKey)
+			if err != nil {
+				t.Fatalf("newHookRunner() error = %v", err)
+			}
+			if !reflect.DeepEqual(runner.Shell, tt.want) {
+				t.Errorf("Shell = %q, want %q", runner.Shell, tt.want)
 			}
 		})
 	}
-}
 
-func TestUploadSchemaToS3(t *testing.T) {
-	tests := []struct {
-		name    string
-		bucket  string
-		key     string
-		schema  []byte
-		putErr  error
-		wantErr bool
-	}{
-		{
-			name:    "successful upload",
-			bucket:  "test-bucket",
-			key:     "schemas/v1/exported.sql",
-			schema:  []byte("CREATE TABLE users (id INT);"),
-			putErr:  nil,
-			wantErr: false,
-		},
-		{
-			name:    "upload error",
-			bucket:  "test-bucket",
-			key:     "schemas/v1/exported.sql",
-			schema:  []byte("CREATE TABLE users (id INT);"),
-			putErr:  fmt.Errorf("access denied"),
-			wantErr: true,
-		},
+	// A custom shell gets the command as its last argument
+	out := filepath.Join(t.TempDir(), "out")
+	if err := runCommandWithEnv(context.Background(), []string{"sh", "-e", "-c"}, "false; echo reached > "+out, nil, nil); err == nil {
+		t.Error("runCommandWithEnv() error = nil, want sh -e to stop at false")
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("sh -e ran past the failing command")
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			var gotBucket, gotKey string
-			mock := &mockS3Client{
-				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
-					if tt.putErr != nil {
-						return nil, tt.putErr
-					}
-					gotBucket = *params.Bucket
-					gotKey = *params.Key
-					return &s3.PutObjectOutput{}, nil
-				},
-			}
+func TestHookRunnerCommandTimeout(t *testing.T) {
+	runner := defaultHookRunner()
+	runner.Timeout = 200 * time.Millisecond
 
-			err := uploadSchemaToS3(context.Background(), mock, tt.bucket, tt.key, tt.schema)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("uploadSchemaToS3() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr {
-				if gotBucket != tt.bucket {
-					t.Errorf("uploadSchemaToS3() bucket = %v, want %v", gotBucket, tt.bucket)
-				}
-				if gotKey != tt.key {
-					t.Errorf("uploadSchemaToS3() key = %v, want %v", gotKey, tt.key)
-				}
-			}
-		})
+	// The hook leaves a background loop behind, like a curl started by a wrapper script
+	tickLog := filepath.Join(t.TempDir(), "tick.log")
+	command := `(while :; do echo tick >> ` + tickLog + `; sleep 0.05; done) & wait`
+
+	failuresBefore := testutil.ToFloat64(hookFailuresTotal.WithLabelValues("on-apply-succeeded"))
+	start := time.Now()
+	runner.runCommand(context.Background(), "on-apply-succeeded", command, &HookEnv{})
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("runCommand() took %v, want the hook killed after %v", elapsed, runner.Timeout)
+	}
+	if got := testutil.ToFloat64(hookFailuresTotal.WithLabelValues("on-apply-succeeded")) - failuresBefore; got != 1 {
+		t.Errorf("hook failures = %v, want 1", got)
+	}
+	if testutil.CollectAndCount(hookDurationSeconds) == 0 {
+		t.Error("expected the hook duration to be recorded")
+	}
+
+	// The whole process group is killed, so the loop stops writing
+	before, _ := os.ReadFile(tickLog)
+	time.Sleep(300 * time.Millisecond)
+	after, _ := os.ReadFile(tickLog)
+	if len(before) == 0 || len(after) != len(before) {
+		t.Errorf("background process kept running after the timeout (%d -> %d bytes)", len(before), len(after))
 	}
 }
 
-func TestFindLatestSchemaWithMock(t *testing.T) {
-	tests := []struct {
-		name           string
-		bucket         string
-		prefix         string
-		schemaFileName string
-		objects        []string
-		listErr        error
-		wantKey        string
-		wantVersion    string
-		wantErr        bool
-	}{
-		{
-			name:           "finds latest version",
-			bucket:         "test-bucket",
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			objects:        []string{"schemas/v1/schema.sql", "schemas/v2/schema.sql", "schemas/v3/schema.sql"},
-			wantKey:        "schemas/v3/schema.sql",
-			wantVersion:    "v3",
-			wantErr:        false,
-		},
-		{
-			name:           "handles semver correctly",
-			bucket:         "test-bucket",
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			objects:        []string{"schemas/v1.0.0/schema.sql", "schemas/v1.10.0/schema.sql", "schemas/v2.0.0/schema.sql"},
-			wantKey:        "schemas/v2.0.0/schema.sql",
-			wantVersion:    "v2.0.0",
-			wantErr:        false,
-		},
-		{
-			name:           "list error",
-			bucket:         "test-bucket",
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			listErr:        fmt.Errorf("access denied"),
-			wantErr:        true,
-		},
-		{
-			name:           "no schema files",
-			bucket:         "test-bucket",
-			prefix:         "schemas/",
-			schemaFileName: "schema.sql",
-			objects:        []string{"schemas/v1/other.sql"},
-			wantErr:        true,
-		},
+func TestHookRunnerCommandPayload(t *testing.T) {
+	if _, err := exec.LookPath("jq"); err != nil {
+		t.Skip("jq not installed")
 	}
+	runner := defaultHookRunner()
+	runner.EnvMaxBytes = 100
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockS3Client{
-				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
-					if tt.listErr != nil {
-						return nil, tt.listErr
-					}
-					var contents []types.Object
-					for _, key := range tt.objects {
-						keyCopy := key
-						contents = append(contents, types.Object{Key: aws.String(keyCopy)})
-					}
-					return &s3.ListObjectsV2Output{Contents: contents}, nil
-				},
-			}
+	dir := t.TempDir()
+	ddl := strings.Repeat("ALTER TABLE users ADD COLUMN \"note\" text;\n", 50)
+	command := `tee ` + filepath.Join(dir, "payload.json") + ` | jq -r '.event, .version' > ` + filepath.Join(dir, "fields") + `
+jq -j .dry_run ` + filepath.Join(dir, "payload.json") + ` > ` + filepath.Join(dir, "stdin") + `
+printf %s "$DB_SCHEMA_SYNC_DRY_RUN" > ` + filepath.Join(dir, "env")
+	runner.runCommand(context.Background(), "on-apply-succeeded", command, &HookEnv{Version: "v1", DryRun: ddl})
 
-			gotKey, gotVersion, err := findLatestSchema(context.Background(), mock, tt.bucket, tt.prefix, tt.schemaFileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("findLatestSchema() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr {
-				if gotKey != tt.wantKey {
-					t.Errorf("findLatestSchema() key = %v, want %v", gotKey, tt.wantKey)
-				}
-				if gotVersion != tt.wantVersion {
-					t.Errorf("findLatestSchema() version = %v, want %v", gotVersion, tt.wantVersion)
-				}
-			}
-		})
+	fields, _ := os.ReadFile(filepath.Join(dir, "fields"))
+	if got := string(fields); got != "apply-succeeded\nv1\n" {
+		t.Errorf("event and version = %q", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "stdin")); string(got) != ddl {
+		t.Errorf("dry_run on stdin = %d bytes, want the full %d", len(got), len(ddl))
+	}
+	env, _ := os.ReadFile(filepath.Join(dir, "env"))
+	if !strings.HasPrefix(ddl, string(env[:100])) || !strings.Contains(string(env), "truncated") {
+		t.Errorf("DB_SCHEMA_SYNC_DRY_RUN = %q, want the first 100 bytes and a truncation note", env)
+	}
+}
+
+// writeStubPsqldef writes an executable shell script that stands in for psqldef
+func writeStubPsqldef(t *testing.T, script string) string {
+	t.Helper()
+	stubPath := filepath.Join(t.TempDir(), "psqldef")
+	if err := os.WriteFile(stubPath, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatalf("failed to write stub psqldef: %v", err)
 	}
+	return stubPath
 }
 
-func TestFindLatestCompletedSchemaWithMock(t *testing.T) {
+func TestCheckSqldef(t *testing.T) {
+	t.Run("returns detected version", func(t *testing.T) {
+		stub := writeStubPsqldef(t, `echo "psqldef v3.9.4"`)
+		got, err := checkSqldef(context.Background(), "psqldef", stub)
+		if err != nil {
+			t.Fatalf("checkSqldef() error = %v", err)
+		}
+		if got != "psqldef v3.9.4" {
+			t.Errorf("checkSqldef() = %q, want %q", got, "psqldef v3.9.4")
+		}
+	})
+
+	t.Run("returns error when binary is missing", func(t *testing.T) {
+		_, err := checkSqldef(context.Background(), "psqldef", filepath.Join(t.TempDir(), "no-such-psqldef"))
+		if err == nil {
+			t.Fatal("checkSqldef() expected error, got nil")
+		}
+		if !strings.Contains(err.Error(), "psqldef not found") {
+			t.Errorf("checkSqldef() error = %v, want psqldef not found", err)
+		}
+	})
+
+	t.Run("returns error when --version fails", func(t *testing.T) {
+		stub := writeStubPsqldef(t, "exit 1")
+		if _, err := checkSqldef(context.Background(), "psqldef", stub); err == nil {
+			t.Error("checkSqldef() expected error, got nil")
+		}
+	})
+}
+
+func TestBackoffInterval(t *testing.T) {
 	tests := []struct {
-		name              string
-		bucket            string
-		prefix            string
-		schemaFileName    string
-		completedFileName string
-		objects           []string
-		listErr           error
-		wantKey           string
-		wantVersion       string
-		wantErr           bool
+		name     string
+		failures int
+		jitter   float64
+		expected time.Duration
 	}{
-		{
-			name:              "finds latest completed version",
-			bucket:            "test-bucket",
-			prefix:            "schemas/",
-			schemaFileName:    "schema.sql",
-			completedFileName: "completed",
-			objects: []string{
-				"schemas/v1/schema.sql",
-				"schemas/v1/completed",
-				"schemas/v2/schema.sql",
-				"schemas/v2/completed",
-				"schemas/v3/schema.sql", // no completion marker
-			},
-			wantKey:     "schemas/v2/schema.sql",
-			wantVersion: "v2",
-			wantErr:     false,
-		},
-		{
-			name:              "no completed schemas",
-			bucket:            "test-bucket",
-			prefix:            "schemas/",
-			schemaFileName:    "schema.sql",
-			completedFileName: "completed",
-			objects: []string{
-				"schemas/v1/schema.sql",
-				"schemas/v2/schema.sql",
-			},
-			wantErr: true,
-		},
-		{
-			name:              "list error",
-			bucket:            "test-bucket",
-			prefix:            "schemas/",
-			schemaFileName:    "schema.sql",
-			completedFileName: "completed",
-			listErr:           fmt.Errorf("access denied"),
-			wantErr:           true,
-		},
+		{"no failures", 0, 0.9, time.Minute},
+		{"one failure", 1, 0, 2 * time.Minute},
+		{"two failures", 2, 0, 4 * time.Minute},
+		{"three failures", 3, 0, 8 * time.Minute},
+		{"capped at max multiplier", 4, 0, 10 * time.Minute},
+		{"stays capped", 50, 0, 10 * time.Minute},
+		{"jitter added", 1, 0.5, 2*time.Minute + 12*time.Second},
+		{"jitter on capped delay", 10, 0.5, 11 * time.Minute},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mock := &mockS3Client{
-				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
-					if tt.listErr != nil {
-						return nil, tt.listErr
-					}
-					var contents []types.Object
-					for _, key := range tt.objects {
-						keyCopy := key
-						contents = append(contents, types.Object{Key: aws.String(keyCopy)})
-					}
-					return &s3.ListObjectsV2Output{Contents: contents}, nil
-				},
-			}
-
-			gotKey, gotVersion, err := findLatestCompletedSchema(context.Background(), mock, tt.bucket, tt.prefix, tt.schemaFileName, tt.completedFileName)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("findLatestCompletedSchema() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if !tt.wantErr {
-				if gotKey != tt.wantKey {
-					t.Errorf("findLatestCompletedSchema() key = %v, want %v", gotKey, tt.wantKey)
-				}
-				if gotVersion != tt.wantVersion {
-					t.Errorf("findLatestCompletedSchema() version = %v, want %v", gotVersion, tt.wantVersion)
-				}
+			got := backoffInterval(time.Minute, tt.failures, tt.jitter)
+			if got != tt.expected {
+				t.Errorf("backoffInterval(1m, %d, %v) = %v, want %v", tt.failures, tt.jitter, got, tt.expected)
 			}
 		})
 	}
 }
 
-func TestRunCommand(t *testing.T) {
+func TestPlanCmdAgainstDatabase(t *testing.T) {
 	tests := []struct {
-		name    string
-		command string
-		wantErr bool
+		name     string
+		output   string
+		exitCode bool
+		wantErr  error
 	}{
-		{
-			name:    "successful command",
-			command: "true",
-			wantErr: false,
-		},
-		{
-			name:    "failing command",
-			command: "false",
-			wantErr: true,
-		},
-		{
-			name:    "echo command",
-			command: "echo hello",
-			wantErr: false,
-		},
+		{"changes pending", "-- dry run --\nALTER TABLE users ADD COLUMN email text;\n", true, errChangesPending},
+		{"nothing to change", "-- Nothing is modified --\n", true, nil},
+		{"changes without --exit-code", "-- dry run --\nALTER TABLE users ADD COLUMN email text;\n", false, nil},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := runCommand(tt.command)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("runCommand() error = %v, wantErr %v", err, tt.wantErr)
+			dir := t.TempDir()
+			argsLog := filepath.Join(dir, "args.log")
+			output := filepath.Join(dir, "output")
+			if err := os.WriteFile(output, []byte(tt.output), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			stub := writeStubPsqldef(t, `case "$*" in
+*--version*) echo "psqldef v3.9.4" ;;
+*) echo "$*" > `+argsLog+`; cat `+output+` ;;
+esac`)
+			localFile := filepath.Join(dir, "schema.sql")
+			if err := os.WriteFile(localFile, []byte("CREATE TABLE users (id int, email text);"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := &PlanCmd{
+				LocalFile:  localFile,
+				DBHost:     "localhost",
+				DBPort:     "5432",
+				DBUser:     "user",
+				DBPassword: "pass",
+				DBName:     "mydb",
+				ExitCode:   tt.exitCode,
+			}
+			err := cmd.Run(context.Background(), &CLI{Engine: EnginePostgres, PsqldefPath: stub})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && exitCode(err) != exitChangesPending {
+				t.Errorf("exit status = %d, want %d", exitCode(err), exitChangesPending)
+			}
+
+			args, _ := os.ReadFile(argsLog)
+			if !strings.Contains(string(args), "--dry-run") || !strings.Contains(string(args), "mydb") {
+				t.Errorf("psqldef args = %q, want a dry-run against mydb", args)
 			}
 		})
 	}
 }
 
-func TestRunCommandWithEnv(t *testing.T) {
+func TestFetchCompletedResolveKey(t *testing.T) {
+	objects := map[string]string{
+		"schemas/v1/schema.sql":   "-- v1",
+		"schemas/v1/completed":    "",
+		"schemas/v1/exported.sql": "-- v1 exported",
+		"schemas/v1/applied.sql":  "CREATE TABLE users (id int);",
+		"schemas/v2/schema.sql":   "-- v2",
+		"schemas/v2/completed":    "",
+		"schemas/v3/schema.sql":   "-- v3",
+	}
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			var contents []types.Object
+			for key := range objects {
+				contents = append(contents, types.Object{Key: aws.String(key)})
+			}
+			return &s3.ListObjectsV2Output{Contents: contents}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if _, ok := objects[*params.Key]; !ok {
+				return nil, &types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", AppliedDDLFile: "applied.sql"}
+
 	tests := []struct {
 		name    string
-		command string
-		hookEnv *HookEnv
-		wantErr bool
+		cmd     FetchCompletedCmd
+		wantKey string
+		wantErr string
 	}{
-		{
-			name:    "with nil hookEnv",
-			command: "true",
-			hookEnv: nil,
-			wantErr: false,
-		},
-		{
-			name:    "with hookEnv",
-			command: "true",
-			hookEnv: &HookEnv{
-				S3Bucket: "test-bucket",
-				Version:  "v1.0.0",
-			},
-			wantErr: false,
-		},
+		{"latest completed", FetchCompletedCmd{}, "schemas/v2/schema.sql", ""},
+		{"explicit version", FetchCompletedCmd{Version: "v1"}, "schemas/v1/schema.sql", ""},
+		{"version not completed", FetchCompletedCmd{Version: "v3"}, "schemas/v3/schema.sql", ""},
+		{"exported", FetchCompletedCmd{Version: "v1", Exported: true}, "schemas/v1/exported.sql", ""},
+		{"applied DDL", FetchCompletedCmd{Version: "v1", DDL: true}, "schemas/v1/applied.sql", ""},
+		{"exported missing", FetchCompletedCmd{Version: "v2", Exported: true}, "", "no exported schema for version v2"},
+		{"unknown version", FetchCompletedCmd{Version: "v5"}, "", "schema not found: s3://test-bucket/schemas/v5/schema.sql (nearby versions: v1, v2, v3)"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := runCommandWithEnv(tt.command, tt.hookEnv)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("runCommandWithEnv() error = %v, wantErr %v", err, tt.wantErr)
+			key, err := tt.cmd.resolveKey(context.Background(), client, cli)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveKey() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveKey() error = %v", err)
+			}
+			if key != tt.wantKey {
+				t.Errorf("resolveKey() = %q, want %q", key, tt.wantKey)
 			}
 		})
 	}
 }
 
-func TestCompareVersions_EdgeCases(t *testing.T) {
+func TestPlanCmdReadsStdin(t *testing.T) {
+	const schema = "CREATE TABLE users (id int, email text);\n"
 	tests := []struct {
-		name string
-		v1   string
-		v2   string
-		want int
+		name     string
+		stdin    string
+		maxBytes int64
+		wantErr  string
 	}{
-		{
-			name: "invalid vs valid version - string comparison (i < v)",
-			v1:   "invalid",
-			v2:   "v1",
-			want: -1,
-		},
-		{
-			name: "valid vs invalid version - string comparison (v > i)",
-			v1:   "v1",
-			v2:   "invalid",
-			want: 1,
-		},
-		{
-			name: "both invalid - string comparison (abc < def)",
-			v1:   "abc",
-			v2:   "def",
-			want: -1,
-		},
-		{
-			name: "both invalid - equal",
-			v1:   "same",
-			v2:   "same",
-			want: 0,
-		},
+		{"schema", schema, 1 << 20, ""},
+		{"empty", " \n\n", 1 << 20, "schema from stdin is empty"},
+		{"too large", schema, 10, "schema from stdin exceeds 10 bytes"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := compareVersions(tt.v1, tt.v2)
-			if got != tt.want {
-				t.Errorf("compareVersions(%q, %q) = %v, want %v", tt.v1, tt.v2, got, tt.want)
+			dir := t.TempDir()
+			desiredLog := filepath.Join(dir, "desired.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--version*) echo "psqldef v3.9.4" ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" > `+desiredLog+`; echo '-- Nothing is modified --' ;;
+esac`)
+
+			cmd := &PlanCmd{
+				LocalFile:     "-",
+				MaxStdinBytes: tt.maxBytes,
+				DBHost:        "localhost",
+				DBPort:        "5432",
+				DBUser:        "user",
+				DBPassword:    "pass",
+				DBName:        "mydb",
+				stdin:         strings.NewReader(tt.stdin),
+			}
+			err := cmd.Run(context.Background(), &CLI{Engine: EnginePostgres, PsqldefPath: stub})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want containing %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(desiredLog); !os.IsNotExist(err) {
+					t.Error("expected psqldef not to run")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if desired, _ := os.ReadFile(desiredLog); string(desired) != schema {
+				t.Errorf("desired schema = %q, want stdin %q", desired, schema)
 			}
 		})
 	}
 }
 
-func TestFindMaxVersion_EdgeCases(t *testing.T) {
+func TestApplyCmdLocalFile(t *testing.T) {
+	const schema = "CREATE TABLE users (id int);\n"
+	sum := sha256.Sum256([]byte(schema))
+
 	tests := []struct {
-		name     string
-		versions []string
-		want     string
-		wantErr  bool
+		name        string
+		version     string
+		wantVersion string
 	}{
-		{
-			name:     "all invalid versions",
-			versions: []string{"invalid1", "invalid2", "invalid3"},
-			wantErr:  true,
-		},
-		{
-			name:     "mixed valid and invalid",
-			versions: []string{"invalid", "v1", "v2"},
-			want:     "v2",
-			wantErr:  false,
-		},
-		{
-			name:     "single valid version",
-			versions: []string{"v1"},
-			want:     "v1",
-			wantErr:  false,
-		},
+		{"sha256 version", "", hex.EncodeToString(sum[:])},
+		{"explicit version", "local-1", "local-1"},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := findMaxVersion(tt.versions)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("findMaxVersion() error = %v, wantErr %v", err, tt.wantErr)
-				return
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			hookLog := filepath.Join(dir, "hook.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--version*) echo "psqldef v3.9.4" ;;
+*--dry-run*) echo 'CREATE TABLE users (id int);' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+			localFile := filepath.Join(dir, "schema.sql")
+			if err := os.WriteFile(localFile, []byte(schema), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := &ApplyCmd{
+				SyncOptions: SyncOptions{
+					DBOptions:        DBOptions{DBHost: "localhost", DBPort: "5432", DBUser: "user", DBPassword: "pass", DBName: "mydb"},
+					SkipLock:         true,
+					OnApplySucceeded: `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_SCHEMA_FILE" > ` + hookLog,
+				},
+				LocalFile: localFile,
+				Version:   tt.version,
+			}
+			// No S3 settings: --local-file must not need them
+			if err := cmd.Run(context.Background(), &CLI{Engine: EnginePostgres, PsqldefPath: stub, CompletedFile: "completed", AppliedDDLFile: "applied.sql"}); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if applied, _ := os.ReadFile(applyLog); string(applied) != schema {
+				t.Errorf("applied schema = %q, want %q", applied, schema)
 			}
-			if !tt.wantErr && got != tt.want {
-				t.Errorf("findMaxVersion() = %v, want %v", got, tt.want)
+			if hook, _ := os.ReadFile(hookLog); string(hook) != tt.wantVersion+" "+localFile+"\n" {
+				t.Errorf("on-apply-succeeded env = %q, want version %s", hook, tt.wantVersion)
 			}
 		})
 	}
+
+	t.Run("rejects --export-after-apply", func(t *testing.T) {
+		cmd := &ApplyCmd{SyncOptions: SyncOptions{ExportAfterApply: true}, LocalFile: "schema.sql"}
+		if err := cmd.Run(context.Background(), &CLI{}); err == nil || !strings.Contains(err.Error(), "--export-after-apply") {
+			t.Errorf("Run() error = %v, want --export-after-apply conflict", err)
+		}
+	})
+
+	t.Run("S3 mode requires S3 settings", func(t *testing.T) {
+		cmd := &ApplyCmd{}
+		if err := cmd.Run(context.Background(), &CLI{}); err == nil || err.Error() != "missing flags: --s3-bucket, --path-prefix" {
+			t.Errorf("Run() error = %v, want missing S3 flags", err)
+		}
+	})
+}
+
+func TestConfigureVersions(t *testing.T) {
+	cli := &CLI{VersionScheme: "numeric", StrictVersions: true, IgnoreVersionPattern: []string{"^archive$"}, IncludeVersionPattern: []string{`^v\d`}}
+	if err := cli.configureVersions(); err != nil {
+		t.Fatalf("configureVersions() error = %v", err)
+	}
+	if v := cli.versioning; v.Scheme != schemastore.SchemeNumeric || !v.Strict || len(v.Include) != 1 || len(v.Ignore) != 1 {
+		t.Errorf("configureVersions() versioning = %+v", v)
+	}
+	_, latest, err := schemastore.FindLatestVersion([]string{"s/v1/schema.sql", "s/archive/schema.sql", "s/2/schema.sql"}, "s/", "schema.sql", cli.versioning)
+	if err != nil || latest != "v1" {
+		t.Errorf("FindLatestVersion() = %q, %v, want v1 after filtering", latest, err)
+	}
+
+	if err := (&CLI{VersionScheme: "calver"}).configureVersions(); err == nil {
+		t.Error("configureVersions() with an unknown scheme succeeded")
+	}
+	cli.IgnoreVersionPattern = []string{"("}
+	if err := cli.configureVersions(); err == nil || !strings.Contains(err.Error(), "--ignore-version-pattern") {
+		t.Errorf("configureVersions() with an invalid pattern error = %v", err)
+	}
 }
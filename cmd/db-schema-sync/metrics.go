@@ -3,27 +3,51 @@ package main
 import (
 	"log/slog"
 	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
 )
 
 var (
-	applyTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	applyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "db_schema_sync_apply_total",
 		Help: "Total number of schema apply attempts",
-	})
+	}, []string{"target"})
+
+	applyBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_blocked_total",
+		Help: "Total number of applies refused because the planned DDL matched --deny-ddl",
+	}, []string{"target"})
+
+	checksumErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_checksum_error_total",
+		Help: "Total number of applies refused because the schema did not match its sha256 sidecar, or had none with --require-checksum",
+	}, []string{"target"})
 
-	applySuccessTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	contentChangedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_content_changed_total",
+		Help: "Total number of applied versions whose schema file was overwritten with different content",
+	}, []string{"target"})
+
+	applySuccessTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "db_schema_sync_apply_success_total",
 		Help: "Total number of successful schema applies",
-	})
+	}, []string{"target"})
 
-	applyErrorTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	noChangeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_noop_total",
+		Help: "Total number of new versions skipped because the dry-run reported no changes",
+	}, []string{"target"})
+
+	applyErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "db_schema_sync_apply_error_total",
 		Help: "Total number of failed schema applies",
-	})
+	}, []string{"target"})
 
 	s3FetchTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "db_schema_sync_s3_fetch_total",
@@ -35,15 +59,35 @@ var (
 		Help: "Total number of S3 fetch errors",
 	})
 
+	s3DownloadSkippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_schema_sync_s3_download_skipped_total",
+		Help: "Total number of schema downloads skipped because the object still had the ETag of the previous download",
+	})
+
 	consecutiveFailures = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "db_schema_sync_consecutive_failures",
 		Help: "Current number of consecutive failures",
 	})
 
-	lastApplyTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+	failureHookThreshold = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_schema_sync_failure_hook_threshold",
+		Help: "Consecutive S3 failures that run on-s3-fetch-error (--max-consecutive-failures; 0 runs it on every failure)",
+	})
+
+	failureExitThreshold = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_schema_sync_failure_exit_threshold",
+		Help: "Consecutive failed syncs after which watch exits (--exit-after-failures; 0 means never)",
+	})
+
+	lastApplyTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "db_schema_sync_last_apply_timestamp_seconds",
 		Help: "Unix timestamp of the last successful schema apply",
-	})
+	}, []string{"target"})
+
+	lastSuccessfulSyncTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_last_successful_sync_timestamp_seconds",
+		Help: "Unix timestamp of the last sync that found the latest schema in S3",
+	}, []string{"target"})
 
 	processStartTime = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "db_schema_sync_process_start_time_seconds",
@@ -53,49 +97,283 @@ var (
 	lastAppliedVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "db_schema_sync_last_applied_version_info",
 		Help: "Information about the last applied schema version",
+	}, []string{"target", "version"})
+
+	lastAppliedVersionMajor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_last_applied_version_major",
+		Help: "Major number of the last applied version, when it is a semantic version",
+	}, []string{"target"})
+
+	lastAppliedVersionMinor = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_last_applied_version_minor",
+		Help: "Minor number of the last applied version, when it is a semantic version",
+	}, []string{"target"})
+
+	lastAppliedVersionPatch = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_last_applied_version_patch",
+		Help: "Patch number of the last applied version, when it is a semantic version",
+	}, []string{"target"})
+
+	lastAppliedVersionTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_last_applied_version_timestamp_seconds",
+		Help: "Unix timestamp of the last applied version, when it is a YYYYMMDDHHMMSS timestamp",
+	}, []string{"target"})
+
+	applyDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_apply_duration_seconds",
+		Help:    "Time spent running psqldef to apply the schema",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+
+	dryRunDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_dry_run_duration_seconds",
+		Help:    "Time spent running psqldef --dry-run",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+
+	s3FetchDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_s3_fetch_duration_seconds",
+		Help:    "Time spent listing and downloading the schema from S3",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+
+	lockWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_lock_wait_seconds",
+		Help:    "Time spent waiting to acquire the advisory lock",
+		Buckets: []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	})
+
+	lockSkippedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_schema_sync_lock_skipped_total",
+		Help: "Total number of syncs skipped because the advisory lock was held by another process",
+	})
+
+	lockAcquireTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_schema_sync_lock_acquire_total",
+		Help: "Total number of attempts to acquire the advisory lock",
+	})
+
+	lockContentionTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_schema_sync_lock_contention_total",
+		Help: "Total number of advisory lock attempts that found the lock held by another process",
+	})
+
+	lockErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "db_schema_sync_lock_errors_total",
+		Help: "Total number of advisory lock attempts that failed with an error, such as a failed database connection",
+	})
+
+	lockHoldDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_lock_hold_duration_seconds",
+		Help:    "Time the advisory lock was held, from acquiring it to releasing it",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+
+	backoffDelaySeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_schema_sync_backoff_delay_seconds",
+		Help: "Extra delay added to the polling interval due to consecutive failures",
+	})
+
+	hookFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_hook_failures_total",
+		Help: "Total number of hook commands that exited non-zero or were killed after --hook-timeout",
+	}, []string{"hook"})
+
+	hookDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_hook_duration_seconds",
+		Help:    "Time spent running each hook command",
+		Buckets: []float64{0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"hook"})
+
+	webhookErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_webhook_error_total",
+		Help: "Total number of webhook deliveries that failed after all retries",
+	}, []string{"event"})
+
+	driftDetected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_drift_detected",
+		Help: "1 if the last drift check found the live schema differs from the last applied version, 0 otherwise",
+	}, []string{"target"})
+
+	driftStatements = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_drift_statements",
+		Help: "Number of DDL statements needed to bring the live schema back to the last applied version",
+	}, []string{"target"})
+
+	downgradeBlockedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_downgrade_blocked_total",
+		Help: "Total number of applies refused because a newer version is already completed",
+	}, []string{"target"})
+
+	versionsHeldBack = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_versions_held_back",
+		Help: "Number of schema versions newer than --max-version that are not applied (0 when nothing is held back)",
+	}, []string{"target"})
+
+	paused = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_paused",
+		Help: "1 while the --pause-file object exists and applies are paused, 0 otherwise",
+	}, []string{"target"})
+
+	approvalPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_approval_pending",
+		Help: "1 while the version to apply waits for approval (--require-approval), 0 otherwise",
+	}, []string{"target"})
+
+	versionsRateLimited = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_versions_rate_limited",
+		Help: "Number of versions waiting for --min-apply-interval to pass since the last apply (0 when none are deferred)",
+	}, []string{"target"})
+
+	ddlStatementsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_ddl_statements_total",
+		Help: "Total number of DDL statements executed by successful applies, by type (create, alter, drop, other)",
+	}, []string{"target", "type"})
+
+	syncInProgressTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_sync_in_progress_total",
+		Help: "Total number of sync requests refused because a sync was already running, by source (http, run)",
+	}, []string{"source"})
+
+	s3FetchRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_s3_fetch_retries_total",
+		Help: "Total number of S3 listings and schema downloads retried within a sync after a transient error, by operation (list, download)",
+	}, []string{"operation"})
+
+	failedVersionSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_failed_version_skipped_total",
+		Help: "Total number of syncs that skipped a version with a failure marker (--skip-failed-versions)",
+	}, []string{"target"})
+
+	syncTimeoutTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_schema_sync_timeout_total",
+		Help: "Total number of syncs canceled after --sync-timeout",
+	}, []string{"target"})
+
+	syncCycleDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "db_schema_sync_cycle_duration_seconds",
+		Help:    "Time spent on one watch cycle syncing every target, including hooks; compare with the polling interval",
+		Buckets: []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+
+	psqldefVersionInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_psqldef_version_info",
+		Help: "Information about the detected psqldef version",
 	}, []string{"version"})
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_build_info",
+		Help: "Always 1; labeled with the db-schema-sync version, the Go version it was built with and the detected sqldef version",
+	}, []string{"version", "go_version", "psqldef_version"})
+
+	// configInfo carries only S3 locations, never credentials or database settings
+	configInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "db_schema_sync_config_info",
+		Help: "Always 1; labeled with the S3 bucket, path prefix and schema file name being synced",
+	}, []string{"bucket", "prefix", "schema_file"})
 )
 
 func init() {
 	prometheus.MustRegister(applyTotal)
 	prometheus.MustRegister(applySuccessTotal)
 	prometheus.MustRegister(applyErrorTotal)
+	prometheus.MustRegister(noChangeTotal)
+	prometheus.MustRegister(applyBlockedTotal)
+	prometheus.MustRegister(checksumErrorTotal)
+	prometheus.MustRegister(contentChangedTotal)
 	prometheus.MustRegister(s3FetchTotal)
 	prometheus.MustRegister(s3FetchErrorTotal)
+	prometheus.MustRegister(s3DownloadSkippedTotal)
+	prometheus.MustRegister(s3FetchRetriesTotal)
 	prometheus.MustRegister(consecutiveFailures)
+	prometheus.MustRegister(failureHookThreshold)
+	prometheus.MustRegister(failureExitThreshold)
 	prometheus.MustRegister(lastApplyTimestamp)
+	prometheus.MustRegister(lastSuccessfulSyncTimestamp)
 	prometheus.MustRegister(processStartTime)
 	prometheus.MustRegister(lastAppliedVersionInfo)
+	prometheus.MustRegister(lastAppliedVersionMajor)
+	prometheus.MustRegister(lastAppliedVersionMinor)
+	prometheus.MustRegister(lastAppliedVersionPatch)
+	prometheus.MustRegister(lastAppliedVersionTimestamp)
+	prometheus.MustRegister(psqldefVersionInfo)
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(configInfo)
+	prometheus.MustRegister(applyDurationSeconds)
+	prometheus.MustRegister(dryRunDurationSeconds)
+	prometheus.MustRegister(s3FetchDurationSeconds)
+	prometheus.MustRegister(lockWaitSeconds)
+	prometheus.MustRegister(lockSkippedTotal)
+	prometheus.MustRegister(lockAcquireTotal)
+	prometheus.MustRegister(lockContentionTotal)
+	prometheus.MustRegister(lockErrorsTotal)
+	prometheus.MustRegister(lockHoldDurationSeconds)
+	prometheus.MustRegister(backoffDelaySeconds)
+	prometheus.MustRegister(hookFailuresTotal)
+	prometheus.MustRegister(hookDurationSeconds)
+	prometheus.MustRegister(webhookErrorTotal)
+	prometheus.MustRegister(driftDetected)
+	prometheus.MustRegister(driftStatements)
+	prometheus.MustRegister(downgradeBlockedTotal)
+	prometheus.MustRegister(versionsHeldBack)
+	prometheus.MustRegister(paused)
+	prometheus.MustRegister(approvalPending)
+	prometheus.MustRegister(versionsRateLimited)
+	prometheus.MustRegister(ddlStatementsTotal)
+	prometheus.MustRegister(syncInProgressTotal)
+	prometheus.MustRegister(syncCycleDurationSeconds)
+	prometheus.MustRegister(syncTimeoutTotal)
+	prometheus.MustRegister(failedVersionSkippedTotal)
+
+	// The sqldef version is filled in once checkSqldef has detected it
+	recordBuildInfo("")
 }
 
-// startMetricsServer starts an HTTP server for Prometheus metrics
-func startMetricsServer(addr string) {
+// startMetricsServer starts an HTTP server for Prometheus metrics, the health endpoints and POST /sync,
+// plus the pprof handlers with enablePprof
+func startMetricsServer(addr string, state *syncState, readiness *atomic.Pointer[readinessConfig], sync http.Handler, enablePprof bool) {
 	if addr == "" {
 		return
 	}
 
 	// Record process start time
-	processStartTime.Set(float64(time.Now().Unix()))
-
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
-	})
+	started := time.Now()
+	processStartTime.Set(float64(started.Unix()))
 
 	server := &http.Server{
 		Addr:              addr,
-		Handler:           mux,
+		Handler:           newMetricsMux(state, readiness, started, sync, enablePprof),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
+	if enablePprof {
+		slog.Warn("pprof endpoints are enabled on the metrics server; do not expose it publicly", "pprof", "http://"+addr+"/debug/pprof/")
+	}
 
-	slog.Info("Starting metrics server", "addr", addr, "metrics", "http://"+addr+"/metrics", "health", "http://"+addr+"/health")
+	slog.Info("Starting metrics server", "addr", addr, "metrics", "http://"+addr+"/metrics", "health", "http://"+addr+"/health", "ready", "http://"+addr+"/ready", "sync", "http://"+addr+"/sync")
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		slog.Error("Metrics server error", "error", err)
 	}
 }
 
+// newMetricsMux routes the metrics server endpoints. The pprof handlers are registered here rather than
+// served from http.DefaultServeMux, so they exist only with enablePprof.
+func newMetricsMux(state *syncState, readiness *atomic.Pointer[readinessConfig], started time.Time, sync http.Handler, enablePprof bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/health", healthHandler(state, readiness, started))
+	mux.Handle("/ready", readyHandler(state, readiness))
+	mux.Handle("/status", statusHandler(state))
+	mux.Handle("/sync", sync)
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
 // recordS3FetchAttempt records an S3 fetch attempt
 func recordS3FetchAttempt() {
 	s3FetchTotal.Inc()
@@ -106,26 +384,263 @@ func recordS3FetchError() {
 	s3FetchErrorTotal.Inc()
 }
 
+// recordS3DownloadSkipped records a conditional schema download answered with 304 Not Modified
+func recordS3DownloadSkipped() {
+	s3DownloadSkippedTotal.Inc()
+}
+
+// initTargetMetrics creates the per-target series so they are exported as 0 before the first apply.
+// target is the --db target name, or empty without --db.
+func initTargetMetrics(target string) {
+	applyTotal.WithLabelValues(target)
+	applySuccessTotal.WithLabelValues(target)
+	applyErrorTotal.WithLabelValues(target)
+	noChangeTotal.WithLabelValues(target)
+	applyBlockedTotal.WithLabelValues(target)
+	checksumErrorTotal.WithLabelValues(target)
+	contentChangedTotal.WithLabelValues(target)
+	lastApplyTimestamp.WithLabelValues(target)
+	paused.WithLabelValues(target)
+	approvalPending.WithLabelValues(target)
+	versionsRateLimited.WithLabelValues(target)
+	syncTimeoutTotal.WithLabelValues(target)
+	failedVersionSkippedTotal.WithLabelValues(target)
+	for _, typ := range []string{ddlCreate, ddlAlter, ddlDrop, ddlOther} {
+		ddlStatementsTotal.WithLabelValues(target, typ)
+	}
+}
+
 // recordApplyAttempt records a schema apply attempt
-func recordApplyAttempt() {
-	applyTotal.Inc()
+func recordApplyAttempt(target string) {
+	applyTotal.WithLabelValues(target).Inc()
 }
 
 // recordApplySuccess records a successful schema apply
-func recordApplySuccess(version string) {
-	applySuccessTotal.Inc()
-	lastApplyTimestamp.Set(float64(time.Now().Unix()))
-	// Reset the previous version labels and set the new one
-	lastAppliedVersionInfo.Reset()
-	lastAppliedVersionInfo.WithLabelValues(version).Set(1)
+func recordApplySuccess(target, version string) {
+	applySuccessTotal.WithLabelValues(target).Inc()
+	lastApplyTimestamp.WithLabelValues(target).Set(float64(time.Now().Unix()))
+	// Reset the target's previous version label and set the new one
+	lastAppliedVersionInfo.DeletePartialMatch(prometheus.Labels{"target": target})
+	lastAppliedVersionInfo.WithLabelValues(target, version).Set(1)
+	recordAppliedVersionNumbers(target, version)
+}
+
+// recordAppliedVersionNumbers exports the applied version as numbers where its name allows, so dashboards can
+// compare environments: a YYYYMMDDHHMMSS timestamp as seconds, otherwise a semantic version as major, minor
+// and patch. The gauges that do not apply to version are removed for the target.
+func recordAppliedVersionNumbers(target, version string) {
+	semver := []*prometheus.GaugeVec{lastAppliedVersionMajor, lastAppliedVersionMinor, lastAppliedVersionPatch}
+	if ts, ok := schemastore.VersionTimestamp(version); ok {
+		lastAppliedVersionTimestamp.WithLabelValues(target).Set(float64(ts.Unix()))
+		for _, g := range semver {
+			g.DeleteLabelValues(target)
+		}
+		return
+	}
+	lastAppliedVersionTimestamp.DeleteLabelValues(target)
+
+	major, minor, patch, ok := schemastore.SemverParts(version)
+	for i, n := range []int64{major, minor, patch} {
+		if ok {
+			semver[i].WithLabelValues(target).Set(float64(n))
+		} else {
+			semver[i].DeleteLabelValues(target)
+		}
+	}
 }
 
 // recordApplyError records a schema apply error
-func recordApplyError() {
-	applyErrorTotal.Inc()
+func recordApplyError(target string) {
+	applyErrorTotal.WithLabelValues(target).Inc()
+}
+
+// recordApplyDuration records how long psqldef took to apply the schema
+func recordApplyDuration(d time.Duration) {
+	applyDurationSeconds.Observe(d.Seconds())
+}
+
+// recordDryRunDuration records how long psqldef --dry-run took
+func recordDryRunDuration(d time.Duration) {
+	dryRunDurationSeconds.Observe(d.Seconds())
+}
+
+// recordS3FetchDuration records how long the S3 list+download took
+func recordS3FetchDuration(d time.Duration) {
+	s3FetchDurationSeconds.Observe(d.Seconds())
+}
+
+// recordNoChange records a new version that needed no DDL
+func recordNoChange(target string) {
+	noChangeTotal.WithLabelValues(target).Inc()
+}
+
+// recordApplyBlocked records an apply refused by the destructive DDL guard
+func recordApplyBlocked(target string) {
+	applyBlockedTotal.WithLabelValues(target).Inc()
+}
+
+// recordChecksumError records an apply refused by the sha256 sidecar check
+func recordChecksumError(target string) {
+	checksumErrorTotal.WithLabelValues(target).Inc()
+}
+
+// recordContentChanged records an applied version whose schema content changed in place
+func recordContentChanged(target string) {
+	contentChangedTotal.WithLabelValues(target).Inc()
 }
 
 // recordConsecutiveFailures updates the consecutive failures gauge
 func recordConsecutiveFailures(count int) {
 	consecutiveFailures.Set(float64(count))
 }
+
+// recordFailureThresholds exposes the --max-consecutive-failures and --exit-after-failures settings
+func recordFailureThresholds(hook, exit int) {
+	failureHookThreshold.Set(float64(hook))
+	failureExitThreshold.Set(float64(exit))
+}
+
+// recordPsqldefVersion records the detected psqldef version
+func recordPsqldefVersion(version string) {
+	psqldefVersionInfo.Reset()
+	psqldefVersionInfo.WithLabelValues(version).Set(1)
+	recordBuildInfo(version)
+}
+
+// recordBuildInfo replaces the build info series with one for psqldefVersion
+func recordBuildInfo(psqldefVersion string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(Version, runtime.Version(), psqldefVersion).Set(1)
+}
+
+// recordConfigInfo adds the config info series of a synced S3 location
+func recordConfigInfo(bucket, prefix, schemaFile string) {
+	configInfo.WithLabelValues(bucket, prefix, schemaFile).Set(1)
+}
+
+// recordLockWait records the time spent acquiring the advisory lock
+func recordLockWait(d time.Duration) {
+	lockWaitSeconds.Observe(d.Seconds())
+}
+
+// recordLockSkipped records a sync skipped due to lock contention
+func recordLockSkipped() {
+	lockSkippedTotal.Inc()
+}
+
+// recordLockAttempt records an attempt to acquire the advisory lock: acquired, held by another process, or failed with err
+func recordLockAttempt(acquired bool, err error) {
+	lockAcquireTotal.Inc()
+	switch {
+	case err != nil:
+		lockErrorsTotal.Inc()
+	case !acquired:
+		lockContentionTotal.Inc()
+	}
+}
+
+// recordLockHold records how long the advisory lock was held
+func recordLockHold(d time.Duration) {
+	lockHoldDurationSeconds.Observe(d.Seconds())
+}
+
+// recordBackoffDelay updates the current backoff delay gauge
+func recordBackoffDelay(d time.Duration) {
+	backoffDelaySeconds.Set(d.Seconds())
+}
+
+// recordDrift updates the drift gauges with the statement count of the last drift check
+func recordDrift(target string, statements int) {
+	if statements > 0 {
+		driftDetected.WithLabelValues(target).Set(1)
+	} else {
+		driftDetected.WithLabelValues(target).Set(0)
+	}
+	driftStatements.WithLabelValues(target).Set(float64(statements))
+}
+
+// recordDowngradeBlocked records an apply refused because a newer version is already completed
+func recordDowngradeBlocked(target string) {
+	downgradeBlockedTotal.WithLabelValues(target).Inc()
+}
+
+// recordVersionsHeldBack updates the number of versions held back by --max-version
+func recordVersionsHeldBack(target string, count int) {
+	versionsHeldBack.WithLabelValues(target).Set(float64(count))
+}
+
+// recordPaused updates the paused gauge
+func recordPaused(target string, isPaused bool) {
+	if isPaused {
+		paused.WithLabelValues(target).Set(1)
+	} else {
+		paused.WithLabelValues(target).Set(0)
+	}
+}
+
+// recordApprovalPending updates the approval pending gauge
+func recordApprovalPending(target string, pending bool) {
+	if pending {
+		approvalPending.WithLabelValues(target).Set(1)
+	} else {
+		approvalPending.WithLabelValues(target).Set(0)
+	}
+}
+
+// recordVersionsRateLimited records the number of versions deferred by --min-apply-interval
+func recordVersionsRateLimited(target string, count int) {
+	versionsRateLimited.WithLabelValues(target).Set(float64(count))
+}
+
+// recordS3FetchRetry counts an S3 listing or download retried within a sync
+func recordS3FetchRetry(operation string) {
+	s3FetchRetriesTotal.WithLabelValues(operation).Inc()
+}
+
+// recordSyncInProgress counts a sync request from source refused because a sync was already running
+func recordSyncInProgress(source string) {
+	syncInProgressTotal.WithLabelValues(source).Inc()
+}
+
+// recordSyncTimeout counts a sync canceled after --sync-timeout
+func recordSyncTimeout(target string) {
+	syncTimeoutTotal.WithLabelValues(target).Inc()
+}
+
+// recordFailedVersionSkipped counts a sync that skipped a version with a failure marker
+func recordFailedVersionSkipped(target string) {
+	failedVersionSkippedTotal.WithLabelValues(target).Inc()
+}
+
+// recordSyncCycleDuration records how long a watch cycle took
+func recordSyncCycleDuration(d time.Duration) {
+	syncCycleDurationSeconds.Observe(d.Seconds())
+}
+
+// recordDDLStatements counts the statements executed by a successful apply
+func recordDDLStatements(target string, summary ddlSummary) {
+	ddlStatementsTotal.WithLabelValues(target, ddlCreate).Add(float64(summary.Create))
+	ddlStatementsTotal.WithLabelValues(target, ddlAlter).Add(float64(summary.Alter))
+	ddlStatementsTotal.WithLabelValues(target, ddlDrop).Add(float64(summary.Drop))
+	ddlStatementsTotal.WithLabelValues(target, ddlOther).Add(float64(summary.Other))
+}
+
+// recordSyncSuccess records the time of a sync that found the latest schema in S3
+func recordSyncSuccess(target string, at time.Time) {
+	lastSuccessfulSyncTimestamp.WithLabelValues(target).Set(float64(at.Unix()))
+}
+
+// recordHookFailure records a hook command that failed or timed out
+func recordHookFailure(hook string) {
+	hookFailuresTotal.WithLabelValues(hook).Inc()
+}
+
+// recordHookDuration records how long a hook command ran
+func recordHookDuration(hook string, d time.Duration) {
+	hookDurationSeconds.WithLabelValues(hook).Observe(d.Seconds())
+}
+
+// recordWebhookError records a failed webhook delivery
+func recordWebhookError(event string) {
+	webhookErrorTotal.WithLabelValues(event).Inc()
+}
@@ -6,13 +6,21 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // getFreePort returns a free port for testing
@@ -72,6 +80,7 @@ func startTestMetricsServer(t *testing.T) (string, func()) {
 func TestMetricsEndpoint(t *testing.T) {
 	baseURL, cleanup := startTestMetricsServer(t)
 	defer cleanup()
+	initTargetMetrics("")
 
 	resp, err := http.Get(baseURL + "/metrics")
 	if err != nil {
@@ -173,12 +182,15 @@ func TestMetricsRecording(t *testing.T) {
 	}
 }
 
-// mockS3Client implements S3Client interface for testing
+// mockS3Client implements schemastore.S3Client interface for testing
 type mockS3ClientForMetrics struct {
-	listObjectsFunc func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
-	getObjectFunc   func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
-	headObjectFunc  func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
-	putObjectFunc   func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	listObjectsFunc   func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	getObjectFunc     func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	headObjectFunc    func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	putObjectFunc     func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	deleteObjectsFunc func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	getTaggingFunc    func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	putTaggingFunc    func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
 }
 
 func (m *mockS3ClientForMetrics) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
@@ -209,6 +221,27 @@ func (m *mockS3ClientForMetrics) PutObject(ctx context.Context, params *s3.PutOb
 	return nil, fmt.Errorf("not implemented")
 }
 
+func (m *mockS3ClientForMetrics) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if m.deleteObjectsFunc != nil {
+		return m.deleteObjectsFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3ClientForMetrics) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if m.getTaggingFunc != nil {
+		return m.getTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3ClientForMetrics) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if m.putTaggingFunc != nil {
+		return m.putTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
 func TestMetricsWithRunSync(t *testing.T) {
 	// Start metrics server
 	baseURL, cleanup := startTestMetricsServer(t)
@@ -221,20 +254,19 @@ func TestMetricsWithRunSync(t *testing.T) {
 		},
 	}
 
-	// Reset global state for test
-	lastAppliedVersion = ""
-	consecutiveFailureCount = 0
-
 	cli := &CLI{
 		S3Bucket:   "test-bucket",
 		PathPrefix: "schemas/",
 		SchemaFile: "schema.sql",
 	}
 
+	syncer := NewSyncer(mockClient, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+
 	// Run sync (should fail due to S3 error)
-	err := runSync(context.Background(), mockClient, cli, "localhost", "5432", "user", "pass", "db", false, true, "", "", "", "")
+	err := syncer.Run(context.Background())
 	if err == nil {
-		t.Error("expected error from runSync, got nil")
+		t.Error("expected error from Run, got nil")
 	}
 
 	// Wait a bit for metrics to be recorded
@@ -265,12 +297,76 @@ func TestMetricsWithRunSync(t *testing.T) {
 	}
 }
 
+func TestDurationMetricsWithRunSync(t *testing.T) {
+	baseURL, cleanup := startTestMetricsServer(t)
+	defer cleanup()
+
+	// Stub psqldef so dry-run and apply succeed without a database
+	psqldefPath := filepath.Join(t.TempDir(), "psqldef")
+	if err := os.WriteFile(psqldefPath, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatalf("failed to write stub psqldef: %v", err)
+	}
+
+	mockClient := &mockS3ClientForMetrics{
+		listObjectsFunc: func(_ context.Context, _ *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}},
+			}, nil
+		},
+		getObjectFunc: func(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if strings.HasSuffix(*params.Key, ".sha256") {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT);"))}, nil
+		},
+	}
+
+	cli := &CLI{
+		S3Bucket:    "test-bucket",
+		PathPrefix:  "schemas/",
+		SchemaFile:  "schema.sql",
+		PsqldefPath: psqldefPath,
+	}
+
+	syncer := NewSyncer(mockClient, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get /metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	bodyStr := string(body)
+	for _, name := range []string{
+		"db_schema_sync_apply_duration_seconds",
+		"db_schema_sync_dry_run_duration_seconds",
+		"db_schema_sync_s3_fetch_duration_seconds",
+	} {
+		if !strings.Contains(bodyStr, name+"_bucket") {
+			t.Errorf("expected %s histogram not found", name)
+		}
+		// Unobserved histograms are exposed too, so make sure the sync recorded a sample
+		if strings.Contains(bodyStr, name+"_count 0\n") {
+			t.Errorf("expected %s to have observations", name)
+		}
+	}
+}
+
 func TestRecordApplySuccess(t *testing.T) {
 	baseURL, cleanup := startTestMetricsServer(t)
 	defer cleanup()
 
 	// Record a successful apply
-	recordApplySuccess("v1.0.0")
+	recordApplySuccess("", "v1.0.0")
 
 	// Wait for metrics to be recorded
 	time.Sleep(50 * time.Millisecond)
@@ -289,8 +385,8 @@ func TestRecordApplySuccess(t *testing.T) {
 
 	bodyStr := string(body)
 
-	// Check that last_applied_version_info has the version label
-	if !strings.Contains(bodyStr, `db_schema_sync_last_applied_version_info{version="v1.0.0"}`) {
+	// Check that last_applied_version_info has the target and version labels
+	if !strings.Contains(bodyStr, `db_schema_sync_last_applied_version_info{target="",version="v1.0.0"}`) {
 		t.Error("expected db_schema_sync_last_applied_version_info with version label not found")
 	}
 
@@ -299,3 +395,224 @@ func TestRecordApplySuccess(t *testing.T) {
 		t.Error("expected db_schema_sync_last_apply_timestamp_seconds metric not found")
 	}
 }
+
+func TestRecordApplySuccessVersionNumbers(t *testing.T) {
+	tests := []struct {
+		version   string
+		semver    []float64
+		timestamp float64
+	}{
+		{version: "v1.2.3", semver: []float64{1, 2, 3}},
+		{version: "2.5", semver: []float64{2, 5, 0}},
+		{version: "20240115120000", timestamp: 1705320000},
+		{version: "3f2a9c1"},
+		{version: "archive"},
+	}
+	gauges := []*prometheus.GaugeVec{lastAppliedVersionMajor, lastAppliedVersionMinor, lastAppliedVersionPatch}
+
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			// Start from a version of the other shape to check that stale gauges are removed
+			recordApplySuccess("numbers", "v9.9.9")
+			recordApplySuccess("numbers", "20000101000000")
+			recordApplySuccess("numbers", tt.version)
+
+			for i, g := range gauges {
+				got, present := targetValue(g, "numbers")
+				if present != (tt.semver != nil) {
+					t.Fatalf("gauge %d present = %v, want %v", i, present, tt.semver != nil)
+				}
+				if present && got != tt.semver[i] {
+					t.Errorf("gauge %d = %v, want %v", i, got, tt.semver[i])
+				}
+			}
+
+			got, present := targetValue(lastAppliedVersionTimestamp, "numbers")
+			if present != (tt.timestamp != 0) {
+				t.Fatalf("timestamp gauge present = %v, want %v", present, tt.timestamp != 0)
+			}
+			if present && got != tt.timestamp {
+				t.Errorf("timestamp gauge = %v, want %v", got, tt.timestamp)
+			}
+		})
+	}
+}
+
+// targetValue returns the value of g for target and whether the series existed before it was read
+func targetValue(g *prometheus.GaugeVec, target string) (float64, bool) {
+	before := testutil.CollectAndCount(g)
+	value := testutil.ToFloat64(g.WithLabelValues(target))
+	existed := testutil.CollectAndCount(g) == before
+	if !existed {
+		g.DeleteLabelValues(target)
+	}
+	return value, existed
+}
+
+func TestRecordPsqldefVersion(t *testing.T) {
+	baseURL, cleanup := startTestMetricsServer(t)
+	defer cleanup()
+
+	recordPsqldefVersion("psqldef v3.9.4")
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get /metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	if !strings.Contains(string(body), `db_schema_sync_psqldef_version_info{version="psqldef v3.9.4"} 1`) {
+		t.Error("expected db_schema_sync_psqldef_version_info with version label not found")
+	}
+}
+
+func TestBuildAndConfigInfo(t *testing.T) {
+	baseURL, cleanup := startTestMetricsServer(t)
+	defer cleanup()
+
+	recordPsqldefVersion("psqldef v3.9.4")
+	cli := &CLI{S3Bucket: "info-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+	newTargetSyncer(&mockS3ClientForMetrics{}, cli, dbTarget{Name: "info", DB: DBConfig{Host: "info-db-host", Port: "5432", User: "app", Password: "info-db-password", Name: "app"}})
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get /metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	for _, series := range []string{
+		fmt.Sprintf(`db_schema_sync_build_info{go_version=%q,psqldef_version="psqldef v3.9.4",version=%q} 1`, runtime.Version(), Version),
+		`db_schema_sync_config_info{bucket="info-bucket",prefix="schemas/",schema_file="schema.sql"} 1`,
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("expected series %s not found in /metrics response", series)
+		}
+	}
+	// A redetected sqldef version replaces the build info series instead of adding one
+	if n := strings.Count(string(body), "db_schema_sync_build_info{"); n != 1 {
+		t.Errorf("found %d db_schema_sync_build_info series, want 1", n)
+	}
+	for _, secret := range []string{"info-db-host", "info-db-password"} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("/metrics exposes %q from the database settings", secret)
+		}
+	}
+}
+
+func TestRecordLockMetrics(t *testing.T) {
+	baseURL, cleanup := startTestMetricsServer(t)
+	defer cleanup()
+
+	recordLockWait(2 * time.Second)
+	recordLockSkipped()
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get /metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	bodyStr := string(body)
+	if !strings.Contains(bodyStr, "db_schema_sync_lock_wait_seconds_bucket") {
+		t.Error("expected db_schema_sync_lock_wait_seconds histogram not found")
+	}
+	if !strings.Contains(bodyStr, "db_schema_sync_lock_skipped_total") {
+		t.Error("expected db_schema_sync_lock_skipped_total metric not found")
+	}
+}
+
+func TestRecordWebhookError(t *testing.T) {
+	baseURL, cleanup := startTestMetricsServer(t)
+	defer cleanup()
+
+	recordWebhookError("apply-failed")
+
+	resp, err := http.Get(baseURL + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get /metrics: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	if !strings.Contains(string(body), `db_schema_sync_webhook_error_total{event="apply-failed"}`) {
+		t.Error("expected db_schema_sync_webhook_error_total metric with event label not found")
+	}
+}
+
+func TestMetricsMuxPprof(t *testing.T) {
+	readiness := &atomic.Pointer[readinessConfig]{}
+	readiness.Store(&readinessConfig{})
+	for _, enabled := range []bool{true, false} {
+		mux := newMetricsMux(&syncState{}, readiness, time.Now(), http.NotFoundHandler(), enabled)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+
+		want := http.StatusNotFound
+		if enabled {
+			want = http.StatusOK
+		}
+		if rec.Code != want {
+			t.Errorf("enablePprof=%v: GET /debug/pprof/ = %d, want %d", enabled, rec.Code, want)
+		}
+	}
+}
+
+func TestRecordLockAttempt(t *testing.T) {
+	acquires := testutil.ToFloat64(lockAcquireTotal)
+	contention := testutil.ToFloat64(lockContentionTotal)
+	errs := testutil.ToFloat64(lockErrorsTotal)
+	holds := lockHoldCount(t)
+
+	recordLockAttempt(true, nil)
+	recordLockAttempt(false, nil)
+	recordLockAttempt(false, nil)
+	recordLockAttempt(false, fmt.Errorf("connection refused"))
+	recordLockHold(3 * time.Second)
+
+	if got := testutil.ToFloat64(lockAcquireTotal) - acquires; got != 4 {
+		t.Errorf("db_schema_sync_lock_acquire_total increased by %v, want 4", got)
+	}
+	if got := testutil.ToFloat64(lockContentionTotal) - contention; got != 2 {
+		t.Errorf("db_schema_sync_lock_contention_total increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(lockErrorsTotal) - errs; got != 1 {
+		t.Errorf("db_schema_sync_lock_errors_total increased by %v, want 1", got)
+	}
+	if got := lockHoldCount(t) - holds; got != 1 {
+		t.Errorf("db_schema_sync_lock_hold_duration_seconds observed %d holds, want 1", got)
+	}
+}
+
+// lockHoldCount returns the number of observations in db_schema_sync_lock_hold_duration_seconds
+func lockHoldCount(t *testing.T) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "db_schema_sync_lock_hold_duration_seconds" {
+			return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	t.Fatalf("db_schema_sync_lock_hold_duration_seconds is not registered")
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// SecretsManagerClient defines the interface for the Secrets Manager call used by --db-password-secret-arn
+type SecretsManagerClient interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// passwordSource is where the database password comes from. At most one of Password, File and SecretARN is set.
+type passwordSource struct {
+	Password string
+	// File is read and trimmed of surrounding whitespace, e.g. a mounted Kubernetes secret
+	File string
+	// SecretARN is a Secrets Manager secret holding the password, or a JSON object holding it under SecretKey
+	SecretARN string
+	SecretKey string
+}
+
+func (o *DBOptions) passwordSource() passwordSource {
+	return passwordSource{Password: o.DBPassword, File: o.DBPasswordFile, SecretARN: o.DBPasswordSecretARN, SecretKey: o.DBPasswordSecretKey}
+}
+
+// check rejects more than one password source, and --db-password-secret-key without a secret
+func (p passwordSource) check() error {
+	var set []string
+	for _, f := range []struct{ flag, value string }{
+		{"--db-password", p.Password},
+		{"--db-password-file", p.File},
+		{"--db-password-secret-arn", p.SecretARN},
+	} {
+		if f.value != "" {
+			set = append(set, f.flag)
+		}
+	}
+	if len(set) > 1 {
+		return fmt.Errorf("%s cannot be combined; set only one password source", strings.Join(set, " and "))
+	}
+	if p.SecretKey != "" && p.SecretARN == "" {
+		return fmt.Errorf("--db-password-secret-key requires --db-password-secret-arn")
+	}
+	return nil
+}
+
+// resolve returns the password, reading the file or fetching the secret again on every call.
+// It is empty when no source is set. Errors never include the password.
+func (p passwordSource) resolve(ctx context.Context, cli *CLI) (string, error) {
+	if err := p.check(); err != nil {
+		return "", err
+	}
+	switch {
+	case p.File != "":
+		return readPasswordFile(p.File)
+	case p.SecretARN != "":
+		client, err := createSecretsManagerClient(ctx, cli)
+		if err != nil {
+			return "", err
+		}
+		return p.fetchSecret(ctx, client)
+	default:
+		return p.Password, nil
+	}
+}
+
+// readPasswordFile returns the contents of path without surrounding whitespace such as a trailing newline
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read --db-password-file: %w", err)
+	}
+	password := strings.TrimSpace(string(data))
+	if password == "" {
+		return "", fmt.Errorf("--db-password-file %s is empty", path)
+	}
+	return password, nil
+}
+
+// fetchSecret returns the string value of the secret, or its SecretKey field when SecretKey is set
+func (p passwordSource) fetchSecret(ctx context.Context, client SecretsManagerClient) (string, error) {
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(p.SecretARN)})
+	if err != nil {
+		return "", fmt.Errorf("failed to get secret %s: %w", p.SecretARN, err)
+	}
+	if out.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", p.SecretARN)
+	}
+	if p.SecretKey == "" {
+		return *out.SecretString, nil
+	}
+
+	// json.Unmarshal errors can quote the input, so they are not wrapped
+	var fields map[string]any
+	if json.Unmarshal([]byte(*out.SecretString), &fields) != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so it has no key %q", p.SecretARN, p.SecretKey)
+	}
+	password, ok := fields[p.SecretKey].(string)
+	if !ok || password == "" {
+		return "", fmt.Errorf("secret %s has no string key %q", p.SecretARN, p.SecretKey)
+	}
+	return password, nil
+}
+
+func createSecretsManagerClient(ctx context.Context, cli *CLI) (*secretsmanager.Client, error) {
+	cfg, err := loadAWSConfig(ctx, cli.awsOptions())
+	if err != nil {
+		return nil, err
+	}
+	return secretsmanager.NewFromConfig(cfg), nil
+}
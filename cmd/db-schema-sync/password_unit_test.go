@@ -0,0 +1,154 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// mockSecretsManagerClient returns a fixed secret value or error
+type mockSecretsManagerClient struct {
+	value *string
+	err   error
+	ids   []string
+}
+
+func (m *mockSecretsManagerClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	m.ids = append(m.ids, aws.ToString(params.SecretId))
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: m.value}, nil
+}
+
+// Ensure mockSecretsManagerClient implements SecretsManagerClient interface
+var _ SecretsManagerClient = (*mockSecretsManagerClient)(nil)
+
+func TestPasswordSourceCheck(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:db-AbCdEf"
+
+	tests := []struct {
+		name    string
+		source  passwordSource
+		wantErr string
+	}{
+		{"none", passwordSource{}, ""},
+		{"password", passwordSource{Password: "secret"}, ""},
+		{"file", passwordSource{File: "/run/secrets/db"}, ""},
+		{"secret", passwordSource{SecretARN: arn}, ""},
+		{"secret with key", passwordSource{SecretARN: arn, SecretKey: "password"}, ""},
+		{"password and file", passwordSource{Password: "secret", File: "/run/secrets/db"}, "--db-password and --db-password-file cannot be combined"},
+		{"password and secret", passwordSource{Password: "secret", SecretARN: arn}, "--db-password and --db-password-secret-arn cannot be combined"},
+		{"file and secret", passwordSource{File: "/run/secrets/db", SecretARN: arn}, "--db-password-file and --db-password-secret-arn cannot be combined"},
+		{"all three", passwordSource{Password: "secret", File: "/run/secrets/db", SecretARN: arn}, "--db-password and --db-password-file and --db-password-secret-arn cannot be combined"},
+		{"key without secret", passwordSource{Password: "secret", SecretKey: "password"}, "--db-password-secret-key requires --db-password-secret-arn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.source.check()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPasswordSourceResolve(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		source  passwordSource
+		want    string
+		wantErr string
+	}{
+		{"none", passwordSource{}, "", ""},
+		{"password", passwordSource{Password: " kept as is "}, " kept as is ", ""},
+		{"file is trimmed", passwordSource{File: write("password", "  s3cr3t with space\n\n")}, "s3cr3t with space", ""},
+		{"empty file", passwordSource{File: write("empty", "\n")}, "", "is empty"},
+		{"missing file", passwordSource{File: filepath.Join(dir, "missing")}, "", "failed to read --db-password-file"},
+		{"two sources", passwordSource{Password: "secret", File: write("other", "x")}, "", "cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.source.resolve(context.Background(), &CLI{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchSecret(t *testing.T) {
+	const arn = "arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:db-AbCdEf"
+	const password = `p@ss"w0rd`
+
+	tests := []struct {
+		name    string
+		key     string
+		client  *mockSecretsManagerClient
+		want    string
+		wantErr string
+	}{
+		{"plain secret", "", &mockSecretsManagerClient{value: aws.String(password)}, password, ""},
+		{"json key", "password", &mockSecretsManagerClient{value: aws.String(`{"username":"app","password":"p@ss\"w0rd","port":5432}`)}, password, ""},
+		{"missing key", "pass", &mockSecretsManagerClient{value: aws.String(`{"password":"p@ss\"w0rd"}`)}, "", `has no string key "pass"`},
+		{"non-string key", "port", &mockSecretsManagerClient{value: aws.String(`{"password":"p@ss\"w0rd","port":5432}`)}, "", `has no string key "port"`},
+		{"not json", "password", &mockSecretsManagerClient{value: aws.String(password)}, "", "is not a JSON object"},
+		{"binary secret", "", &mockSecretsManagerClient{}, "", "has no string value"},
+		{"api error", "", &mockSecretsManagerClient{err: errors.New("AccessDeniedException")}, "", "failed to get secret " + arn + ": AccessDeniedException"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := passwordSource{SecretARN: arn, SecretKey: tt.key}.fetchSecret(context.Background(), tt.client)
+			if len(tt.client.ids) != 1 || tt.client.ids[0] != arn {
+				t.Errorf("GetSecretValue ids = %q, want %q", tt.client.ids, arn)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fetchSecret() error = %v, want containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "w0rd") {
+					t.Errorf("fetchSecret() error = %q, want it not to contain the password", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchSecret() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("fetchSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// failurePostApplyCheck is the DB_SCHEMA_SYNC_FAILURE_REASON of a sync whose --post-apply-check-sql failed
+const failurePostApplyCheck = "post-apply-check"
+
+// loadPostApplyChecks returns the --post-apply-check-sql queries followed by the statements of
+// --post-apply-check-file, which ends each statement with a semicolon at the end of a line
+func loadPostApplyChecks(queries []string, file string) ([]string, error) {
+	var checks []string
+	for _, query := range queries {
+		if query != "" {
+			checks = append(checks, query)
+		}
+	}
+	if file == "" {
+		return checks, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --post-apply-check-file: %w", err)
+	}
+	statements := splitDDLStatements(string(data))
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("--post-apply-check-file %s has no statements", file)
+	}
+	return append(checks, statements...), nil
+}
+
+// runPostApplyChecks runs each check in order and returns the first failure.
+// A query returning columns must return at least one row; any other statement only has to succeed.
+func runPostApplyChecks(ctx context.Context, db sqlQuerier, checks []string) error {
+	for _, query := range checks {
+		if err := runPostApplyCheck(ctx, db, query); err != nil {
+			return fmt.Errorf("%q: %w", query, err)
+		}
+	}
+	return nil
+}
+
+func runPostApplyCheck(ctx context.Context, db sqlQuerier, query string) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(columns) > 0 && !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return errors.New("returned no rows")
+	}
+	return rows.Err()
+}
+
+// checkPostApply runs PostApplyChecks on the advisory lock connection, or on a new connection with --skip-lock,
+// after the schema was applied and before the version is recorded as applied. A failure is reported like a failed
+// apply: on-apply-failed runs with DB_SCHEMA_SYNC_FAILURE_REASON=post-apply-check and no completion marker is written.
+func (s *Syncer) checkPostApply(ctx context.Context, locker Locker, version string, hookEnv HookEnv, dryRunOutput, applyOutput string, applyDuration time.Duration) error {
+	if len(s.PostApplyChecks) == 0 {
+		return nil
+	}
+	start := time.Now()
+	db, closeDB, err := dbQuerier(ctx, locker, s.DB)
+	if err == nil {
+		err = runPostApplyChecks(ctx, db, s.PostApplyChecks)
+		closeDB()
+	}
+	if err == nil {
+		s.logger().Info("Post-apply checks passed", "version", version, "checks", len(s.PostApplyChecks), "duration", time.Since(start))
+		return nil
+	}
+	s.reportingApply(ctx)
+	recordApplyError(s.Target)
+	s.logger().Error("Post-apply check failed; not marking the version completed", "version", version, "error", err)
+	hookEnv.Version = version
+	hookEnv.Error = err.Error()
+	hookEnv.DryRun = dryRunOutput
+	hookEnv.Stdout = applyOutput
+	hookEnv.FailureReason = failurePostApplyCheck
+	hookEnv.finish(applyDuration)
+	s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	return fmt.Errorf("post-apply check failed for version %s: %w", version, err)
+}
@@ -0,0 +1,131 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// sqlApplier plans a schema file as its own content and applies it by running it as SQL, standing in for psqldef
+type sqlApplier struct {
+	SchemaApplier
+	db DBConfig
+}
+
+func (a sqlApplier) DryRun(ctx context.Context, schemaFile string) (string, error) {
+	ddl, err := os.ReadFile(schemaFile)
+	return string(ddl), err
+}
+
+func (a sqlApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	ddl, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDB(ctx, a.db)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, string(ddl)); err != nil {
+		return nil, err
+	}
+	return &ApplyResult{Stdout: string(ddl)}, nil
+}
+
+// markerRecorder records the keys of uploaded objects; applySchema only uploads the completion marker here
+type markerRecorder struct {
+	schemastore.S3Client
+	mu   sync.Mutex
+	keys []string
+}
+
+func (m *markerRecorder) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = append(m.keys, *params.Key)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestPostApplyCheck(t *testing.T) {
+	host, port, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	dbConfig := testDBConfig(host, port)
+	db, err := openDB(ctx, dbConfig)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `CREATE TABLE users (id integer, active boolean);
+INSERT INTO users VALUES (1, true);
+CREATE VIEW active_users AS SELECT id FROM users WHERE active;`); err != nil {
+		t.Fatalf("failed to create the view: %v", err)
+	}
+
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hook.log")
+	apply := func(t *testing.T, version, ddl string) (*markerRecorder, error) {
+		t.Helper()
+		schemaFile := filepath.Join(dir, version+".sql")
+		if err := os.WriteFile(schemaFile, []byte(ddl), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		client := &markerRecorder{}
+		syncer := NewSyncer(client, &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}, dbConfig)
+		syncer.Applier = sqlApplier{db: dbConfig}
+		syncer.LockID = AdvisoryLockID
+		syncer.PostApplyChecks = []string{"SELECT 1 FROM active_users LIMIT 1", "SELECT id FROM users WHERE id = 1"}
+		syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_FAILURE_REASON $DB_SCHEMA_SYNC_ERROR" >> ` + hookLog
+		err := syncer.applySchema(ctx, "schemas/"+version+"/schema.sql", version, "", schemaFile, &HookEnv{})
+		return client, err
+	}
+
+	t.Run("checks pass", func(t *testing.T) {
+		client, err := apply(t, "v1", "ALTER TABLE users ADD COLUMN name text;")
+		if err != nil {
+			t.Fatalf("applySchema() error = %v", err)
+		}
+		if len(client.keys) != 1 || client.keys[0] != "schemas/v1/completed" {
+			t.Errorf("uploaded %q, want the completion marker", client.keys)
+		}
+	})
+
+	t.Run("view broken", func(t *testing.T) {
+		client, err := apply(t, "v2", "DROP VIEW active_users; CREATE VIEW active_users AS SELECT id FROM users WHERE NOT active;")
+		if err == nil || !strings.Contains(err.Error(), "post-apply check failed for version v2") || !strings.Contains(err.Error(), "returned no rows") {
+			t.Fatalf("applySchema() error = %v, want the empty view to fail the check", err)
+		}
+		if len(client.keys) != 0 {
+			t.Errorf("uploaded %q, want the completion marker withheld", client.keys)
+		}
+	})
+
+	t.Run("view dropped", func(t *testing.T) {
+		client, err := apply(t, "v3", "DROP VIEW active_users;")
+		if err == nil || !strings.Contains(err.Error(), `relation "active_users" does not exist`) {
+			t.Fatalf("applySchema() error = %v, want the missing view to fail the check", err)
+		}
+		if len(client.keys) != 0 {
+			t.Errorf("uploaded %q, want the completion marker withheld", client.keys)
+		}
+	})
+
+	content, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatalf("failed to read hook log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "post-apply-check ") || !strings.HasPrefix(lines[1], "post-apply-check ") {
+		t.Errorf("on-apply-failed ran with %q, want two post-apply-check failures", lines)
+	}
+}
@@ -0,0 +1,90 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadPostApplyChecks(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "checks.sql")
+	content := `-- critical views
+SELECT 1 FROM active_users LIMIT 1;
+SELECT count(*)
+  FROM orders;
+`
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.sql")
+	if err := os.WriteFile(empty, []byte("-- nothing yet\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadPostApplyChecks([]string{"SELECT 1", ""}, file)
+	if err != nil {
+		t.Fatalf("loadPostApplyChecks() error = %v", err)
+	}
+	want := []string{"SELECT 1", "SELECT 1 FROM active_users LIMIT 1;", "SELECT count(*) FROM orders;"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadPostApplyChecks() = %q, want %q", got, want)
+	}
+
+	if got, err := loadPostApplyChecks(nil, ""); err != nil || len(got) != 0 {
+		t.Errorf("loadPostApplyChecks() = %q, %v, want no checks", got, err)
+	}
+	if _, err := loadPostApplyChecks(nil, empty); err == nil || !strings.Contains(err.Error(), "has no statements") {
+		t.Errorf("loadPostApplyChecks() error = %v, want no statements", err)
+	}
+	if _, err := loadPostApplyChecks(nil, filepath.Join(dir, "missing.sql")); err == nil || !strings.Contains(err.Error(), "failed to read --post-apply-check-file") {
+		t.Errorf("loadPostApplyChecks() error = %v, want a read error", err)
+	}
+}
+
+func TestSyncerPostApplyCheckFailed(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun string
+	}{
+		{"after apply", `echo 'CREATE TABLE users (id integer);'`},
+		// A version whose checks failed is not marked completed, so the next sync finds nothing to apply
+		{"no change", `echo '-- Nothing is modified --'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: writeStubPsqldef(t, tt.dryRun)}
+			// Nothing listens on the database port, so the checks cannot connect
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "127.0.0.1", Port: closedPort(t), User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			syncer.SkipLock = true
+			syncer.PostApplyChecks = []string{"SELECT 1 FROM active_users LIMIT 1"}
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+			err := syncer.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "post-apply check failed for version v1") {
+				t.Fatalf("Run() error = %v, want a post-apply check failure", err)
+			}
+			if bucket.has("schemas/v1/completed") {
+				t.Error("completion marker was created after the post-apply check failed")
+			}
+			if syncer.LastAppliedVersion() != "" {
+				t.Errorf("LastAppliedVersion() = %q, want none so the next sync checks again", syncer.LastAppliedVersion())
+			}
+			content, err := os.ReadFile(hookLog)
+			if err != nil {
+				t.Fatalf("failed to read hook log: %v", err)
+			}
+			if strings.TrimSpace(string(content)) != failurePostApplyCheck {
+				t.Errorf("DB_SCHEMA_SYNC_FAILURE_REASON = %q, want %s", content, failurePostApplyCheck)
+			}
+		})
+	}
+}
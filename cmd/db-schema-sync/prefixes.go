@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// prefixFile is the --prefix-file format: the path prefixes watched by one daemon and the database of each
+type prefixFile struct {
+	Prefixes []prefixEntry `yaml:"prefixes"`
+}
+
+// prefixEntry pairs a path prefix with its database. Unset database fields fall back to the --db-* flags.
+type prefixEntry struct {
+	PathPrefix string `yaml:"path_prefix"`
+	// Name labels the entry in metrics and hooks; defaults to the path prefix without its trailing slash
+	Name       string `yaml:"name"`
+	DBHost     string `yaml:"db_host"`
+	DBPort     string `yaml:"db_port"`
+	DBUser     string `yaml:"db_user"`
+	DBPassword string `yaml:"db_password"`
+	DBName     string `yaml:"db_name"`
+	DBFile     string `yaml:"db_file"`
+}
+
+// loadPrefixFile reads --prefix-file and returns one target per entry.
+// Unknown keys are rejected so a typo does not silently fall back to the --db-* flags.
+func loadPrefixFile(path, engine string, db DBConfig) ([]dbTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prefix file: %w", err)
+	}
+
+	var file prefixFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid prefix file %s: %w", path, err)
+	}
+	if len(file.Prefixes) == 0 {
+		return nil, fmt.Errorf("prefix file %s lists no prefixes", path)
+	}
+
+	seenPrefixes := make(map[string]bool)
+	seenNames := make(map[string]bool)
+	targets := make([]dbTarget, 0, len(file.Prefixes))
+	for i, entry := range file.Prefixes {
+		if entry.PathPrefix == "" {
+			return nil, fmt.Errorf("prefix file %s: entry %d has no path_prefix", path, i+1)
+		}
+		prefix := entry.PathPrefix
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		name := entry.Name
+		if name == "" {
+			name = strings.TrimSuffix(prefix, "/")
+		}
+		if seenPrefixes[prefix] {
+			return nil, fmt.Errorf("prefix file %s: duplicate path_prefix %q", path, prefix)
+		}
+		if seenNames[name] {
+			return nil, fmt.Errorf("prefix file %s: duplicate name %q", path, name)
+		}
+		seenPrefixes[prefix] = true
+		seenNames[name] = true
+
+		entryDB := DBConfig{
+			Host:     cmp.Or(entry.DBHost, db.Host),
+			Port:     cmp.Or(entry.DBPort, db.Port),
+			User:     cmp.Or(entry.DBUser, db.User),
+			Password: cmp.Or(entry.DBPassword, db.Password),
+			Name:     cmp.Or(entry.DBName, db.Name),
+			File:     cmp.Or(entry.DBFile, db.File),
+
+			SSLMode:        db.SSLMode,
+			SSLRootCert:    db.SSLRootCert,
+			ConnectTimeout: db.ConnectTimeout,
+			IAMAuthToken:   db.IAMAuthToken,
+		}
+		if err := entryDB.validate(engine); err != nil {
+			return nil, fmt.Errorf("prefix file %s: %s: %w", path, prefix, err)
+		}
+		targets = append(targets, dbTarget{Name: name, PathPrefix: prefix, DB: entryDB})
+	}
+	return targets, nil
+}
@@ -0,0 +1,142 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writePrefixFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prefixes.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrefixFile(t *testing.T) {
+	base := DBConfig{Host: "localhost", Port: "5432", User: "app", Password: "secret"}
+
+	tests := []struct {
+		name    string
+		content string
+		want    []dbTarget
+		wantErr string
+	}{
+		{
+			"entries inherit unset database flags",
+			`prefixes:
+  - path_prefix: service-a
+    db_name: service_a
+  - path_prefix: team/service-b/
+    name: b
+    db_host: db-b.internal
+    db_name: service_b
+`,
+			[]dbTarget{
+				{Name: "service-a", PathPrefix: "service-a/", DB: DBConfig{Host: "localhost", Port: "5432", User: "app", Password: "secret", Name: "service_a"}},
+				{Name: "b", PathPrefix: "team/service-b/", DB: DBConfig{Host: "db-b.internal", Port: "5432", User: "app", Password: "secret", Name: "service_b"}},
+			},
+			"",
+		},
+		{"unknown key", "prefixes:\n  - path_prefix: a/\n    db_nmae: a\n", nil, "field db_nmae not found"},
+		{"empty", "", nil, "lists no prefixes"},
+		{"missing path_prefix", "prefixes:\n  - db_name: a\n", nil, "entry 1 has no path_prefix"},
+		{"duplicate prefix", "prefixes:\n  - path_prefix: a\n    db_name: a\n  - path_prefix: a/\n    db_name: b\n", nil, `duplicate path_prefix "a/"`},
+		{"missing database name", "prefixes:\n  - path_prefix: a/\n", nil, "a/: missing flags required with --engine postgres: --db-name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadPrefixFile(writePrefixFile(t, tt.content), EnginePostgres, base)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadPrefixFile() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadPrefixFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadPrefixFile() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixesAreIsolated(t *testing.T) {
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id int);' ;;
+*) echo applied ;;
+esac`)
+
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			switch *params.Prefix {
+			case "service-a/":
+				return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("service-a/v3/schema.sql")}}}, nil
+			case "service-b/":
+				return nil, errors.New("access denied")
+			default:
+				return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("service-c/v1/schema.sql")}}}, nil
+			}
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if strings.HasSuffix(*params.Key, ".sha256") {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id int);"))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", SchemaFile: "schema.sql", PsqldefPath: stub}
+
+	targets, err := loadPrefixFile(writePrefixFile(t, `prefixes:
+  - path_prefix: service-a/
+  - path_prefix: service-b/
+  - path_prefix: service-c/
+`), EnginePostgres, DBConfig{Host: "localhost", Port: "5432", User: "app", Password: "secret", Name: "app"})
+	if err != nil {
+		t.Fatalf("loadPrefixFile() error = %v", err)
+	}
+	var syncers []*Syncer
+	for _, target := range targets {
+		syncer := newTargetSyncer(client, cli, target)
+		syncer.SkipLock = true
+		syncer.Hooks.OnApplySucceeded = `echo "$DB_SCHEMA_SYNC_TARGET $DB_SCHEMA_SYNC_PATH_PREFIX $DB_SCHEMA_SYNC_VERSION" >> ` + hookLog
+		syncers = append(syncers, syncer)
+	}
+
+	err = forEachTarget(syncers, func(s *Syncer) error { return s.Run(context.Background()) })
+	if err == nil || !strings.Contains(err.Error(), "target service-b: failed to find latest schema") {
+		t.Fatalf("forEachTarget() error = %v, want service-b failure", err)
+	}
+	if hook, _ := os.ReadFile(hookLog); string(hook) != "service-a service-a/ v3\nservice-c service-c/ v1\n" {
+		t.Errorf("on-apply-succeeded output = %q", hook)
+	}
+	if syncers[0].LastAppliedVersion() != "v3" || syncers[2].LastAppliedVersion() != "v1" {
+		t.Errorf("last applied versions = %q, %q", syncers[0].LastAppliedVersion(), syncers[2].LastAppliedVersion())
+	}
+	if got := testutil.ToFloat64(lastAppliedVersionInfo.WithLabelValues("service-c", "v1")); got != 1 {
+		t.Errorf("last_applied_version_info{target=service-c} = %v, want 1", got)
+	}
+	// The healthy prefixes keep the normal polling interval
+	if got := backoffFailures(syncers); got != 0 {
+		t.Errorf("backoffFailures() = %d, want 0", got)
+	}
+}
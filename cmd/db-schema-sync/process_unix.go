@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+)
+
+// defaultHookShell runs hook commands when --hook-shell is not set
+const defaultHookShell = "sh -c"
+
+// processGroupCommand runs name in its own process group and kills the whole group when ctx is done,
+// so a sqldef wrapper script cannot leave the real tool running (and holding DB locks) after a timeout
+func processGroupCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
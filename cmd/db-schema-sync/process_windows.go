@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+)
+
+// defaultHookShell runs hook commands when --hook-shell is not set
+const defaultHookShell = "cmd /C"
+
+// processGroupCommand runs name and kills it with every process it started when ctx is done,
+// so a sqldef wrapper script cannot leave the real tool running (and holding DB locks) after a timeout.
+// Windows has no process groups to signal, so the process tree is killed with taskkill.
+func processGroupCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// PruneCmd deletes old version directories from S3
+type PruneCmd struct {
+	Keep      int    `help:"Number of newest completed versions to keep (the applied version is always kept)" default:"0"`
+	OlderThan string `name:"older-than" help:"Only delete versions last modified longer ago than this, e.g. 90d or 720h"`
+	Yes       bool   `help:"Delete the versions; without it they are only listed"`
+}
+
+// Run executes the prune command
+func (cmd *PruneCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	if cmd.Keep < 0 {
+		return fmt.Errorf("--keep must not be negative, got %d", cmd.Keep)
+	}
+	if cmd.Keep == 0 && cmd.OlderThan == "" {
+		return fmt.Errorf("prune requires --keep or --older-than")
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+	return cmd.prune(ctx, client, cli, time.Now(), os.Stdout)
+}
+
+// prune lists the versions to delete and, with --yes, deletes every object in their directories
+func (cmd *PruneCmd) prune(ctx context.Context, client schemastore.S3Client, cli *CLI, now time.Time, w io.Writer) error {
+	opts := schemastore.PruneOptions{Keep: cmd.Keep, AnyName: cli.VersionOrder == versionOrderLastModified, Versioning: cli.versioning}
+	if cmd.OlderThan != "" {
+		age, err := parseAge(cmd.OlderThan)
+		if err != nil {
+			return fmt.Errorf("invalid --older-than %q: %w", cmd.OlderThan, err)
+		}
+		opts.Before = now.Add(-age)
+	}
+
+	objects, err := schemastore.ListAllObjects(ctx, client, cli.S3Bucket, cli.PathPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	versions := orderVersions(schemastore.CollectVersions(objects, cli.PathPrefix, cli.SchemaFile, cli.CompletedFile, cli.versioning), cli.VersionOrder)
+	kept, pruned := schemastore.PlanPrune(versions, opts)
+
+	keys := versionObjectKeys(objects, cli.PathPrefix)
+	var deleteKeys []string
+	for _, v := range pruned {
+		deleteKeys = append(deleteKeys, keys[v.Version]...)
+	}
+	if err := writePrunePlan(w, pruned, keys); err != nil {
+		return err
+	}
+
+	if len(pruned) == 0 {
+		_, err := fmt.Fprintf(w, "Nothing to prune, keeping %d versions\n", len(kept))
+		return err
+	}
+	if !cmd.Yes {
+		_, err := fmt.Fprintf(w, "Would delete %d versions (%d objects), keeping %d. Run again with --yes to delete them.\n", len(pruned), len(deleteKeys), len(kept))
+		return err
+	}
+
+	if err := schemastore.DeleteObjects(ctx, client, cli.S3Bucket, deleteKeys); err != nil {
+		return err
+	}
+	slog.Info("Pruned schema versions", "versions", len(pruned), "objects", len(deleteKeys), "kept", len(kept))
+	_, err = fmt.Fprintf(w, "Deleted %d versions (%d objects), keeping %d\n", len(pruned), len(deleteKeys), len(kept))
+	return err
+}
+
+// versionObjectKeys groups the keys of objects by version directory, including files the tool does not know about
+func versionObjectKeys(objects []types.Object, prefix string) map[string][]string {
+	keys := make(map[string][]string)
+	for _, obj := range objects {
+		key := aws.ToString(obj.Key)
+		ver, fileName, ok := strings.Cut(strings.TrimPrefix(key, prefix), "/")
+		if !ok || ver == "" || fileName == "" {
+			continue
+		}
+		keys[ver] = append(keys[ver], key)
+	}
+	return keys
+}
+
+// writePrunePlan lists the versions to delete, oldest first
+func writePrunePlan(w io.Writer, pruned []schemastore.VersionInfo, keys map[string][]string) error {
+	if len(pruned) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "VERSION\tCOMPLETED\tOBJECTS\tLAST MODIFIED")
+	for _, v := range pruned {
+		lastModified := "-"
+		if !v.LastModified.IsZero() {
+			lastModified = v.LastModified.UTC().Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", v.Version, yesNo(v.Completed), len(keys[v.Version]), lastModified)
+	}
+	return tw.Flush()
+}
+
+// parseAge parses a Go duration, or a whole number of days such as 90d
+func parseAge(s string) (time.Duration, error) {
+	var age time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("want a number of days such as 90d")
+		}
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if age, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if age <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return age, nil
+}
@@ -0,0 +1,99 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	cli := &CLI{S3Bucket: "bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+	keys := []string{
+		"schemas/v1/schema.sql",
+		"schemas/v1/completed",
+		"schemas/v1/exported.sql",
+		"schemas/v1/notes.txt",
+		"schemas/v2/schema.sql",
+		"schemas/v3/schema.sql",
+		"schemas/v3/completed",
+		"schemas/v10/schema.sql",
+		"schemas/v10/completed",
+		"schemas/v11/schema.sql",
+		"schemas/archive/schema.sql",
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		bucket := newMemoryBucket(keys...)
+		var buf bytes.Buffer
+		cmd := &PruneCmd{Keep: 2}
+		if err := cmd.prune(context.Background(), bucket.client(), cli, time.Now(), &buf); err != nil {
+			t.Fatalf("prune() error = %v", err)
+		}
+		for _, key := range keys {
+			if !bucket.has(key) {
+				t.Errorf("dry run deleted %s", key)
+			}
+		}
+		out := buf.String()
+		if !strings.Contains(out, "Would delete 2 versions (5 objects), keeping 4") {
+			t.Errorf("unexpected summary:\n%s", out)
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if strings.Join(strings.Fields(lines[1]), " ") != "v1 yes 4 -" || strings.Join(strings.Fields(lines[2]), " ") != "v2 no 1 -" {
+			t.Errorf("unexpected listing:\n%s", out)
+		}
+	})
+
+	t.Run("yes", func(t *testing.T) {
+		bucket := newMemoryBucket(keys...)
+		var buf bytes.Buffer
+		cmd := &PruneCmd{Keep: 2, Yes: true}
+		if err := cmd.prune(context.Background(), bucket.client(), cli, time.Now(), &buf); err != nil {
+			t.Fatalf("prune() error = %v", err)
+		}
+		for _, key := range keys {
+			deleted := strings.HasPrefix(key, "schemas/v1/") || strings.HasPrefix(key, "schemas/v2/")
+			if bucket.has(key) == deleted {
+				t.Errorf("%s: present = %v, want deleted = %v", key, bucket.has(key), deleted)
+			}
+		}
+		if !strings.Contains(buf.String(), "Deleted 2 versions (5 objects), keeping 4") {
+			t.Errorf("unexpected summary:\n%s", buf.String())
+		}
+	})
+
+	t.Run("invalid older-than", func(t *testing.T) {
+		cmd := &PruneCmd{OlderThan: "ninety days"}
+		if err := cmd.prune(context.Background(), newMemoryBucket(keys...).client(), cli, time.Now(), &bytes.Buffer{}); err == nil {
+			t.Error("prune() with an invalid --older-than should fail")
+		}
+	})
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "90d", want: 90 * 24 * time.Hour},
+		{in: "36h", want: 36 * time.Hour},
+		{in: "1.5d", wantErr: true},
+		{in: "0d", wantErr: true},
+		{in: "-1h", wantErr: true},
+		{in: "d", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAge(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseAge(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// isLocalConfigPath reports whether a --psqldef-config value names a local file rather than an S3 object.
+// Only absolute paths and paths starting with ./ or ../ are local; a bare name such as "config.yaml" is a key
+// relative to the version directory.
+func isLocalConfigPath(config string) bool {
+	return filepath.IsAbs(config) || strings.HasPrefix(config, "./") || strings.HasPrefix(config, "../")
+}
+
+// parseS3URL splits s3://bucket/key into its bucket and key
+func parseS3URL(url string) (bucket, key string, err error) {
+	rest, ok := strings.CutPrefix(url, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// URL", url)
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("%q must be of the form s3://bucket/key", url)
+	}
+	return bucket, key, nil
+}
+
+// loadPsqldefConfig resolves --psqldef-config for version and hands the config to the applier.
+// A key relative to the version directory falls back to the same key under the path prefix, then to no config.
+func (s *Syncer) loadPsqldefConfig(ctx context.Context, version string) error {
+	config, err := s.resolvePsqldefConfig(ctx, version)
+	if err != nil {
+		return fmt.Errorf("failed to load psqldef config: %w", err)
+	}
+	s.Applier.SetConfig(config)
+	return nil
+}
+
+// resolvePsqldefConfig returns the contents of the sqldef config to use for version, or nil for none
+func (s *Syncer) resolvePsqldefConfig(ctx context.Context, version string) ([]byte, error) {
+	switch {
+	case s.PsqldefConfig == "":
+		return nil, nil
+	case isLocalConfigPath(s.PsqldefConfig):
+		config, err := os.ReadFile(s.PsqldefConfig)
+		if err != nil {
+			return nil, err
+		}
+		s.logger().Info("Using local psqldef config", "path", s.PsqldefConfig)
+		return config, nil
+	case strings.HasPrefix(s.PsqldefConfig, "s3://"):
+		bucket, key, err := parseS3URL(s.PsqldefConfig)
+		if err != nil {
+			return nil, err
+		}
+		config, err := schemastore.DownloadSchema(ctx, s.Client, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", s.PsqldefConfig, err)
+		}
+		s.logger().Info("Using psqldef config from S3", "url", s.PsqldefConfig)
+		return config, nil
+	}
+
+	for _, key := range []string{
+		schemastore.SchemaKey(s.PathPrefix, version, s.PsqldefConfig),
+		path.Join(s.PathPrefix, s.PsqldefConfig),
+	} {
+		config, err := schemastore.DownloadSchema(ctx, s.Client, s.S3Bucket, key)
+		if err == nil {
+			s.logger().Info("Using psqldef config from S3", "key", key)
+			return config, nil
+		}
+		if !schemastore.IsNotFoundError(err) {
+			return nil, fmt.Errorf("failed to download s3://%s/%s: %w", s.S3Bucket, key, err)
+		}
+		s.logger().Info("psqldef config not found", "key", key)
+	}
+	s.logger().Info("No psqldef config found, running sqldef without --config", "version", version)
+	return nil, nil
+}
@@ -0,0 +1,128 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestResolvePsqldefConfig(t *testing.T) {
+	localConfig := filepath.Join(t.TempDir(), "sqldef.yml")
+	if err := os.WriteFile(localConfig, []byte("skip_tables: local"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		objects map[string]string
+		want    string
+		wantErr string
+	}{
+		{"not set", "", nil, "", ""},
+		{
+			"version directory",
+			"config.yaml",
+			map[string]string{"schemas/v2/config.yaml": "skip_tables: v2", "schemas/config.yaml": "skip_tables: default"},
+			"skip_tables: v2",
+			"",
+		},
+		{"prefix-level default", "config.yaml", map[string]string{"schemas/config.yaml": "skip_tables: default"}, "skip_tables: default", ""},
+		{"none", "config.yaml", nil, "", ""},
+		{"s3 url", "s3://config-bucket/sqldef/config.yaml", map[string]string{"config-bucket/sqldef/config.yaml": "skip_tables: url"}, "skip_tables: url", ""},
+		{"missing s3 url", "s3://config-bucket/sqldef/config.yaml", nil, "", "failed to download s3://config-bucket/sqldef/config.yaml"},
+		{"invalid s3 url", "s3://config-bucket", nil, "", "must be of the form s3://bucket/key"},
+		{"local path", localConfig, nil, "skip_tables: local", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockS3Client{
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					key := *params.Key
+					if *params.Bucket != "test-bucket" {
+						key = *params.Bucket + "/" + key
+					}
+					body, ok := tt.objects[key]
+					if !ok {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+				},
+			}
+			syncer := &Syncer{Client: client, S3Bucket: "test-bucket", PathPrefix: "schemas/", PsqldefConfig: tt.config}
+
+			got, err := syncer.resolvePsqldefConfig(context.Background(), "v2")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolvePsqldefConfig() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePsqldefConfig() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("resolvePsqldefConfig() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePsqldefConfigS3Error(t *testing.T) {
+	client := &mockS3Client{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return nil, errors.New("access denied")
+		},
+	}
+	syncer := &Syncer{Client: client, S3Bucket: "test-bucket", PathPrefix: "schemas/", PsqldefConfig: "config.yaml"}
+
+	// Only a missing object falls back; other errors must not silently drop skip_tables
+	_, err := syncer.resolvePsqldefConfig(context.Background(), "v2")
+	if err == nil || !strings.Contains(err.Error(), "s3://test-bucket/schemas/v2/config.yaml") {
+		t.Errorf("resolvePsqldefConfig() error = %v, want download failure", err)
+	}
+}
+
+func TestSqldefConfigPassedToDryRunAndApply(t *testing.T) {
+	stub := writeStubPsqldef(t, `while [ $# -gt 0 ]; do
+  if [ "$1" = "--config" ]; then cat "$2"; echo; fi
+  shift
+done`)
+	applier, _ := newEngine(EnginePostgres, stub, nil, nil, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	applier.SetConfig([]byte("skip_tables: audit_log"))
+
+	dryRun, err := applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if dryRun != "skip_tables: audit_log\n" {
+		t.Errorf("DryRun() config = %q", dryRun)
+	}
+
+	result, err := applier.Apply(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if result.Stdout != "skip_tables: audit_log\n" {
+		t.Errorf("Apply() config = %q", result.Stdout)
+	}
+
+	applier.SetConfig(nil)
+	dryRun, err = applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if dryRun != "" {
+		t.Errorf("DryRun() config = %q, want no --config", dryRun)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// runSuccess is pushed by apply with --pushgateway-url. It is not registered for /metrics,
+// where watch would always report it as 0.
+var runSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "db_schema_sync_last_run_success",
+	Help: "Whether the last apply run succeeded (1) or failed (0)",
+})
+
+// pushgatewayConfig is where apply pushes its metrics when the run ends
+type pushgatewayConfig struct {
+	URL      string
+	Job      string
+	Instance string
+	Timeout  time.Duration
+}
+
+// pushedCollectors are the metrics an apply run records, pushed instead of the whole default registry
+// so that the Pushgateway does not keep go_* and process_* series of a process that has exited
+func pushedCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		runSuccess,
+		applyTotal,
+		applySuccessTotal,
+		applyErrorTotal,
+		noChangeTotal,
+		applyBlockedTotal,
+		checksumErrorTotal,
+		contentChangedTotal,
+		s3FetchTotal,
+		s3FetchErrorTotal,
+		lastApplyTimestamp,
+		lastAppliedVersionInfo,
+		lastAppliedVersionMajor,
+		lastAppliedVersionMinor,
+		lastAppliedVersionPatch,
+		lastAppliedVersionTimestamp,
+		psqldefVersionInfo,
+		buildInfo,
+		configInfo,
+		applyDurationSeconds,
+		dryRunDurationSeconds,
+		s3FetchDurationSeconds,
+		lockWaitSeconds,
+		lockSkippedTotal,
+		lockAcquireTotal,
+		lockContentionTotal,
+		lockErrorsTotal,
+		lockHoldDurationSeconds,
+		hookFailuresTotal,
+		hookDurationSeconds,
+		webhookErrorTotal,
+		downgradeBlockedTotal,
+		versionsHeldBack,
+	}
+}
+
+// pushMetrics records the outcome of the run and pushes the apply metrics, replacing the ones
+// previously pushed for the same job and instance. A failed push is only logged: the apply is done.
+func pushMetrics(ctx context.Context, cfg pushgatewayConfig, succeeded bool) {
+	if succeeded {
+		runSuccess.Set(1)
+	} else {
+		runSuccess.Set(0)
+	}
+
+	pusher := push.New(cfg.URL, cfg.Job).Client(&http.Client{Timeout: cfg.Timeout})
+	if cfg.Instance != "" {
+		pusher = pusher.Grouping("instance", cfg.Instance)
+	}
+	for _, c := range pushedCollectors() {
+		pusher = pusher.Collector(c)
+	}
+
+	if err := pusher.PushContext(ctx); err != nil {
+		slog.Warn("Could not push metrics to the Pushgateway", "url", cfg.URL, "job", cfg.Job, "error", err)
+		return
+	}
+	slog.Info("Pushed metrics to the Pushgateway", "url", cfg.URL, "job", cfg.Job, "instance", cfg.Instance)
+}
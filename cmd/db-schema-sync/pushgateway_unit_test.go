@@ -0,0 +1,62 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.Path, string(raw)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	recordApplySuccess("pushed", "v1.4.0")
+	recordApplyDuration(2 * time.Second)
+	cfg := pushgatewayConfig{URL: server.URL, Job: "db-schema-sync", Instance: "staging", Timeout: 5 * time.Second}
+	pushMetrics(context.Background(), cfg, true)
+
+	if method != http.MethodPut || path != "/metrics/job/db-schema-sync/instance/staging" {
+		t.Errorf("pushed with %s %s, want PUT to the job and instance grouping", method, path)
+	}
+	for _, want := range []string{
+		"db_schema_sync_last_run_success",
+		"db_schema_sync_apply_success_total",
+		"db_schema_sync_apply_duration_seconds",
+		"db_schema_sync_last_applied_version_info",
+		"v1.4.0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("pushed body does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "go_goroutines") || strings.Contains(body, "process_start_time_seconds") {
+		t.Error("pushed body contains runtime metrics")
+	}
+	if got := testutil.ToFloat64(runSuccess); got != 1 {
+		t.Errorf("last run success = %v, want 1", got)
+	}
+
+	// A failed run is pushed as 0, and a failing Pushgateway is only logged
+	status = http.StatusInternalServerError
+	pushMetrics(context.Background(), pushgatewayConfig{URL: server.URL, Job: "db-schema-sync", Timeout: 5 * time.Second}, false)
+	if path != "/metrics/job/db-schema-sync" {
+		t.Errorf("pushed to %s, want the job grouping only", path)
+	}
+	if got := testutil.ToFloat64(runSuccess); got != 0 {
+		t.Errorf("last run success = %v, want 0", got)
+	}
+}
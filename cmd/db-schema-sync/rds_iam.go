@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+)
+
+// authTokenFunc generates the password for user on endpoint (host:port)
+type authTokenFunc func(ctx context.Context, endpoint, user string) (string, error)
+
+// withIAMAuth makes db authenticate with RDS IAM auth tokens signed with the AWS credentials and region
+// of the S3 client instead of --db-password
+func withIAMAuth(ctx context.Context, cli *CLI, db DBConfig) (DBConfig, error) {
+	if cli.Engine != EnginePostgres {
+		return DBConfig{}, fmt.Errorf("--db-iam-auth is only supported with --engine %s", EnginePostgres)
+	}
+	if db.Password != "" {
+		return DBConfig{}, fmt.Errorf("--db-iam-auth cannot be combined with --db-password, --db-password-file, --db-password-secret-arn or a password in --db-url")
+	}
+	cfg, err := loadAWSConfig(ctx, cli.awsOptions())
+	if err != nil {
+		return DBConfig{}, err
+	}
+	if cfg.Region == "" {
+		return DBConfig{}, fmt.Errorf("--db-iam-auth requires an AWS region (--aws-region or AWS_REGION)")
+	}
+	db.IAMAuthToken = newRDSAuthToken(cfg.Credentials, cfg.Region)
+	slog.Info("Using RDS IAM authentication", "region", cfg.Region)
+	return db, nil
+}
+
+// newRDSAuthToken returns an authTokenFunc building tokens with rds/auth.BuildAuthToken.
+// Signing is local, so a token is cheap to regenerate.
+func newRDSAuthToken(creds aws.CredentialsProvider, region string) authTokenFunc {
+	return func(ctx context.Context, endpoint, user string) (string, error) {
+		return auth.BuildAuthToken(ctx, endpoint, region, user, creds)
+	}
+}
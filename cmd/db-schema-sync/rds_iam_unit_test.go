@@ -0,0 +1,115 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+)
+
+func TestRDSAuthToken(t *testing.T) {
+	creds := credentials.NewStaticCredentialsProvider("AKIDEXAMPLE", "secret", "")
+	token, err := newRDSAuthToken(creds, "ap-northeast-1")(context.Background(), "db.abc.ap-northeast-1.rds.amazonaws.com:5432", "app")
+	if err != nil {
+		t.Fatalf("token error = %v", err)
+	}
+
+	endpoint, rawQuery, ok := strings.Cut(token, "?")
+	if !ok || endpoint != "db.abc.ap-northeast-1.rds.amazonaws.com:5432" {
+		t.Fatalf("token = %q, want host:port?query without a scheme", token)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatalf("token query: %v", err)
+	}
+	for key, want := range map[string]string{
+		"Action":          "connect",
+		"DBUser":          "app",
+		"X-Amz-Algorithm": "AWS4-HMAC-SHA256",
+		"X-Amz-Expires":   "900",
+	} {
+		if got := query.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := query.Get("X-Amz-Credential"); !strings.HasPrefix(got, "AKIDEXAMPLE/") || !strings.HasSuffix(got, "/ap-northeast-1/rds-db/aws4_request") {
+		t.Errorf("X-Amz-Credential = %q", got)
+	}
+	if query.Get("X-Amz-Signature") == "" {
+		t.Error("token is not signed")
+	}
+}
+
+func TestRDSAuthTokenCredentialsError(t *testing.T) {
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{}, fmt.Errorf("no credentials")
+	})
+	if _, err := newRDSAuthToken(creds, "us-east-1")(context.Background(), "db:5432", "app"); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("token error = %v, want the credentials error", err)
+	}
+}
+
+func TestDBConfigValidateIAMAuth(t *testing.T) {
+	token := func(context.Context, string, string) (string, error) { return "token", nil }
+	iam := DBConfig{Host: "db", Port: "5432", User: "app", Name: "appdb", SSLMode: "require", IAMAuthToken: token}
+
+	if err := iam.validate(EnginePostgres); err != nil {
+		t.Errorf("validate() error = %v, want no password to be required", err)
+	}
+	for name, tt := range map[string]struct {
+		db      func(DBConfig) DBConfig
+		wantErr string
+	}{
+		"sslmode disable": {func(c DBConfig) DBConfig { c.SSLMode = "disable"; return c }, "requires --db-sslmode require"},
+		"no sslmode":      {func(c DBConfig) DBConfig { c.SSLMode = ""; return c }, "requires --db-sslmode require"},
+		"password":        {func(c DBConfig) DBConfig { c.Password = "secret"; return c }, "cannot be combined with a database password"},
+		"missing user":    {func(c DBConfig) DBConfig { c.User = ""; return c }, "missing flags required with --engine postgres: --db-user"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := tt.db(iam).validate(EnginePostgres)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIAMAuthPsqldef(t *testing.T) {
+	var calls []string
+	db := DBConfig{Host: "db.internal", Port: "5432", User: "app", Name: "appdb", SSLMode: "verify-full",
+		IAMAuthToken: func(_ context.Context, endpoint, user string) (string, error) {
+			calls = append(calls, endpoint+" "+user)
+			return fmt.Sprintf("token-%d", len(calls)), nil
+		},
+	}
+
+	// Every run gets a new token in PGPASSWORD and no --password argument
+	stub := writeStubPsqldef(t, `echo "$PGPASSWORD $*"`)
+	applier, _ := newEngine(EnginePostgres, stub, nil, nil, db)
+	schemaFile := writeSchemaFile(t, "CREATE TABLE t (id int);")
+	for i := 1; i <= 2; i++ {
+		out, err := applier.DryRun(context.Background(), schemaFile)
+		if err != nil {
+			t.Fatalf("DryRun() error = %v", err)
+		}
+		want := fmt.Sprintf("token-%d -U app -h db.internal -p 5432 appdb --dry-run", i)
+		if !strings.HasPrefix(out, want) {
+			t.Errorf("run %d: psqldef got %q, want prefix %q", i, out, want)
+		}
+	}
+	if len(calls) != 2 || calls[0] != "db.internal:5432 app" {
+		t.Errorf("token requests = %q", calls)
+	}
+
+	db.IAMAuthToken = func(context.Context, string, string) (string, error) { return "", fmt.Errorf("no credentials") }
+	applier, _ = newEngine(EnginePostgres, stub, nil, nil, db)
+	if _, err := applier.DryRun(context.Background(), schemaFile); err == nil || !strings.Contains(err.Error(), "failed to generate RDS IAM auth token: no credentials") {
+		t.Errorf("DryRun() error = %v, want the token error", err)
+	}
+}
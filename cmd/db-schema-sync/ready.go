@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessConfig controls when /ready reports the daemon as ready and when /health reports it as degraded
+type readinessConfig struct {
+	// RequireApply requires the database to be confirmed at the latest version, not just a successful S3 listing
+	RequireApply bool
+	// MaxFailures is the number of consecutive failures tolerated before becoming unready
+	MaxFailures int
+	// MaxStaleness is how old the last successful sync may be (0 disables the check)
+	MaxStaleness time.Duration
+	// MaxSyncStaleness is how old the last successful sync may be before /health fails (0 disables the check)
+	MaxSyncStaleness time.Duration
+}
+
+// readyResponse is the JSON body returned by /ready
+type readyResponse struct {
+	Ready               bool    `json:"ready"`
+	Reason              string  `json:"reason,omitempty"`
+	LastAppliedVersion  string  `json:"lastAppliedVersion"`
+	LastSyncTime        *string `json:"lastSyncTime"`
+	ConsecutiveFailures int     `json:"consecutiveFailures"`
+}
+
+// checkReadiness returns an empty reason when ready, or why the daemon is not ready
+func checkReadiness(s syncStateSnapshot, cfg readinessConfig, now time.Time) string {
+	switch {
+	case s.LastSyncTime.IsZero():
+		return "no successful sync yet"
+	case cfg.RequireApply && s.LastAppliedVersion == "":
+		return "no schema applied yet"
+	case s.ConsecutiveFailures > cfg.MaxFailures:
+		return fmt.Sprintf("%d consecutive failures", s.ConsecutiveFailures)
+	case cfg.MaxStaleness > 0 && now.Sub(s.LastSyncTime) > cfg.MaxStaleness:
+		return fmt.Sprintf("last successful sync was %s ago", now.Sub(s.LastSyncTime).Truncate(time.Second))
+	}
+	return ""
+}
+
+// readyHandler serves /ready: 200 when the daemon is syncing successfully, 503 otherwise.
+// cfg is read on every request so watch can replace it on SIGHUP.
+func readyHandler(state *syncState, cfg *atomic.Pointer[readinessConfig]) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		snapshot := state.get()
+		reason := checkReadiness(snapshot, *cfg.Load(), time.Now())
+
+		resp := readyResponse{
+			Ready:               reason == "",
+			Reason:              reason,
+			LastAppliedVersion:  snapshot.LastAppliedVersion,
+			LastSyncTime:        formatOptionalTime(snapshot.LastSyncTime),
+			ConsecutiveFailures: snapshot.ConsecutiveFailures,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if reason != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// healthResponse is the JSON body returned by /health when the daemon is degraded
+type healthResponse struct {
+	Status      string  `json:"status"`
+	Reason      string  `json:"reason"`
+	LastSuccess *string `json:"lastSuccess"`
+}
+
+// syncIsStale reports whether no sync has succeeded for longer than cfg.MaxSyncStaleness.
+// Before the first successful sync the time is measured from started.
+func syncIsStale(s syncStateSnapshot, cfg readinessConfig, started, now time.Time) bool {
+	if cfg.MaxSyncStaleness <= 0 {
+		return false
+	}
+	last := s.LastSyncTime
+	if last.IsZero() {
+		last = started
+	}
+	return now.Sub(last) > cfg.MaxSyncStaleness
+}
+
+// healthHandler serves /health: 200 while the process is running, or 503 once the last successful sync
+// is older than --max-sync-staleness, so a liveness probe restarts a daemon that is alive but stuck
+func healthHandler(state *syncState, cfg *atomic.Pointer[readinessConfig], started time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		snapshot := state.get()
+		if !syncIsStale(snapshot, *cfg.Load(), started, time.Now()) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("OK"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(healthResponse{
+			Status:      "degraded",
+			Reason:      "stale",
+			LastSuccess: formatOptionalTime(snapshot.LastSyncTime),
+		})
+	}
+}
@@ -0,0 +1,189 @@
+//go:build !integration
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckReadiness(t *testing.T) {
+	now := time.Date(2026, 1, 20, 15, 30, 0, 0, time.UTC)
+	defaultCfg := readinessConfig{MaxFailures: 3}
+
+	tests := []struct {
+		name      string
+		state     syncStateSnapshot
+		cfg       readinessConfig
+		wantReady bool
+	}{
+		{
+			name:      "not ready before first sync",
+			state:     syncStateSnapshot{},
+			cfg:       defaultCfg,
+			wantReady: false,
+		},
+		{
+			name:      "ready after first successful listing",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Minute)},
+			cfg:       defaultCfg,
+			wantReady: true,
+		},
+		{
+			name:      "requires apply but nothing applied",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Minute)},
+			cfg:       readinessConfig{RequireApply: true, MaxFailures: 3},
+			wantReady: false,
+		},
+		{
+			name:      "requires apply and version applied",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Minute), LastAppliedVersion: "v2"},
+			cfg:       readinessConfig{RequireApply: true, MaxFailures: 3},
+			wantReady: true,
+		},
+		{
+			name:      "failures at threshold",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Minute), ConsecutiveFailures: 3},
+			cfg:       defaultCfg,
+			wantReady: true,
+		},
+		{
+			name:      "failures above threshold",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Minute), ConsecutiveFailures: 4},
+			cfg:       defaultCfg,
+			wantReady: false,
+		},
+		{
+			name:      "stale sync",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Hour)},
+			cfg:       readinessConfig{MaxFailures: 3, MaxStaleness: 10 * time.Minute},
+			wantReady: false,
+		},
+		{
+			name:      "staleness check disabled",
+			state:     syncStateSnapshot{LastSyncTime: now.Add(-time.Hour)},
+			cfg:       defaultCfg,
+			wantReady: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := checkReadiness(tt.state, tt.cfg, now)
+			if (reason == "") != tt.wantReady {
+				t.Errorf("checkReadiness() = %q, want ready=%v", reason, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	state := &syncState{}
+	var cfg atomic.Pointer[readinessConfig]
+	cfg.Store(&readinessConfig{MaxFailures: 3})
+	handler := readyHandler(state, &cfg)
+
+	get := func() (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid JSON body: %v", err)
+		}
+		return rec.Code, body
+	}
+
+	code, body := get()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before first sync, got %d", code)
+	}
+	if body["lastSyncTime"] != nil {
+		t.Errorf("expected null lastSyncTime, got %v", body["lastSyncTime"])
+	}
+
+	state.fetchSucceeded(time.Now())
+	state.applied("v2", time.Now())
+	code, body = get()
+	if code != http.StatusOK {
+		t.Errorf("expected 200 after successful sync, got %d", code)
+	}
+	if body["lastAppliedVersion"] != "v2" {
+		t.Errorf("expected lastAppliedVersion v2, got %v", body["lastAppliedVersion"])
+	}
+	if body["lastSyncTime"] == nil {
+		t.Error("expected lastSyncTime to be set")
+	}
+
+	state.fetchFailed(4)
+	code, body = get()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after repeated failures, got %d", code)
+	}
+	if body["consecutiveFailures"] != float64(4) {
+		t.Errorf("expected consecutiveFailures 4, got %v", body["consecutiveFailures"])
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	state := &syncState{}
+	var cfg atomic.Pointer[readinessConfig]
+	cfg.Store(&readinessConfig{MaxFailures: 3, MaxSyncStaleness: time.Hour})
+	started := time.Now()
+	handler := healthHandler(state, &cfg, started)
+
+	get := func() (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if rec.Code == http.StatusOK {
+			if rec.Body.String() != "OK" {
+				t.Errorf("healthy body = %q, want OK", rec.Body.String())
+			}
+			return rec.Code, nil
+		}
+		var body map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("invalid JSON body: %v", err)
+		}
+		return rec.Code, body
+	}
+
+	// Shortly after start there has been no sync yet, but nothing is stale either
+	if code, _ := get(); code != http.StatusOK {
+		t.Errorf("expected 200 after start, got %d", code)
+	}
+
+	state.update(func(st *syncStateSnapshot) { st.LastSyncTime = time.Now().Add(-30 * time.Minute) })
+	if code, _ := get(); code != http.StatusOK {
+		t.Errorf("expected 200 with a recent sync, got %d", code)
+	}
+
+	lastSuccess := time.Date(2026, 1, 20, 15, 30, 45, 0, time.UTC)
+	state.update(func(st *syncStateSnapshot) { st.LastSyncTime = lastSuccess })
+	code, body := get()
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 with a stale sync, got %d", code)
+	}
+	if body["status"] != "degraded" || body["reason"] != "stale" || body["lastSuccess"] != "2026-01-20T15:30:45Z" {
+		t.Errorf("unexpected body: %v", body)
+	}
+
+	// The check can be switched off by a reload
+	cfg.Store(&readinessConfig{MaxFailures: 3})
+	if code, _ := get(); code != http.StatusOK {
+		t.Errorf("expected 200 with the check disabled, got %d", code)
+	}
+
+	// Without any successful sync, staleness is measured from the start
+	never := healthHandler(&syncState{}, &cfg, started.Add(-2*time.Hour))
+	cfg.Store(&readinessConfig{MaxFailures: 3, MaxSyncStaleness: time.Hour})
+	rec := httptest.NewRecorder()
+	never(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"lastSuccess":null`) {
+		t.Errorf("never synced: got %d %s, want 503 with a null lastSuccess", rec.Code, rec.Body.String())
+	}
+}
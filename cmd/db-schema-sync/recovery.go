@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+// recoveryTracker tracks consecutive sync failures in watch mode so that
+// the on-recovered hook can fire when a sync succeeds again.
+type recoveryTracker struct {
+	failures     int
+	firstFailure time.Time
+}
+
+// observe records the outcome of a sync attempt made at now.
+// It returns recovered=true when err is nil and one or more failures preceded it,
+// together with the number of those failures and how long the outage lasted.
+func (r *recoveryTracker) observe(err error, now time.Time) (recovered bool, failures int, outage time.Duration) {
+	if err != nil {
+		if r.failures == 0 {
+			r.firstFailure = now
+		}
+		r.failures++
+		return false, r.failures, 0
+	}
+
+	if r.failures == 0 {
+		return false, 0, 0
+	}
+	failures, outage = r.failures, now.Sub(r.firstFailure)
+	r.failures = 0
+	r.firstFailure = time.Time{}
+	return true, failures, outage
+}
@@ -0,0 +1,88 @@
+//go:build !integration
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecoveryTracker(t *testing.T) {
+	start := time.Date(2026, 1, 20, 15, 0, 0, 0, time.UTC)
+	errSync := errors.New("sync failed")
+
+	type step struct {
+		err          error
+		at           time.Duration
+		recovered    bool
+		wantFailures int
+		wantOutage   time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first success after startup does not recover",
+			steps: []step{
+				{err: nil, at: 0},
+				{err: nil, at: time.Minute},
+			},
+		},
+		{
+			name: "success after single failure recovers",
+			steps: []step{
+				{err: errSync, at: 0, wantFailures: 1},
+				{err: nil, at: time.Minute, recovered: true, wantFailures: 1, wantOutage: time.Minute},
+			},
+		},
+		{
+			name: "outage measured from first failure",
+			steps: []step{
+				{err: nil, at: 0},
+				{err: errSync, at: time.Minute, wantFailures: 1},
+				{err: errSync, at: 3 * time.Minute, wantFailures: 2},
+				{err: errSync, at: 7 * time.Minute, wantFailures: 3},
+				{err: nil, at: 15 * time.Minute, recovered: true, wantFailures: 3, wantOutage: 14 * time.Minute},
+			},
+		},
+		{
+			name: "recovery fires only once",
+			steps: []step{
+				{err: errSync, at: 0, wantFailures: 1},
+				{err: nil, at: time.Minute, recovered: true, wantFailures: 1, wantOutage: time.Minute},
+				{err: nil, at: 2 * time.Minute},
+			},
+		},
+		{
+			name: "second outage is tracked independently",
+			steps: []step{
+				{err: errSync, at: 0, wantFailures: 1},
+				{err: nil, at: time.Minute, recovered: true, wantFailures: 1, wantOutage: time.Minute},
+				{err: errSync, at: 10 * time.Minute, wantFailures: 1},
+				{err: errSync, at: 11 * time.Minute, wantFailures: 2},
+				{err: nil, at: 12 * time.Minute, recovered: true, wantFailures: 2, wantOutage: 2 * time.Minute},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tracker recoveryTracker
+			for i, s := range tt.steps {
+				recovered, failures, outage := tracker.observe(s.err, start.Add(s.at))
+				if recovered != s.recovered {
+					t.Errorf("step %d: recovered = %v, want %v", i, recovered, s.recovered)
+				}
+				if failures != s.wantFailures {
+					t.Errorf("step %d: failures = %d, want %d", i, failures, s.wantFailures)
+				}
+				if outage != s.wantOutage {
+					t.Errorf("step %d: outage = %v, want %v", i, outage, s.wantOutage)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// RollbackCmd re-applies the previous completed version and marks the newest one as rolled back
+type RollbackCmd struct {
+	// Database settings (host/port/user/password/name for postgres and mysql, file for sqlite3)
+	DBHost           string        `help:"Database host" env:"DB_HOST"`
+	DBPort           string        `help:"Database port" env:"DB_PORT"`
+	DBUser           string        `help:"Database user" env:"DB_USER"`
+	DBPassword       string        `help:"Database password" env:"DB_PASSWORD"`
+	DBName           string        `help:"Database name" env:"DB_NAME"`
+	DBFile           string        `name:"db-file" help:"SQLite database file (--engine sqlite3)" env:"DB_FILE"`
+	DBSSLMode        string        `name:"db-sslmode" help:"SSL mode for PostgreSQL connections (the advisory lock, --history-table and psqldef); unset, psqldef keeps an inherited PGSSLMODE and the lock connection uses disable" env:"DB_SSLMODE" enum:",disable,require,verify-ca,verify-full" default:""`
+	DBSSLRootCert    string        `name:"db-sslrootcert" placeholder:"FILE" help:"CA certificate file trusted for PostgreSQL connections with --db-sslmode verify-ca or verify-full" env:"DB_SSLROOTCERT"`
+	DBConnectTimeout time.Duration `name:"db-connect-timeout" help:"Timeout for establishing PostgreSQL connections, rounded up to whole seconds (0 waits indefinitely)" env:"DB_CONNECT_TIMEOUT" default:"0s"`
+
+	Yes bool `short:"y" help:"Apply without asking for confirmation (required when stdin is not a terminal)"`
+
+	// Lock settings
+	SkipLock bool          `help:"Skip advisory lock (not recommended for production)" env:"SKIP_LOCK"`
+	LockID   int64         `name:"lock-id" help:"Advisory lock ID (default: 0x4442534348454D41)" env:"LOCK_ID"`
+	LockKey  string        `name:"lock-key" help:"String hashed (FNV-1a 64-bit) into the advisory lock ID; mutually exclusive with --lock-id" env:"LOCK_KEY"`
+	LockWait time.Duration `name:"lock-wait" help:"How long to wait for the advisory lock when another process holds it (0 skips immediately)" env:"LOCK_WAIT" default:"0s"`
+
+	// Timeout settings
+	DryRunTimeout time.Duration `name:"dry-run-timeout" help:"Kill sqldef --dry-run and --export after this long (0 disables)" env:"DRY_RUN_TIMEOUT" default:"10m"`
+	ApplyTimeout  time.Duration `name:"apply-timeout" help:"Kill the sqldef apply after this long and fail the sync (0 disables)" env:"APPLY_TIMEOUT" default:"10m"`
+
+	// Lifecycle hooks
+	OnBeforeApply    string        `help:"Command to run before schema application starts" env:"ON_BEFORE_APPLY"`
+	OnApplyFailed    string        `help:"Command to run when schema application fails" env:"ON_APPLY_FAILED"`
+	OnApplySucceeded string        `help:"Command to run after schema is successfully applied" env:"ON_APPLY_SUCCEEDED"`
+	HookTimeout      time.Duration `name:"hook-timeout" help:"Kill a hook command and the processes it started after this long (0 disables)" env:"HOOK_TIMEOUT" default:"60s"`
+	HookEnvMaxBytes  int           `name:"hook-env-max-bytes" help:"Truncate DDL and output in hook environment variables to this many bytes (0 means no limit); stdin gets them in full as JSON" env:"HOOK_ENV_MAX_BYTES" default:"32768"`
+	HookShell        string        `name:"hook-shell" help:"Shell that runs hook commands, given the command as its last argument (default sh -c, or cmd /C on Windows); none runs them directly, split into arguments with shell quoting and without variable expansion" env:"HOOK_SHELL"`
+}
+
+// Run executes the rollback command
+func (cmd *RollbackCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	toolName, toolPath := cli.sqldefTool()
+	if _, err := checkSqldef(ctx, toolName, toolPath); err != nil {
+		return err
+	}
+	if err := cli.parseSqldefArgs(); err != nil {
+		return err
+	}
+	db := DBConfig{Host: cmd.DBHost, Port: cmd.DBPort, User: cmd.DBUser, Password: cmd.DBPassword, Name: cmd.DBName, File: cmd.DBFile, SSLMode: cmd.DBSSLMode, SSLRootCert: cmd.DBSSLRootCert, ConnectTimeout: cmd.DBConnectTimeout}
+	if err := db.validate(cli.Engine); err != nil {
+		return err
+	}
+
+	lockID, err := resolveLockID(cmd.LockID, cmd.LockKey)
+	if err != nil {
+		return err
+	}
+
+	confirm := func(string) (bool, error) { return true, nil }
+	if !cmd.Yes {
+		if !isTerminal(os.Stdin) {
+			return fmt.Errorf("stdin is not a terminal; pass --yes to roll back without confirmation")
+		}
+		confirm = func(prompt string) (bool, error) { return promptYesNo(os.Stdin, os.Stderr, prompt) }
+	}
+
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	syncer := NewSyncer(client, cli, db)
+	syncer.SkipLock = cmd.SkipLock
+	syncer.LockID = lockID
+	syncer.LockWait = cmd.LockWait
+	syncer.DryRunTimeout = cmd.DryRunTimeout
+	syncer.ApplyTimeout = cmd.ApplyTimeout
+	syncer.Hooks = Hooks{
+		OnBeforeApply:    cmd.OnBeforeApply,
+		OnApplyFailed:    cmd.OnApplyFailed,
+		OnApplySucceeded: cmd.OnApplySucceeded,
+	}
+	if syncer.HookRunner, err = newHookRunner(cmd.HookTimeout, cmd.HookEnvMaxBytes, cmd.HookShell); err != nil {
+		return err
+	}
+	return syncer.Rollback(ctx, os.Stdout, confirm)
+}
+
+// Rollback applies the completed version before the newest one, preferring its exported.sql,
+// and writes a rolled-back marker next to the newest one so watch mode does not re-apply it.
+// The planned DDL is written to out and confirm is asked before applying.
+func (s *Syncer) Rollback(ctx context.Context, out io.Writer, confirm func(prompt string) (bool, error)) error {
+	if s.CompletedFile == "" {
+		return fmt.Errorf("rollback needs completion markers to find the previous version (--completed-file is empty)")
+	}
+
+	objects, err := schemastore.ListAllObjects(ctx, s.Client, s.S3Bucket, s.PathPrefix)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	versions := orderVersions(schemastore.CollectVersions(objects, s.PathPrefix, s.SchemaFile, s.CompletedFile, s.Versioning), s.VersionOrder)
+	from, to, err := schemastore.FindRollbackTarget(versions)
+	if err != nil {
+		return err
+	}
+	fromKey := schemastore.SchemaKey(s.PathPrefix, from.Version, s.SchemaFile)
+
+	// The backup taken before the newest version was applied is the state to return to. Without one,
+	// exported.sql is the actual state after the previous version was applied.
+	toKey := schemastore.SchemaKey(s.PathPrefix, to.Version, s.SchemaFile)
+	var backupKey string
+	if s.PreApplyBackupFile != "" {
+		backupKey = schemastore.PreApplyBackupKey(fromKey, s.PreApplyBackupFile)
+	}
+	switch {
+	case backupKey != "" && slices.ContainsFunc(objects, func(obj types.Object) bool { return aws.ToString(obj.Key) == backupKey }):
+		toKey = backupKey
+	case to.Exported:
+		toKey = schemastore.ExportedSchemaKey(toKey)
+	}
+	schema, err := schemastore.DownloadSchema(ctx, s.Client, s.S3Bucket, toKey)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", toKey, err)
+	}
+	workDir, cleanup, err := s.useWorkDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	schemaFile, _, err := writeTempFile(workDir, "schema-*.sql", schema)
+	if err != nil {
+		return err
+	}
+	if err := s.loadPsqldefConfig(ctx, to.Version); err != nil {
+		return err
+	}
+	s.logger().Info("Rolling back", "from", from.Version, "to", to.Version, "key", toKey)
+
+	if !s.SkipLock {
+		locker, err := s.NewLocker(ctx, s.LockID)
+		if err != nil {
+			return fmt.Errorf("failed to create locker: %w", err)
+		}
+		defer func() { _ = locker.Close() }()
+
+		acquired, err := locker.TryLockWithWait(ctx, s.LockWait)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		if !acquired {
+			return fmt.Errorf("another process is applying schema (lock %d is held)", s.LockID)
+		}
+		defer func() {
+			if unlockErr := locker.Unlock(ctx); unlockErr != nil {
+				s.logger().Warn("Failed to release lock", "error", unlockErr)
+			}
+		}()
+	}
+
+	dryRunOutput, err := s.dryRun(ctx, schemaFile)
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, dryRunOutput)
+	}
+	_, _ = fmt.Fprintf(out, "-- Rollback from %s to %s (%s)\n%s", from.Version, to.Version, toKey, dryRunOutput)
+
+	ok, err := confirm(fmt.Sprintf("Roll back the database from %s to %s?", from.Version, to.Version))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("rollback cancelled")
+	}
+
+	hookEnv := *s.startHookEnv(&HookEnv{
+		S3Bucket:      s.S3Bucket,
+		PathPrefix:    s.PathPrefix,
+		SchemaFile:    s.SchemaFile,
+		CompletedFile: s.CompletedFile,
+		Version:       to.Version,
+		DryRun:        dryRunOutput,
+	})
+	beforeHookEnv := hookEnv
+	s.HookRunner.run(ctx, "on-before-apply", s.Hooks.OnBeforeApply, &beforeHookEnv)
+
+	recordApplyAttempt(s.Target)
+	applyStart := time.Now()
+	applyResult, err := s.apply(ctx, schemaFile)
+	applyDuration := time.Since(applyStart)
+	recordApplyDuration(applyDuration)
+	if err != nil {
+		recordApplyError(s.Target)
+		failedHookEnv := hookEnv
+		failedHookEnv.Error = err.Error()
+		if applyResult != nil {
+			failedHookEnv.Stdout = applyResult.Stdout
+			failedHookEnv.Stderr = applyResult.Stderr
+		}
+		failedHookEnv.FailureReason = failureReason(err, failedHookEnv.Stderr)
+		failedHookEnv.finish(applyDuration)
+		s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &failedHookEnv)
+		return fmt.Errorf("failed to apply schema: %w", err)
+	}
+	recordApplySuccess(s.Target, to.Version)
+
+	hostname, _ := os.Hostname()
+	if err := schemastore.CreateRolledBackMarker(ctx, s.Client, s.S3Bucket, fromKey, &schemastore.RollbackMetadata{
+		RolledBackTo: to.Version,
+		RolledBackAt: applyStart.UTC(),
+		Hostname:     hostname,
+		AppVersion:   Version,
+	}); err != nil {
+		return fmt.Errorf("rolled back to %s but failed to mark %s as rolled back: %w", to.Version, from.Version, err)
+	}
+
+	successHookEnv := hookEnv
+	successHookEnv.Stdout = applyResult.Stdout
+	successHookEnv.Stderr = applyResult.Stderr
+	successHookEnv.finish(applyDuration)
+	s.HookRunner.run(ctx, "on-apply-succeeded", s.Hooks.OnApplySucceeded, &successHookEnv)
+
+	s.logger().Info("Rolled back schema", "from", from.Version, "to", to.Version)
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// promptYesNo writes prompt to w and reads a y/yes answer from r
+func promptYesNo(r io.Reader, w io.Writer, prompt string) (bool, error) {
+	_, _ = fmt.Fprintf(w, "%s [y/N]: ", prompt)
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
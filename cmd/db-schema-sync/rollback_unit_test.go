@@ -0,0 +1,170 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+func TestSyncerRollback(t *testing.T) {
+	tests := []struct {
+		name        string
+		confirm     bool
+		backup      bool
+		wantApplied string
+		wantErr     string
+	}{
+		{"confirmed", true, false, "-- v2 exported", ""},
+		{"cancelled", false, false, "", "rollback cancelled"},
+		{"pre-apply backup", true, true, "-- before v3", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'DROP TABLE "public"."audit_logs";' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+
+			objects := map[string]string{
+				"schemas/v1/schema.sql":   "-- v1",
+				"schemas/v1/completed":    "",
+				"schemas/v2/schema.sql":   "-- v2",
+				"schemas/v2/completed":    "",
+				"schemas/v2/exported.sql": "-- v2 exported",
+				"schemas/v3/schema.sql":   "-- v3",
+				"schemas/v3/completed":    "",
+			}
+			if tt.backup {
+				objects["schemas/v3/pre-apply-backup.sql"] = "-- before v3"
+			}
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					var contents []types.Object
+					for key := range objects {
+						contents = append(contents, types.Object{Key: aws.String(key)})
+					}
+					return &s3.ListObjectsV2Output{Contents: contents}, nil
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(objects[*params.Key]))}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					body, _ := io.ReadAll(params.Body)
+					objects[*params.Key] = string(body)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PreApplyBackupFile: "pre-apply-backup.sql", PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+
+			var out bytes.Buffer
+			var prompt string
+			err := syncer.Rollback(context.Background(), &out, func(p string) (bool, error) {
+				prompt = p
+				return tt.confirm, nil
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Rollback() error = %v, want containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Rollback() error = %v", err)
+			}
+
+			if !strings.Contains(out.String(), "Rollback from v3 to v2") || !strings.Contains(out.String(), `DROP TABLE "public"."audit_logs";`) {
+				t.Errorf("planned DDL output = %q", out.String())
+			}
+			if !strings.Contains(prompt, "from v3 to v2") {
+				t.Errorf("prompt = %q", prompt)
+			}
+
+			applied, _ := os.ReadFile(applyLog)
+			if string(applied) != tt.wantApplied {
+				t.Errorf("applied schema = %q, want %q", applied, tt.wantApplied)
+			}
+
+			marker, marked := objects["schemas/v3/rolled-back"]
+			if marked != tt.confirm {
+				t.Fatalf("rolled-back marker written = %v, want %v", marked, tt.confirm)
+			}
+			if marked {
+				var meta schemastore.RollbackMetadata
+				if err := json.Unmarshal([]byte(marker), &meta); err != nil || meta.RolledBackTo != "v2" {
+					t.Errorf("rolled-back marker = %q (%v), want rolled_back_to v2", marker, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncerSkipsRolledBackVersion(t *testing.T) {
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	stub := writeStubPsqldef(t, `echo applied >> `+applyLog)
+
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v3/schema.sql")}}}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if *params.Key == "schemas/v3/rolled-back" {
+				return &s3.HeadObjectOutput{}, nil
+			}
+			return nil, &types.NotFound{}
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if _, err := os.Stat(applyLog); !os.IsNotExist(err) {
+		t.Error("expected rolled-back version not to be applied")
+	}
+}
+
+func TestPromptYesNo(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"YES\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		var w bytes.Buffer
+		got, err := promptYesNo(strings.NewReader(tt.input), &w, "Roll back?")
+		if err != nil {
+			t.Fatalf("promptYesNo(%q) error = %v", tt.input, err)
+		}
+		if got != tt.want {
+			t.Errorf("promptYesNo(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+		if w.String() != "Roll back? [y/N]: " {
+			t.Errorf("prompt = %q", w.String())
+		}
+	}
+}
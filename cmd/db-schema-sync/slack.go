@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// slackNotifyEvents maps --slack-notify values to lifecycle events
+var slackNotifyEvents = map[string]string{
+	"success":     "apply-succeeded",
+	"failure":     "apply-failed",
+	"fetch-error": "s3-fetch-error",
+}
+
+// SlackNotifier posts apply results to a Slack incoming webhook
+type SlackNotifier struct {
+	webhook   *WebhookNotifier
+	events    map[string]bool
+	dbName    string
+	maxLength int
+}
+
+// NewSlackNotifier creates a notifier for the given --slack-notify values
+func NewSlackNotifier(webhookURL string, notify []string, dbName string, maxLength int, timeout time.Duration) (*SlackNotifier, error) {
+	events := make(map[string]bool)
+	for _, n := range notify {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		event, ok := slackNotifyEvents[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown --slack-notify value %q (valid: success, failure, fetch-error)", n)
+		}
+		events[event] = true
+	}
+
+	webhook, err := NewWebhookNotifier(webhookURL, "", nil, timeout, 3)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SlackNotifier{webhook: webhook, events: events, dbName: dbName, maxLength: maxLength}, nil
+}
+
+// Notify posts a message for a lifecycle hook if its event is enabled.
+// Failures are logged and counted but never returned, mirroring hook commands.
+func (n *SlackNotifier) Notify(ctx context.Context, hookName string, hookEnv *HookEnv) {
+	event := strings.TrimPrefix(hookName, "on-")
+	if !n.events[event] {
+		return
+	}
+
+	// With --db each target is named in its own message
+	dbName := n.dbName
+	if hookEnv.Target != "" {
+		dbName = hookEnv.Target
+	}
+	body, err := marshalSlackMessage(buildSlackMessage(event, hookEnv, dbName, n.maxLength))
+	if err != nil {
+		recordWebhookError("slack-" + event)
+		slog.Error("Failed to encode Slack message", "event", event, "error", err)
+		return
+	}
+	if err := n.webhook.send(ctx, body); err != nil {
+		recordWebhookError("slack-" + event)
+		slog.Error("Slack notification failed", "event", event, "error", err)
+		return
+	}
+	slog.Info("Slack notification sent", "event", event)
+}
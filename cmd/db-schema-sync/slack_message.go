@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// slackMessage is a Slack incoming webhook payload using Block Kit
+type slackMessage struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text,omitempty"`
+	Fields   []slackText `json:"fields,omitempty"`
+	Elements []slackText `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func slackMarkdown(text string) slackText {
+	return slackText{Type: "mrkdwn", Text: text}
+}
+
+// buildSlackMessage formats a lifecycle event as a Slack message.
+// event is one of "apply-succeeded", "apply-failed" or "s3-fetch-error".
+// DDL and stderr are truncated to maxLength bytes (0 means no limit).
+func buildSlackMessage(event string, hookEnv *HookEnv, dbName string, maxLength int) slackMessage {
+	var title string
+	switch event {
+	case "apply-succeeded":
+		title = fmt.Sprintf(":white_check_mark: Schema %s applied to %s", hookEnv.Version, dbName)
+	case "apply-failed":
+		title = fmt.Sprintf(":x: Schema %s failed to apply to %s", hookEnv.Version, dbName)
+	case "s3-fetch-error":
+		title = fmt.Sprintf(":warning: Failed to fetch schema from s3://%s/%s", hookEnv.S3Bucket, hookEnv.PathPrefix)
+	default:
+		title = fmt.Sprintf("db-schema-sync: %s", event)
+	}
+
+	fields := []slackText{slackMarkdown("*Database*\n" + slackEscape(dbName))}
+	if hookEnv.Version != "" {
+		fields = append([]slackText{slackMarkdown("*Version*\n" + slackEscape(hookEnv.Version))}, fields...)
+	}
+	if hookEnv.S3Bucket != "" {
+		location := "s3://" + hookEnv.S3Bucket + "/" + hookEnv.PathPrefix
+		if hookEnv.Version != "" {
+			location += hookEnv.Version + "/" + hookEnv.SchemaFile
+		}
+		fields = append(fields, slackMarkdown("*Schema*\n`"+slackEscape(location)+"`"))
+	}
+
+	blocks := []slackBlock{
+		{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*" + slackEscape(title) + "*"}},
+		{Type: "section", Fields: fields},
+	}
+
+	if hookEnv.Error != "" {
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*Error*\n>" + slackEscape(hookEnv.Error)}})
+	}
+	if hookEnv.BlockedDDL != "" {
+		blocks = append(blocks, slackCodeBlock("Blocked DDL", hookEnv.BlockedDDL, maxLength))
+	}
+	if event == "apply-failed" && hookEnv.Stderr != "" {
+		blocks = append(blocks, slackCodeBlock("psqldef stderr", hookEnv.Stderr, maxLength))
+	}
+	if event != "s3-fetch-error" {
+		if strings.TrimSpace(hookEnv.DryRun) != "" {
+			blocks = append(blocks, slackCodeBlock("DDL", hookEnv.DryRun, maxLength))
+		} else if event == "apply-succeeded" {
+			blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*DDL*\n_No changes_"}})
+		}
+	}
+
+	if hookEnv.AppVersion != "" {
+		blocks = append(blocks, slackBlock{Type: "context", Elements: []slackText{slackMarkdown("db-schema-sync " + slackEscape(hookEnv.AppVersion))}})
+	}
+
+	return slackMessage{Text: title, Blocks: blocks}
+}
+
+// marshalSlackMessage encodes a message without Go's HTML escaping so mrkdwn stays readable
+func marshalSlackMessage(msg slackMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func slackCodeBlock(label, content string, maxLength int) slackBlock {
+	content = truncateText(strings.TrimRight(content, "\n"), maxLength)
+	return slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*" + label + "*\n```" + slackEscape(content) + "```"}}
+}
+
+// truncateText shortens s to at most maxLength bytes without splitting a UTF-8 character,
+// noting how much was cut. maxLength <= 0 disables truncation.
+func truncateText(s string, maxLength int) string {
+	if maxLength <= 0 || len(s) <= maxLength {
+		return s
+	}
+	cut := maxLength
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n... (%d more bytes truncated)", s[:cut], len(s)-cut)
+}
+
+// slackEscape escapes the control characters Slack mrkdwn treats specially
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
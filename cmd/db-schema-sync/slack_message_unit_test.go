@@ -0,0 +1,142 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestBuildSlackMessage(t *testing.T) {
+	base := HookEnv{
+		S3Bucket:      "my-bucket",
+		PathPrefix:    "schemas/",
+		SchemaFile:    "schema.sql",
+		CompletedFile: "completed",
+		AppVersion:    "v0.1.0",
+	}
+
+	tests := []struct {
+		name      string
+		event     string
+		hookEnv   HookEnv
+		maxLength int
+	}{
+		{
+			name:  "apply_succeeded",
+			event: "apply-succeeded",
+			hookEnv: func() HookEnv {
+				h := base
+				h.Version = "v2"
+				h.DryRun = "-- Apply --\nALTER TABLE users ADD COLUMN email text;\n"
+				return h
+			}(),
+			maxLength: 2000,
+		},
+		{
+			name:  "apply_succeeded_no_changes",
+			event: "apply-succeeded",
+			hookEnv: func() HookEnv {
+				h := base
+				h.Version = "v3"
+				return h
+			}(),
+			maxLength: 2000,
+		},
+		{
+			name:  "apply_failed",
+			event: "apply-failed",
+			hookEnv: func() HookEnv {
+				h := base
+				h.Version = "v2"
+				h.Error = "exit status 1"
+				h.Stderr = "ERROR: column \"email\" contains null values & cannot be NOT NULL <fatal>\n"
+				h.DryRun = "-- Apply --\nALTER TABLE users ALTER COLUMN email SET NOT NULL;\n"
+				return h
+			}(),
+			maxLength: 2000,
+		},
+		{
+			name:  "apply_failed_truncated",
+			event: "apply-failed",
+			hookEnv: func() HookEnv {
+				h := base
+				h.Version = "v2"
+				h.Error = "exit status 1"
+				h.Stderr = strings.Repeat("x", 50)
+				h.DryRun = strings.Repeat("CREATE TABLE t (id int);\n", 4)
+				return h
+			}(),
+			maxLength: 30,
+		},
+		{
+			name:  "s3_fetch_error",
+			event: "s3-fetch-error",
+			hookEnv: func() HookEnv {
+				h := base
+				h.Error = "operation error S3: ListObjectsV2, https response error StatusCode: 503"
+				return h
+			}(),
+			maxLength: 2000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := buildSlackMessage(tt.event, &tt.hookEnv, "appdb", tt.maxLength)
+			body, err := marshalSlackMessage(msg)
+			if err != nil {
+				t.Fatalf("failed to marshal message: %v", err)
+			}
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, body, "", "  "); err != nil {
+				t.Fatalf("failed to indent message: %v", err)
+			}
+			got := buf.Bytes()
+
+			golden := filepath.Join("testdata", "slack", tt.name+".json")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file (run with -update to create): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("message does not match %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestTruncateText(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		maxLength int
+		expected  string
+	}{
+		{"shorter than limit", "abc", 10, "abc"},
+		{"exactly at limit", "abcde", 5, "abcde"},
+		{"no limit", "abcdef", 0, "abcdef"},
+		{"truncated", "abcdef", 4, "abcd\n... (2 more bytes truncated)"},
+		{"does not split multibyte character", "aあい", 2, "a\n... (6 more bytes truncated)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateText(tt.input, tt.maxLength); got != tt.expected {
+				t.Errorf("truncateText(%q, %d) = %q, want %q", tt.input, tt.maxLength, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlackNotifier_Notify(t *testing.T) {
+	var messages []slackMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg slackMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("invalid Slack payload: %v", err)
+		}
+		messages = append(messages, msg)
+	}))
+	defer server.Close()
+
+	n, err := NewSlackNotifier(server.URL, []string{"failure"}, "appdb", 2000, time.Second)
+	if err != nil {
+		t.Fatalf("NewSlackNotifier failed: %v", err)
+	}
+
+	n.Notify(context.Background(), "on-apply-succeeded", &HookEnv{Version: "v1"})
+	n.Notify(context.Background(), "on-before-apply", &HookEnv{Version: "v2"})
+	n.Notify(context.Background(), "on-apply-failed", &HookEnv{Version: "v2", Error: "exit status 1"})
+
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 Slack message, got %d", len(messages))
+	}
+	if messages[0].Text != ":x: Schema v2 failed to apply to appdb" {
+		t.Errorf("unexpected message text: %q", messages[0].Text)
+	}
+}
+
+func TestNewSlackNotifier_InvalidNotify(t *testing.T) {
+	if _, err := NewSlackNotifier("http://example.com", []string{"success", "sometimes"}, "appdb", 0, time.Second); err == nil {
+		t.Error("expected error for unknown --slack-notify value, got nil")
+	}
+}
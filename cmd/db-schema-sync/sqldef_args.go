@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// reservedSqldefFlags are set by db-schema-sync itself and must not be passed with --psqldef-arg
+var reservedSqldefFlags = map[string][]string{
+	EnginePostgres: {"--file", "-f", "--dry-run", "--export", "--user", "-U", "--host", "-h", "--port", "-p", "--password", "-W"},
+	EngineMySQL:    {"--file", "-f", "--dry-run", "--export", "--user", "-u", "--host", "-h", "--port", "-P", "--password", "-p"},
+	EngineSQLite3:  {"--file", "-f", "--dry-run", "--export"},
+}
+
+// parseSqldefArgs combines PSQLDEF_EXTRA_ARGS and --psqldef-arg into cli.sqldefArgs,
+// rejecting arguments that conflict with the ones db-schema-sync sets itself.
+// The session settings become cli.applyArgs.
+func (c *CLI) parseSqldefArgs() error {
+	args, err := splitArgs(c.PsqldefExtraArgs)
+	if err != nil {
+		return fmt.Errorf("invalid PSQLDEF_EXTRA_ARGS: %w", err)
+	}
+	args = append(args, c.PsqldefArgs...)
+
+	if err := validateSqldefArgs(c.Engine, args); err != nil {
+		return err
+	}
+	c.sqldefArgs = args
+
+	if c.PsqldefConfig != "" {
+		for _, arg := range args {
+			if arg == "--config" || strings.HasPrefix(arg, "--config=") {
+				return fmt.Errorf("extra sqldef argument %q conflicts with --psqldef-config", arg)
+			}
+		}
+	}
+
+	beforeApply, err := c.beforeApplySQL()
+	if err != nil {
+		return err
+	}
+	c.applyArgs = nil
+	if beforeApply != "" {
+		for _, arg := range args {
+			if arg == "--before-apply" || strings.HasPrefix(arg, "--before-apply=") {
+				return fmt.Errorf("extra sqldef argument %q conflicts with --statement-timeout, --lock-timeout and --before-apply-sql; use --before-apply-sql instead", arg)
+			}
+		}
+		c.applyArgs = []string{"--before-apply=" + beforeApply}
+	}
+	return nil
+}
+
+// beforeApplySQL builds the SQL sqldef runs before the DDL on apply: SET statements for
+// --statement-timeout and --lock-timeout, followed by --before-apply-sql
+func (c *CLI) beforeApplySQL() (string, error) {
+	var stmts []string
+	settings := []struct {
+		flag, name string
+		value      time.Duration
+	}{
+		{"--statement-timeout", "statement_timeout", c.StatementTimeout},
+		{"--lock-timeout", "lock_timeout", c.LockTimeout},
+	}
+	for _, setting := range settings {
+		if setting.value == 0 {
+			continue
+		}
+		if c.Engine != EnginePostgres {
+			return "", fmt.Errorf("%s is only supported with --engine postgres", setting.flag)
+		}
+		interval, err := postgresInterval(setting.value)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %w", setting.flag, err)
+		}
+		stmts = append(stmts, fmt.Sprintf("SET %s = '%s';", setting.name, interval))
+	}
+
+	if sql := strings.TrimSpace(c.BeforeApplySQL); sql != "" {
+		if c.Engine == EngineSQLite3 {
+			return "", fmt.Errorf("--before-apply-sql is not supported with --engine sqlite3")
+		}
+		if !strings.HasSuffix(sql, ";") {
+			sql += ";"
+		}
+		stmts = append(stmts, sql)
+	}
+	return strings.Join(stmts, " "), nil
+}
+
+// postgresInterval formats d as a PostgreSQL time setting, e.g. 30s or 1500ms
+func postgresInterval(d time.Duration) (string, error) {
+	switch {
+	case d < 0:
+		return "", fmt.Errorf("%s is negative", d)
+	case d%time.Millisecond != 0:
+		return "", fmt.Errorf("%s is not a whole number of milliseconds", d)
+	case d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second), nil
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond), nil
+	}
+}
+
+// validateSqldefArgs reports an error if any extra argument is a flag db-schema-sync already sets for engine
+func validateSqldefArgs(engine string, args []string) error {
+	reserved, ok := reservedSqldefFlags[engine]
+	if !ok {
+		reserved = reservedSqldefFlags[EnginePostgres]
+	}
+	for _, arg := range args {
+		for _, flag := range reserved {
+			// Long flags may be given as --flag=value, short flags as -xvalue
+			long := strings.HasPrefix(flag, "--")
+			if arg == flag || (long && strings.HasPrefix(arg, flag+"=")) || (!long && strings.HasPrefix(arg, flag)) {
+				return fmt.Errorf("extra sqldef argument %q conflicts with %s, which db-schema-sync sets itself", arg, flag)
+			}
+		}
+	}
+	return nil
+}
+
+// splitArgs splits s into arguments on whitespace, following POSIX shell quoting:
+// single quotes preserve everything literally, double quotes allow \" and \\ escapes,
+// and a backslash outside quotes escapes the next character.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg := false
+
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			current.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case ch == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+				}
+				current.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inArg = true
+		case ch == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			current.WriteByte(s[i])
+			inArg = true
+		default:
+			current.WriteByte(ch)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,208 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"   ", nil, false},
+		{"--enable-drop-table --skip-view", []string{"--enable-drop-table", "--skip-view"}, false},
+		{"  --config  /etc/sqldef.yml\t--skip-view\n", []string{"--config", "/etc/sqldef.yml", "--skip-view"}, false},
+		{`--before-apply='SET lock_timeout = 1000;'`, []string{"--before-apply=SET lock_timeout = 1000;"}, false},
+		{`--before-apply "SET search_path = \"app\";"`, []string{"--before-apply", `SET search_path = "app";`}, false},
+		{`--config my\ config.yml`, []string{"--config", "my config.yml"}, false},
+		{`''`, []string{""}, false},
+		{`--before-apply 'unterminated`, nil, true},
+		{`--before-apply "unterminated`, nil, true},
+		{`--skip-view \`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := splitArgs(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitArgs(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitArgs(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateSqldefArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		engine  string
+		args    []string
+		wantErr string
+	}{
+		{"allowed flags", EnginePostgres, []string{"--enable-drop-table", "--skip-view", "--config", "sqldef.yml"}, ""},
+		{"file", EnginePostgres, []string{"--file", "other.sql"}, "--file"},
+		{"file with value", EnginePostgres, []string{"--file=other.sql"}, "--file"},
+		{"dry-run", EnginePostgres, []string{"--dry-run"}, "--dry-run"},
+		{"export", EngineMySQL, []string{"--export"}, "--export"},
+		{"postgres short port", EnginePostgres, []string{"-p5433"}, "-p"},
+		{"mysql short port", EngineMySQL, []string{"-P", "3307"}, "-P"},
+		{"mysql password", EngineMySQL, []string{"--password=secret"}, "--password"},
+		{"sqlite3 allows connection-like flags", EngineSQLite3, []string{"--enable-drop-table"}, ""},
+		{"long flag prefix is not a conflict", EnginePostgres, []string{"--filer"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSqldefArgs(tt.engine, tt.args)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSqldefArgs() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "conflicts with "+tt.wantErr) {
+				t.Errorf("validateSqldefArgs() error = %v, want conflict with %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseSqldefArgsFromFlags(t *testing.T) {
+	t.Setenv("PSQLDEF_EXTRA_ARGS", `--config 'my config.yml'`)
+
+	var c CLI
+	parser, err := kong.New(&c, kong.Exit(func(int) { t.Fatal("unexpected exit") }))
+	if err != nil {
+		t.Fatalf("kong.New() error = %v", err)
+	}
+	_, err = parser.Parse([]string{
+		"--s3-bucket", "bucket", "--path-prefix", "schemas/",
+		"--psqldef-arg=--enable-drop-table", "--psqldef-arg=--before-apply=SET a = 1, b = 2;",
+		"list-versions",
+	})
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if err := c.parseSqldefArgs(); err != nil {
+		t.Fatalf("parseSqldefArgs() error = %v", err)
+	}
+	want := []string{"--config", "my config.yml", "--enable-drop-table", "--before-apply=SET a = 1, b = 2;"}
+	if !reflect.DeepEqual(c.sqldefArgs, want) {
+		t.Errorf("sqldefArgs = %q, want %q", c.sqldefArgs, want)
+	}
+
+	c.PsqldefArgs = append(c.PsqldefArgs, "--dry-run")
+	if err := c.parseSqldefArgs(); err == nil {
+		t.Error("parseSqldefArgs() expected conflict error, got nil")
+	}
+}
+
+func TestSqldefExtraArgsNotPassedToExport(t *testing.T) {
+	stub := writeStubPsqldef(t, `echo "$@"`)
+	applier, _ := newEngine(EnginePostgres, stub, []string{"--enable-drop-table"}, nil, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+
+	dryRun, err := applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(dryRun), " --enable-drop-table") {
+		t.Errorf("DryRun() args = %q, want extra args appended", dryRun)
+	}
+
+	result, err := applier.Apply(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(result.Stdout), " --enable-drop-table") {
+		t.Errorf("Apply() args = %q, want extra args appended", result.Stdout)
+	}
+
+	exported, err := applier.Export(context.Background())
+	if err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+	if strings.Contains(string(exported), "--enable-drop-table") {
+		t.Errorf("Export() args = %q, want no extra args", exported)
+	}
+}
+
+func TestParseSqldefArgsSessionSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		cli     CLI
+		want    []string
+		wantErr string
+	}{
+		{"none", CLI{Engine: EnginePostgres}, nil, ""},
+		{
+			"timeouts and sql",
+			CLI{Engine: EnginePostgres, StatementTimeout: 30 * time.Second, LockTimeout: 1500 * time.Millisecond, BeforeApplySQL: "SET search_path = app"},
+			[]string{"--before-apply=SET statement_timeout = '30s'; SET lock_timeout = '1500ms'; SET search_path = app;"},
+			"",
+		},
+		{"lock timeout only", CLI{Engine: EnginePostgres, LockTimeout: 2 * time.Minute}, []string{"--before-apply=SET lock_timeout = '120s';"}, ""},
+		{"mysql sql", CLI{Engine: EngineMySQL, BeforeApplySQL: "SET SESSION lock_wait_timeout = 5;"}, []string{"--before-apply=SET SESSION lock_wait_timeout = 5;"}, ""},
+		{"mysql timeout", CLI{Engine: EngineMySQL, LockTimeout: time.Second}, nil, "--lock-timeout is only supported with --engine postgres"},
+		{"sqlite3 sql", CLI{Engine: EngineSQLite3, BeforeApplySQL: "PRAGMA foreign_keys = ON"}, nil, "not supported with --engine sqlite3"},
+		{"negative", CLI{Engine: EnginePostgres, StatementTimeout: -time.Second}, nil, "invalid --statement-timeout"},
+		{"sub-millisecond", CLI{Engine: EnginePostgres, StatementTimeout: 1500 * time.Microsecond}, nil, "whole number of milliseconds"},
+		{
+			"conflicting extra arg",
+			CLI{Engine: EnginePostgres, LockTimeout: time.Second, PsqldefArgs: []string{"--before-apply", "SET a = 1;"}},
+			nil,
+			"use --before-apply-sql instead",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cli.parseSqldefArgs()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSqldefArgs() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSqldefArgs() error = %v", err)
+			}
+			if !reflect.DeepEqual(tt.cli.applyArgs, tt.want) {
+				t.Errorf("applyArgs = %q, want %q", tt.cli.applyArgs, tt.want)
+			}
+		})
+	}
+}
+
+func TestSqldefApplyArgsOnlyPassedToApply(t *testing.T) {
+	stub := writeStubPsqldef(t, `echo "$@"`)
+	applier, _ := newEngine(EnginePostgres, stub, nil, []string{"--before-apply=SET lock_timeout = '5s';"}, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+
+	dryRun, err := applier.DryRun(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("DryRun() error = %v", err)
+	}
+	if strings.Contains(dryRun, "--before-apply") {
+		t.Errorf("DryRun() args = %q, want no --before-apply", dryRun)
+	}
+
+	result, err := applier.Apply(context.Background(), writeSchemaFile(t, "CREATE TABLE users (id INT);"))
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(result.Stdout), " --before-apply=SET lock_timeout = '5s';") {
+		t.Errorf("Apply() args = %q, want --before-apply appended", result.Stdout)
+	}
+}
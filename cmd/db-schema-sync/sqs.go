@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQSClient defines the interface for SQS operations
+type SQSClient interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+}
+
+// sqsReceiveErrorBackoff is the delay before retrying after a failed ReceiveMessage call
+const sqsReceiveErrorBackoff = 5 * time.Second
+
+// syncRequest asks the watch loop to run a sync immediately.
+// The loop sets err to the sync result and closes done once the sync attempt has completed.
+type syncRequest struct {
+	done chan struct{}
+	err  error
+}
+
+// s3EventNotification is the subset of the S3 event notification format we need
+type s3EventNotification struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+func createSQSClient(ctx context.Context, cli *CLI) (*sqs.Client, error) {
+	cfg, err := loadAWSConfig(ctx, cli.awsOptions())
+	if err != nil {
+		return nil, err
+	}
+	return sqs.NewFromConfig(cfg), nil
+}
+
+// isSchemaCreatedEvent reports whether an SQS message body is an S3 ObjectCreated
+// notification for <prefix>/<version>/<schema-file> in the given bucket.
+func isSchemaCreatedEvent(body, bucket, prefix, schemaFileName string) (bool, error) {
+	var event s3EventNotification
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return false, fmt.Errorf("failed to parse S3 event notification: %w", err)
+	}
+
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") || record.S3.Bucket.Name != bucket {
+			continue
+		}
+		// Object keys in S3 event notifications are URL-encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			continue
+		}
+		rel, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		ver, fileName, ok := strings.Cut(rel, "/")
+		if ok && ver != "" && fileName == schemaFileName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// consumeSQS long-polls the queue and sends a syncRequest to triggers for every batch
+// containing a schema upload event. Matching messages are deleted only after the
+// triggered sync attempt completes; unrelated messages are deleted immediately.
+func consumeSQS(ctx context.Context, client SQSClient, queueURL, bucket, prefix, schemaFileName string, triggers chan<- *syncRequest) {
+	for ctx.Err() == nil {
+		resp, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL),
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("Failed to receive SQS messages", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sqsReceiveErrorBackoff):
+			}
+			continue
+		}
+
+		var matched []sqstypes.Message
+		for _, msg := range resp.Messages {
+			ok, err := isSchemaCreatedEvent(aws.ToString(msg.Body), bucket, prefix, schemaFileName)
+			if err != nil {
+				slog.Warn("Ignoring unrecognized SQS message", "message_id", aws.ToString(msg.MessageId), "error", err)
+			}
+			if ok {
+				matched = append(matched, msg)
+			} else {
+				deleteSQSMessage(ctx, client, queueURL, msg)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		slog.Info("Received schema upload event, triggering sync", "messages", len(matched))
+		req := &syncRequest{done: make(chan struct{})}
+		select {
+		case <-ctx.Done():
+			return
+		case triggers <- req:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-req.done:
+		}
+
+		for _, msg := range matched {
+			deleteSQSMessage(ctx, client, queueURL, msg)
+		}
+	}
+}
+
+func deleteSQSMessage(ctx context.Context, client SQSClient, queueURL string, msg sqstypes.Message) {
+	_, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		slog.Warn("Failed to delete SQS message", "message_id", aws.ToString(msg.MessageId), "error", err)
+	}
+}
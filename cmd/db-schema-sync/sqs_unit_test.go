@@ -0,0 +1,181 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// mockSQSClient implements SQSClient interface for testing
+type mockSQSClient struct {
+	receiveMessageFunc func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (m *mockSQSClient) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	if m.receiveMessageFunc != nil {
+		return m.receiveMessageFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockSQSClient) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m *mockSQSClient) deletedHandles() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.deleted...)
+}
+
+// Ensure mockSQSClient implements SQSClient interface
+var _ SQSClient = (*mockSQSClient)(nil)
+
+func s3EventBody(eventName, bucket, key string) string {
+	return fmt.Sprintf(`{"Records":[{"eventName":%q,"s3":{"bucket":{"name":%q},"object":{"key":%q}}}]}`, eventName, bucket, key)
+}
+
+func TestIsSchemaCreatedEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		expected  bool
+		expectErr bool
+	}{
+		{
+			name:     "schema upload",
+			body:     s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2/schema.sql"),
+			expected: true,
+		},
+		{
+			name:     "multipart upload",
+			body:     s3EventBody("ObjectCreated:CompleteMultipartUpload", "my-bucket", "schemas/v2/schema.sql"),
+			expected: true,
+		},
+		{
+			name:     "URL-encoded key",
+			body:     s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2.1.0%2Brc1/schema.sql"),
+			expected: true,
+		},
+		{
+			name:     "different bucket",
+			body:     s3EventBody("ObjectCreated:Put", "other-bucket", "schemas/v2/schema.sql"),
+			expected: false,
+		},
+		{
+			name:     "different prefix",
+			body:     s3EventBody("ObjectCreated:Put", "my-bucket", "other/v2/schema.sql"),
+			expected: false,
+		},
+		{
+			name:     "completion marker",
+			body:     s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2/completed"),
+			expected: false,
+		},
+		{
+			name:     "nested path",
+			body:     s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2/extra/schema.sql"),
+			expected: false,
+		},
+		{
+			name:     "object removed",
+			body:     s3EventBody("ObjectRemoved:Delete", "my-bucket", "schemas/v2/schema.sql"),
+			expected: false,
+		},
+		{
+			name:     "test event without records",
+			body:     `{"Service":"Amazon S3","Event":"s3:TestEvent"}`,
+			expected: false,
+		},
+		{
+			name:      "invalid JSON",
+			body:      "not json",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isSchemaCreatedEvent(tt.body, "my-bucket", "schemas/", "schema.sql")
+			if tt.expectErr {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestConsumeSQS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	delivered := false
+	client := &mockSQSClient{
+		receiveMessageFunc: func(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+			if aws.ToString(params.QueueUrl) != "https://sqs.example/queue" {
+				t.Errorf("unexpected queue URL: %s", aws.ToString(params.QueueUrl))
+			}
+			if delivered {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			delivered = true
+			return &sqs.ReceiveMessageOutput{
+				Messages: []sqstypes.Message{
+					{ReceiptHandle: aws.String("unrelated"), Body: aws.String(s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2/completed"))},
+					{ReceiptHandle: aws.String("schema"), Body: aws.String(s3EventBody("ObjectCreated:Put", "my-bucket", "schemas/v2/schema.sql"))},
+				},
+			}, nil
+		},
+	}
+
+	triggers := make(chan *syncRequest)
+	go consumeSQS(ctx, client, "https://sqs.example/queue", "my-bucket", "schemas/", "schema.sql", triggers)
+
+	var req *syncRequest
+	select {
+	case req = <-triggers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a sync request")
+	}
+
+	// The unrelated message is deleted right away; the schema event waits for the sync
+	if got := client.deletedHandles(); len(got) != 1 || got[0] != "unrelated" {
+		t.Fatalf("expected only the unrelated message to be deleted before sync, got %v", got)
+	}
+
+	close(req.done)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.deletedHandles()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected schema message to be deleted after sync, got %v", client.deletedHandles())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := client.deletedHandles(); got[1] != "schema" {
+		t.Errorf("expected schema message to be deleted, got %v", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// syncState is a snapshot of a Syncer's progress that the HTTP server can read safely
+type syncState struct {
+	mu       sync.Mutex
+	snapshot syncStateSnapshot
+}
+
+// syncStateSnapshot is a copy of syncState taken under its lock
+type syncStateSnapshot struct {
+	S3Bucket       string
+	PathPrefix     string
+	PsqldefVersion string
+
+	LastAppliedVersion string
+	LatestVersion      string
+	// CompletionMarkerExists is nil when the marker for LatestVersion was not checked
+	CompletionMarkerExists *bool
+	LockSkipped            bool
+
+	LastSyncTime        time.Time
+	LastApplyTime       time.Time
+	ConsecutiveFailures int
+}
+
+func (s *syncState) update(fn func(*syncStateSnapshot)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.snapshot)
+}
+
+// describe records the static configuration reported by /status
+func (s *syncState) describe(bucket, prefix, psqldefVersion string) {
+	s.update(func(st *syncStateSnapshot) {
+		st.S3Bucket = bucket
+		st.PathPrefix = prefix
+		st.PsqldefVersion = psqldefVersion
+	})
+}
+
+// fetchSucceeded records a successful listing of the schema versions in S3
+func (s *syncState) fetchSucceeded(at time.Time) {
+	s.update(func(st *syncStateSnapshot) {
+		st.LastSyncTime = at
+		st.ConsecutiveFailures = 0
+	})
+}
+
+// fetchFailed records the current number of consecutive S3 failures
+func (s *syncState) fetchFailed(consecutiveFailures int) {
+	s.update(func(st *syncStateSnapshot) {
+		st.ConsecutiveFailures = consecutiveFailures
+	})
+}
+
+// sawLatest records the latest version found in S3 and, if checked, whether its completion marker exists
+func (s *syncState) sawLatest(version string, markerExists *bool) {
+	s.update(func(st *syncStateSnapshot) {
+		st.LatestVersion = version
+		st.CompletionMarkerExists = markerExists
+	})
+}
+
+// lockAttempted records whether the last advisory lock attempt was skipped because another process held it
+func (s *syncState) lockAttempted(skipped bool) {
+	s.update(func(st *syncStateSnapshot) {
+		st.LockSkipped = skipped
+	})
+}
+
+// alreadyApplied records that the database is at version because its completion marker exists
+func (s *syncState) alreadyApplied(version string) {
+	s.update(func(st *syncStateSnapshot) {
+		st.LastAppliedVersion = version
+	})
+}
+
+// applied records a successful apply of version
+func (s *syncState) applied(version string, at time.Time) {
+	s.update(func(st *syncStateSnapshot) {
+		st.LastAppliedVersion = version
+		st.LastApplyTime = at
+	})
+}
+
+func (s *syncState) get() syncStateSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.snapshot
+	if st.CompletionMarkerExists != nil {
+		exists := *st.CompletionMarkerExists
+		st.CompletionMarkerExists = &exists
+	}
+	return st
+}
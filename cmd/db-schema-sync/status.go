@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// statusResponse is the JSON body returned by /status
+type statusResponse struct {
+	AppVersion             string  `json:"appVersion"`
+	PsqldefVersion         string  `json:"psqldefVersion"`
+	S3Bucket               string  `json:"s3Bucket"`
+	PathPrefix             string  `json:"pathPrefix"`
+	LastAppliedVersion     string  `json:"lastAppliedVersion"`
+	LatestVersion          string  `json:"latestVersion"`
+	CompletionMarkerExists *bool   `json:"completionMarkerExists"`
+	ConsecutiveFailures    int     `json:"consecutiveFailures"`
+	LastFetchTime          *string `json:"lastFetchTime"`
+	LastApplyTime          *string `json:"lastApplyTime"`
+	LockSkipped            bool    `json:"lockSkipped"`
+}
+
+func newStatusResponse(s syncStateSnapshot) statusResponse {
+	return statusResponse{
+		AppVersion:             Version,
+		PsqldefVersion:         s.PsqldefVersion,
+		S3Bucket:               s.S3Bucket,
+		PathPrefix:             s.PathPrefix,
+		LastAppliedVersion:     s.LastAppliedVersion,
+		LatestVersion:          s.LatestVersion,
+		CompletionMarkerExists: s.CompletionMarkerExists,
+		ConsecutiveFailures:    s.ConsecutiveFailures,
+		LastFetchTime:          formatOptionalTime(s.LastSyncTime),
+		LastApplyTime:          formatOptionalTime(s.LastApplyTime),
+		LockSkipped:            s.LockSkipped,
+	}
+}
+
+// formatOptionalTime formats t as RFC 3339, or returns nil (JSON null) for the zero time
+func formatOptionalTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	formatted := t.UTC().Format(time.RFC3339)
+	return &formatted
+}
+
+// statusHandler serves /status: a JSON view of the daemon's sync state
+func statusHandler(state *syncState) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(newStatusResponse(state.get()))
+	}
+}
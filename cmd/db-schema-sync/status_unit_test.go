@@ -0,0 +1,65 @@
+//go:build !integration
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, state *syncState) statusResponse {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statusHandler(state)(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %s", ct)
+	}
+	var resp statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	return resp
+}
+
+func TestStatusHandler(t *testing.T) {
+	state := &syncState{}
+	state.describe("my-bucket", "schemas/", "psqldef v3.9.4")
+
+	resp := getStatus(t, state)
+	if resp.S3Bucket != "my-bucket" || resp.PathPrefix != "schemas/" || resp.PsqldefVersion != "psqldef v3.9.4" {
+		t.Errorf("unexpected static fields: %+v", resp)
+	}
+	if resp.AppVersion != Version {
+		t.Errorf("expected app version %s, got %s", Version, resp.AppVersion)
+	}
+	if resp.LastFetchTime != nil || resp.LastApplyTime != nil || resp.CompletionMarkerExists != nil {
+		t.Errorf("expected null times and marker before first sync: %+v", resp)
+	}
+
+	appliedAt := time.Date(2026, 1, 20, 15, 30, 45, 0, time.UTC)
+	markerExists := false
+	state.fetchSucceeded(appliedAt)
+	state.sawLatest("v3", &markerExists)
+	state.applied("v2", appliedAt)
+	state.lockAttempted(true)
+
+	resp = getStatus(t, state)
+	if resp.LatestVersion != "v3" || resp.LastAppliedVersion != "v2" {
+		t.Errorf("unexpected versions: latest=%s applied=%s", resp.LatestVersion, resp.LastAppliedVersion)
+	}
+	if resp.CompletionMarkerExists == nil || *resp.CompletionMarkerExists {
+		t.Errorf("expected completionMarkerExists=false, got %v", resp.CompletionMarkerExists)
+	}
+	if resp.LastApplyTime == nil || *resp.LastApplyTime != "2026-01-20T15:30:45Z" {
+		t.Errorf("unexpected lastApplyTime: %v", resp.LastApplyTime)
+	}
+	if !resp.LockSkipped {
+		t.Error("expected lockSkipped=true")
+	}
+}
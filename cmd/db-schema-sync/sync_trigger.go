@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// syncTriggerResponse is the JSON body returned by POST /sync
+type syncTriggerResponse struct {
+	// Status is triggered without ?wait=true, otherwise succeeded, failed or timeout;
+	// in_progress when the request was refused because a sync is running
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// syncHandler serves POST /sync: it asks the watch loop to sync now and returns 202.
+// With ?wait=true the response carries the outcome, waiting at most timeout for it.
+// The loop only receives requests while it waits between syncs, so a request that cannot be
+// handed over immediately means a sync is running and gets 409 with the in_progress status.
+// When token is set, the request needs an "Authorization: Bearer <token>" header.
+func syncHandler(triggers chan<- *syncRequest, token string, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		req := &syncRequest{done: make(chan struct{})}
+		select {
+		case triggers <- req:
+		default:
+			recordSyncInProgress("http")
+			writeSyncTriggerResponse(w, http.StatusConflict, syncTriggerResponse{Status: "in_progress", Error: errSyncInProgress.Error()})
+			return
+		}
+		slog.Info("Sync triggered via HTTP", "remote_addr", r.RemoteAddr)
+
+		resp := syncTriggerResponse{Status: "triggered"}
+		if r.URL.Query().Get("wait") == "true" {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-req.done:
+				resp.Status = "succeeded"
+				if req.err != nil {
+					resp.Status = "failed"
+					resp.Error = req.err.Error()
+				}
+			case <-timer.C:
+				resp.Status = "timeout"
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		writeSyncTriggerResponse(w, http.StatusAccepted, resp)
+	}
+}
+
+func writeSyncTriggerResponse(w http.ResponseWriter, code int, resp syncTriggerResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,173 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSyncHandlerRejects(t *testing.T) {
+	// Nothing receives from triggers, as while a sync is running
+	handler := syncHandler(make(chan *syncRequest), "s3cr3t", time.Second)
+
+	tests := []struct {
+		name   string
+		method string
+		auth   string
+		want   int
+	}{
+		{"wrong method", http.MethodGet, "Bearer s3cr3t", http.StatusMethodNotAllowed},
+		{"missing token", http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "Bearer wrong", http.StatusUnauthorized},
+		{"sync running", http.MethodPost, "Bearer s3cr3t", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/sync", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncHandlerTriggersWatchLoop(t *testing.T) {
+	var polls atomic.Int32
+	var block atomic.Bool
+	release := make(chan struct{})
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			polls.Add(1)
+			if block.Load() {
+				<-release
+			}
+			return nil, errors.New("unavailable")
+		},
+	}
+	w, _ := newTestWatcher(t, client, "s3_bucket: test-bucket\ninterval: 1h\n")
+	w.triggers = make(chan *syncRequest)
+	handler := syncHandler(w.triggers, "", 5*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.run(ctx, nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(cond func() bool) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if cond() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	post := func(target string) (int, syncTriggerResponse) {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		var resp syncTriggerResponse
+		if rec.Code == http.StatusAccepted {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid JSON body: %v", err)
+			}
+		}
+		return rec.Code, resp
+	}
+
+	// The trigger is only accepted once the loop waits after its first sync
+	if !waitFor(func() bool { code, _ := post("/sync"); return code == http.StatusAccepted }) {
+		t.Fatal("expected POST /sync to be accepted")
+	}
+	if !waitFor(func() bool { return polls.Load() == 2 }) {
+		t.Fatalf("polls = %d, want the triggered sync", polls.Load())
+	}
+
+	// A second request while a sync runs is refused
+	block.Store(true)
+	if !waitFor(func() bool { code, _ := post("/sync"); return code == http.StatusAccepted }) {
+		t.Fatal("expected POST /sync to be accepted")
+	}
+	if !waitFor(func() bool { return polls.Load() == 3 }) {
+		t.Fatalf("polls = %d, want the blocked sync to start", polls.Load())
+	}
+	if code, _ := post("/sync"); code != http.StatusConflict {
+		t.Errorf("status = %d while a sync is running, want 409", code)
+	}
+	block.Store(false)
+	close(release)
+
+	var code int
+	var resp syncTriggerResponse
+	if !waitFor(func() bool { code, resp = post("/sync?wait=true"); return code == http.StatusAccepted }) {
+		t.Fatalf("status = %d, want 202", code)
+	}
+	if resp.Status != "failed" || !strings.Contains(resp.Error, "unavailable") {
+		t.Errorf("response = %+v, want the failed outcome", resp)
+	}
+}
+
+func TestSyncHandlerConcurrentRequests(t *testing.T) {
+	// One request can be handed over, like to a waiting loop, which then syncs and stops receiving
+	triggers := make(chan *syncRequest, 1)
+	handler := syncHandler(triggers, "", time.Second)
+
+	const requests = 50
+	refusedBefore := testutil.ToFloat64(syncInProgressTotal.WithLabelValues("http"))
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodPost, "/sync", nil))
+			if rec.Code == http.StatusConflict {
+				var resp syncTriggerResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Status != "in_progress" {
+					t.Errorf("409 body = %q, want the in_progress status", rec.Body.String())
+				}
+			}
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusAccepted] != 1 || counts[http.StatusConflict] != requests-1 {
+		t.Errorf("status counts = %v, want one 202 and %d 409", counts, requests-1)
+	}
+	if got := testutil.ToFloat64(syncInProgressTotal.WithLabelValues("http")) - refusedBefore; got != requests-1 {
+		t.Errorf("sync_in_progress_total{source=http} increased by %v, want %d", got, requests-1)
+	}
+	if len(triggers) != 1 {
+		t.Errorf("%d requests reached the loop, want 1", len(triggers))
+	}
+}
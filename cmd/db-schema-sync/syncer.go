@@ -0,0 +1,1381 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DBConfig holds the database connection settings
+type DBConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	// File is the database file for sqlite3; the other fields are unused then
+	File string
+
+	// SSLMode, SSLRootCert and ConnectTimeout apply to PostgreSQL connections; empty SSLMode means disable for
+	// the lock connection and leaves psqldef the PGSSLMODE it inherits
+	SSLMode        string
+	SSLRootCert    string
+	ConnectTimeout time.Duration
+	// IAMAuthToken, set by --db-iam-auth, generates the PostgreSQL password for every connection and
+	// psqldef run instead of Password, since an RDS IAM auth token expires after 15 minutes
+	IAMAuthToken authTokenFunc
+}
+
+// Hooks holds the lifecycle hook commands run during a sync
+type Hooks struct {
+	OnS3FetchError   string
+	OnPlan           string
+	OnBeforeApply    string
+	OnApplyFailed    string
+	OnApplySucceeded string
+	OnNoChange       string
+	OnDriftDetected  string
+	OnPaused         string
+}
+
+// Syncer applies the latest schema from S3 to the database.
+// A Syncer keeps in-memory state between runs, so watch mode reuses one instance.
+type Syncer struct {
+	Client        schemastore.S3Client
+	S3Bucket      string
+	PathPrefix    string
+	SchemaFile    string
+	CompletedFile string
+	// AppliedDDLFile is uploaded next to the completion marker with the executed DDL; empty disables it
+	AppliedDDLFile string
+	// PreApplyBackupFile is uploaded into the version directory with the schema exported before the apply;
+	// empty disables it
+	PreApplyBackupFile string
+	// PauseFile is the object under the path prefix whose presence pauses applies; empty disables the check
+	PauseFile string
+	DB        DBConfig
+	Hooks     Hooks
+	// HookRunner runs Hooks and delivers every lifecycle event to the webhook and Slack
+	HookRunner *hookRunner
+	// Target names the database in a --db fan-out for metrics, hooks and its completion marker; empty otherwise
+	Target string
+
+	// Applier and NewLocker are the engine-specific implementations chosen by NewSyncer
+	Applier   SchemaApplier
+	NewLocker func(ctx context.Context, lockID int64) (Locker, error)
+	// PsqldefConfig is the --psqldef-config value, resolved for each version by loadPsqldefConfig
+	PsqldefConfig string
+	// WorkDir holds the temporary files (see useWorkDir); empty means the system temp directory
+	WorkDir string
+
+	ExportAfterApply bool
+	// CompressExported uploads the exported schema gzip-compressed
+	CompressExported bool
+	// ExportedHistory also uploads each export as a timestamped copy next to exported.sql
+	ExportedHistory bool
+	SkipLock        bool
+	LockID          int64
+	LockWait        time.Duration
+	// LockKeepalive is how often a held PostgreSQL advisory lock is checked during the apply; 0 disables it
+	LockKeepalive time.Duration
+	HistoryTable  string
+	// PostApplyChecks are queries that must succeed after the apply before the version is marked completed
+	PostApplyChecks []string
+
+	// DenyDDL blocks the apply when a planned statement matches, or when the dry-run failed; nil disables the check
+	DenyDDL      []*regexp.Regexp
+	StrictDryRun bool
+	// RequireChecksum refuses a schema without a <schema-file>.sha256 sidecar; a mismatching sidecar is always refused
+	RequireChecksum bool
+	// RequireBackup fails the sync when the PreApplyBackupFile backup fails instead of logging it
+	RequireBackup bool
+	// ApprovalMethod, when set, applies only versions approved with it (approvalMarker or approvalTag)
+	ApprovalMethod string
+	// ApprovedFile is the approval marker file name for approvalMarker
+	ApprovedFile string
+	// FailedFile is the failure marker file name written when an apply fails; empty disables the marker
+	FailedFile string
+	// SkipFailedVersions skips a version that has a FailedFile marker, unless Force is set
+	SkipFailedVersions bool
+	// ReapplyOnContentChange re-applies an applied version whose schema file was overwritten in place.
+	// Such a change is logged and counted either way.
+	ReapplyOnContentChange bool
+
+	// AlwaysApply runs the sqldef apply even when the dry-run reports no changes
+	AlwaysApply bool
+
+	// PinnedVersion applies exactly this version instead of the latest one (apply --version)
+	PinnedVersion string
+	// MaxVersion ignores versions newer than this (--max-version)
+	MaxVersion string
+	// OnlyCompletedFile, when set, makes only versions with this completion marker eligible, so a version is
+	// applied only after another environment completed it (--only-completed)
+	OnlyCompletedFile string
+	// ApplySequentially applies every version between the last applied one and the latest in order (--apply-sequentially)
+	ApplySequentially bool
+	// MinApplyInterval defers applying a version until this long after the last successful apply (--min-apply-interval)
+	MinApplyInterval time.Duration
+	// VersionOrder is "last-modified" to pick the most recently uploaded schema instead of the highest version (--version-order)
+	VersionOrder string
+	// Versioning filters, validates and orders version names (--version-scheme, --strict-versions, --*-version-pattern)
+	Versioning schemastore.Versioning
+	// Force ignores the completion marker, the last applied version and the downgrade check
+	Force bool
+	// AllowDowngrade applies a version older than the newest completed one (--allow-downgrade)
+	AllowDowngrade bool
+
+	// DryRunTimeout and ApplyTimeout bound each sqldef invocation; 0 means no limit.
+	// DryRunTimeout also covers the read-only --export and offline diff.
+	DryRunTimeout time.Duration
+	ApplyTimeout  time.Duration
+	// SyncTimeout bounds a whole Run, including S3, the lock and hooks; 0 means no limit
+	SyncTimeout time.Duration
+
+	// DisableConditionalWrites creates the completion marker without If-None-Match.
+	// It is also set at runtime when the S3 store rejects conditional writes.
+	DisableConditionalWrites bool
+
+	// running is held by Run and CheckDrift so a drift check never overlaps a sync
+	running sync.Mutex
+	// syncing is set while Run is in progress, so a second Run is refused instead of queued behind it
+	syncing atomic.Bool
+	// applying is the on-before-apply environment from when that hook has run until the outcome of the apply
+	// is known, for the on-apply-failed hook of a sync that times out in between
+	applying *HookEnv
+
+	// MaxConsecutiveFailures is the number of consecutive S3 failures that fires on-s3-fetch-error;
+	// 0 fires it on every failure
+	MaxConsecutiveFailures int
+	// FetchRetries is how many times a listing or schema download that failed with a transient error is retried
+	// within a sync before it counts as a failure; FetchRetryBackoff is the delay before the first retry
+	FetchRetries      int
+	FetchRetryBackoff time.Duration
+
+	// In-memory state (for watch mode)
+	lastAppliedVersion string
+	// lastAppliedModified is the LastModified of lastAppliedVersion's schema file with --version-order last-modified
+	lastAppliedModified     time.Time
+	consecutiveFailureCount int
+	// appliedETag is the ETag of the schema applied as lastAppliedVersion; empty when unknown
+	appliedETag string
+	// changedETag is the last changed ETag reported, so each content change is warned about once
+	changedETag string
+	// cachedSchema is the last downloaded schema, reused while a conditional download reports it
+	// unchanged, for example while an apply keeps failing. Close removes its file.
+	cachedSchema *downloadedSchema
+	// replaceMarker makes the completion marker of a re-apply after a content change replace the existing one
+	replaceMarker bool
+	state         *syncState
+	// heldBack is the number of versions above MaxVersion last reported, so the log line is written on change
+	heldBack int
+	// lastApplyAt is when this process last applied a version, for MinApplyInterval
+	lastApplyAt time.Time
+	// paused is whether the last sync found the PauseFile object, so on-paused runs once per pause
+	paused bool
+	// lastDrift is the drift DDL last reported to on-drift-detected
+	lastDrift string
+	// syncAttempts counts Run and ApplyLocal calls, for DB_SCHEMA_SYNC_SYNC_ATTEMPT
+	syncAttempts int64
+}
+
+// versionOrderLastModified orders versions by the LastModified of their schema file instead of by name
+const versionOrderLastModified = "last-modified"
+
+// NewSyncer creates a Syncer with the S3 layout and database engine taken from the global CLI flags
+func NewSyncer(client schemastore.S3Client, cli *CLI, db DBConfig) *Syncer {
+	_, toolPath := cli.sqldefTool()
+	applier, newLocker := newEngine(cli.Engine, toolPath, cli.sqldefArgs, cli.applyArgs, db)
+	return &Syncer{
+		Client:             client,
+		S3Bucket:           cli.S3Bucket,
+		PathPrefix:         cli.PathPrefix,
+		SchemaFile:         cli.SchemaFile,
+		CompletedFile:      cli.CompletedFile,
+		AppliedDDLFile:     cli.AppliedDDLFile,
+		PreApplyBackupFile: cli.PreApplyBackupFile,
+		PauseFile:          cli.PauseFile,
+		ApprovedFile:       cli.ApprovedFile,
+		FailedFile:         cli.FailedFile,
+		DB:                 db,
+		Applier:            applier,
+		NewLocker:          newLocker,
+		PsqldefConfig:      cli.PsqldefConfig,
+		WorkDir:            cli.WorkDir,
+		VersionOrder:       cli.VersionOrder,
+		Versioning:         cli.versioning,
+		LockID:             AdvisoryLockID,
+		HookRunner:         defaultHookRunner(),
+		state:              &syncState{},
+
+		MaxConsecutiveFailures: defaultMaxConsecutiveFailures,
+	}
+}
+
+// reconfigure changes the syncer with fn once a running sync or drift check has finished
+func (s *Syncer) reconfigure(fn func(*Syncer)) {
+	s.running.Lock()
+	defer s.running.Unlock()
+	fn(s)
+}
+
+// State returns the thread-safe view of this Syncer's progress
+func (s *Syncer) State() *syncState {
+	return s.state
+}
+
+// LastAppliedVersion returns the last version this Syncer applied or found already completed
+func (s *Syncer) LastAppliedVersion() string {
+	return s.lastAppliedVersion
+}
+
+// ConsecutiveFailures returns the current number of consecutive S3 fetch failures
+func (s *Syncer) ConsecutiveFailures() int {
+	return s.consecutiveFailureCount
+}
+
+// logger returns the default logger with the prefix and, in a --db fan-out, the target of this Syncer,
+// so lines from several prefixes or databases can be told apart
+func (s *Syncer) logger() *slog.Logger {
+	if s.Target != "" {
+		return slog.With("prefix", s.PathPrefix, "target", s.Target)
+	}
+	return slog.With("prefix", s.PathPrefix)
+}
+
+// unlockTimeout bounds releasing the lock, which does not use the sync context since that may have expired
+const unlockTimeout = 10 * time.Second
+
+// checkSyncTimeout requires --sync-timeout to leave the dry-run and the apply room to fail on their own timeouts,
+// which report which step hung
+func checkSyncTimeout(syncTimeout, dryRunTimeout, applyTimeout time.Duration) error {
+	if syncTimeout > 0 && syncTimeout <= dryRunTimeout+applyTimeout {
+		return fmt.Errorf("--sync-timeout %s must be larger than --dry-run-timeout plus --apply-timeout (%s)", syncTimeout, dryRunTimeout+applyTimeout)
+	}
+	return nil
+}
+
+// syncTimedOut reports a sync cut off by SyncTimeout. Everything it was running has been canceled and the lock
+// released; ctx is the context of the caller, so on-apply-failed can still run when the apply had begun.
+func (s *Syncer) syncTimedOut(ctx context.Context, err error) error {
+	recordSyncTimeout(s.Target)
+	err = fmt.Errorf("sync timed out after %s (--sync-timeout): %w", s.SyncTimeout, err)
+	s.logger().Error("Sync timed out and was canceled", "timeout", s.SyncTimeout, "error", err)
+	if s.applying != nil {
+		hookEnv := *s.applying
+		hookEnv.Error = err.Error()
+		hookEnv.FailureReason = failureSyncTimeout
+		hookEnv.finish(0)
+		s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	}
+	return err
+}
+
+// reportingApply forgets the apply begun by on-before-apply when on-apply-failed is about to report its outcome.
+// Once the sync has timed out no hook can run, so syncTimedOut reports it instead.
+func (s *Syncer) reportingApply(ctx context.Context) {
+	if ctx.Err() == nil {
+		s.applying = nil
+	}
+}
+
+// errSyncInProgress is returned by Run when another Run of the same syncer has not finished
+var errSyncInProgress = errors.New("a sync is already in progress")
+
+// Run performs one sync: find the latest schema in S3 and apply it if it is new.
+// A call made while another is running returns errSyncInProgress; a drift check is waited for.
+func (s *Syncer) Run(ctx context.Context) (err error) {
+	if !s.syncing.CompareAndSwap(false, true) {
+		recordSyncInProgress("run")
+		s.logger().Warn("A sync is already in progress, skipping")
+		return errSyncInProgress
+	}
+	defer s.syncing.Store(false)
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	ctx, sp := startSpan(ctx, "sync", bucketAttr(s.S3Bucket), attribute.String("db_schema_sync.prefix", s.PathPrefix), attribute.String("db_schema_sync.target", s.Target))
+	defer func() { sp.end(err) }()
+
+	s.applying = nil
+	if s.SyncTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.SyncTimeout)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+				err = s.syncTimedOut(parent, err)
+			}
+		}()
+	}
+
+	s.logger().Info("Finding latest schema...")
+
+	// Base hook environment with S3 settings
+	baseHookEnv := s.startHookEnv(&HookEnv{
+		S3Bucket:      s.S3Bucket,
+		PathPrefix:    s.PathPrefix,
+		SchemaFile:    s.SchemaFile,
+		CompletedFile: s.CompletedFile,
+	})
+
+	// Record S3 fetch attempt
+	recordS3FetchAttempt()
+
+	// Time the S3 list+download once per sync; polls that stop after listing record just that part
+	fetchStart := time.Now()
+	observeFetch := sync.OnceFunc(func() { recordS3FetchDuration(time.Since(fetchStart)) })
+	defer observeFetch()
+
+	// Find the schema file to apply
+	listCtx, listSpan := startSpan(ctx, "list", bucketAttr(s.S3Bucket))
+	var latestSchemaKey, latestVersion string
+	var latestModified time.Time
+	err = s.retryFetch(listCtx, fetchOperationList, func(ctx context.Context) error {
+		var err error
+		latestSchemaKey, latestVersion, latestModified, err = s.findSchema(ctx)
+		return err
+	})
+	notPromoted := s.OnlyCompletedFile != "" && errors.Is(err, schemastore.ErrSchemaNotFound)
+	if notPromoted {
+		listSpan.end(nil)
+	} else {
+		listSpan.set(keyAttr(latestSchemaKey), versionAttr(latestVersion))
+		listSpan.end(err)
+	}
+	if err != nil && !notPromoted {
+		observeFetch()
+		s.fetchFailed(ctx, *baseHookEnv, err)
+		s.logger().Error("Failed to find latest schema", "error", err, "consecutive_failures", s.consecutiveFailureCount)
+		return fmt.Errorf("failed to find latest schema: %w", err)
+	}
+
+	// Reset failure count on success
+	s.consecutiveFailureCount = 0
+	recordConsecutiveFailures(s.consecutiveFailureCount)
+	syncedAt := time.Now()
+	s.state.fetchSucceeded(syncedAt)
+	recordSyncSuccess(s.Target, syncedAt)
+	if notPromoted {
+		s.logger().Info("No completed version to apply yet (--only-completed)", "completed_file", s.OnlyCompletedFile)
+		return nil
+	}
+	s.state.sawLatest(latestVersion, nil)
+	sp.set(versionAttr(latestVersion))
+	if paused, err := s.checkPaused(ctx, baseHookEnv); err != nil || paused {
+		return err
+	}
+
+	var reapply bool
+	if !s.Force && s.lastAppliedVersion != "" && s.PinnedVersion == "" && s.olderThanApplied(latestVersion, latestModified) {
+		// A newer version directory was deleted from S3 after it was applied
+		if !s.AllowDowngrade {
+			return s.downgradeBlocked(ctx, latestVersion, s.lastAppliedVersion, "--allow-downgrade", baseHookEnv)
+		}
+		s.logger().Warn("Downgrading to a version older than the last applied one (--allow-downgrade)", "version", latestVersion, "last_applied", s.lastAppliedVersion)
+	} else if !s.Force && s.lastAppliedVersion != "" && !s.newerThanApplied(latestVersion, latestModified) {
+		reapply, err = s.checkContentChanged(ctx, latestSchemaKey, latestVersion)
+		if err != nil {
+			return err
+		}
+		if !reapply {
+			s.logger().Info("Latest version is not newer than last applied version, skipping", "version", latestVersion, "last_applied", s.lastAppliedVersion)
+			return nil
+		}
+	}
+
+	// Refuse to silently downgrade to a pinned version older than what is already completed
+	if s.PinnedVersion != "" && !s.Force && !s.AllowDowngrade && s.CompletedFile != "" {
+		if err := s.checkNotDowngrade(ctx, latestVersion, "--force", baseHookEnv); err != nil {
+			return err
+		}
+	}
+
+	// Check if completion marker already exists in S3. When it is the marker --only-completed requires,
+	// it exists by definition and only the last applied version tells whether this database has the version.
+	if s.CompletedFile != "" && !s.Force && !reapply && !s.sharesCompletionMarker() {
+		// A version undone by the rollback subcommand stays skipped until a newer version is pushed
+		rolledBack, err := schemastore.CheckRolledBackMarker(ctx, s.Client, s.S3Bucket, latestSchemaKey)
+		if err != nil {
+			recordS3FetchError()
+			return fmt.Errorf("failed to check rolled-back marker: %w", err)
+		}
+		if rolledBack {
+			s.logger().Info("Version has been rolled back, skipping", "version", latestVersion)
+			return nil
+		}
+
+		exists, err := schemastore.CheckCompletionMarker(ctx, s.Client, s.S3Bucket, latestSchemaKey, s.CompletedFile)
+		if err != nil {
+			// Do not treat an unknown marker state as "not completed", or we would re-apply
+			recordS3FetchError()
+			return fmt.Errorf("failed to check completion marker: %w", err)
+		}
+		s.state.sawLatest(latestVersion, &exists)
+		if exists {
+			s.lastAppliedVersion = latestVersion
+			s.lastAppliedModified = latestModified
+			s.appliedETag = s.markerETag(ctx, latestSchemaKey)
+			s.state.alreadyApplied(latestVersion)
+			reapply, err = s.checkContentChanged(ctx, latestSchemaKey, latestVersion)
+			if err != nil {
+				return err
+			}
+			if !reapply {
+				s.logger().Info("Completion marker already exists for version, skipping", "version", latestVersion)
+				return nil
+			}
+		}
+	}
+	// The latest version can be older than a completed one when a version directory was deleted from S3;
+	// a fresh process has no last applied version to stop it, so the completion markers do
+	if s.PinnedVersion == "" && !s.Force && !s.AllowDowngrade && !reapply && s.CompletedFile != "" {
+		if err := s.checkNotDowngrade(ctx, latestVersion, "--allow-downgrade", baseHookEnv); err != nil {
+			return err
+		}
+	}
+
+	if reapply {
+		s.logger().Warn("Re-applying version after its schema content changed", "version", latestVersion)
+		s.replaceMarker = true
+		defer func() { s.replaceMarker = false }()
+	} else if s.ApplySequentially && s.PinnedVersion == "" {
+		if caughtUp, err := s.applyIntermediateVersions(ctx, latestVersion, baseHookEnv, observeFetch); err != nil || !caughtUp {
+			return err
+		}
+	}
+
+	if s.applyDeferred(latestVersion, 1) {
+		return nil
+	}
+	if err := s.applyVersion(ctx, latestSchemaKey, latestVersion, baseHookEnv, observeFetch); err != nil {
+		return err
+	}
+	if s.lastAppliedVersion == latestVersion {
+		s.lastAppliedModified = latestModified
+	}
+	return nil
+}
+
+// applyDeferred reports whether applying version now would come sooner than MinApplyInterval after the last
+// apply, and logs the deferral. held is the number of versions waiting with it. A deferred version gets no
+// completion marker and is not recorded as applied, so a sync after the interval applies it.
+func (s *Syncer) applyDeferred(version string, held int) bool {
+	if s.MinApplyInterval <= 0 || s.lastApplyAt.IsZero() {
+		recordVersionsRateLimited(s.Target, 0)
+		return false
+	}
+	wait := s.MinApplyInterval - time.Since(s.lastApplyAt)
+	if wait <= 0 {
+		recordVersionsRateLimited(s.Target, 0)
+		return false
+	}
+	recordVersionsRateLimited(s.Target, held)
+	s.logger().Info("Deferring apply until --min-apply-interval has passed since the last apply", "version", version, "pending", held, "last_apply", s.lastApplyAt.UTC().Format(time.RFC3339), "wait", wait.Round(time.Second))
+	return true
+}
+
+// checkPaused reports whether the PauseFile object exists under the path prefix. While it does, every sync
+// logs its content as the reason and skips the apply; on-paused runs when a sync first finds it.
+func (s *Syncer) checkPaused(ctx context.Context, baseHookEnv *HookEnv) (bool, error) {
+	if s.PauseFile == "" {
+		return false, nil
+	}
+	key := s.PathPrefix + s.PauseFile
+	body, err := schemastore.DownloadSchema(ctx, s.Client, s.S3Bucket, key)
+	if schemastore.IsNotFoundError(err) {
+		if s.paused {
+			s.paused = false
+			recordPaused(s.Target, false)
+			s.logger().Info("Pause object removed, resuming applies", "key", key)
+		}
+		return false, nil
+	}
+	if err != nil {
+		// Do not apply while the pause state is unknown
+		recordS3FetchError()
+		return false, fmt.Errorf("failed to check pause object %s: %w", key, err)
+	}
+
+	reason := strings.TrimSpace(string(body))
+	s.logger().Warn("Applies are paused, skipping", "key", key, "reason", reason)
+	if !s.paused {
+		s.paused = true
+		recordPaused(s.Target, true)
+		hookEnv := *baseHookEnv
+		hookEnv.PauseReason = reason
+		hookEnv.finish(0)
+		s.HookRunner.run(ctx, "on-paused", s.Hooks.OnPaused, &hookEnv)
+	}
+	return true, nil
+}
+
+// applyVersion downloads, checks and applies the schema of version. fetched is called once the download
+// is done, to time the S3 fetch.
+func (s *Syncer) applyVersion(ctx context.Context, schemaKey, version string, baseHookEnv *HookEnv, fetched func()) error {
+	if failed, err := s.checkFailed(ctx, schemaKey, version); err != nil || failed {
+		return err
+	}
+	if approved, err := s.checkApproved(ctx, schemaKey, version); err != nil || !approved {
+		return err
+	}
+	downloadCtx, downloadSpan := startSpan(ctx, "download", bucketAttr(s.S3Bucket), keyAttr(schemaKey), versionAttr(version))
+	var schema *downloadedSchema
+	err := s.retryFetch(downloadCtx, fetchOperationDownload, func(ctx context.Context) error {
+		var err error
+		schema, err = s.downloadSchema(ctx, schemaKey)
+		return err
+	})
+	downloadSpan.end(err)
+	fetched()
+	if err != nil {
+		hookEnv := *baseHookEnv
+		hookEnv.Version = version
+		s.fetchFailed(ctx, hookEnv, err)
+		return fmt.Errorf("failed to download schema: %w", err)
+	}
+	if err := s.verifyChecksum(ctx, schemaKey, version, schema.digest, baseHookEnv); err != nil {
+		return err
+	}
+	if err := s.loadPsqldefConfig(ctx, version); err != nil {
+		recordS3FetchError()
+		return err
+	}
+
+	_, cleanup, err := s.useWorkDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := s.applySchema(ctx, schemaKey, version, schema.etag, schema.path, baseHookEnv); err != nil {
+		return err
+	}
+	// The version is not downloaded again once applied
+	if s.lastAppliedVersion == version {
+		s.Close()
+	}
+	return nil
+}
+
+// applyIntermediateVersions applies, oldest first, the versions after the last applied one and before latest
+// (--apply-sequentially), each with its own completion marker, hooks and metrics. It stops at the first version
+// that fails, or that is not applied because another process holds the lock, and then reports false so the
+// sync ends there; the next sync continues from the last version applied.
+func (s *Syncer) applyIntermediateVersions(ctx context.Context, latest string, baseHookEnv *HookEnv, fetched func()) (bool, error) {
+	objects, err := schemastore.ListAllObjects(ctx, s.Client, s.S3Bucket, s.PathPrefix)
+	if err != nil {
+		recordS3FetchError()
+		return false, fmt.Errorf("failed to list objects: %w", err)
+	}
+	versions := schemastore.CollectVersions(objects, s.PathPrefix, s.SchemaFile, s.CompletedFile, s.Versioning)
+	pending := planSequentialVersions(versions, s.lastAppliedVersion, latest, s.Versioning)
+	if len(pending) == 0 {
+		return true, nil
+	}
+	s.logger().Info("Applying intermediate versions in order", "versions", pending, "version", latest)
+	for i, ver := range pending {
+		// The versions after ver and latest wait with it
+		if s.applyDeferred(ver, len(pending)-i+1) {
+			return false, nil
+		}
+		if err := s.applyVersion(ctx, schemastore.SchemaKey(s.PathPrefix, ver, s.SchemaFile), ver, baseHookEnv, fetched); err != nil {
+			return false, fmt.Errorf("failed to apply intermediate version %s: %w", ver, err)
+		}
+		if s.lastAppliedVersion != ver {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// planSequentialVersions returns, oldest first, the versions with a schema that come after both lastApplied and
+// the newest completed version, and before latest under versioning. Completed and rolled-back versions are never included.
+func planSequentialVersions(versions []schemastore.VersionInfo, lastApplied, latest string, versioning schemastore.Versioning) []string {
+	base := lastApplied
+	for _, v := range versions {
+		if v.Completed && !v.RolledBack && (base == "" || versioning.CompareVersions(v.Version, base) > 0) {
+			base = v.Version
+		}
+	}
+	var pending []string
+	for _, v := range versions {
+		if !v.Schema || v.Completed || v.RolledBack {
+			continue
+		}
+		if base != "" && versioning.CompareVersions(v.Version, base) <= 0 {
+			continue
+		}
+		if versioning.CompareVersions(v.Version, latest) >= 0 {
+			continue
+		}
+		pending = append(pending, v.Version)
+	}
+	return pending
+}
+
+// downloadedSchema is a schema streamed from S3 to a temporary file
+type downloadedSchema struct {
+	key  string
+	path string
+	etag string
+	// digest is the sha256 of the (decompressed) schema, computed while downloading it
+	digest []byte
+}
+
+// downloadProgressStep is how many bytes a schema download writes between progress logs
+const downloadProgressStep = 64 << 20
+
+// downloadProgress logs the progress of a schema download every downloadProgressStep bytes
+type downloadProgress struct {
+	key     string
+	written int64
+}
+
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	before := p.written
+	p.written += int64(len(b))
+	if p.written/downloadProgressStep > before/downloadProgressStep {
+		slog.Info("Downloading schema", "key", p.key, "bytes", p.written)
+	}
+	return len(b), nil
+}
+
+// downloadSchema streams the schema at schemaKey to a temporary file. When the previous download was of
+// the same key, the download is conditional on its ETag and the cached file is reused if it has not changed.
+func (s *Syncer) downloadSchema(ctx context.Context, schemaKey string) (*downloadedSchema, error) {
+	var ifNoneMatch string
+	if s.cachedSchema != nil && s.cachedSchema.key == schemaKey {
+		ifNoneMatch = s.cachedSchema.etag
+	}
+
+	// The download outlives the sync for reuse, so it is created in WorkDir itself; CreateTemp makes it 0600
+	tmpFile, err := os.CreateTemp(s.WorkDir, "schema-*.sql")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	progress := &downloadProgress{key: schemaKey}
+	etag, err := schemastore.DownloadSchemaTo(ctx, s.Client, s.S3Bucket, schemaKey, ifNoneMatch, io.MultiWriter(tmpFile, hash, progress))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		if errors.Is(err, schemastore.ErrNotModified) {
+			recordS3DownloadSkipped()
+			s.logger().Info("Schema unchanged since the last download, reusing it", "key", schemaKey, "etag", ifNoneMatch)
+			return s.cachedSchema, nil
+		}
+		return nil, err
+	}
+	if progress.written >= downloadProgressStep {
+		s.logger().Info("Downloaded schema", "key", schemaKey, "bytes", progress.written)
+	}
+
+	s.Close()
+	s.cachedSchema = &downloadedSchema{key: schemaKey, path: tmpFile.Name(), etag: etag, digest: hash.Sum(nil)}
+	return s.cachedSchema, nil
+}
+
+// fetchFailed counts a failed S3 fetch and runs on-s3-fetch-error when the count reaches MaxConsecutiveFailures.
+// The hook fires once per threshold crossing rather than on every failure after it, unless the threshold is 0.
+func (s *Syncer) fetchFailed(ctx context.Context, hookEnv HookEnv, err error) {
+	s.consecutiveFailureCount++
+	recordS3FetchError()
+	recordConsecutiveFailures(s.consecutiveFailureCount)
+	s.state.fetchFailed(s.consecutiveFailureCount)
+	if s.MaxConsecutiveFailures > 0 && s.consecutiveFailureCount != s.MaxConsecutiveFailures {
+		return
+	}
+	hookEnv.Error = err.Error()
+	hookEnv.FailureCount = strconv.Itoa(s.consecutiveFailureCount)
+	hookEnv.FailureThreshold = strconv.Itoa(s.MaxConsecutiveFailures)
+	s.HookRunner.run(ctx, "on-s3-fetch-error", s.Hooks.OnS3FetchError, &hookEnv)
+}
+
+// useWorkDir creates the private directory for the temporary files of one sync under WorkDir and points
+// the Applier at it. Deferring cleanup removes the directory even when the sync panics.
+func (s *Syncer) useWorkDir() (string, func(), error) {
+	dir, cleanup, err := newWorkDir(s.WorkDir)
+	if err != nil {
+		return "", nil, err
+	}
+	s.Applier.SetWorkDir(dir)
+	return dir, func() {
+		s.Applier.SetWorkDir("")
+		cleanup()
+	}, nil
+}
+
+// Close removes the temporary file of the last downloaded schema
+func (s *Syncer) Close() {
+	if s.cachedSchema != nil {
+		_ = os.Remove(s.cachedSchema.path)
+		s.cachedSchema = nil
+	}
+}
+
+// markerETag returns the schema ETag recorded in the completion marker of schemaKey, or empty when
+// the marker cannot be read or was written without one
+func (s *Syncer) markerETag(ctx context.Context, schemaKey string) string {
+	meta, err := schemastore.ReadCompletionMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.CompletedFile)
+	if err != nil {
+		s.logger().Warn("Could not read completion marker, not checking the schema for content changes", "error", err)
+		return ""
+	}
+	if meta == nil {
+		return ""
+	}
+	return meta.SchemaETag
+}
+
+// checkContentChanged compares the ETag of the schema of version, the last applied one, with the ETag it was
+// applied with. A change means the file was overwritten in place; it is warned about and counted once per new
+// ETag. It reports whether to re-apply, which needs ReapplyOnContentChange.
+func (s *Syncer) checkContentChanged(ctx context.Context, schemaKey, version string) (bool, error) {
+	if s.appliedETag == "" || version != s.lastAppliedVersion {
+		return false, nil
+	}
+	etag, err := schemastore.SchemaETag(ctx, s.Client, s.S3Bucket, schemaKey)
+	if err != nil {
+		recordS3FetchError()
+		return false, fmt.Errorf("failed to check schema content: %w", err)
+	}
+	if etag == "" || etag == s.appliedETag {
+		return false, nil
+	}
+	if etag != s.changedETag {
+		s.changedETag = etag
+		recordContentChanged(s.Target)
+		s.logger().Warn("Schema content changed after the version was applied; push a new version instead of overwriting one",
+			"version", version, "key", schemaKey, "applied_etag", s.appliedETag, "etag", etag, "reapply", s.ReapplyOnContentChange)
+	}
+	return s.ReapplyOnContentChange, nil
+}
+
+// verifyChecksum checks schema against its sha256 sidecar. A mismatch, or a missing sidecar with
+// RequireChecksum, fires on-apply-failed and refuses the apply.
+func (s *Syncer) verifyChecksum(ctx context.Context, schemaKey, version string, digest []byte, baseHookEnv *HookEnv) error {
+	found, err := schemastore.VerifyDigest(ctx, s.Client, s.S3Bucket, schemaKey, digest)
+	reason := failureChecksumMismatch
+	switch {
+	case err != nil && !errors.Is(err, schemastore.ErrChecksumMismatch):
+		recordS3FetchError()
+		return err
+	case err == nil && !found && s.RequireChecksum:
+		err = fmt.Errorf("%s has no checksum sidecar %s (--require-checksum)", schemaKey, schemastore.ChecksumKey(schemaKey))
+		reason = failureChecksumMissing
+	case err == nil:
+		if found {
+			s.logger().Info("Schema checksum verified", "version", version, "key", schemaKey)
+		}
+		return nil
+	}
+
+	recordChecksumError(s.Target)
+	s.logger().Error("Refusing to apply schema that failed the checksum check", "version", version, "error", err)
+	hookEnv := *baseHookEnv
+	hookEnv.Version = version
+	hookEnv.Error = err.Error()
+	hookEnv.FailureReason = reason
+	hookEnv.finish(0)
+	s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	return fmt.Errorf("refusing to apply: %w", err)
+}
+
+// applySchema takes the lock, then dry-runs, checks and applies schema as version and runs the hooks.
+// schemaKey locates the version in S3 for the exported schema, the applied DDL and the completion marker;
+// it is empty for apply --local-file, which skips those uploads. etag is the ETag of the downloaded schema
+// and schemaFile the file holding it.
+func (s *Syncer) applySchema(ctx context.Context, schemaKey, version, etag, schemaFile string, baseHookEnv *HookEnv) error {
+	// Acquire advisory lock if not skipped
+	var err error
+	var locker Locker
+	if !s.SkipLock {
+		lockCtx, lockSpan := startSpan(ctx, "lock", attribute.Int64("db_schema_sync.lock_id", s.LockID))
+		locker, err = s.NewLocker(lockCtx, s.LockID)
+		if err != nil {
+			recordLockAttempt(false, err)
+			lockSpan.end(err)
+			return fmt.Errorf("failed to create locker: %w", err)
+		}
+		defer func() { _ = locker.Close() }()
+		if advisoryLocker, ok := locker.(*AdvisoryLocker); ok {
+			advisoryLocker.SetKeepalive(s.LockKeepalive)
+		}
+
+		lockWaitStart := time.Now()
+		acquired, err := locker.TryLockWithWait(lockCtx, s.LockWait)
+		waited := time.Since(lockWaitStart)
+		recordLockWait(waited)
+		recordLockAttempt(acquired, err)
+		lockSpan.set(attribute.Bool("db_schema_sync.lock_acquired", acquired))
+		lockSpan.end(err)
+		if err != nil {
+			return fmt.Errorf("failed to acquire lock: %w", err)
+		}
+		s.state.lockAttempted(!acquired)
+		if !acquired {
+			recordLockSkipped()
+			if s.LockWait > 0 {
+				s.logger().Info("Timed out waiting for lock held by another process, skipping", "version", version, "lock_id", s.LockID, "lock_wait", s.LockWait)
+			} else {
+				s.logger().Info("Another process is applying schema, skipping", "version", version, "lock_id", s.LockID)
+			}
+			return nil
+		}
+		s.logger().Info("Acquired advisory lock", "version", version, "lock_id", s.LockID, "waited", waited)
+		lockedAt := time.Now()
+		defer func() {
+			// Release the lock even when the sync was cut off by --sync-timeout
+			unlockCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), unlockTimeout)
+			defer cancel()
+			if unlockErr := locker.Unlock(unlockCtx); unlockErr != nil {
+				s.logger().Warn("Failed to release lock", "version", version, "error", unlockErr)
+			}
+			recordLockHold(time.Since(lockedAt))
+		}()
+	}
+
+	// Run dry-run to get DDL that will be applied
+	dryRunStart := time.Now()
+	dryRunOutput, err := s.dryRun(ctx, schemaFile)
+	recordDryRunDuration(time.Since(dryRunStart))
+	if err != nil {
+		// A dry-run that timed out is likely waiting on a table lock, which the apply would hit too.
+		// Without a plan, the DenyDDL guard cannot check what the apply would run.
+		unchecked := !s.StrictDryRun && !errors.Is(err, context.DeadlineExceeded)
+		if !unchecked || len(s.DenyDDL) > 0 {
+			recordApplyError(s.Target)
+			s.logger().Error("Dry-run failed, aborting", "version", version, "error", err, "output", dryRunOutput)
+			hookEnv := *baseHookEnv
+			hookEnv.Version = version
+			hookEnv.Error = err.Error()
+			hookEnv.Stderr = dryRunOutput
+			hookEnv.FailureReason = failureReason(err, dryRunOutput)
+			hookEnv.finish(0)
+			s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+			if unchecked {
+				return fmt.Errorf("aborting apply, destructive DDL cannot be checked without a dry-run (use --allow-destructive to apply anyway): %w", err)
+			}
+			return fmt.Errorf("aborting apply: %w", err)
+		}
+		s.logger().Warn("Dry-run failed", "version", version, "error", err, "output", dryRunOutput)
+		// Continue with apply even if dry-run fails
+	} else {
+		// Run on-plan hook, also for an empty diff so every planned version can be reported
+		hookEnv := *baseHookEnv
+		hookEnv.Version = version
+		hookEnv.DryRun = dryRunOutput
+		hookEnv.PlanEmpty = strconv.FormatBool(isNoChange(dryRunOutput))
+		s.HookRunner.run(ctx, "on-plan", s.Hooks.OnPlan, &hookEnv)
+	}
+
+	// Refuse destructive DDL unless --allow-destructive is set
+	if blocked := findDeniedStatements(dryRunOutput, s.DenyDDL); len(blocked) > 0 {
+		recordApplyBlocked(s.Target)
+		s.logger().Error("Refusing to apply destructive DDL", "version", version, "statements", blocked)
+		hookEnv := *baseHookEnv
+		hookEnv.Version = version
+		hookEnv.Error = "destructive DDL blocked (use --allow-destructive to apply)"
+		hookEnv.DryRun = dryRunOutput
+		hookEnv.BlockedDDL = strings.Join(blocked, "\n")
+		hookEnv.finish(0)
+		s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+		return fmt.Errorf("refusing to apply %d destructive DDL statement(s) (use --allow-destructive to apply): %s", len(blocked), strings.Join(blocked, " "))
+	}
+
+	// Nothing to apply: mark the version completed without running the sqldef apply
+	if err == nil && !s.AlwaysApply && isNoChange(dryRunOutput) {
+		if err := s.checkLockHeld(ctx, locker, version, *baseHookEnv, dryRunOutput, 0); err != nil {
+			return err
+		}
+		// A version whose checks failed after its apply reaches this path on the next sync
+		if err := s.checkPostApply(ctx, locker, version, *baseHookEnv, dryRunOutput, "", 0); err != nil {
+			s.markFailed(ctx, schemaKey, version, err, "", failurePostApplyCheck)
+			return err
+		}
+		recordNoChange(s.Target)
+		s.lastAppliedVersion = version
+		s.appliedETag = etag
+		s.state.applied(version, time.Now())
+		s.createCompletionMarker(ctx, schemaKey, completionMetadata(version, etag, time.Now(), ""))
+		s.clearFailed(ctx, schemaKey, version)
+
+		hookEnv := *baseHookEnv
+		hookEnv.Version = version
+		hookEnv.DryRun = dryRunOutput
+		hookEnv.finish(0)
+		s.HookRunner.run(ctx, "on-no-change", s.Hooks.OnNoChange, &hookEnv)
+
+		s.logger().Info("Schema is already up to date, skipping apply", "version", version)
+		return nil
+	}
+
+	if err := s.backupBeforeApply(ctx, schemaKey, version, *baseHookEnv, dryRunOutput); err != nil {
+		return err
+	}
+
+	// Run on-before-apply hook
+	hookEnv := *baseHookEnv
+	hookEnv.Version = version
+	hookEnv.DryRun = dryRunOutput
+	s.HookRunner.run(ctx, "on-before-apply", s.Hooks.OnBeforeApply, &hookEnv)
+	s.applying = &hookEnv
+
+	s.logger().Info("Applying schema", "version", version, summarizeDDL(dryRunOutput).group("planned_ddl"))
+
+	// Record apply attempt
+	recordApplyAttempt(s.Target)
+
+	// Apply schema using the sqldef tool
+	applyStart := time.Now()
+	applyResult, err := s.apply(ctx, schemaFile)
+	applyDuration := time.Since(applyStart)
+	recordApplyDuration(applyDuration)
+	if err != nil {
+		s.reportingApply(ctx)
+		recordApplyError(s.Target)
+		hookEnv := *baseHookEnv
+		hookEnv.Version = version
+		hookEnv.Error = err.Error()
+		hookEnv.DryRun = dryRunOutput
+		if applyResult != nil {
+			hookEnv.Stdout = applyResult.Stdout
+			hookEnv.Stderr = applyResult.Stderr
+		}
+		hookEnv.FailureReason = failureReason(err, hookEnv.Stderr)
+		hookEnv.finish(applyDuration)
+		s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+		s.markFailed(ctx, schemaKey, version, err, hookEnv.Stderr, hookEnv.FailureReason)
+		return fmt.Errorf("failed to apply schema: %w", err)
+	}
+
+	// Without the lock another process may have applied concurrently, so the version is neither
+	// recorded as applied nor marked completed; the next sync applies it again under the lock
+	if err := s.checkLockHeld(ctx, locker, version, *baseHookEnv, dryRunOutput, applyDuration); err != nil {
+		return err
+	}
+	if err := s.checkPostApply(ctx, locker, version, *baseHookEnv, dryRunOutput, applyResult.Stdout, applyDuration); err != nil {
+		s.markFailed(ctx, schemaKey, version, err, "", failurePostApplyCheck)
+		return err
+	}
+
+	// Record successful apply. A timeout from here on does not fail the apply, which has already succeeded.
+	s.applying = nil
+	recordApplySuccess(s.Target, version)
+	summary := summarizeDDL(applyResult.Stdout)
+	recordDDLStatements(s.Target, summary)
+
+	// Record the applied version
+	s.lastAppliedVersion = version
+	s.appliedETag = etag
+	s.lastApplyAt = time.Now()
+	s.state.applied(version, s.lastApplyAt)
+
+	// Record the apply in the history table if enabled
+	if s.HistoryTable != "" {
+		hostname, _ := os.Hostname()
+		recordHistory(ctx, locker, s.DB, s.HistoryTable, HistoryRecord{
+			Version:    version,
+			AppliedAt:  applyStart,
+			Hostname:   hostname,
+			AppVersion: Version,
+			DurationMs: time.Since(applyStart).Milliseconds(),
+			DDL:        applyResult.Stdout,
+		})
+	}
+
+	// Export schema from DB and upload to S3 if enabled
+	if s.ExportAfterApply && schemaKey != "" {
+		exportedSchema, err := s.export(ctx)
+		if err != nil {
+			s.logger().Warn("Could not export schema from DB", "version", version, "error", err)
+		} else {
+			s.uploadExported(ctx, schemaKey, version, exportedSchema)
+		}
+	}
+
+	// Upload the executed DDL for post-incident review
+	if s.AppliedDDLFile != "" && schemaKey != "" && len(splitDDLStatements(applyResult.Stdout)) > 0 {
+		appliedKey := schemastore.AppliedDDLKey(schemaKey, s.AppliedDDLFile)
+		if err := schemastore.UploadSchema(ctx, s.Client, s.S3Bucket, appliedKey, []byte(applyResult.Stdout)); err != nil {
+			s.logger().Warn("Could not upload applied DDL to S3", "version", version, "error", err)
+		} else {
+			s.logger().Info("Applied DDL uploaded to S3", "version", version, "key", appliedKey)
+		}
+	}
+
+	// Create completion marker in S3
+	s.createCompletionMarker(ctx, schemaKey, completionMetadata(version, etag, applyStart, applyResult.Stdout))
+	s.clearFailed(ctx, schemaKey, version)
+
+	// Run on-apply-succeeded hook
+	successHookEnv := *baseHookEnv
+	successHookEnv.Version = version
+	successHookEnv.DryRun = dryRunOutput
+	successHookEnv.Stdout = applyResult.Stdout
+	successHookEnv.Stderr = applyResult.Stderr
+	successHookEnv.DDLSummary = summary.String()
+	successHookEnv.finish(applyDuration)
+	s.HookRunner.run(ctx, "on-apply-succeeded", s.Hooks.OnApplySucceeded, &successHookEnv)
+
+	s.logger().Info("Successfully applied schema", "version", version, summary.group("ddl"))
+	return nil
+}
+
+// checkLockHeld fails the sync when locker, acquired before the dry-run, has lost its lock since.
+// It runs on-apply-failed with DB_SCHEMA_SYNC_FAILURE_REASON=lock-lost. A nil locker (--skip-lock) is not checked.
+func (s *Syncer) checkLockHeld(ctx context.Context, locker Locker, version string, hookEnv HookEnv, dryRunOutput string, applyDuration time.Duration) error {
+	if locker == nil {
+		return nil
+	}
+	err := locker.HeldCheck(ctx)
+	if err == nil {
+		return nil
+	}
+	s.reportingApply(ctx)
+	recordApplyError(s.Target)
+	s.logger().Error("Lost the advisory lock during the apply; not marking the version completed", "version", version, "lock_id", s.LockID, "error", err)
+	hookEnv.Version = version
+	hookEnv.Error = err.Error()
+	hookEnv.DryRun = dryRunOutput
+	hookEnv.FailureReason = failureLockLost
+	hookEnv.finish(applyDuration)
+	s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	return fmt.Errorf("lost the advisory lock while applying version %s: %w", version, err)
+}
+
+// ApplyLocal applies schema read from a local file instead of S3 (apply --local-file).
+// It takes the lock, dry-runs, applies and runs the hooks like Run, but never touches S3:
+// the exported schema, applied DDL and completion marker are not uploaded.
+func (s *Syncer) ApplyLocal(ctx context.Context, path, version string, schema []byte) error {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	s.logger().Info("Applying local schema", "file", path, "version", version)
+	if err := s.loadPsqldefConfig(ctx, version); err != nil {
+		return err
+	}
+	// The schema may have been read from stdin, so the tool gets a copy
+	workDir, cleanup, err := s.useWorkDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	schemaFile, _, err := writeTempFile(workDir, "schema-*.sql", schema)
+	if err != nil {
+		return err
+	}
+	return s.applySchema(ctx, "", version, "", schemaFile, s.startHookEnv(&HookEnv{SchemaFile: path}))
+}
+
+// startHookEnv counts a new sync and adds the fields shared by all of its hooks to hookEnv
+func (s *Syncer) startHookEnv(hookEnv *HookEnv) *HookEnv {
+	s.syncAttempts++
+	s.identifyHookEnv(hookEnv)
+	hookEnv.SyncAttempt = strconv.FormatInt(s.syncAttempts, 10)
+	hookEnv.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	return hookEnv
+}
+
+// identifyHookEnv adds the target, database and host to hookEnv
+func (s *Syncer) identifyHookEnv(hookEnv *HookEnv) {
+	hookEnv.AppVersion = Version
+	hookEnv.Target = s.Target
+	hookEnv.DBHost = s.DB.Host
+	hookEnv.DBPort = s.DB.Port
+	hookEnv.DBName = s.DB.displayName()
+	hookEnv.Hostname, _ = os.Hostname()
+}
+
+// localSchemaVersion is the version recorded for a local schema without --version: its sha256 in hex
+func localSchemaVersion(schema []byte) string {
+	sum := sha256.Sum256(schema)
+	return hex.EncodeToString(sum[:])
+}
+
+// createCompletionMarker creates the completion marker for schemaKey if --completed-file is set
+// and the schema came from S3. Failures are logged rather than returned because the schema has already been applied.
+func (s *Syncer) createCompletionMarker(ctx context.Context, schemaKey string, meta *schemastore.CompletionMetadata) {
+	// The marker --only-completed requires belongs to the environment that completed the version first
+	if s.CompletedFile == "" || schemaKey == "" || s.sharesCompletionMarker() {
+		return
+	}
+	ctx, sp := startSpan(ctx, "marker", bucketAttr(s.S3Bucket), keyAttr(schemastore.CompletionMarkerKey(schemaKey, s.CompletedFile)), versionAttr(meta.Version))
+	// A forced re-apply, or one after a content change, replaces the existing marker
+	err := schemastore.CreateCompletionMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.CompletedFile, meta, !s.DisableConditionalWrites && !s.Force && !s.replaceMarker)
+	if errors.Is(err, schemastore.ErrConditionalWriteUnsupported) {
+		s.logger().Warn("S3 store does not support conditional writes, creating completion markers unconditionally", "error", err)
+		s.DisableConditionalWrites = true
+		err = schemastore.CreateCompletionMarker(ctx, s.Client, s.S3Bucket, schemaKey, s.CompletedFile, meta, false)
+	}
+	sp.end(err)
+	switch {
+	case errors.Is(err, schemastore.ErrMarkerExists):
+		// Both instances applied; keep the first marker so it describes the earlier apply
+		s.logger().Warn("Another instance completed this version first, keeping its completion marker", "version", meta.Version)
+	case err != nil:
+		s.logger().Warn("Could not create completion marker", "version", meta.Version, "error", err)
+		return
+	}
+	markerExists := true
+	s.state.sawLatest(meta.Version, &markerExists)
+}
+
+// sharesCompletionMarker reports whether this Syncer's completion marker is the one --only-completed requires,
+// rather than a marker of its own such as the completed.<name> of a --db target
+func (s *Syncer) sharesCompletionMarker() bool {
+	return s.OnlyCompletedFile != "" && s.CompletedFile == s.OnlyCompletedFile
+}
+
+// completionMetadata describes an apply of the schema with etag as version that started at appliedAt and executed ddl
+func completionMetadata(version, etag string, appliedAt time.Time, ddl string) *schemastore.CompletionMetadata {
+	hostname, _ := os.Hostname()
+	return &schemastore.CompletionMetadata{
+		Version:           version,
+		AppliedAt:         appliedAt.UTC(),
+		Hostname:          hostname,
+		AppVersion:        Version,
+		DurationMs:        time.Since(appliedAt).Milliseconds(),
+		DDLStatementCount: len(splitDDLStatements(ddl)),
+		SchemaETag:        etag,
+	}
+}
+
+// uploadExported uploads the exported schema as exported.sql, and as a timestamped copy with ExportedHistory.
+// A failed upload is only logged, since the schema has already been applied.
+func (s *Syncer) uploadExported(ctx context.Context, schemaKey, version string, schema []byte) {
+	meta := schemastore.ExportMetadata{AppVersion: Version, SourceDatabase: s.DB.identity(), ExportedAt: time.Now().UTC()}
+	keys := []string{schemastore.ExportedSchemaKey(schemaKey)}
+	if s.ExportedHistory {
+		keys = append(keys, schemastore.ExportedHistoryKey(schemaKey, meta.ExportedAt))
+	}
+	for _, key := range keys {
+		if err := schemastore.UploadExportedSchema(ctx, s.Client, s.S3Bucket, key, schema, s.CompressExported, meta); err != nil {
+			s.logger().Warn("Could not upload exported schema to S3", "version", version, "key", key, "error", err)
+		} else {
+			s.logger().Info("Exported schema uploaded to S3", "version", version, "key", key)
+		}
+	}
+}
+
+// backupBeforeApply exports the current schema of the database and uploads it as PreApplyBackupFile into the
+// version directory, so the state before the apply can be restored; rollback prefers it. It is skipped for
+// apply --local-file. A failed backup fails the sync with RequireBackup and is only logged otherwise.
+func (s *Syncer) backupBeforeApply(ctx context.Context, schemaKey, version string, hookEnv HookEnv, dryRunOutput string) error {
+	if s.PreApplyBackupFile == "" || schemaKey == "" {
+		return nil
+	}
+	key := schemastore.PreApplyBackupKey(schemaKey, s.PreApplyBackupFile)
+	schema, err := s.export(ctx)
+	if err != nil {
+		err = fmt.Errorf("failed to export schema: %w", err)
+	} else if err = schemastore.UploadSchema(ctx, s.Client, s.S3Bucket, key, schema); err != nil {
+		err = fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	if err == nil {
+		s.logger().Info("Pre-apply backup uploaded to S3", "version", version, "key", key)
+		return nil
+	}
+	if !s.RequireBackup {
+		s.logger().Warn("Could not back up the schema before applying", "version", version, "error", err)
+		return nil
+	}
+
+	recordApplyError(s.Target)
+	s.logger().Error("Could not back up the schema before applying, aborting (--require-backup)", "version", version, "error", err)
+	hookEnv.Version = version
+	hookEnv.Error = err.Error()
+	hookEnv.DryRun = dryRunOutput
+	hookEnv.FailureReason = failureBackupFailed
+	hookEnv.finish(0)
+	s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	return fmt.Errorf("failed to back up the schema before applying version %s: %w", version, err)
+}
+
+// findSchema returns the key and version of the schema to apply: PinnedVersion if set,
+// otherwise the latest version, limited to versions with an OnlyCompletedFile marker or capped at MaxVersion
+// if set. With --version-order last-modified the latest version is the most recently uploaded schema,
+// and its LastModified is returned too.
+func (s *Syncer) findSchema(ctx context.Context) (string, string, time.Time, error) {
+	switch {
+	case s.PinnedVersion != "":
+		key, err := schemastore.FindSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.PinnedVersion, s.Versioning)
+		return key, s.PinnedVersion, time.Time{}, err
+	case s.OnlyCompletedFile != "" && s.VersionOrder == versionOrderLastModified:
+		return schemastore.FindNewestCompletedSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.OnlyCompletedFile, s.Versioning)
+	case s.OnlyCompletedFile != "":
+		key, ver, err := schemastore.FindLatestCompletedSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.OnlyCompletedFile, s.Versioning)
+		return key, ver, time.Time{}, err
+	case s.VersionOrder == versionOrderLastModified:
+		return schemastore.FindNewestSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.Versioning)
+	case s.MaxVersion != "":
+		key, ver, err := s.findSchemaUpToMax(ctx)
+		return key, ver, time.Time{}, err
+	default:
+		key, ver, err := schemastore.FindLatestSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.Versioning)
+		return key, ver, time.Time{}, err
+	}
+}
+
+// findSchemaUpToMax returns the latest schema not newer than MaxVersion and reports the versions it holds back
+func (s *Syncer) findSchemaUpToMax(ctx context.Context) (string, string, error) {
+	objects, err := schemastore.ListAllObjects(ctx, s.Client, s.S3Bucket, s.PathPrefix)
+	if err != nil {
+		return "", "", err
+	}
+	key, ver, heldBack, err := schemastore.LatestSchemaUpTo(objects, s.PathPrefix, s.SchemaFile, s.MaxVersion, s.Versioning)
+	recordVersionsHeldBack(s.Target, heldBack)
+	if heldBack != s.heldBack {
+		if heldBack > 0 {
+			s.logger().Info("Holding back newer versions above --max-version", "max_version", s.MaxVersion, "held_back", heldBack)
+		} else {
+			s.logger().Info("No versions held back by --max-version", "max_version", s.MaxVersion)
+		}
+		s.heldBack = heldBack
+	}
+	return key, ver, err
+}
+
+// newerThanApplied reports whether the latest schema is newer than lastAppliedVersion: by the LastModified
+// of its schema file with --version-order last-modified, by version otherwise
+func (s *Syncer) newerThanApplied(version string, modified time.Time) bool {
+	if s.VersionOrder == versionOrderLastModified {
+		return version != s.lastAppliedVersion && modified.After(s.lastAppliedModified)
+	}
+	return s.Versioning.CompareVersions(version, s.lastAppliedVersion) > 0
+}
+
+// olderThanApplied reports whether the latest schema is older than lastAppliedVersion, the reverse of newerThanApplied
+func (s *Syncer) olderThanApplied(version string, modified time.Time) bool {
+	if s.VersionOrder == versionOrderLastModified {
+		return version != s.lastAppliedVersion && modified.Before(s.lastAppliedModified)
+	}
+	return s.Versioning.CompareVersions(version, s.lastAppliedVersion) < 0
+}
+
+// checkNotDowngrade refuses ver when a newer version is already completed. override names the flag that
+// allows the downgrade.
+func (s *Syncer) checkNotDowngrade(ctx context.Context, ver, override string, baseHookEnv *HookEnv) error {
+	newer, err := s.newerCompletedVersion(ctx, ver)
+	if err != nil || newer == "" {
+		return err
+	}
+	return s.downgradeBlocked(ctx, ver, newer, override, baseHookEnv)
+}
+
+// downgradeBlocked refuses to apply ver because newer is already applied: it logs the downgrade, counts it
+// and runs on-apply-failed
+func (s *Syncer) downgradeBlocked(ctx context.Context, ver, newer, override string, baseHookEnv *HookEnv) error {
+	recordDowngradeBlocked(s.Target)
+	s.logger().Error("Refusing to downgrade: a newer version is already applied", "version", ver, "applied", newer)
+	err := fmt.Errorf("downgrade blocked: refusing to apply version %s: newer version %s is already applied (use %s to downgrade)", ver, newer, override)
+	hookEnv := *baseHookEnv
+	hookEnv.Version = ver
+	hookEnv.Error = err.Error()
+	hookEnv.FailureReason = failureDowngradeBlocked
+	hookEnv.finish(0)
+	s.HookRunner.run(ctx, "on-apply-failed", s.Hooks.OnApplyFailed, &hookEnv)
+	return err
+}
+
+// newerCompletedVersion returns the newest completed version that is newer than ver, or empty if there is none.
+// A version undone by the rollback subcommand does not count.
+func (s *Syncer) newerCompletedVersion(ctx context.Context, ver string) (string, error) {
+	objects, err := schemastore.ListAllObjects(ctx, s.Client, s.S3Bucket, s.PathPrefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list objects: %w", err)
+	}
+	if s.VersionOrder == versionOrderLastModified {
+		return s.newerCompletedByModified(objects, ver)
+	}
+	// Versions are sorted oldest first; report the newest completed one
+	versions := schemastore.CollectVersions(objects, s.PathPrefix, s.SchemaFile, s.CompletedFile, s.Versioning)
+	for i := len(versions) - 1; i >= 0; i-- {
+		if v := versions[i]; v.Completed && !v.RolledBack && s.Versioning.CompareVersions(ver, v.Version) < 0 {
+			return v.Version, nil
+		}
+	}
+	return "", nil
+}
+
+// newerCompletedByModified is newerCompletedVersion for --version-order last-modified: it returns the newest
+// completed schema when it was uploaded after ver's
+func (s *Syncer) newerCompletedByModified(objects []types.Object, ver string) (string, error) {
+	_, newest, newestModified, err := schemastore.NewestSchema(objects, s.PathPrefix, s.SchemaFile, s.CompletedFile, s.Versioning)
+	if errors.Is(err, schemastore.ErrSchemaNotFound) || newest == ver {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	schemaKey := schemastore.SchemaKey(s.PathPrefix, ver, s.SchemaFile)
+	for _, obj := range objects {
+		if aws.ToString(obj.Key) == schemaKey && obj.LastModified != nil && obj.LastModified.Before(newestModified) {
+			return newest, nil
+		}
+	}
+	return "", nil
+}
+
+// dryRun runs Applier.DryRun, killing the tool after DryRunTimeout
+func (s *Syncer) dryRun(ctx context.Context, schemaFile string) (string, error) {
+	ctx, sp := startSpan(ctx, "dry-run")
+	ctx, cancel := withTimeout(ctx, s.DryRunTimeout)
+	defer cancel()
+	output, err := s.Applier.DryRun(ctx, schemaFile)
+	err = timeoutError(ctx, s.DryRunTimeout, err)
+	sp.endCommand(output, err)
+	return output, err
+}
+
+// apply runs Applier.Apply, killing the tool after ApplyTimeout
+func (s *Syncer) apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	ctx, sp := startSpan(ctx, "apply")
+	ctx, cancel := withTimeout(ctx, s.ApplyTimeout)
+	defer cancel()
+	result, err := s.Applier.Apply(ctx, schemaFile)
+	err = timeoutError(ctx, s.ApplyTimeout, err)
+	var stdout string
+	if result != nil {
+		stdout = result.Stdout
+	}
+	sp.endCommand(stdout, err)
+	return result, err
+}
+
+// export runs Applier.Export, killing the tool after DryRunTimeout
+func (s *Syncer) export(ctx context.Context) ([]byte, error) {
+	ctx, sp := startSpan(ctx, "export")
+	ctx, cancel := withTimeout(ctx, s.DryRunTimeout)
+	defer cancel()
+	schema, err := s.Applier.Export(ctx)
+	err = timeoutError(ctx, s.DryRunTimeout, err)
+	sp.end(err)
+	return schema, err
+}
+
+// diff runs Applier.Diff, killing the tool after DryRunTimeout
+func (s *Syncer) diff(ctx context.Context, current, desired []byte) (string, error) {
+	ctx, cancel := withTimeout(ctx, s.DryRunTimeout)
+	defer cancel()
+	output, err := s.Applier.Diff(ctx, current, desired)
+	return output, timeoutError(ctx, s.DryRunTimeout, err)
+}
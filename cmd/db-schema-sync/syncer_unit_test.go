@@ -0,0 +1,2431 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+func TestNewSyncer(t *testing.T) {
+	cli := &CLI{S3Bucket: "my-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: "/usr/local/bin/psqldef"}
+	syncer := NewSyncer(&mockS3Client{}, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+
+	if syncer.S3Bucket != "my-bucket" || syncer.PathPrefix != "schemas/" || syncer.SchemaFile != "schema.sql" || syncer.CompletedFile != "completed" {
+		t.Errorf("S3 settings not copied from CLI: %+v", syncer)
+	}
+	if applier, ok := syncer.Applier.(*sqldefApplier); !ok || applier.path != "/usr/local/bin/psqldef" {
+		t.Errorf("expected psqldef applier, got %+v", syncer.Applier)
+	}
+	if syncer.LockID != AdvisoryLockID {
+		t.Errorf("expected default lock ID %d, got %d", AdvisoryLockID, syncer.LockID)
+	}
+	if syncer.State() == nil {
+		t.Error("expected state to be initialized")
+	}
+}
+
+func TestSyncerFiresS3FetchErrorHookOncePerThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		// outcomes of consecutive syncs; false is an S3 failure
+		outcomes []bool
+		want     []string
+	}{
+		{
+			name:      "fires once when the threshold is reached",
+			threshold: 3,
+			outcomes:  []bool{false, false, false, false, false, false},
+			want:      []string{"3/3"},
+		},
+		{
+			name:      "success resets the count",
+			threshold: 2,
+			outcomes:  []bool{false, true, false, false, false, true, false, false},
+			want:      []string{"2/2", "2/2"},
+		},
+		{
+			name:      "zero fires on every failure",
+			threshold: 0,
+			outcomes:  []bool{false, false, true, false},
+			want:      []string{"1/0", "2/0", "1/0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			var fail bool
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					if fail {
+						return nil, fmt.Errorf("simulated S3 error")
+					}
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql"}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			syncer.MaxConsecutiveFailures = tt.threshold
+			// v1 is already applied, so a successful poll stops after listing
+			syncer.lastAppliedVersion = "v1"
+			syncer.Hooks.OnS3FetchError = `echo "$DB_SCHEMA_SYNC_FAILURE_COUNT/$DB_SCHEMA_SYNC_FAILURE_THRESHOLD" >> ` + hookLog
+
+			for _, ok := range tt.outcomes {
+				fail = !ok
+				_ = syncer.Run(context.Background())
+				if ok && syncer.ConsecutiveFailures() != 0 {
+					t.Errorf("ConsecutiveFailures() = %d after a successful fetch, want 0", syncer.ConsecutiveFailures())
+				}
+			}
+
+			content, _ := os.ReadFile(hookLog)
+			if got := strings.Fields(string(content)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hook fired with count/threshold %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncerUpdatesSyncState(t *testing.T) {
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if *params.Key == "schemas/v1/completed" {
+				return &s3.HeadObjectOutput{}, nil
+			}
+			return nil, &types.NotFound{}
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if syncer.LastAppliedVersion() != "v1" {
+		t.Errorf("expected last applied version v1, got %s", syncer.LastAppliedVersion())
+	}
+
+	st := syncer.State().get()
+	if st.LatestVersion != "v1" || st.LastAppliedVersion != "v1" {
+		t.Errorf("unexpected versions: latest=%s applied=%s", st.LatestVersion, st.LastAppliedVersion)
+	}
+	if st.CompletionMarkerExists == nil || !*st.CompletionMarkerExists {
+		t.Errorf("expected completion marker to be recorded as existing")
+	}
+	if st.LastSyncTime.IsZero() {
+		t.Error("expected last sync time to be set")
+	}
+	if !st.LastApplyTime.IsZero() {
+		t.Error("expected no apply time when the marker already existed")
+	}
+}
+
+func TestSyncerAppliesSQLiteSchema(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "app.db")
+	argsLog := filepath.Join(dir, "args.log")
+	stub := writeStubPsqldef(t, `echo "$@" >> `+argsLog)
+
+	var putKeys []string
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return nil, &types.NotFound{}
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if strings.HasSuffix(*params.Key, ".sha256") {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INTEGER);"))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			putKeys = append(putKeys, *params.Key)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", Engine: EngineSQLite3, Sqlite3defPath: stub}
+
+	syncer := NewSyncer(client, cli, DBConfig{File: dbFile})
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	content, err := os.ReadFile(argsLog)
+	if err != nil {
+		t.Fatalf("failed to read stub log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], dbFile+" --dry-run --file ") || !strings.HasPrefix(lines[1], dbFile+" --file ") {
+		t.Errorf("unexpected sqlite3def invocations: %q", lines)
+	}
+	if _, err := os.Stat(dbFile + ".lock"); err != nil {
+		t.Errorf("expected lock file next to the database: %v", err)
+	}
+	if len(putKeys) != 1 || putKeys[0] != "schemas/v1/completed" {
+		t.Errorf("expected completion marker upload, got %v", putKeys)
+	}
+}
+
+func TestSyncerBlocksDestructiveDDL(t *testing.T) {
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'DROP TABLE "public"."sessions";' ;;
+*) echo applied >> `+filepath.Join(dir, "apply.log")+` ;;
+esac`)
+
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if strings.HasSuffix(*params.Key, ".sha256") {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT);"))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub}
+
+	t.Run("blocked by default patterns", func(t *testing.T) {
+		deny, err := compileDenyDDL(nil)
+		if err != nil {
+			t.Fatalf("compileDenyDDL() error = %v", err)
+		}
+		syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.SkipLock = true
+		defer syncer.Close()
+		syncer.DenyDDL = deny
+		syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_BLOCKED_DDL" >> ` + hookLog
+
+		err = syncer.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "destructive DDL") {
+			t.Fatalf("Run() error = %v, want destructive DDL error", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "apply.log")); !os.IsNotExist(err) {
+			t.Error("expected apply not to run")
+		}
+		content, err := os.ReadFile(hookLog)
+		if err != nil {
+			t.Fatalf("failed to read hook log: %v", err)
+		}
+		if strings.TrimSpace(string(content)) != `DROP TABLE "public"."sessions";` {
+			t.Errorf("unexpected DB_SCHEMA_SYNC_BLOCKED_DDL: %q", content)
+		}
+		if syncer.LastAppliedVersion() != "" {
+			t.Errorf("expected no applied version, got %s", syncer.LastAppliedVersion())
+		}
+	})
+
+	t.Run("blocked when the dry-run fails", func(t *testing.T) {
+		failLog := filepath.Join(dir, "fail.log")
+		failing := *cli
+		failing.PsqldefPath = writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'connection reset' >&2; exit 1 ;;
+*) echo applied >> `+filepath.Join(dir, "apply.log")+` ;;
+esac`)
+		deny, err := compileDenyDDL(nil)
+		if err != nil {
+			t.Fatalf("compileDenyDDL() error = %v", err)
+		}
+		syncer := NewSyncer(client, &failing, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.SkipLock = true
+		defer syncer.Close()
+		syncer.DenyDDL = deny
+		syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_STDERR" >> ` + failLog
+
+		err = syncer.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "destructive DDL cannot be checked") {
+			t.Fatalf("Run() error = %v, want the unchecked destructive DDL error", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "apply.log")); !os.IsNotExist(err) {
+			t.Error("expected apply not to run")
+		}
+		content, err := os.ReadFile(failLog)
+		if err != nil {
+			t.Fatalf("on-apply-failed did not run: %v", err)
+		}
+		if !strings.Contains(string(content), "connection reset") {
+			t.Errorf("unexpected DB_SCHEMA_SYNC_STDERR: %q", content)
+		}
+	})
+
+	t.Run("applied with --allow-destructive", func(t *testing.T) {
+		syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.SkipLock = true
+		defer syncer.Close()
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "apply.log")); err != nil {
+			t.Errorf("expected apply to run: %v", err)
+		}
+	})
+}
+
+func TestSyncerVerifiesChecksum(t *testing.T) {
+	const schema = "CREATE TABLE users (id INT);"
+	sum := sha256.Sum256([]byte(schema))
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name        string
+		sidecar     string // empty means no sidecar
+		require     bool
+		wantApplied bool
+		wantReason  string
+	}{
+		{"match", digest + "  schema.sql\n", false, true, ""},
+		{"mismatch", strings.Repeat("0", 64) + "  schema.sql\n", false, false, failureChecksumMismatch},
+		{"missing", "", false, true, ""},
+		{"missing with --require-checksum", "", true, false, failureChecksumMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			hookLog := filepath.Join(dir, "hook.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id INT);' ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+			objects := map[string]string{"schemas/v1/schema.sql": schema}
+			if tt.sidecar != "" {
+				objects["schemas/v1/schema.sql.sha256"] = tt.sidecar
+			}
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					body, ok := objects[*params.Key]
+					if !ok {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub}
+			target := "checksum-" + strings.ReplaceAll(tt.name, " ", "-")
+			syncer := newTargetSyncer(client, cli, dbTarget{Name: target, DB: DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}})
+			syncer.SkipLock = true
+			defer syncer.Close()
+			syncer.RequireChecksum = tt.require
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+			err := syncer.Run(context.Background())
+			_, statErr := os.Stat(applyLog)
+			if applied := statErr == nil; applied != tt.wantApplied {
+				t.Fatalf("applied = %v, want %v (Run() error = %v)", applied, tt.wantApplied, err)
+			}
+			if tt.wantApplied {
+				if err != nil {
+					t.Errorf("Run() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "refusing to apply") {
+				t.Errorf("Run() error = %v, want a checksum refusal", err)
+			}
+			if hook, _ := os.ReadFile(hookLog); strings.TrimSpace(string(hook)) != tt.wantReason {
+				t.Errorf("DB_SCHEMA_SYNC_FAILURE_REASON = %q, want %q", hook, tt.wantReason)
+			}
+			if got := testutil.ToFloat64(checksumErrorTotal.WithLabelValues(target)); got != 1 {
+				t.Errorf("checksum_error_total = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestSyncerContentChange(t *testing.T) {
+	for _, reapply := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reapply=%v", reapply), func(t *testing.T) {
+			applyLog := filepath.Join(t.TempDir(), "apply.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id INT);' ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+			objects := map[string]string{"schemas/v1/schema.sql": "CREATE TABLE users (id INT);"}
+			etags := map[string]string{"schemas/v1/schema.sql": `"etag-1"`}
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					body, ok := objects[*params.Key]
+					if !ok {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body)), ETag: aws.String(etags[*params.Key])}, nil
+				},
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					if _, ok := objects[*params.Key]; !ok {
+						return nil, &types.NotFound{}
+					}
+					return &s3.HeadObjectOutput{ETag: aws.String(etags[*params.Key])}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					if _, ok := objects[*params.Key]; ok && params.IfNoneMatch != nil {
+						return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+					}
+					body, _ := io.ReadAll(params.Body)
+					objects[*params.Key] = string(body)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+			target := fmt.Sprintf("content-change-%v", reapply)
+			marker := "schemas/v1/completed." + target
+			newSyncer := func() *Syncer {
+				syncer := newTargetSyncer(client, cli, dbTarget{Name: target, DB: DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}})
+				syncer.SkipLock = true
+				syncer.ReapplyOnContentChange = reapply
+				return syncer
+			}
+			run := func(syncer *Syncer, wantApplies int, wantChanged float64) {
+				t.Helper()
+				if err := syncer.Run(context.Background()); err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				log, _ := os.ReadFile(applyLog)
+				if got := strings.Count(string(log), "applied"); got != wantApplies {
+					t.Errorf("applies = %d, want %d", got, wantApplies)
+				}
+				if got := testutil.ToFloat64(contentChangedTotal.WithLabelValues(target)); got != wantChanged {
+					t.Errorf("content_changed_total = %v, want %v", got, wantChanged)
+				}
+			}
+
+			syncer := newSyncer()
+			run(syncer, 1, 0)
+			if !strings.Contains(objects[marker], `"schema_etag":"\"etag-1\""`) {
+				t.Errorf("completion marker = %s, want the applied ETag", objects[marker])
+			}
+			run(syncer, 1, 0)
+
+			// The schema is overwritten in place: only the ETag check notices
+			objects["schemas/v1/schema.sql"] = "CREATE TABLE users (id INT, name TEXT);"
+			etags["schemas/v1/schema.sql"] = `"etag-2"`
+			if reapply {
+				run(syncer, 2, 1)
+				if !strings.Contains(objects[marker], "etag-2") {
+					t.Errorf("completion marker = %s, want the re-applied ETag", objects[marker])
+				}
+				run(syncer, 2, 1)
+				return
+			}
+			run(syncer, 1, 1)
+			run(syncer, 1, 1)
+
+			// A restarted syncer reads the applied ETag from the completion marker
+			run(newSyncer(), 1, 2)
+		})
+	}
+}
+
+func TestSyncerReusesUnchangedSchema(t *testing.T) {
+	// Every apply fails, so each poll downloads the same version again
+	applyLog := filepath.Join(t.TempDir(), "apply.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id INT);' ;;
+*) while [ "$1" != --file ]; do shift; done; cat "$2" >> `+applyLog+`; echo >> `+applyLog+`; exit 1 ;;
+esac`)
+
+	schema, etag := "CREATE TABLE users (id INT);", `"etag-1"`
+	var ifNoneMatch []string
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if *params.Key != "schemas/v1/schema.sql" {
+				return nil, &types.NoSuchKey{}
+			}
+			ifNoneMatch = append(ifNoneMatch, aws.ToString(params.IfNoneMatch))
+			if aws.ToString(params.IfNoneMatch) == etag {
+				return nil, &smithy.GenericAPIError{Code: "NotModified"}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(schema)), ETag: aws.String(etag)}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	defer syncer.Close()
+
+	skipped := testutil.ToFloat64(s3DownloadSkippedTotal)
+	for range 2 {
+		if err := syncer.Run(context.Background()); err == nil {
+			t.Fatal("Run() expected the apply to fail")
+		}
+	}
+	schema, etag = "CREATE TABLE users (id INT, name TEXT);", `"etag-2"`
+	if err := syncer.Run(context.Background()); err == nil {
+		t.Fatal("Run() expected the apply to fail")
+	}
+
+	if want := []string{"", `"etag-1"`, `"etag-1"`}; !reflect.DeepEqual(ifNoneMatch, want) {
+		t.Errorf("If-None-Match = %q, want %q", ifNoneMatch, want)
+	}
+	if got := testutil.ToFloat64(s3DownloadSkippedTotal) - skipped; got != 1 {
+		t.Errorf("s3_download_skipped_total increased by %v, want 1", got)
+	}
+	// The skipped download applies the cached schema; the changed one is downloaded again
+	log, _ := os.ReadFile(applyLog)
+	want := "CREATE TABLE users (id INT);\nCREATE TABLE users (id INT);\nCREATE TABLE users (id INT, name TEXT);\n"
+	if string(log) != want {
+		t.Errorf("applied schemas = %q, want %q", log, want)
+	}
+}
+
+// fillReader endlessly repeats a SQL comment line, to generate large schemas without holding them in memory
+type fillReader struct{ n int }
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	const line = "-- generated padding line\n"
+	for i := range p {
+		p[i] = line[r.n%len(line)]
+		r.n++
+	}
+	return len(p), nil
+}
+
+func TestSyncerStreamsLargeSchema(t *testing.T) {
+	const size = 64 << 20
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(&fillReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	sidecar := hex.EncodeToString(hash.Sum(nil)) + "  schema.sql\n"
+
+	sizeLog := filepath.Join(t.TempDir(), "size.log")
+	stub := writeStubPsqldef(t, `while [ "$1" != --file ]; do shift; done
+wc -c < "$2" >> `+sizeLog+`
+echo '-- Nothing is modified --'`)
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			switch *params.Key {
+			case "schemas/v1/schema.sql":
+				return &s3.GetObjectOutput{Body: io.NopCloser(io.LimitReader(&fillReader{}, size))}, nil
+			case "schemas/v1/schema.sql.sha256":
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(sidecar))}, nil
+			}
+			return nil, &types.NoSuchKey{}
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	syncer.RequireChecksum = true
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// The schema goes from S3 to the temporary file without being buffered
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/4 {
+		t.Errorf("Run() allocated %d bytes for a %d byte schema", allocated, size)
+	}
+	if got, _ := os.ReadFile(sizeLog); strings.TrimSpace(string(got)) != strconv.Itoa(size) {
+		t.Errorf("psqldef got a %s byte schema, want %d", strings.TrimSpace(string(got)), size)
+	}
+	if syncer.LastAppliedVersion() != "v1" || syncer.cachedSchema != nil {
+		t.Errorf("expected v1 to be applied and its temporary file removed")
+	}
+}
+
+// panicApplier stands in for a tool that brings the sync down mid-apply
+type panicApplier struct{ SchemaApplier }
+
+func (panicApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	panic("psqldef crashed")
+}
+
+func TestSyncerWorkDir(t *testing.T) {
+	workDir := t.TempDir()
+	modeLog := filepath.Join(t.TempDir(), "mode.log")
+	stub := writeStubPsqldef(t, `case "$*" in *--dry-run*) dryRun=1 ;; esac
+while [ "$1" != --file ]; do shift; done
+stat -c '%a' "$2" `+workDir+`/db-schema-sync-* >> `+modeLog+`
+if [ -z "$dryRun" ] && [ -n "$FAIL_APPLY" ]; then exit 1; fi
+echo 'CREATE TABLE users (id INT);'`)
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if *params.Key != "schemas/v1/schema.sql" {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT);"))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub, WorkDir: workDir}
+	db := DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}
+
+	assertEmpty := func(t *testing.T) {
+		t.Helper()
+		entries, err := os.ReadDir(workDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			t.Errorf("unexpected leftover in work dir: %s", e.Name())
+		}
+	}
+
+	t.Run("files are private and removed after apply", func(t *testing.T) {
+		syncer := NewSyncer(client, cli, db)
+		syncer.SkipLock = true
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		content, err := os.ReadFile(modeLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One line per psqldef call: the schema file, then the per-sync directory
+		if got, want := strings.Fields(string(content)), []string{"600", "700", "600", "700"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("modes = %v, want %v", got, want)
+		}
+		assertEmpty(t)
+	})
+
+	t.Run("failed apply keeps only the cached download", func(t *testing.T) {
+		t.Setenv("FAIL_APPLY", "1")
+		syncer := NewSyncer(client, cli, db)
+		syncer.SkipLock = true
+		if err := syncer.Run(context.Background()); err == nil {
+			t.Fatal("expected Run() to fail")
+		}
+		entries, _ := os.ReadDir(workDir)
+		if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "schema-") {
+			t.Errorf("work dir = %v, want only the cached schema", entries)
+		}
+		syncer.Close()
+		assertEmpty(t)
+	})
+
+	t.Run("panicking apply still removes the directory", func(t *testing.T) {
+		syncer := NewSyncer(client, cli, db)
+		syncer.SkipLock = true
+		syncer.Applier = panicApplier{syncer.Applier}
+		defer syncer.Close()
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("expected Run() to panic")
+				}
+			}()
+			_ = syncer.Run(context.Background())
+		}()
+		entries, _ := os.ReadDir(workDir)
+		for _, e := range entries {
+			if e.IsDir() {
+				t.Errorf("work directory %s was not removed", e.Name())
+			}
+		}
+	})
+}
+
+func TestSyncerStrictDryRun(t *testing.T) {
+	dir := t.TempDir()
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ERROR: syntax error at or near "TABEL"' >&2; exit 1 ;;
+*) echo applied >> `+filepath.Join(dir, "apply.log")+` ;;
+esac`)
+
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if strings.HasSuffix(*params.Key, ".sha256") {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABEL users (id INT);"))}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", PsqldefPath: stub}
+	db := DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"}
+
+	t.Run("strict aborts before apply", func(t *testing.T) {
+		hookLog := filepath.Join(dir, "hook.log")
+		syncer := NewSyncer(client, cli, db)
+		syncer.SkipLock = true
+		defer syncer.Close()
+		syncer.StrictDryRun = true
+		syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_STDERR" >> ` + hookLog
+
+		errorsBefore := testutil.ToFloat64(applyErrorTotal.WithLabelValues(""))
+		err := syncer.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "dry-run failed") {
+			t.Fatalf("Run() error = %v, want dry-run failure", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "apply.log")); !os.IsNotExist(err) {
+			t.Error("expected apply not to run")
+		}
+		content, err := os.ReadFile(hookLog)
+		if err != nil {
+			t.Fatalf("failed to read hook log: %v", err)
+		}
+		if !strings.Contains(string(content), `syntax error at or near "TABEL"`) {
+			t.Errorf("unexpected DB_SCHEMA_SYNC_STDERR: %q", content)
+		}
+		if got := testutil.ToFloat64(applyErrorTotal.WithLabelValues("")) - errorsBefore; got != 1 {
+			t.Errorf("applyErrorTotal increased by %v, want 1", got)
+		}
+		if syncer.LastAppliedVersion() != "" {
+			t.Errorf("expected no applied version, got %s", syncer.LastAppliedVersion())
+		}
+	})
+
+	t.Run("lenient applies anyway", func(t *testing.T) {
+		syncer := NewSyncer(client, cli, db)
+		syncer.SkipLock = true
+		defer syncer.Close()
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "apply.log")); err != nil {
+			t.Errorf("expected apply to run: %v", err)
+		}
+		if syncer.LastAppliedVersion() != "v1" {
+			t.Errorf("LastAppliedVersion() = %q, want v1", syncer.LastAppliedVersion())
+		}
+	})
+}
+
+func TestSyncerSkipsApplyWhenNoChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      string
+		alwaysApply bool
+		wantApply   bool
+	}{
+		{"no change skips apply", "-- dry run --\n-- Nothing is modified --", false, false},
+		{"changes are applied", "-- dry run --\nALTER TABLE users ADD COLUMN name text;", false, true},
+		{"--always-apply runs apply", "-- dry run --\n-- Nothing is modified --", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			hookLog := filepath.Join(dir, "hook.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) printf '%s\n' '`+strings.ReplaceAll(tt.dryRun, "\n", "' '")+`' ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+			var putKeys []string
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					return nil, &types.NotFound{}
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if strings.HasSuffix(*params.Key, ".sha256") {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT);"))}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					putKeys = append(putKeys, *params.Key)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			syncer.AlwaysApply = tt.alwaysApply
+			syncer.Hooks.OnNoChange = `echo no-change >> ` + hookLog
+			syncer.Hooks.OnApplySucceeded = `echo apply-succeeded >> ` + hookLog
+
+			noChangeBefore := testutil.ToFloat64(noChangeTotal.WithLabelValues(""))
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			_, err := os.Stat(applyLog)
+			if applied := err == nil; applied != tt.wantApply {
+				t.Errorf("apply ran = %v, want %v", applied, tt.wantApply)
+			}
+			content, err := os.ReadFile(hookLog)
+			if err != nil {
+				t.Fatalf("failed to read hook log: %v", err)
+			}
+			wantHook, wantNoChange := "apply-succeeded", 0.0
+			if !tt.wantApply {
+				wantHook, wantNoChange = "no-change", 1
+			}
+			if got := strings.TrimSpace(string(content)); got != wantHook {
+				t.Errorf("hooks run = %q, want %q", got, wantHook)
+			}
+			if got := testutil.ToFloat64(noChangeTotal.WithLabelValues("")) - noChangeBefore; got != wantNoChange {
+				t.Errorf("noChangeTotal increased by %v, want %v", got, wantNoChange)
+			}
+			if syncer.LastAppliedVersion() != "v1" {
+				t.Errorf("LastAppliedVersion() = %q, want v1", syncer.LastAppliedVersion())
+			}
+			if len(putKeys) != 1 || putKeys[0] != "schemas/v1/completed" {
+				t.Errorf("expected completion marker upload, got %v", putKeys)
+			}
+		})
+	}
+}
+
+func TestSyncerRunsPlanHook(t *testing.T) {
+	tests := []struct {
+		name          string
+		dryRun        string
+		wantHooks     string
+		wantPlanEmpty bool
+	}{
+		{"changes planned", "ALTER TABLE users ADD COLUMN name text;\n", "plan v1 false\nbefore-apply\napply-succeeded", false},
+		{"empty diff", "-- Nothing is modified --\n", "plan v1 true\nno-change", true},
+		{"destructive DDL blocked", "DROP TABLE users;\n", "plan v1 false\napply-failed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			hookLog := filepath.Join(dir, "hook.log")
+			payloadFile := filepath.Join(dir, "plan.json")
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			syncer.Applier = &fakeApplier{dryRun: tt.dryRun}
+			syncer.SkipLock = true
+			deny, err := compileDenyDDL(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			syncer.DenyDDL = deny
+			syncer.Hooks.OnPlan = `echo "plan $DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_PLAN_EMPTY" >> ` + hookLog + `; cat > ` + payloadFile
+			syncer.Hooks.OnBeforeApply = `echo before-apply >> ` + hookLog
+			syncer.Hooks.OnApplySucceeded = `echo apply-succeeded >> ` + hookLog
+			syncer.Hooks.OnApplyFailed = `echo apply-failed >> ` + hookLog
+			syncer.Hooks.OnNoChange = `echo no-change >> ` + hookLog
+
+			_ = syncer.Run(context.Background())
+
+			content, _ := os.ReadFile(hookLog)
+			if got := strings.TrimSpace(string(content)); got != tt.wantHooks {
+				t.Errorf("hooks run = %q, want %q", got, tt.wantHooks)
+			}
+			data, err := os.ReadFile(payloadFile)
+			if err != nil {
+				t.Fatalf("on-plan got no payload: %v", err)
+			}
+			var payload HookPayload
+			if err := json.Unmarshal(data, &payload); err != nil {
+				t.Fatalf("on-plan payload is not JSON: %v: %s", err, data)
+			}
+			if payload.Event != "plan" || payload.Version != "v1" || payload.DryRun != tt.dryRun || payload.PlanEmpty == nil || *payload.PlanEmpty != tt.wantPlanEmpty {
+				t.Errorf("on-plan payload = %s, want the plan of v1 with plan_empty %v", data, tt.wantPlanEmpty)
+			}
+		})
+	}
+
+	t.Run("dry-run failed", func(t *testing.T) {
+		hookLog := filepath.Join(t.TempDir(), "hook.log")
+		stub := writeStubPsqldef(t, `exit 1`)
+		bucket := newMemoryBucket("schemas/v1/schema.sql")
+		cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+		syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		defer syncer.Close()
+		syncer.SkipLock = true
+		syncer.StrictDryRun = true
+		syncer.Hooks.OnPlan = `echo plan >> ` + hookLog
+		syncer.Hooks.OnApplyFailed = `echo apply-failed >> ` + hookLog
+
+		if err := syncer.Run(context.Background()); err == nil {
+			t.Fatal("Run() succeeded, want the dry-run failure")
+		}
+		content, _ := os.ReadFile(hookLog)
+		if got := strings.TrimSpace(string(content)); got != "apply-failed" {
+			t.Errorf("hooks run = %q, want on-plan skipped for a failed dry-run", got)
+		}
+	})
+}
+
+func TestSyncerUploadsAppliedDDL(t *testing.T) {
+	tests := []struct {
+		name           string
+		applyOutput    string
+		appliedDDLFile string
+		wantUpload     bool
+		wantStatements int
+	}{
+		{"uploads executed DDL", "-- Apply --\nALTER TABLE users ADD COLUMN name text;", "applied.sql", true, 1},
+		{"skips empty diff", "-- Apply --", "applied.sql", false, 0},
+		{"disabled with empty file name", "-- Apply --\nALTER TABLE users ADD COLUMN name text;", "", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) printf '%s\n' '`+strings.ReplaceAll(tt.applyOutput, "\n", "' '")+`' ;;
+esac`)
+
+			uploads := make(map[string]string)
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					return nil, &types.NotFound{}
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if strings.HasSuffix(*params.Key, ".sha256") {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT, name text);"))}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					body, _ := io.ReadAll(params.Body)
+					uploads[*params.Key] = string(body)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", AppliedDDLFile: tt.appliedDDLFile, PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			body, uploaded := uploads["schemas/v1/applied.sql"]
+			if uploaded != tt.wantUpload {
+				t.Fatalf("applied DDL uploaded = %v, want %v (uploads: %v)", uploaded, tt.wantUpload, uploads)
+			}
+			if uploaded && body != tt.applyOutput+"\n" {
+				t.Errorf("applied DDL = %q, want %q", body, tt.applyOutput+"\n")
+			}
+			var meta schemastore.CompletionMetadata
+			if err := json.Unmarshal([]byte(uploads["schemas/v1/completed"]), &meta); err != nil {
+				t.Fatalf("completion marker is not JSON metadata: %v", err)
+			}
+			if meta.Version != "v1" || meta.AppVersion != Version || meta.DDLStatementCount != tt.wantStatements || meta.AppliedAt.IsZero() {
+				t.Errorf("completion metadata = %+v, want version v1 with %d statements", meta, tt.wantStatements)
+			}
+		})
+	}
+}
+
+func TestSyncerPreApplyBackup(t *testing.T) {
+	tests := []struct {
+		name          string
+		dryRun        string
+		exportFails   bool
+		backupFile    string
+		requireBackup bool
+		wantBackup    bool
+		wantApplied   bool
+		wantErr       string
+	}{
+		{"backs up before applying", "ALTER TABLE users ADD COLUMN name text;", false, "pre-apply-backup.sql", false, true, true, ""},
+		{"skipped when nothing changes", "-- Nothing is modified --", false, "pre-apply-backup.sql", false, false, false, ""},
+		{"disabled with empty file name", "ALTER TABLE users ADD COLUMN name text;", false, "", true, false, true, ""},
+		{"failure is a warning", "ALTER TABLE users ADD COLUMN name text;", true, "pre-apply-backup.sql", false, false, true, ""},
+		{"failure is fatal with --require-backup", "ALTER TABLE users ADD COLUMN name text;", true, "pre-apply-backup.sql", true, false, false, "failed to back up the schema before applying version v1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			hookLog := filepath.Join(dir, "hook.log")
+			exportCmd := `echo 'CREATE TABLE users (id integer);'`
+			if tt.exportFails {
+				exportCmd = `echo 'permission denied for table users' >&2; exit 1`
+			}
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo '`+tt.dryRun+`' ;;
+*--export*) `+exportCmd+` ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			uploads := make(map[string]string)
+			client := bucket.client()
+			client.putObjectFunc = func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+				body, _ := io.ReadAll(params.Body)
+				uploads[*params.Key] = string(body)
+				bucket.put(*params.Key)
+				return &s3.PutObjectOutput{}, nil
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PreApplyBackupFile: tt.backupFile, PsqldefPath: stub}
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			syncer.SkipLock = true
+			syncer.RequireBackup = tt.requireBackup
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+			err := syncer.Run(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want containing %q", err, tt.wantErr)
+				}
+				if reason, _ := os.ReadFile(hookLog); strings.TrimSpace(string(reason)) != failureBackupFailed {
+					t.Errorf("DB_SCHEMA_SYNC_FAILURE_REASON = %q, want %s", reason, failureBackupFailed)
+				}
+				if bucket.has("schemas/v1/completed") {
+					t.Error("completion marker was created after the backup failed")
+				}
+			} else if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			backup, backedUp := uploads["schemas/v1/pre-apply-backup.sql"]
+			if backedUp != tt.wantBackup {
+				t.Fatalf("pre-apply backup uploaded = %v, want %v (uploads: %v)", backedUp, tt.wantBackup, uploads)
+			}
+			if backedUp && backup != "CREATE TABLE users (id integer);\n" {
+				t.Errorf("pre-apply backup = %q, want the exported schema", backup)
+			}
+			if _, err := os.Stat(applyLog); (err == nil) != tt.wantApplied {
+				t.Errorf("applied = %v, want %v", err == nil, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestSyncerApplySucceededOutput(t *testing.T) {
+	dir := t.TempDir()
+	applied := "-- Apply --\n" + strings.Repeat("ALTER TABLE users ADD COLUMN \"note\" text;\n", 5)
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN "note" text;' ;;
+*) printf -- '`+applied+`'; echo 'NOTICE: column "note" of relation "users" already exists, skipping' >&2 ;;
+esac`)
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	defer syncer.Close()
+	syncer.SkipLock = true
+	syncer.HookRunner.EnvMaxBytes = 100
+	syncer.Hooks.OnApplySucceeded = `cat > ` + filepath.Join(dir, "payload.json") + `
+printf %s "$DB_SCHEMA_SYNC_STDOUT" > ` + filepath.Join(dir, "stdout") + `
+printf %s "$DB_SCHEMA_SYNC_STDERR" > ` + filepath.Join(dir, "stderr") + `
+printf %s "$DB_SCHEMA_SYNC_DRY_RUN" > ` + filepath.Join(dir, "dry_run")
+
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	read := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		return string(content)
+	}
+	// The environment gets the output cut at --hook-env-max-bytes, stdin gets it in full
+	if got, want := read("stdout"), truncateText(applied, 100); got != want {
+		t.Errorf("DB_SCHEMA_SYNC_STDOUT = %q, want %q", got, want)
+	}
+	if got := read("stderr"); !strings.HasPrefix(got, "NOTICE: column \"note\"") {
+		t.Errorf("DB_SCHEMA_SYNC_STDERR = %q, want the psqldef notice", got)
+	}
+	if got := read("dry_run"); got != "ALTER TABLE users ADD COLUMN \"note\" text;\n" {
+		t.Errorf("DB_SCHEMA_SYNC_DRY_RUN = %q, want the dry-run DDL", got)
+	}
+	var payload HookPayload
+	if err := json.Unmarshal([]byte(read("payload.json")), &payload); err != nil {
+		t.Fatalf("hook stdin is not JSON: %v", err)
+	}
+	if payload.Stdout != applied || !strings.Contains(payload.Stderr, "already exists, skipping") {
+		t.Errorf("hook stdin stdout = %q, stderr = %q, want the full apply output", payload.Stdout, payload.Stderr)
+	}
+}
+
+func TestSyncerPaused(t *testing.T) {
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) echo applied >> `+applyLog+` ;;
+esac`)
+
+	bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/PAUSED")
+	client := bucket.client()
+	getObject := client.getObjectFunc
+	var pauseErr error
+	client.getObjectFunc = func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if *params.Key == "schemas/PAUSED" {
+			if pauseErr != nil {
+				return nil, pauseErr
+			}
+			if bucket.has(*params.Key) {
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("incident INC-42: replica lag\n"))}, nil
+			}
+		}
+		return getObject(ctx, params, optFns...)
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PauseFile: "PAUSED", PsqldefPath: stub}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	defer syncer.Close()
+	syncer.SkipLock = true
+	syncer.Target = "paused"
+	syncer.Hooks.OnPaused = `echo "$DB_SCHEMA_SYNC_PAUSE_REASON" >> ` + hookLog
+
+	// Paused: every sync skips the apply, on-paused runs once
+	for range 2 {
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	if _, err := os.Stat(applyLog); !os.IsNotExist(err) {
+		t.Error("schema was applied while paused")
+	}
+	if got := testutil.ToFloat64(paused.WithLabelValues("paused")); got != 1 {
+		t.Errorf("paused = %v, want 1", got)
+	}
+	if hook, _ := os.ReadFile(hookLog); string(hook) != "incident INC-42: replica lag\n" {
+		t.Errorf("on-paused output = %q, want the reason once", hook)
+	}
+
+	// The pause state cannot be read: nothing is applied
+	pauseErr = errors.New("AccessDenied")
+	if err := syncer.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to check pause object schemas/PAUSED") {
+		t.Fatalf("Run() error = %v, want a pause check failure", err)
+	}
+	if _, err := os.Stat(applyLog); !os.IsNotExist(err) {
+		t.Error("schema was applied while the pause state was unknown")
+	}
+	pauseErr = nil
+
+	// Removing the object resumes on the next sync
+	if err := schemastore.DeleteObjects(context.Background(), client, "test-bucket", []string{"schemas/PAUSED"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if applied, _ := os.ReadFile(applyLog); string(applied) != "applied\n" {
+		t.Errorf("apply log = %q, want one apply after resuming", applied)
+	}
+	if got := testutil.ToFloat64(paused.WithLabelValues("paused")); got != 0 {
+		t.Errorf("paused = %v, want 0", got)
+	}
+
+	// Pausing again runs on-paused again
+	bucket.put("schemas/PAUSED")
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if hook, _ := os.ReadFile(hookLog); strings.Count(string(hook), "\n") != 2 {
+		t.Errorf("on-paused output = %q, want a second run after pausing again", hook)
+	}
+}
+
+func TestSyncerConditionalCompletionMarker(t *testing.T) {
+	tests := []struct {
+		name         string
+		putErrs      []error
+		wantConds    []string
+		wantDisabled bool
+	}{
+		{"first writer", []error{nil}, []string{"*"}, false},
+		{"another instance completed first", []error{&smithy.GenericAPIError{Code: "PreconditionFailed"}}, []string{"*"}, false},
+		{"store rejects If-None-Match", []error{&smithy.GenericAPIError{Code: "NotImplemented"}, nil}, []string{"*", ""}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := writeStubPsqldef(t, `echo 'ALTER TABLE users ADD COLUMN name text;'`)
+
+			var conds []string
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+				},
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					return nil, &types.NotFound{}
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if strings.HasSuffix(*params.Key, ".sha256") {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT, name text);"))}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					conds = append(conds, aws.ToString(params.IfNoneMatch))
+					if err := tt.putErrs[len(conds)-1]; err != nil {
+						return nil, err
+					}
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			if err := syncer.Run(context.Background()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(conds, tt.wantConds) {
+				t.Errorf("IfNoneMatch per marker write = %q, want %q", conds, tt.wantConds)
+			}
+			if syncer.DisableConditionalWrites != tt.wantDisabled {
+				t.Errorf("DisableConditionalWrites = %v, want %v", syncer.DisableConditionalWrites, tt.wantDisabled)
+			}
+			if syncer.LastAppliedVersion() != "v1" {
+				t.Errorf("LastAppliedVersion() = %q, want v1", syncer.LastAppliedVersion())
+			}
+		})
+	}
+}
+
+func TestSyncerVersionSelection(t *testing.T) {
+	// v2 is completed; v1 and v3 are not
+	objects := map[string]bool{
+		"schemas/v1/schema.sql": true,
+		"schemas/v2/schema.sql": true,
+		"schemas/v2/completed":  true,
+		"schemas/v3/schema.sql": true,
+	}
+
+	tests := []struct {
+		name           string
+		pinned         string
+		maxVersion     string
+		force          bool
+		allowDowngrade bool
+		wantHeldBack   float64
+		wantApplied    string
+		wantErr        string
+		wantCondition  string
+	}{
+		{name: "latest", wantApplied: "v3", wantCondition: "*"},
+		{name: "max version equal to completed v2", maxVersion: "v2", wantHeldBack: 1},
+		{name: "max version between versions skips completed v2", maxVersion: "v2.5", wantHeldBack: 1},
+		{name: "max version below completed is a downgrade", maxVersion: "v1", wantHeldBack: 2, wantErr: "downgrade blocked"},
+		{name: "max version below completed allowed", maxVersion: "v1", allowDowngrade: true, wantHeldBack: 2, wantApplied: "v1", wantCondition: "*"},
+		{name: "max version below every version", maxVersion: "v0.5", wantHeldBack: 3, wantErr: "no schema at or below version v0.5"},
+		{name: "max version above every version", maxVersion: "v4", wantApplied: "v3", wantCondition: "*"},
+		{name: "pinned newer version", pinned: "v3", wantApplied: "v3", wantCondition: "*"},
+		{name: "pinned missing version", pinned: "v9", wantErr: "schema not found"},
+		{name: "pinned downgrade refused", pinned: "v1", wantErr: "use --force to downgrade"},
+		{name: "pinned downgrade forced", pinned: "v1", force: true, wantApplied: "v1", wantCondition: ""},
+		{name: "pinned completed version skipped", pinned: "v2"},
+		{name: "pinned completed version forced", pinned: "v2", force: true, wantApplied: "v2", wantCondition: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+
+			var markerCondition *string
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					var contents []types.Object
+					for key := range objects {
+						contents = append(contents, types.Object{Key: aws.String(key)})
+					}
+					return &s3.ListObjectsV2Output{Contents: contents}, nil
+				},
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					if objects[*params.Key] {
+						return &s3.HeadObjectOutput{}, nil
+					}
+					return nil, &types.NotFound{}
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if strings.HasSuffix(*params.Key, ".sha256") {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(path.Base(path.Dir(*params.Key))))}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					markerCondition = aws.String(aws.ToString(params.IfNoneMatch))
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			syncer.PinnedVersion = tt.pinned
+			syncer.MaxVersion = tt.maxVersion
+			syncer.Force = tt.force
+			syncer.AllowDowngrade = tt.allowDowngrade
+
+			err := syncer.Run(context.Background())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Run() error = %v, want containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			applied, _ := os.ReadFile(applyLog)
+			if string(applied) != tt.wantApplied {
+				t.Errorf("applied version = %q, want %q", applied, tt.wantApplied)
+			}
+			if tt.maxVersion != "" {
+				if got := testutil.ToFloat64(versionsHeldBack.WithLabelValues("")); got != tt.wantHeldBack {
+					t.Errorf("versions held back = %v, want %v", got, tt.wantHeldBack)
+				}
+			}
+			if tt.wantApplied != "" && (markerCondition == nil || *markerCondition != tt.wantCondition) {
+				t.Errorf("completion marker IfNoneMatch = %v, want %q", aws.ToString(markerCondition), tt.wantCondition)
+			}
+		})
+	}
+}
+
+func TestSyncerVersionOrderLastModified(t *testing.T) {
+	// Version directories are git SHAs: only upload times order them
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	objects := map[string]time.Time{}
+	upload := func(key string, minutes int) {
+		mu.Lock()
+		defer mu.Unlock()
+		objects[key] = base.Add(time.Duration(minutes) * time.Minute)
+	}
+	upload("schemas/0a1b2c3/schema.sql", 10)
+	upload("schemas/f00baa5/schema.sql", 30)
+
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var contents []types.Object
+			for key, modified := range objects {
+				contents = append(contents, types.Object{Key: aws.String(key), LastModified: aws.Time(modified)})
+			}
+			return &s3.ListObjectsV2Output{Contents: contents}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := objects[*params.Key]; ok {
+				return &s3.HeadObjectOutput{}, nil
+			}
+			return nil, &types.NotFound{}
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if path.Base(*params.Key) != "schema.sql" {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(path.Base(path.Dir(*params.Key)) + "\n"))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			// Markers are written after the schema they complete
+			upload(*params.Key, 60)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub, VersionOrder: versionOrderLastModified}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+
+	run := func(wantApplied string) {
+		t.Helper()
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		applied, _ := os.ReadFile(applyLog)
+		if string(applied) != wantApplied {
+			t.Errorf("applied versions = %q, want %q", applied, wantApplied)
+		}
+	}
+
+	// The most recent upload wins, although 0a1b2c3 sorts first by name
+	run("f00baa5\n")
+	if syncer.LastAppliedVersion() != "f00baa5" {
+		t.Errorf("LastAppliedVersion() = %q, want the directory name", syncer.LastAppliedVersion())
+	}
+
+	// A directory that sorts higher by name but was uploaded earlier is not newer
+	upload("schemas/ffff000/schema.sql", 20)
+	run("f00baa5\n")
+
+	upload("schemas/1234abc/schema.sql", 40)
+	run("f00baa5\n1234abc\n")
+
+	// Pinning the older upload is a downgrade by time (apply --version runs a fresh syncer)
+	pinned := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	pinned.SkipLock = true
+	pinned.PinnedVersion = "f00baa5"
+	if err := pinned.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "use --force to downgrade") {
+		t.Errorf("Run() pinned to an older upload error = %v, want a refused downgrade", err)
+	}
+}
+
+func TestPlanSequentialVersions(t *testing.T) {
+	versions := []schemastore.VersionInfo{
+		{Version: "v1", Schema: true, Completed: true},
+		{Version: "v2", Schema: true, Completed: true},
+		{Version: "v3", Schema: true, Completed: true},
+		{Version: "v4", Schema: true},
+		{Version: "v5"},
+		{Version: "v6", Schema: true, Completed: true, RolledBack: true},
+		{Version: "v7", Schema: true},
+		{Version: "v8", Schema: true},
+	}
+
+	tests := []struct {
+		name        string
+		versions    []schemastore.VersionInfo
+		lastApplied string
+		latest      string
+		want        []string
+	}{
+		{name: "from the newest completed version", versions: versions, latest: "v8", want: []string{"v4", "v7"}},
+		{name: "last applied ahead of the markers", versions: versions, lastApplied: "v4", latest: "v8", want: []string{"v7"}},
+		{name: "latest is next", versions: versions, lastApplied: "v7", latest: "v8"},
+		{name: "capped below latest", versions: versions, latest: "v7", want: []string{"v4"}},
+		{
+			name:     "nothing applied yet",
+			versions: []schemastore.VersionInfo{{Version: "v1", Schema: true}, {Version: "v2", Schema: true}, {Version: "v3", Schema: true}},
+			latest:   "v3",
+			want:     []string{"v1", "v2"},
+		},
+		{
+			name:     "newer completed version than latest",
+			versions: []schemastore.VersionInfo{{Version: "v1", Schema: true}, {Version: "v2", Schema: true}, {Version: "v3", Schema: true, Completed: true}},
+			latest:   "v2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := planSequentialVersions(tt.versions, tt.lastApplied, tt.latest, schemastore.Versioning{})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSequentialVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// memoryBucket is an in-memory bucket behind mockS3Client. A schema file's content is its version directory name;
+// every other object, such as a completion marker, is empty.
+type memoryBucket struct {
+	mu      sync.Mutex
+	objects map[string]bool
+}
+
+func newMemoryBucket(keys ...string) *memoryBucket {
+	b := &memoryBucket{objects: make(map[string]bool)}
+	for _, key := range keys {
+		b.objects[key] = true
+	}
+	return b
+}
+
+func (b *memoryBucket) has(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.objects[key]
+}
+
+func (b *memoryBucket) put(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = true
+}
+
+// deleteDir removes every object of version ver under schemas/
+func (b *memoryBucket) deleteDir(ver string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key := range b.objects {
+		if strings.HasPrefix(key, "schemas/"+ver+"/") {
+			delete(b.objects, key)
+		}
+	}
+}
+
+func (b *memoryBucket) client() *mockS3Client {
+	return &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			var contents []types.Object
+			for key := range b.objects {
+				contents = append(contents, types.Object{Key: aws.String(key)})
+			}
+			return &s3.ListObjectsV2Output{Contents: contents}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if b.has(*params.Key) {
+				return &s3.HeadObjectOutput{}, nil
+			}
+			return nil, &types.NotFound{}
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			switch {
+			case !b.has(*params.Key):
+				return nil, &types.NoSuchKey{}
+			case path.Base(*params.Key) == "schema.sql":
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(path.Base(path.Dir(*params.Key)) + "\n"))}, nil
+			default:
+				return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(""))}, nil
+			}
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			b.put(*params.Key)
+			return &s3.PutObjectOutput{}, nil
+		},
+		deleteObjectsFunc: func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, obj := range params.Delete.Objects {
+				delete(b.objects, *obj.Key)
+			}
+			return &s3.DeleteObjectsOutput{}, nil
+		},
+	}
+}
+
+// fakeApplier stands in for the sqldef tool: it plans dryRun for any schema, records each applied schema,
+// and fails the apply with applyErr when set
+type fakeApplier struct {
+	dryRun   string
+	applyErr error
+	export   []byte
+	mu       sync.Mutex
+	applied  []string
+}
+
+func (a *fakeApplier) DryRun(ctx context.Context, schemaFile string) (string, error) {
+	return a.dryRun, nil
+}
+
+func (a *fakeApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	if a.applyErr != nil {
+		return &ApplyResult{Stderr: a.applyErr.Error()}, a.applyErr
+	}
+	schema, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied = append(a.applied, strings.TrimSpace(string(schema)))
+	return &ApplyResult{Stdout: a.dryRun}, nil
+}
+
+func (a *fakeApplier) Export(ctx context.Context) ([]byte, error) { return a.export, nil }
+
+func (a *fakeApplier) Diff(ctx context.Context, current, desired []byte) (string, error) {
+	return "", nil
+}
+
+func (a *fakeApplier) SetConfig(config []byte) {}
+
+func (a *fakeApplier) SetWorkDir(dir string) {}
+
+// heldCheckLocker acquires the lock and keeps it
+type heldCheckLocker struct{ lostLocker }
+
+func (heldCheckLocker) HeldCheck(context.Context) error { return nil }
+
+func TestSyncerRunFlow(t *testing.T) {
+	applyFailed := errors.New("ERROR: syntax error at or near \"TABLE\"")
+	tests := []struct {
+		name          string
+		keys          []string
+		locker        Locker
+		applyErr      error
+		exportAfter   bool
+		wantErr       string
+		wantApplied   []string
+		wantMarker    bool
+		wantExported  bool
+		wantFailedLog string
+	}{
+		{
+			name:        "new version applied",
+			keys:        []string{"schemas/v1/schema.sql", "schemas/v1/completed", "schemas/v2/schema.sql"},
+			locker:      heldCheckLocker{},
+			wantApplied: []string{"v2"},
+			wantMarker:  true,
+		},
+		{
+			name:       "completed version skipped",
+			keys:       []string{"schemas/v2/schema.sql", "schemas/v2/completed"},
+			locker:     heldCheckLocker{},
+			wantMarker: true,
+		},
+		{
+			name:   "lock held elsewhere",
+			keys:   []string{"schemas/v2/schema.sql"},
+			locker: heldLocker{},
+		},
+		{
+			name:          "apply failure runs the hook",
+			keys:          []string{"schemas/v2/schema.sql"},
+			locker:        heldCheckLocker{},
+			applyErr:      applyFailed,
+			wantErr:       "failed to apply schema",
+			wantFailedLog: "v2 " + applyFailed.Error(),
+		},
+		{
+			name:         "export after apply",
+			keys:         []string{"schemas/v2/schema.sql"},
+			locker:       heldCheckLocker{},
+			exportAfter:  true,
+			wantApplied:  []string{"v2"},
+			wantMarker:   true,
+			wantExported: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			bucket := newMemoryBucket(tt.keys...)
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			applier := &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n", applyErr: tt.applyErr, export: []byte("CREATE TABLE users (id integer);\n")}
+			syncer.Applier = applier
+			syncer.NewLocker = func(context.Context, int64) (Locker, error) { return tt.locker, nil }
+			syncer.ExportAfterApply = tt.exportAfter
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_STDERR" >> ` + hookLog
+
+			err := syncer.Run(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(applier.applied, tt.wantApplied) {
+				t.Errorf("applied %q, want %q", applier.applied, tt.wantApplied)
+			}
+			if got := bucket.has("schemas/v2/completed"); got != tt.wantMarker {
+				t.Errorf("completion marker exists = %v, want %v", got, tt.wantMarker)
+			}
+			if got := bucket.has("schemas/v2/exported.sql"); got != tt.wantExported {
+				t.Errorf("exported schema uploaded = %v, want %v", got, tt.wantExported)
+			}
+			hook, _ := os.ReadFile(hookLog)
+			if got := strings.TrimSpace(string(hook)); got != tt.wantFailedLog {
+				t.Errorf("on-apply-failed ran with %q, want %q", got, tt.wantFailedLog)
+			}
+		})
+	}
+}
+
+func TestSyncerApplySequentially(t *testing.T) {
+	bucket := newMemoryBucket(
+		"schemas/v3/schema.sql",
+		"schemas/v3/completed",
+		"schemas/v4/schema.sql",
+		"schemas/v5/schema.sql",
+		"schemas/v6/schema.sql",
+		"schemas/v7/schema.sql",
+	)
+
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	hookLog := filepath.Join(dir, "hook.log")
+	failV6 := filepath.Join(dir, "fail-v6")
+	if err := os.WriteFile(failV6, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stub := writeStubPsqldef(t, `file="$(echo "$@" | sed 's/.*--file //')"
+case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) if [ "$(cat "$file")" = v6 ] && [ -e `+failV6+` ]; then echo 'seed data missing' >&2; exit 1; fi
+   cat "$file" >> `+applyLog+` ;;
+esac`)
+
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+	syncer.ApplySequentially = true
+	syncer.Target = "sequential"
+	syncer.Hooks.OnApplySucceeded = `echo "$DB_SCHEMA_SYNC_VERSION" >> ` + hookLog
+	successes := testutil.ToFloat64(applySuccessTotal.WithLabelValues("sequential"))
+
+	// v6 fails: v4 and v5 stay applied and completed, v7 is left for the next sync
+	err := syncer.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to apply intermediate version v6") {
+		t.Fatalf("Run() error = %v, want v6 to fail", err)
+	}
+	if applied, _ := os.ReadFile(applyLog); string(applied) != "v4\nv5\n" {
+		t.Errorf("applied versions = %q, want v4 and v5", applied)
+	}
+	if syncer.LastAppliedVersion() != "v5" {
+		t.Errorf("LastAppliedVersion() = %q, want v5", syncer.LastAppliedVersion())
+	}
+	if !bucket.has("schemas/v4/completed") || !bucket.has("schemas/v5/completed") || bucket.has("schemas/v6/completed") {
+		t.Errorf("completion markers = %v, want v4 and v5 only", bucket.objects)
+	}
+
+	if err := os.Remove(failV6); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if applied, _ := os.ReadFile(applyLog); string(applied) != "v4\nv5\nv6\nv7\n" {
+		t.Errorf("applied versions = %q, want v6 and v7 added in order", applied)
+	}
+	if hooks, _ := os.ReadFile(hookLog); string(hooks) != "v4\nv5\nv6\nv7\n" {
+		t.Errorf("on-apply-succeeded versions = %q, want one per version", hooks)
+	}
+	if got := testutil.ToFloat64(applySuccessTotal.WithLabelValues("sequential")) - successes; got != 4 {
+		t.Errorf("apply successes = %v, want 4", got)
+	}
+}
+
+func TestSyncerMinApplyInterval(t *testing.T) {
+	const addColumn = "ALTER TABLE users ADD COLUMN name text;"
+	newSyncer := func(t *testing.T, bucket *memoryBucket, sequential bool, dryRun string) (*Syncer, string) {
+		t.Helper()
+		applyLog := filepath.Join(t.TempDir(), "apply.log")
+		stub := writeStubPsqldef(t, `file="$(echo "$@" | sed 's/.*--file //')"
+case "$*" in
+*--dry-run*) echo '`+dryRun+`' ;;
+*) cat "$file" >> `+applyLog+` ;;
+esac`)
+		cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+		syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		t.Cleanup(syncer.Close)
+		syncer.SkipLock = true
+		syncer.ApplySequentially = sequential
+		syncer.MinApplyInterval = time.Hour
+		syncer.Target = "rate-limit-" + t.Name()
+		return syncer, applyLog
+	}
+	run := func(t *testing.T, syncer *Syncer) {
+		t.Helper()
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+	}
+	// elapse moves the last apply back past the interval, as if the polls in between had waited it out
+	elapse := func(syncer *Syncer) { syncer.lastApplyAt = time.Now().Add(-syncer.MinApplyInterval - time.Second) }
+	check := func(t *testing.T, syncer *Syncer, applyLog, wantApplied string, wantHeld float64) {
+		t.Helper()
+		applied, _ := os.ReadFile(applyLog)
+		if got := strings.Join(strings.Fields(string(applied)), " "); got != wantApplied {
+			t.Errorf("applied %q, want %q", got, wantApplied)
+		}
+		if got := testutil.ToFloat64(versionsRateLimited.WithLabelValues(syncer.Target)); got != wantHeld {
+			t.Errorf("versions_rate_limited = %v, want %v", got, wantHeld)
+		}
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/v1/completed", "schemas/v2/schema.sql", "schemas/v3/schema.sql", "schemas/v4/schema.sql")
+		syncer, applyLog := newSyncer(t, bucket, true, addColumn)
+
+		// The first apply of the process is not limited; v3 and v4 wait for the interval
+		run(t, syncer)
+		check(t, syncer, applyLog, "v2", 2)
+
+		// Polls within the interval apply nothing and leave the deferred versions without a marker
+		run(t, syncer)
+		check(t, syncer, applyLog, "v2", 2)
+		if bucket.has("schemas/v3/completed") || bucket.has("schemas/v4/completed") {
+			t.Error("a deferred version was marked completed")
+		}
+
+		// Each interval lets one more version through, in order
+		elapse(syncer)
+		run(t, syncer)
+		check(t, syncer, applyLog, "v2 v3", 1)
+		elapse(syncer)
+		run(t, syncer)
+		check(t, syncer, applyLog, "v2 v3 v4", 0)
+		for _, ver := range []string{"v2", "v3", "v4"} {
+			if !bucket.has("schemas/" + ver + "/completed") {
+				t.Errorf("%s was not marked completed", ver)
+			}
+		}
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		bucket := newMemoryBucket("schemas/v1/schema.sql")
+		syncer, applyLog := newSyncer(t, bucket, false, addColumn)
+		run(t, syncer)
+		check(t, syncer, applyLog, "v1", 0)
+
+		// A version pushed within the interval waits; a newer one pushed meanwhile replaces it as the latest
+		bucket.put("schemas/v2/schema.sql")
+		run(t, syncer)
+		check(t, syncer, applyLog, "v1", 1)
+		if syncer.LastAppliedVersion() != "v1" {
+			t.Errorf("LastAppliedVersion() = %q, want v1 while v2 is deferred", syncer.LastAppliedVersion())
+		}
+		bucket.put("schemas/v3/schema.sql")
+		elapse(syncer)
+		run(t, syncer)
+		check(t, syncer, applyLog, "v1 v3", 0)
+
+		// Nothing new: the interval does not matter
+		run(t, syncer)
+		check(t, syncer, applyLog, "v1 v3", 0)
+	})
+
+	t.Run("no change does not start the interval", func(t *testing.T) {
+		bucket := newMemoryBucket("schemas/v1/schema.sql")
+		syncer, _ := newSyncer(t, bucket, false, "-- Nothing is modified --")
+		run(t, syncer)
+		if !syncer.lastApplyAt.IsZero() {
+			t.Error("a version that needed no DDL started the --min-apply-interval")
+		}
+	})
+}
+
+func TestSyncerDowngradeBlocked(t *testing.T) {
+	// v9 was never applied: the syncer went from v8 straight to v10
+	bucket := newMemoryBucket(
+		"schemas/v8/schema.sql",
+		"schemas/v8/completed",
+		"schemas/v9/schema.sql",
+		"schemas/v10/schema.sql",
+		"schemas/v10/completed",
+	)
+
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	newSyncer := func() *Syncer {
+		syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.SkipLock = true
+		syncer.Target = "downgrade"
+		syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+		return syncer
+	}
+	blocked := func() float64 {
+		return testutil.ToFloat64(downgradeBlockedTotal.WithLabelValues("downgrade"))
+	}
+	before := blocked()
+
+	// A running syncer has applied v10 when the whole v10 directory, marker included, is deleted
+	running := newSyncer()
+	if err := running.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if running.LastAppliedVersion() != "v10" {
+		t.Fatalf("LastAppliedVersion() = %q, want v10", running.LastAppliedVersion())
+	}
+	bucket.deleteDir("v10")
+	if err := running.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "downgrade blocked") {
+		t.Errorf("Run() after deleting v10 error = %v, want downgrade blocked", err)
+	}
+
+	// A fresh syncer only has the completion markers: the v10 schema is gone but its marker is left
+	bucket.put("schemas/v10/completed")
+	if err := newSyncer().Run(context.Background()); err == nil || !strings.Contains(err.Error(), "downgrade blocked") {
+		t.Errorf("Run() on a fresh syncer error = %v, want downgrade blocked", err)
+	}
+
+	if applied, _ := os.ReadFile(applyLog); len(applied) != 0 {
+		t.Errorf("applied versions = %q, want none", applied)
+	}
+	if hooks, _ := os.ReadFile(hookLog); string(hooks) != "v9 downgrade-blocked\nv9 downgrade-blocked\n" {
+		t.Errorf("on-apply-failed = %q, want two downgrade-blocked runs for v9", hooks)
+	}
+	if got := blocked() - before; got != 2 {
+		t.Errorf("downgrades blocked = %v, want 2", got)
+	}
+
+	allowed := newSyncer()
+	allowed.AllowDowngrade = true
+	if err := allowed.Run(context.Background()); err != nil {
+		t.Fatalf("Run() with AllowDowngrade error = %v", err)
+	}
+	if applied, _ := os.ReadFile(applyLog); string(applied) != "v9\n" {
+		t.Errorf("applied versions = %q, want v9 with AllowDowngrade", applied)
+	}
+}
+
+func TestSyncerOnlyCompleted(t *testing.T) {
+	dir := t.TempDir()
+	applyLog := filepath.Join(dir, "apply.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'ALTER TABLE users ADD COLUMN name text;' ;;
+*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+applyLog+` ;;
+esac`)
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	newSyncer := func(bucket *memoryBucket, completedFile string) *Syncer {
+		syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+		syncer.SkipLock = true
+		syncer.CompletedFile = completedFile
+		syncer.OnlyCompletedFile = "completed"
+		return syncer
+	}
+	run := func(syncer *Syncer, wantApplied string) {
+		t.Helper()
+		if err := syncer.Run(context.Background()); err != nil {
+			t.Fatalf("Run() error = %v", err)
+		}
+		if applied, _ := os.ReadFile(applyLog); string(applied) != wantApplied {
+			t.Errorf("applied versions = %q, want %q", applied, wantApplied)
+		}
+	}
+
+	t.Run("shared marker is a precondition", func(t *testing.T) {
+		t.Cleanup(func() { _ = os.Remove(applyLog) })
+		bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/v2/schema.sql")
+		syncer := newSyncer(bucket, "completed")
+
+		// Nothing is completed anywhere yet
+		run(syncer, "")
+
+		// Staging completed v1; v2 is not validated yet
+		bucket.put("schemas/v1/completed")
+		run(syncer, "v1\n")
+		run(syncer, "v1\n")
+
+		// A rolled-back version is not promoted
+		bucket.put("schemas/v2/completed")
+		bucket.put("schemas/v2/" + schemastore.RolledBackFileName)
+		run(syncer, "v1\n")
+
+		bucket.deleteDir("v2")
+		bucket.put("schemas/v3/schema.sql")
+		bucket.put("schemas/v3/completed")
+		run(syncer, "v1\nv3\n")
+		if syncer.LastAppliedVersion() != "v3" {
+			t.Errorf("LastAppliedVersion() = %q, want v3", syncer.LastAppliedVersion())
+		}
+	})
+
+	t.Run("own marker still skips", func(t *testing.T) {
+		t.Cleanup(func() { _ = os.Remove(applyLog) })
+		// A --db target writes completed.prod and requires the completed marker of staging
+		bucket := newMemoryBucket(
+			"schemas/v1/schema.sql", "schemas/v1/completed", "schemas/v1/completed.prod",
+			"schemas/v2/schema.sql", "schemas/v2/completed",
+			"schemas/v3/schema.sql",
+		)
+		run(newSyncer(bucket, "completed.prod"), "v2\n")
+		if !bucket.has("schemas/v2/completed.prod") {
+			t.Error("expected the target's own completion marker for v2")
+		}
+
+		// A restarted process skips v2 by its own marker
+		run(newSyncer(bucket, "completed.prod"), "v2\n")
+	})
+}
+
+func TestSyncerTimeouts(t *testing.T) {
+	tests := []struct {
+		name      string
+		script    string
+		dryRun    time.Duration
+		apply     time.Duration
+		wantErr   string
+		wantApply bool
+	}{
+		{
+			name: "apply timeout",
+			script: `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id int);' ;;
+*) echo applying >> $APPLY_LOG; sleep 30 ;;
+esac`,
+			apply:     200 * time.Millisecond,
+			wantErr:   "timed out after 200ms",
+			wantApply: true,
+		},
+		{
+			name: "dry-run timeout aborts without applying",
+			script: `case "$*" in
+*--dry-run*) sleep 30 ;;
+*) echo applying >> $APPLY_LOG ;;
+esac`,
+			dryRun:  200 * time.Millisecond,
+			wantErr: "timed out after 200ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			applyLog := filepath.Join(dir, "apply.log")
+			hookLog := filepath.Join(dir, "hook.log")
+			t.Setenv("APPLY_LOG", applyLog)
+			stub := writeStubPsqldef(t, tt.script)
+
+			syncer := NewSyncer(nil, &CLI{PsqldefPath: stub}, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			syncer.SkipLock = true
+			syncer.DryRunTimeout = tt.dryRun
+			syncer.ApplyTimeout = tt.apply
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_ERROR" > ` + hookLog
+
+			errorsBefore := testutil.ToFloat64(applyErrorTotal.WithLabelValues(""))
+			start := time.Now()
+			err := syncer.ApplyLocal(context.Background(), "schema.sql", "v1", []byte("CREATE TABLE users (id int);"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ApplyLocal() error = %v, want containing %q", err, tt.wantErr)
+			}
+			// The sleep runs in a child of the stub shell; it must be killed with the process group
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("ApplyLocal() took %v, want the sqldef process group killed at the timeout", elapsed)
+			}
+			if got := testutil.ToFloat64(applyErrorTotal.WithLabelValues("")) - errorsBefore; got != 1 {
+				t.Errorf("apply errors = %v, want 1", got)
+			}
+			if hook, _ := os.ReadFile(hookLog); !strings.Contains(string(hook), tt.wantErr) {
+				t.Errorf("on-apply-failed DB_SCHEMA_SYNC_ERROR = %q, want containing %q", hook, tt.wantErr)
+			}
+			if _, err := os.Stat(applyLog); (err == nil) != tt.wantApply {
+				t.Errorf("apply ran = %v, want %v", err == nil, tt.wantApply)
+			}
+		})
+	}
+}
+
+func TestSyncerCancelKillsApply(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "apply.pid")
+	stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) echo 'CREATE TABLE users (id int);' ;;
+*) echo $$ > `+pidFile+`; sleep 30 ;;
+esac`)
+	syncer := NewSyncer(nil, &CLI{PsqldefPath: stub}, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	syncer.SkipLock = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			if _, err := os.Stat(pidFile); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	err := syncer.ApplyLocal(ctx, "schema.sql", "v1", []byte("CREATE TABLE users (id int);"))
+	if err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("ApplyLocal() error = %v, want a cancellation", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("ApplyLocal() took %v, want the apply killed on cancel", elapsed)
+	}
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(pid, 0); !errors.Is(err, syscall.ESRCH) {
+		t.Errorf("apply process %d still exists: %v", pid, err)
+	}
+}
+
+func TestSyncerHookEnvIdentity(t *testing.T) {
+	hookLog := filepath.Join(t.TempDir(), "hook.log")
+	stub := writeStubPsqldef(t, `echo 'CREATE TABLE users (id int);'`)
+	syncer := NewSyncer(nil, &CLI{PsqldefPath: stub}, DBConfig{Host: "db.internal", Port: "5432", User: "user", Password: "pass", Name: "app"})
+	syncer.SkipLock = true
+	syncer.Hooks.OnApplySucceeded = `echo "$DB_SCHEMA_SYNC_SYNC_ATTEMPT $DB_SCHEMA_SYNC_DB_HOST:$DB_SCHEMA_SYNC_DB_PORT/$DB_SCHEMA_SYNC_DB_NAME $DB_SCHEMA_SYNC_HOSTNAME $DB_SCHEMA_SYNC_STARTED_AT $DB_SCHEMA_SYNC_FINISHED_AT $DB_SCHEMA_SYNC_APPLY_DURATION_MS" >> ` + hookLog
+
+	for range 2 {
+		if err := syncer.ApplyLocal(context.Background(), "schema.sql", "v1", []byte("CREATE TABLE users (id int);")); err != nil {
+			t.Fatalf("ApplyLocal() error = %v", err)
+		}
+	}
+
+	content, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("hook ran %d times, want 2: %q", len(lines), content)
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			t.Fatalf("hook env = %q, want 6 fields", line)
+		}
+		if fields[0] != strconv.Itoa(i+1) || fields[1] != "db.internal:5432/app" || fields[2] != hostname {
+			t.Errorf("attempt, database and host = %v", fields[:3])
+		}
+		started, err1 := time.Parse(time.RFC3339, fields[3])
+		finished, err2 := time.Parse(time.RFC3339, fields[4])
+		if err1 != nil || err2 != nil || finished.Before(started) {
+			t.Errorf("started_at %s, finished_at %s", fields[3], fields[4])
+		}
+		if _, err := strconv.ParseInt(fields[5], 10, 64); err != nil {
+			t.Errorf("apply duration %q is not a number of milliseconds", fields[5])
+		}
+	}
+}
+
+func TestSyncerExportedHistory(t *testing.T) {
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	client := bucket.client()
+	uploads := make(map[string]*s3.PutObjectInput)
+	put := client.putObjectFunc
+	client.putObjectFunc = func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		uploads[*params.Key] = params
+		return put(ctx, params, optFns...)
+	}
+	stub := writeStubPsqldef(t, `case "$*" in
+*--export*) echo 'CREATE TABLE users (id integer);' ;;
+esac`)
+
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(client, cli, DBConfig{Host: "db.internal", Port: "5432", User: "user", Password: "pass", Name: "app"})
+	syncer.SkipLock = true
+	syncer.ExportAfterApply = true
+	syncer.ExportedHistory = true
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	var history string
+	for key := range uploads {
+		if strings.HasPrefix(key, "schemas/v1/exported-") {
+			history = key
+		}
+	}
+	if !regexp.MustCompile(`^schemas/v1/exported-\d{8}T\d{6}Z\.sql$`).MatchString(history) {
+		t.Fatalf("uploaded keys = %v, want a timestamped exported copy", bucket.objects)
+	}
+	for _, key := range []string{"schemas/v1/exported.sql", history} {
+		params := uploads[key]
+		if params == nil {
+			t.Fatalf("%s was not uploaded", key)
+		}
+		if ct := aws.ToString(params.ContentType); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s Content-Type = %q", key, ct)
+		}
+		if params.Metadata["source-database"] != "db.internal:5432/app" || params.Metadata["app-version"] != Version || params.Metadata["exported-at"] == "" {
+			t.Errorf("%s metadata = %v", key, params.Metadata)
+		}
+	}
+	if ct := aws.ToString(uploads["schemas/v1/completed"].ContentType); ct != "application/json" {
+		t.Errorf("completion marker Content-Type = %q, want application/json", ct)
+	}
+}
+
+// lostLocker acquires the lock but reports it lost by the time HeldCheck is called
+type lostLocker struct{}
+
+func (lostLocker) TryLockWithWait(context.Context, time.Duration) (bool, error) { return true, nil }
+func (lostLocker) Unlock(context.Context) error                                 { return nil }
+func (lostLocker) Close() error                                                 { return nil }
+func (lostLocker) HeldCheck(context.Context) error {
+	return fmt.Errorf("advisory lock 1 held by backend 42: %w", errLockLost)
+}
+
+func TestSyncerLockLost(t *testing.T) {
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `echo 'CREATE TABLE users (id integer);'`)
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+	syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	defer syncer.Close()
+	syncer.NewLocker = func(context.Context, int64) (Locker, error) { return lostLocker{}, nil }
+	syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+	err := syncer.Run(context.Background())
+	if !errors.Is(err, errLockLost) {
+		t.Fatalf("Run() error = %v, want errLockLost", err)
+	}
+	if bucket.has("schemas/v1/completed") {
+		t.Error("completion marker was created after the lock was lost")
+	}
+	if syncer.LastAppliedVersion() != "" {
+		t.Errorf("LastAppliedVersion() = %q, want none so the next sync applies again", syncer.LastAppliedVersion())
+	}
+	content, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatalf("failed to read hook log: %v", err)
+	}
+	if strings.TrimSpace(string(content)) != "lock-lost" {
+		t.Errorf("DB_SCHEMA_SYNC_FAILURE_REASON = %q, want lock-lost", content)
+	}
+}
+
+// blockingApplier holds the apply until release is closed, like a long psqldef run
+type blockingApplier struct {
+	*fakeApplier
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a blockingApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	close(a.started)
+	<-a.release
+	return a.fakeApplier.Apply(ctx, schemaFile)
+}
+
+func TestSyncerRunSingleFlight(t *testing.T) {
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+	syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	defer syncer.Close()
+	syncer.SkipLock = true
+	applier := blockingApplier{&fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}, make(chan struct{}), make(chan struct{})}
+	syncer.Applier = applier
+
+	first := make(chan error, 1)
+	go func() { first <- syncer.Run(context.Background()) }()
+	<-applier.started
+
+	const callers = 20
+	refusedBefore := testutil.ToFloat64(syncInProgressTotal.WithLabelValues("run"))
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- syncer.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, errSyncInProgress) {
+			t.Errorf("Run() during a sync error = %v, want errSyncInProgress", err)
+		}
+	}
+	if got := testutil.ToFloat64(syncInProgressTotal.WithLabelValues("run")) - refusedBefore; got != callers {
+		t.Errorf("sync_in_progress_total{source=run} increased by %v, want %d", got, callers)
+	}
+
+	close(applier.release)
+	if err := <-first; err != nil {
+		t.Fatalf("first Run() error = %v", err)
+	}
+	if len(applier.applied) != 1 {
+		t.Errorf("applied %q, want the version once", applier.applied)
+	}
+	// The guard is released with the sync
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Errorf("Run() after the sync error = %v", err)
+	}
+}
+
+// ctxApplier plans a change and blocks in Apply until ctx is done, like psqldef waiting on a table lock
+type ctxApplier struct{ *fakeApplier }
+
+func (ctxApplier) Apply(ctx context.Context, schemaFile string) (*ApplyResult, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// hangingDryRunApplier blocks every dry-run after the first hangAfter until the context is done
+type hangingDryRunApplier struct {
+	*fakeApplier
+	hangAfter int
+	dryRuns   int
+}
+
+func (a *hangingDryRunApplier) DryRun(ctx context.Context, schemaFile string) (string, error) {
+	a.dryRuns++
+	if a.dryRuns > a.hangAfter {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return a.fakeApplier.DryRun(ctx, schemaFile)
+}
+
+// unlockRecorder holds the lock and records whether Unlock got a live context
+type unlockRecorder struct {
+	heldCheckLocker
+	unlocked bool
+}
+
+func (l *unlockRecorder) Unlock(ctx context.Context) error {
+	l.unlocked = ctx.Err() == nil
+	return nil
+}
+
+func TestSyncerSyncTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		listBlocks  bool
+		beforeApply string
+		wantHook    bool
+	}{
+		{name: "S3 listing hangs", listBlocks: true},
+		{name: "apply hangs", wantHook: true},
+		{name: "hook hangs", beforeApply: "sleep 10", wantHook: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			bucket := newMemoryBucket("schemas/v1/schema.sql")
+			client := bucket.client()
+			if tt.listBlocks {
+				client.listObjectsFunc = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			locker := &unlockRecorder{}
+			syncer.NewLocker = func(context.Context, int64) (Locker, error) { return locker, nil }
+			syncer.Applier = ctxApplier{&fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}}
+			syncer.SyncTimeout = 200 * time.Millisecond
+			syncer.Target = "sync-timeout-" + strings.ReplaceAll(tt.name, " ", "-")
+			syncer.Hooks.OnBeforeApply = tt.beforeApply
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+			start := time.Now()
+			err := syncer.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), "sync timed out after 200ms (--sync-timeout)") {
+				t.Fatalf("Run() error = %v, want a sync timeout", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Run() took %v, want it canceled at the timeout", elapsed)
+			}
+			if got := testutil.ToFloat64(syncTimeoutTotal.WithLabelValues(syncer.Target)); got != 1 {
+				t.Errorf("timeout_total = %v, want 1", got)
+			}
+			hook, _ := os.ReadFile(hookLog)
+			wantHook := ""
+			if tt.wantHook {
+				wantHook = "v1 sync-timeout\n"
+			}
+			if string(hook) != wantHook {
+				t.Errorf("on-apply-failed ran with %q, want %q", hook, wantHook)
+			}
+			if !tt.listBlocks && !locker.unlocked {
+				t.Error("the lock was not released with a live context")
+			}
+			if bucket.has("schemas/v1/completed") {
+				t.Error("completion marker was created for a timed-out sync")
+			}
+		})
+	}
+
+	// Once the apply has succeeded, a timeout later in the sync fails the sync but not the apply
+	for _, tt := range []struct {
+		name        string
+		keys        []string
+		succeeded   string
+		wantTimeout bool
+		wantApplied []string
+	}{
+		{name: "success hook hangs", keys: []string{"schemas/v1/schema.sql"}, succeeded: "sleep 10", wantApplied: []string{"v1"}},
+		{name: "next version hangs", keys: []string{"schemas/v1/schema.sql", "schemas/v2/schema.sql"}, wantTimeout: true, wantApplied: []string{"v1"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			hookLog := filepath.Join(t.TempDir(), "hook.log")
+			bucket := newMemoryBucket(tt.keys...)
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+			syncer := NewSyncer(bucket.client(), cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+			defer syncer.Close()
+			applier := &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}
+			syncer.Applier = &hangingDryRunApplier{fakeApplier: applier, hangAfter: 1}
+			syncer.SkipLock = true
+			syncer.ApplySequentially = true
+			syncer.SyncTimeout = 200 * time.Millisecond
+			syncer.Hooks.OnApplySucceeded = tt.succeeded
+			syncer.Hooks.OnApplyFailed = `echo "$DB_SCHEMA_SYNC_VERSION $DB_SCHEMA_SYNC_FAILURE_REASON" >> ` + hookLog
+
+			err := syncer.Run(context.Background())
+			if tt.wantTimeout && (err == nil || !strings.Contains(err.Error(), "sync timed out after 200ms (--sync-timeout)")) {
+				t.Fatalf("Run() error = %v, want a sync timeout", err)
+			}
+			if !tt.wantTimeout && err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if hook, _ := os.ReadFile(hookLog); len(hook) > 0 {
+				t.Errorf("on-apply-failed ran with %q after the apply succeeded", hook)
+			}
+			if !reflect.DeepEqual(applier.applied, tt.wantApplied) {
+				t.Errorf("applied %q, want %q", applier.applied, tt.wantApplied)
+			}
+			if !bucket.has("schemas/v1/completed") {
+				t.Error("completion marker of the applied version was not created")
+			}
+		})
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		if err := checkSyncTimeout(30*time.Minute, 10*time.Minute, 10*time.Minute); err != nil {
+			t.Errorf("checkSyncTimeout() error = %v", err)
+		}
+		if err := checkSyncTimeout(0, 10*time.Minute, 10*time.Minute); err != nil {
+			t.Errorf("checkSyncTimeout() error = %v, want 0 to disable the check", err)
+		}
+		if err := checkSyncTimeout(20*time.Minute, 10*time.Minute, 10*time.Minute); err == nil || !strings.Contains(err.Error(), "must be larger than --dry-run-timeout plus --apply-timeout (20m0s)") {
+			t.Errorf("checkSyncTimeout() error = %v, want the timeouts rejected", err)
+		}
+	})
+}
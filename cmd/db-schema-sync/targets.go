@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// dbTarget is one database the schema is applied to. Name is empty unless --db or --prefix-file is used.
+type dbTarget struct {
+	Name string
+	// PathPrefix replaces --path-prefix for a --prefix-file entry
+	PathPrefix string
+	DB         DBConfig
+}
+
+// targetNamePattern restricts target names to characters that are safe in S3 keys and metric labels
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// resolveTargets returns one target per --db value, or a single unnamed target for db when --db is not set.
+// --db values are [name=]host:port/dbname and take the user and password from db; the name defaults to the host.
+func resolveTargets(specs []string, engine string, db DBConfig) ([]dbTarget, error) {
+	if len(specs) == 0 {
+		if err := db.validate(engine); err != nil {
+			return nil, err
+		}
+		return []dbTarget{{DB: db}}, nil
+	}
+	if engine == EngineSQLite3 {
+		return nil, fmt.Errorf("--db cannot be used with --engine %s", engine)
+	}
+	if db.Host != "" || db.Port != "" || db.Name != "" {
+		return nil, fmt.Errorf("--db cannot be combined with --db-host, --db-port or --db-name")
+	}
+
+	seen := make(map[string]bool)
+	targets := make([]dbTarget, 0, len(specs))
+	for _, spec := range specs {
+		target, err := parseDBTarget(spec, db)
+		if err != nil {
+			return nil, err
+		}
+		if err := target.DB.validate(engine); err != nil {
+			return nil, fmt.Errorf("--db %s: %w", target.Name, err)
+		}
+		if seen[target.Name] {
+			return nil, fmt.Errorf("duplicate --db target name %q (name targets explicitly with name=host:port/dbname)", target.Name)
+		}
+		seen[target.Name] = true
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// parseDBTarget parses a --db value of the form [name=]host:port/dbname
+func parseDBTarget(spec string, db DBConfig) (dbTarget, error) {
+	name, addr, named := strings.Cut(spec, "=")
+	if !named {
+		name, addr = "", spec
+	}
+	hostPort, dbName, _ := strings.Cut(addr, "/")
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || host == "" || port == "" || dbName == "" {
+		return dbTarget{}, fmt.Errorf("invalid --db %q: want [name=]host:port/dbname", spec)
+	}
+	if name == "" {
+		name = host
+	}
+	if !targetNamePattern.MatchString(name) {
+		return dbTarget{}, fmt.Errorf("invalid --db %q: target name %q may only contain letters, digits, '.', '_' and '-'", spec, name)
+	}
+
+	db.Host, db.Port, db.Name = host, port, dbName
+	return dbTarget{Name: name, DB: db}, nil
+}
+
+// newTargetSyncer creates the Syncer for target. A --db target gets its own completion marker, failure marker
+// and applied DDL file (completed.<name>), so a target that failed is retried while the others stay completed.
+// A --prefix-file target already has its own markers under its path prefix.
+func newTargetSyncer(client schemastore.S3Client, cli *CLI, target dbTarget) *Syncer {
+	s := NewSyncer(client, cli, target.DB)
+	if target.PathPrefix != "" {
+		s.PathPrefix = target.PathPrefix
+		s.Target = target.Name
+	} else if target.Name != "" {
+		s.Target = target.Name
+		if s.CompletedFile != "" {
+			s.CompletedFile += "." + target.Name
+		}
+		if s.AppliedDDLFile != "" {
+			s.AppliedDDLFile += "." + target.Name
+		}
+		if s.PreApplyBackupFile != "" {
+			s.PreApplyBackupFile += "." + target.Name
+		}
+		if s.FailedFile != "" {
+			s.FailedFile += "." + target.Name
+		}
+	}
+	initTargetMetrics(s.Target)
+	recordConfigInfo(s.S3Bucket, s.PathPrefix, s.SchemaFile)
+	return s
+}
+
+// forEachTarget calls fn for every syncer in order. A failing target does not stop the others;
+// the errors of all failed targets are joined.
+func forEachTarget(syncers []*Syncer, fn func(*Syncer) error) error {
+	if len(syncers) == 1 {
+		return fn(syncers[0])
+	}
+	var errs []error
+	for _, s := range syncers {
+		if err := fn(s); err != nil {
+			slog.Error("Sync failed for target", "target", s.Target, "error", err)
+			errs = append(errs, fmt.Errorf("target %s: %w", s.Target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// backoffFailures returns the consecutive S3 failure count that drives the backoff: the lowest of syncers,
+// so a broken prefix does not slow down polling for the healthy ones
+func backoffFailures(syncers []*Syncer) int {
+	failures := syncers[0].ConsecutiveFailures()
+	for _, s := range syncers[1:] {
+		failures = min(failures, s.ConsecutiveFailures())
+	}
+	return failures
+}
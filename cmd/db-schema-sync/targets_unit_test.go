@@ -0,0 +1,161 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResolveTargets(t *testing.T) {
+	creds := DBConfig{User: "app", Password: "secret"}
+
+	tests := []struct {
+		name    string
+		engine  string
+		specs   []string
+		db      DBConfig
+		want    []dbTarget
+		wantErr string
+	}{
+		{
+			"no --db uses the single database",
+			EnginePostgres, nil,
+			DBConfig{Host: "localhost", Port: "5432", User: "app", Password: "secret", Name: "appdb"},
+			[]dbTarget{{DB: DBConfig{Host: "localhost", Port: "5432", User: "app", Password: "secret", Name: "appdb"}}},
+			"",
+		},
+		{
+			"named and unnamed targets",
+			EnginePostgres, []string{"db01=10.0.0.1:5432/app", "db02.internal:5433/app"}, creds,
+			[]dbTarget{
+				{Name: "db01", DB: DBConfig{Host: "10.0.0.1", Port: "5432", User: "app", Password: "secret", Name: "app"}},
+				{Name: "db02.internal", DB: DBConfig{Host: "db02.internal", Port: "5433", User: "app", Password: "secret", Name: "app"}},
+			},
+			"",
+		},
+		{"ipv6 host", EngineMySQL, []string{"shard=[::1]:3306/app"}, creds, []dbTarget{{Name: "shard", DB: DBConfig{Host: "::1", Port: "3306", User: "app", Password: "secret", Name: "app"}}}, ""},
+		{"missing port", EnginePostgres, []string{"db01/app"}, creds, nil, "want [name=]host:port/dbname"},
+		{"missing dbname", EnginePostgres, []string{"db01:5432"}, creds, nil, "want [name=]host:port/dbname"},
+		{"invalid name", EnginePostgres, []string{"db 01=db01:5432/app"}, creds, nil, "may only contain"},
+		{"duplicate name", EnginePostgres, []string{"db01:5432/app", "db01:5433/app"}, creds, nil, `duplicate --db target name "db01"`},
+		{"missing credentials", EnginePostgres, []string{"db01:5432/app"}, DBConfig{}, nil, "--db db01: missing flags"},
+		{"combined with --db-host", EnginePostgres, []string{"db01:5432/app"}, DBConfig{Host: "localhost"}, nil, "cannot be combined with --db-host"},
+		{"sqlite3", EngineSQLite3, []string{"db01:5432/app"}, creds, nil, "cannot be used with --engine sqlite3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveTargets(tt.specs, tt.engine, tt.db)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveTargets() error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTargets() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveTargets() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFanOutContinuesAfterFailedTarget(t *testing.T) {
+	dir := t.TempDir()
+	hookLog := filepath.Join(dir, "hook.log")
+	stub := writeStubPsqldef(t, `case "$*" in
+*db02*) echo 'connection refused' >&2; exit 1 ;;
+*--dry-run*) echo 'CREATE TABLE users (id int);' ;;
+*) echo applied ;;
+esac`)
+
+	objects := map[string]string{"schemas/v1/schema.sql": "CREATE TABLE users (id int);"}
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{{Key: aws.String("schemas/v1/schema.sql")}}}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if _, ok := objects[*params.Key]; !ok {
+				return nil, &types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			objects[*params.Key] = string(body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PreApplyBackupFile: "pre-apply-backup.sql", PsqldefPath: stub}
+
+	targets, err := resolveTargets([]string{"db01=db01:5432/app", "db02=db02:5432/app", "db03=db03:5432/app"}, EnginePostgres, DBConfig{User: "app", Password: "secret"})
+	if err != nil {
+		t.Fatalf("resolveTargets() error = %v", err)
+	}
+	var syncers []*Syncer
+	for _, target := range targets {
+		syncer := newTargetSyncer(client, cli, target)
+		syncer.SkipLock = true
+		defer syncer.Close()
+		syncer.Hooks.OnApplySucceeded = `echo "$DB_SCHEMA_SYNC_TARGET $DB_SCHEMA_SYNC_COMPLETED_FILE" >> ` + hookLog
+		syncers = append(syncers, syncer)
+	}
+
+	run := func(s *Syncer) error { return s.Run(context.Background()) }
+	err = forEachTarget(syncers, run)
+	if err == nil || !strings.Contains(err.Error(), "target db02: failed to apply schema") {
+		t.Fatalf("forEachTarget() error = %v, want db02 failure", err)
+	}
+
+	for _, key := range []string{"schemas/v1/completed.db01", "schemas/v1/completed.db03", "schemas/v1/pre-apply-backup.sql.db01", "schemas/v1/pre-apply-backup.sql.db03"} {
+		if _, ok := objects[key]; !ok {
+			t.Errorf("expected %s", key)
+		}
+	}
+	if _, ok := objects["schemas/v1/completed.db02"]; ok {
+		t.Error("expected no completion marker for the failed target")
+	}
+	if hook, _ := os.ReadFile(hookLog); string(hook) != "db01 completed.db01\ndb03 completed.db03\n" {
+		t.Errorf("on-apply-succeeded output = %q", hook)
+	}
+	if got := testutil.ToFloat64(applySuccessTotal.WithLabelValues("db03")); got != 1 {
+		t.Errorf("apply_success_total{target=db03} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(applyErrorTotal.WithLabelValues("db02")); got != 1 {
+		t.Errorf("apply_error_total{target=db02} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(lastAppliedVersionInfo.WithLabelValues("db01", "v1")); got != 1 {
+		t.Errorf("last_applied_version_info{target=db01} = %v, want 1", got)
+	}
+
+	// Completed targets are skipped on the next run
+	if err := os.Remove(hookLog); err != nil {
+		t.Fatal(err)
+	}
+	if err := forEachTarget([]*Syncer{syncers[0], syncers[2]}, run); err != nil {
+		t.Fatalf("forEachTarget() error = %v", err)
+	}
+	if _, err := os.Stat(hookLog); !os.IsNotExist(err) {
+		t.Error("expected completed targets to be skipped")
+	}
+}
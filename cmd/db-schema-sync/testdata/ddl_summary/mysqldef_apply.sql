@@ -0,0 +1,7 @@
+-- Apply --
+CREATE TABLE `orders` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  PRIMARY KEY (`id`)
+);
+ALTER TABLE `users` ADD COLUMN `email` varchar(255) AFTER `name`;
+drop table `sessions`;
@@ -0,0 +1,2 @@
+-- dry run --
+-- Nothing is modified --
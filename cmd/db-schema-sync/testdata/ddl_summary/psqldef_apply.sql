@@ -0,0 +1,14 @@
+-- Apply --
+BEGIN;
+CREATE TABLE "public"."orders" (
+    "id" bigserial NOT NULL,
+    "user_id" bigint NOT NULL,
+    "total" numeric(10,2),
+    PRIMARY KEY ("id")
+);
+ALTER TABLE "public"."users" ADD COLUMN "email" text;
+ALTER TABLE "public"."users" ALTER COLUMN "name" SET NOT NULL;
+CREATE INDEX idx_orders_user_id ON public.orders USING btree (user_id);
+DROP INDEX "public"."idx_users_legacy";
+COMMENT ON COLUMN "public"."users"."email" IS 'login address';
+COMMIT;
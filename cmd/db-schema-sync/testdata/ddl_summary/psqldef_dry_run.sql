@@ -0,0 +1,6 @@
+-- dry run --
+BEGIN;
+ALTER TABLE "public"."users" DROP COLUMN "legacy_name";
+-- Skipped: DROP TABLE "public"."sessions";
+CREATE VIEW "public"."active_users" AS select id from users where active;
+COMMIT;
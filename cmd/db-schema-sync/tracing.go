@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the spans of syncs, S3 calls and sqldef runs when --otel-enabled is set.
+// It is nil otherwise, so an untraced run only pays for the nil checks in startSpan and the span methods.
+var tracer trace.Tracer
+
+// setupTracing sets tracer to export spans over OTLP/HTTP. The endpoint, headers, timeout and TLS
+// settings come from the standard OTEL_EXPORTER_OTLP_* environment variables, the sampler from
+// OTEL_TRACES_SAMPLER and extra resource attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+// The returned function flushes the spans not exported yet.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	// Detectors later in the list win, so OTEL_SERVICE_NAME overrides the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "db-schema-sync"), attribute.String("service.version", Version)),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OpenTelemetry resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	tracer = provider.Tracer("github.com/tokuhirom/db-schema-sync", trace.WithInstrumentationVersion(Version))
+	return provider.Shutdown, nil
+}
+
+// span is a span that may be disabled; its methods do nothing when tracing is off
+type span struct {
+	s trace.Span
+}
+
+// startSpan starts a child span of the span in ctx, if tracing is enabled
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, span) {
+	if tracer == nil {
+		return ctx, span{}
+	}
+	ctx, s := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, span{s: s}
+}
+
+// set adds attributes known only after the span started
+func (sp span) set(attrs ...attribute.KeyValue) {
+	if sp.s != nil {
+		sp.s.SetAttributes(attrs...)
+	}
+}
+
+// end ends the span, recording err as its failure
+func (sp span) end(err error) {
+	if sp.s == nil {
+		return
+	}
+	if err != nil {
+		sp.s.RecordError(err)
+		sp.s.SetStatus(codes.Error, err.Error())
+	}
+	sp.s.End()
+}
+
+// endCommand ends the span of a sqldef run with the number of DDL statements in its output and its exit code.
+// The statements are only counted when tracing is enabled.
+func (sp span) endCommand(output string, err error) {
+	if sp.s == nil {
+		return
+	}
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		exitCode = -1
+	}
+	sp.s.SetAttributes(
+		attribute.Int("db_schema_sync.ddl_statement_count", len(splitDDLStatements(output))),
+		attribute.Int("process.exit_code", exitCode),
+	)
+	sp.end(err)
+}
+
+// bucketAttr is the attribute for the S3 bucket a span works on
+func bucketAttr(bucket string) attribute.KeyValue {
+	return attribute.String("aws.s3.bucket", bucket)
+}
+
+// keyAttr is the attribute for the S3 object key a span works on
+func keyAttr(key string) attribute.KeyValue {
+	return attribute.String("aws.s3.key", key)
+}
+
+// versionAttr is the attribute for the schema version a span works on
+func versionAttr(ver string) attribute.KeyValue {
+	return attribute.String("db_schema_sync.version", ver)
+}
+
+// tracingClient wraps every S3 call in a span. A GetObject span ends when the response arrives,
+// before its body is read.
+type tracingClient struct {
+	schemastore.S3Client
+}
+
+// withTracing returns client with its calls traced, or client itself when tracing is disabled
+func withTracing(client schemastore.S3Client) schemastore.S3Client {
+	if tracer == nil {
+		return client
+	}
+	return &tracingClient{S3Client: client}
+}
+
+func (c *tracingClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	ctx, sp := startSpan(ctx, "s3.ListObjectsV2", bucketAttr(aws.ToString(params.Bucket)), attribute.String("aws.s3.prefix", aws.ToString(params.Prefix)))
+	out, err := c.S3Client.ListObjectsV2(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.GetObject", bucketAttr(aws.ToString(params.Bucket)), keyAttr(aws.ToString(params.Key)))
+	out, err := c.S3Client.GetObject(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.HeadObject", bucketAttr(aws.ToString(params.Bucket)), keyAttr(aws.ToString(params.Key)))
+	out, err := c.S3Client.HeadObject(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.PutObject", bucketAttr(aws.ToString(params.Bucket)), keyAttr(aws.ToString(params.Key)))
+	out, err := c.S3Client.PutObject(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.DeleteObjects", bucketAttr(aws.ToString(params.Bucket)))
+	if params.Delete != nil {
+		sp.set(attribute.Int("aws.s3.delete.count", len(params.Delete.Objects)))
+	}
+	out, err := c.S3Client.DeleteObjects(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.GetObjectTagging", bucketAttr(aws.ToString(params.Bucket)), keyAttr(aws.ToString(params.Key)))
+	out, err := c.S3Client.GetObjectTagging(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
+
+func (c *tracingClient) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	ctx, sp := startSpan(ctx, "s3.PutObjectTagging", bucketAttr(aws.ToString(params.Bucket)), keyAttr(aws.ToString(params.Key)))
+	out, err := c.S3Client.PutObjectTagging(ctx, params, optFns...)
+	sp.end(err)
+	return out, err
+}
@@ -0,0 +1,105 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// useTestTracer enables tracing for the test, recording the spans in the returned exporter
+func useTestTracer(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		tracer = nil
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func TestSyncerTracing(t *testing.T) {
+	exporter := useTestTracer(t)
+
+	stub := writeStubPsqldef(t, `case "$*" in
+*--export*) echo 'CREATE TABLE users (id integer);' ;;
+*) echo 'CREATE TABLE users (id integer);' ;;
+esac`)
+	bucket := newMemoryBucket("schemas/v1/schema.sql")
+	cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", Engine: EngineSQLite3, Sqlite3defPath: stub}
+	syncer := NewSyncer(withTracing(bucket.client()), cli, DBConfig{File: filepath.Join(t.TempDir(), "app.db")})
+	syncer.ExportAfterApply = true
+	if err := syncer.Run(context.Background()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	parents := make(map[string][]string)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	for _, s := range spans {
+		for _, p := range spans {
+			if s.Parent.SpanID() == p.SpanContext.SpanID() {
+				parents[p.Name] = append(parents[p.Name], s.Name)
+			}
+		}
+	}
+
+	root, ok := byName["sync"]
+	if !ok {
+		t.Fatalf("no sync span in %v", parents)
+	}
+	if root.Parent.IsValid() {
+		t.Errorf("sync span has a parent")
+	}
+	for _, name := range []string{"list", "download", "lock", "dry-run", "apply", "export", "marker"} {
+		if !slices.Contains(parents["sync"], name) {
+			t.Errorf("span %q is not a child of sync; children = %v", name, parents["sync"])
+		}
+	}
+	for parent, child := range map[string]string{"list": "s3.ListObjectsV2", "download": "s3.GetObject", "marker": "s3.PutObject"} {
+		if !slices.Contains(parents[parent], child) {
+			t.Errorf("span %q is not a child of %s; children = %v", child, parent, parents[parent])
+		}
+	}
+
+	attrs := func(name string) map[string]string {
+		got := make(map[string]string)
+		for _, kv := range byName[name].Attributes {
+			got[string(kv.Key)] = kv.Value.Emit()
+		}
+		return got
+	}
+	if got := attrs("sync"); got["aws.s3.bucket"] != "test-bucket" || got["db_schema_sync.version"] != "v1" {
+		t.Errorf("sync attributes = %v", got)
+	}
+	if got := attrs("download"); got["aws.s3.key"] != "schemas/v1/schema.sql" {
+		t.Errorf("download attributes = %v", got)
+	}
+	if got := attrs("apply"); got["db_schema_sync.ddl_statement_count"] != "1" || got["process.exit_code"] != "0" {
+		t.Errorf("apply attributes = %v", got)
+	}
+	if got := attrs("marker"); got["aws.s3.key"] != "schemas/v1/completed" {
+		t.Errorf("marker attributes = %v", got)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	client := &mockS3Client{}
+	if got := withTracing(client); got != client {
+		t.Errorf("withTracing() wrapped the client while tracing is disabled")
+	}
+	ctx := context.Background()
+	if got, sp := startSpan(ctx, "sync"); got != ctx || sp.s != nil {
+		t.Errorf("startSpan() started a span while tracing is disabled")
+	}
+}
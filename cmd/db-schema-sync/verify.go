@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// errDriftDetected is returned by verify, with exit status exitChangesPending, when the database does not
+// match the latest completed schema, so callers can tell drift apart from other failures.
+var errDriftDetected = errors.New("database schema has drifted from the latest completed version")
+
+// VerifyCmd checks that the database matches the latest completed schema
+type VerifyCmd struct {
+	// Database settings (host/port/user/password/name for postgres and mysql, file for sqlite3)
+	DBHost           string        `help:"Database host" env:"DB_HOST"`
+	DBPort           string        `help:"Database port" env:"DB_PORT"`
+	DBUser           string        `help:"Database user" env:"DB_USER"`
+	DBPassword       string        `help:"Database password" env:"DB_PASSWORD"`
+	DBName           string        `help:"Database name" env:"DB_NAME"`
+	DBFile           string        `name:"db-file" help:"SQLite database file (--engine sqlite3)" env:"DB_FILE"`
+	DBSSLMode        string        `name:"db-sslmode" help:"SSL mode for PostgreSQL connections (the advisory lock, --history-table and psqldef); unset, psqldef keeps an inherited PGSSLMODE and the lock connection uses disable" env:"DB_SSLMODE" enum:",disable,require,verify-ca,verify-full" default:""`
+	DBSSLRootCert    string        `name:"db-sslrootcert" placeholder:"FILE" help:"CA certificate file trusted for PostgreSQL connections with --db-sslmode verify-ca or verify-full" env:"DB_SSLROOTCERT"`
+	DBConnectTimeout time.Duration `name:"db-connect-timeout" help:"Timeout for establishing PostgreSQL connections, rounded up to whole seconds (0 waits indefinitely)" env:"DB_CONNECT_TIMEOUT" default:"0s"`
+
+	Quiet  bool   `short:"q" help:"Do not print the drift DDL, only set the exit status"`
+	Format string `help:"Output format (text or json)" enum:"text,json" default:"text"`
+
+	DryRunTimeout time.Duration `name:"dry-run-timeout" help:"Kill sqldef --dry-run after this long (0 disables)" env:"DRY_RUN_TIMEOUT" default:"10m"`
+}
+
+// verifyResult is the --format json output of verify
+type verifyResult struct {
+	Version    string   `json:"version"`
+	Drifted    bool     `json:"drifted"`
+	Statements []string `json:"statements"`
+}
+
+// Run executes the verify command
+func (cmd *VerifyCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	toolName, toolPath := cli.sqldefTool()
+	if _, err := checkSqldef(ctx, toolName, toolPath); err != nil {
+		return err
+	}
+	if err := cli.parseSqldefArgs(); err != nil {
+		return err
+	}
+	db := DBConfig{Host: cmd.DBHost, Port: cmd.DBPort, User: cmd.DBUser, Password: cmd.DBPassword, Name: cmd.DBName, File: cmd.DBFile, SSLMode: cmd.DBSSLMode, SSLRootCert: cmd.DBSSLRootCert, ConnectTimeout: cmd.DBConnectTimeout}
+	if err := db.validate(cli.Engine); err != nil {
+		return err
+	}
+
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	syncer := NewSyncer(client, cli, db)
+	syncer.DryRunTimeout = cmd.DryRunTimeout
+	return syncer.Verify(ctx, os.Stdout, cmd.Quiet, cmd.Format)
+}
+
+// Verify dry-runs the latest completed version, preferring its exported.sql, against the database.
+// It returns errDriftDetected when the dry-run plans any DDL. The planned DDL is written to out
+// unless quiet is set; format "json" writes a verifyResult instead of the raw dry-run output.
+func (s *Syncer) Verify(ctx context.Context, out io.Writer, quiet bool, format string) error {
+	schemaKey, version, err := findLatestCompletedSchema(ctx, s.Client, s.S3Bucket, s.PathPrefix, s.SchemaFile, s.CompletedFile, s.VersionOrder, s.Versioning)
+	if err != nil {
+		return fmt.Errorf("failed to find latest completed schema: %w", err)
+	}
+
+	schema, err := s.downloadAppliedSchema(ctx, schemaKey)
+	if err != nil {
+		return err
+	}
+	if err := s.loadPsqldefConfig(ctx, version); err != nil {
+		return err
+	}
+	workDir, cleanup, err := s.useWorkDir()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	schemaFile, _, err := writeTempFile(workDir, "schema-*.sql", schema)
+	if err != nil {
+		return err
+	}
+
+	dryRunOutput, err := s.dryRun(ctx, schemaFile)
+	if err != nil {
+		return fmt.Errorf("%w\n%s", err, dryRunOutput)
+	}
+
+	statements := splitDDLStatements(dryRunOutput)
+	drifted := !isNoChange(dryRunOutput) && len(statements) > 0
+
+	if !quiet {
+		switch format {
+		case "json":
+			if statements == nil {
+				statements = []string{}
+			}
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(verifyResult{Version: version, Drifted: drifted, Statements: statements}); err != nil {
+				return fmt.Errorf("failed to encode result: %w", err)
+			}
+		default:
+			if drifted {
+				_, _ = fmt.Fprint(out, dryRunOutput)
+			}
+		}
+	}
+
+	if drifted {
+		s.logger().Warn("Schema drift detected", "version", version, "statements", len(statements))
+		return &exitError{code: exitChangesPending, err: errDriftDetected}
+	}
+	s.logger().Info("Database matches the latest completed schema", "version", version)
+	return nil
+}
+
+// downloadAppliedSchema downloads the schema a completed version left the database in.
+// exported.sql is the actual state after the version was applied, so it is preferred over schema.sql.
+func (s *Syncer) downloadAppliedSchema(ctx context.Context, schemaKey string) ([]byte, error) {
+	exportedKey := schemastore.ExportedSchemaKey(schemaKey)
+	schema, err := schemastore.DownloadSchema(ctx, s.Client, s.S3Bucket, exportedKey)
+	if err == nil {
+		s.logger().Info("Using exported.sql as the applied schema", "key", exportedKey)
+		return schema, nil
+	}
+	s.logger().Info("exported.sql not found, using schema.sql as the applied schema", "key", schemaKey)
+	schema, err = schemastore.DownloadSchema(ctx, s.Client, s.S3Bucket, schemaKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download schema from S3: %w", err)
+	}
+	return schema, nil
+}
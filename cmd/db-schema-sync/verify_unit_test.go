@@ -0,0 +1,110 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestSyncerVerify(t *testing.T) {
+	const drift = `-- dry run --
+ALTER TABLE "public"."users" DROP COLUMN "nickname";
+`
+	tests := []struct {
+		name    string
+		dryRun  string
+		quiet   bool
+		format  string
+		wantErr error
+		wantOut string
+	}{
+		{"no drift", "-- Nothing is modified --", false, "text", nil, ""},
+		{"drift", drift, false, "text", errDriftDetected, drift},
+		{"drift quiet", drift, true, "text", errDriftDetected, ""},
+		{"drift json", drift, false, "json", errDriftDetected, `{
+  "version": "v2",
+  "drifted": true,
+  "statements": [
+    "ALTER TABLE \"public\".\"users\" DROP COLUMN \"nickname\";"
+  ]
+}
+`},
+		{"no drift json", "-- Nothing is modified --", false, "json", nil, `{
+  "version": "v2",
+  "drifted": false,
+  "statements": []
+}
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dryRunLog := filepath.Join(dir, "dry-run.log")
+			output := filepath.Join(dir, "output")
+			if err := os.WriteFile(output, []byte(tt.dryRun), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			stub := writeStubPsqldef(t, `case "$*" in
+*--dry-run*) cat "$(echo "$@" | sed 's/.*--file //')" >> `+dryRunLog+`; cat `+output+` ;;
+*) exit 1 ;;
+esac`)
+
+			objects := map[string]string{
+				"schemas/v1/schema.sql":   "-- v1",
+				"schemas/v1/completed":    "",
+				"schemas/v2/schema.sql":   "-- v2",
+				"schemas/v2/completed":    "",
+				"schemas/v2/exported.sql": "-- v2 exported",
+				"schemas/v3/schema.sql":   "-- v3",
+			}
+			client := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					var contents []types.Object
+					for key := range objects {
+						contents = append(contents, types.Object{Key: aws.String(key)})
+					}
+					return &s3.ListObjectsV2Output{Contents: contents}, nil
+				},
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					body, ok := objects[*params.Key]
+					if !ok {
+						return nil, &types.NoSuchKey{}
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+				},
+			}
+			cli := &CLI{S3Bucket: "test-bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed", PsqldefPath: stub}
+
+			syncer := NewSyncer(client, cli, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+
+			var out bytes.Buffer
+			err := syncer.Verify(context.Background(), &out, tt.quiet, tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errDriftDetected) && exitCode(err) != exitChangesPending {
+				t.Errorf("exit status = %d, want %d", exitCode(err), exitChangesPending)
+			}
+			if out.String() != tt.wantOut {
+				t.Errorf("output = %q, want %q", out.String(), tt.wantOut)
+			}
+
+			verified, _ := os.ReadFile(dryRunLog)
+			if string(verified) != "-- v2 exported" {
+				t.Errorf("verified schema = %q, want the latest completed exported.sql", verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/tokuhirom/db-schema-sync/pkg/schemastore"
+)
+
+// WaitCompletedCmd blocks until a version's completion marker appears, so a deploy pipeline can wait for the apply
+type WaitCompletedCmd struct {
+	Version string        `help:"Version to wait for" xor:"target"`
+	Latest  bool          `help:"Wait for the latest version in S3 instead of --version" xor:"target"`
+	Timeout time.Duration `help:"Give up and exit 1 after this long" default:"10m"`
+	Poll    time.Duration `help:"How often to check for the completion marker" default:"5s"`
+}
+
+// Run executes the wait-completed command
+func (cmd *WaitCompletedCmd) Run(ctx context.Context, cli *CLI) error {
+	if err := cli.requireS3(); err != nil {
+		return err
+	}
+	if cmd.Version == "" && !cmd.Latest {
+		return fmt.Errorf("wait-completed requires --version or --latest")
+	}
+	if cmd.Poll <= 0 {
+		return fmt.Errorf("--poll must be positive, got %s", cmd.Poll)
+	}
+	client, err := createS3Client(ctx, cli)
+	if err != nil {
+		return err
+	}
+	return cmd.wait(ctx, client, cli, os.Stdout)
+}
+
+// wait polls the completion marker of the requested version until it exists or Timeout elapses,
+// then writes where and when the version was applied to w
+func (cmd *WaitCompletedCmd) wait(ctx context.Context, client schemastore.S3Client, cli *CLI, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, cmd.Timeout)
+	defer cancel()
+
+	schemaKey, ver, err := cmd.resolve(ctx, client, cli)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	slog.Info("Waiting for completion marker", "version", ver, "key", schemastore.CompletionMarkerKey(schemaKey, cli.CompletedFile), "timeout", cmd.Timeout)
+	ticker := time.NewTicker(cmd.Poll)
+	defer ticker.Stop()
+	for {
+		completed, err := schemastore.CheckCompletionMarker(ctx, client, cli.S3Bucket, schemaKey, cli.CompletedFile)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			// A transient S3 error should not end the wait; the next poll retries
+			slog.Warn("Failed to check completion marker", "version", ver, "error", err)
+		case completed:
+			return writeCompletion(ctx, w, client, cli, schemaKey, ver)
+		case err == nil:
+			slog.Info("Version not completed yet", "version", ver, "elapsed", time.Since(start).Round(time.Second))
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("timed out after %s waiting for version %s to be completed", cmd.Timeout, ver)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// resolve returns the schema key and version to wait for. With --latest the latest version is
+// looked up once, so a version pushed while waiting does not move the target.
+func (cmd *WaitCompletedCmd) resolve(ctx context.Context, client schemastore.S3Client, cli *CLI) (string, string, error) {
+	if !cmd.Latest {
+		if err := cli.versioning.ValidateVersion(cmd.Version); err != nil {
+			return "", "", fmt.Errorf("invalid --version %q: %w", cmd.Version, err)
+		}
+		return schemastore.SchemaKey(cli.PathPrefix, cmd.Version, cli.SchemaFile), cmd.Version, nil
+	}
+
+	var (
+		key, ver string
+		err      error
+	)
+	if cli.VersionOrder == versionOrderLastModified {
+		key, ver, _, err = schemastore.FindNewestSchema(ctx, client, cli.S3Bucket, cli.PathPrefix, cli.SchemaFile, cli.versioning)
+	} else {
+		key, ver, err = schemastore.FindLatestSchema(ctx, client, cli.S3Bucket, cli.PathPrefix, cli.SchemaFile, cli.versioning)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to find latest schema: %w", err)
+	}
+	slog.Info("Found latest schema", "version", ver, "key", key)
+	return key, ver, nil
+}
+
+// writeCompletion reports a completed version along with the metadata recorded in its marker.
+// Markers written before they carried JSON are empty, so only the version is reported for them.
+func writeCompletion(ctx context.Context, w io.Writer, client schemastore.S3Client, cli *CLI, schemaKey, ver string) error {
+	if _, err := fmt.Fprintf(w, "Version %s completed\n", ver); err != nil {
+		return err
+	}
+	meta, err := schemastore.ReadCompletionMarker(ctx, client, cli.S3Bucket, schemaKey, cli.CompletedFile)
+	if err != nil {
+		// The marker exists, which is what the caller waits for; missing details are not a failure
+		slog.Warn("Failed to read completion marker metadata", "version", ver, "error", err)
+		return nil
+	}
+	if meta == nil {
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "  applied at:     %s\n  hostname:       %s\n  app version:    %s\n  duration:       %s\n  DDL statements: %d\n",
+		meta.AppliedAt.UTC().Format(time.RFC3339), orDash(meta.Hostname), orDash(meta.AppVersion),
+		time.Duration(meta.DurationMs)*time.Millisecond, meta.DDLStatementCount)
+	return err
+}
+
+// orDash returns s, or "-" when it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+//go:build !integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// markerAfter returns a client whose completed marker for v2 appears on the given HeadObject call (0 never)
+func markerAfter(appearsOn int32, heads *atomic.Int32) *mockS3Client {
+	const marker = `{"version":"v2","applied_at":"2026-01-20T15:31:02Z","hostname":"db-1","app_version":"v0.0.9","duration_ms":1204,"ddl_statement_count":3}`
+	return &mockS3Client{
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if *params.Key != "schemas/v2/completed" {
+				return nil, &types.NotFound{}
+			}
+			if n := heads.Add(1); appearsOn == 0 || n < appearsOn {
+				return nil, &types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(marker))}, nil
+		},
+	}
+}
+
+func TestWaitCompleted(t *testing.T) {
+	cli := &CLI{S3Bucket: "bucket", PathPrefix: "schemas/", SchemaFile: "schema.sql", CompletedFile: "completed"}
+
+	tests := []struct {
+		name      string
+		appearsOn int32
+		wantErr   string
+		wantHeads int32
+	}{
+		{name: "immediate success", appearsOn: 1, wantHeads: 1},
+		{name: "eventual success", appearsOn: 3, wantHeads: 3},
+		{name: "timeout", appearsOn: 0, wantErr: "timed out after 50ms waiting for version v2 to be completed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var heads atomic.Int32
+			cmd := &WaitCompletedCmd{Version: "v2", Timeout: 50 * time.Millisecond, Poll: 5 * time.Millisecond}
+			if tt.appearsOn > 0 {
+				cmd.Timeout = 5 * time.Second
+			}
+			var buf bytes.Buffer
+			err := cmd.wait(context.Background(), markerAfter(tt.appearsOn, &heads), cli, &buf)
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("wait() error = %v, want %q", err, tt.wantErr)
+				}
+				if buf.Len() != 0 {
+					t.Errorf("unexpected output on timeout: %q", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("wait() error = %v", err)
+			}
+			if got := heads.Load(); got != tt.wantHeads {
+				t.Errorf("HeadObject calls = %d, want %d", got, tt.wantHeads)
+			}
+			out := buf.String()
+			for _, want := range []string{"Version v2 completed", "applied at:     2026-01-20T15:31:02Z", "hostname:       db-1", "duration:       1.204s", "DDL statements: 3"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("output missing %q:\n%s", want, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// errDBUnavailable is returned when --wait-for-db runs out, so the failure reads differently from an S3 error
+var errDBUnavailable = errors.New("database did not become available")
+
+// Backoff between connection attempts while waiting for the database
+const (
+	waitForDBInitialDelay = 500 * time.Millisecond
+	waitForDBMaxDelay     = 10 * time.Second
+)
+
+// waitForDB connects to the database of every syncer until each connection succeeds, retrying with
+// exponential backoff, so a daemon started before its database does not count the first syncs as failures.
+// All syncers share the timeout; 0 disables the wait.
+func waitForDB(ctx context.Context, syncers []*Syncer, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for _, s := range syncers {
+		if err := s.waitForDB(waitCtx, waitForDBInitialDelay); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("%w within %s (--wait-for-db): %w", errDBUnavailable, timeout, err)
+		}
+	}
+	return nil
+}
+
+// waitForDB calls pingDB until it succeeds or ctx is done, doubling the delay between attempts from initialDelay
+// up to waitForDBMaxDelay. It returns the last connection error.
+func (s *Syncer) waitForDB(ctx context.Context, initialDelay time.Duration) error {
+	start := time.Now()
+	delay := initialDelay
+	for attempt := 1; ; attempt++ {
+		err := s.pingDB(ctx)
+		if err == nil {
+			if attempt > 1 {
+				s.logger().Info("Database is available", "attempts", attempt, "waited", time.Since(start).Round(time.Millisecond))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		s.logger().Warn("Database is not available yet, retrying", "database", s.DB.displayName(), "attempt", attempt, "retry_in", delay, "error", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay = min(delay*2, waitForDBMaxDelay)
+	}
+}
+
+// pingDB opens and closes a connection the way a sync does, through the engine's locker, without locking
+func (s *Syncer) pingDB(ctx context.Context) error {
+	locker, err := s.NewLocker(ctx, s.LockID)
+	if err != nil {
+		return err
+	}
+	return locker.Close()
+}
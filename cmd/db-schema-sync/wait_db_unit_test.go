@@ -0,0 +1,83 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	_ = l.Close()
+	return port
+}
+
+func TestSyncerWaitForDB(t *testing.T) {
+	syncer := NewSyncer(&mockS3Client{}, &CLI{}, DBConfig{Host: "localhost", Port: "5432", User: "user", Password: "pass", Name: "db"})
+	attempts := 0
+	syncer.NewLocker = func(context.Context, int64) (Locker, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return lostLocker{}, nil
+	}
+
+	if err := syncer.waitForDB(context.Background(), time.Millisecond); err != nil {
+		t.Fatalf("waitForDB() error = %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestWaitForDB(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		syncer := NewSyncer(&mockS3Client{}, &CLI{}, DBConfig{})
+		syncer.NewLocker = func(context.Context, int64) (Locker, error) {
+			t.Error("connected with --wait-for-db 0")
+			return lostLocker{}, nil
+		}
+		if err := waitForDB(context.Background(), []*Syncer{syncer}, 0); err != nil {
+			t.Errorf("waitForDB() error = %v", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		syncer := NewSyncer(&mockS3Client{}, &CLI{}, DBConfig{Host: "127.0.0.1", Port: closedPort(t), User: "user", Password: "pass", Name: "db"})
+		start := time.Now()
+		err := waitForDB(context.Background(), []*Syncer{syncer}, 200*time.Millisecond)
+		if !errors.Is(err, errDBUnavailable) {
+			t.Fatalf("waitForDB() error = %v, want errDBUnavailable", err)
+		}
+		if !strings.Contains(err.Error(), "database did not become available within 200ms (--wait-for-db)") || !strings.Contains(err.Error(), "failed to ping database") {
+			t.Errorf("waitForDB() error = %q, want the timeout and the last connection error", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("waitForDB() took %s, want it to stop at the timeout", elapsed)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		syncer := NewSyncer(&mockS3Client{}, &CLI{}, DBConfig{})
+		ctx, cancel := context.WithCancel(context.Background())
+		syncer.NewLocker = func(context.Context, int64) (Locker, error) {
+			cancel()
+			return nil, errors.New("connection refused")
+		}
+		if err := waitForDB(ctx, []*Syncer{syncer}, time.Minute); !errors.Is(err, context.Canceled) || errors.Is(err, errDBUnavailable) {
+			t.Errorf("waitForDB() error = %v, want context.Canceled", err)
+		}
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// reloadableFlags are the watch settings a SIGHUP applies at runtime. Any other change, such as the bucket,
+// path prefix or database identity, is rejected and needs a restart.
+var reloadableFlags = map[string]bool{
+	"interval":               true,
+	"min-apply-interval":     true,
+	"sqs-fallback-interval":  true,
+	"db-password":            true,
+	"db-password-file":       true,
+	"db-password-secret-arn": true,
+	"db-password-secret-key": true,
+	"allow-destructive":      true,
+	"allow-downgrade":        true,
+	"deny-ddl":               true,
+	"ready-requires-apply":   true,
+	"ready-max-failures":     true,
+	"max-staleness":          true,
+	"max-sync-staleness":     true,
+	"max-version":            true,
+	"on-s3-fetch-error":      true,
+	"on-plan":                true,
+	"on-before-apply":        true,
+	"on-apply-failed":        true,
+	"on-apply-succeeded":     true,
+	"on-no-change":           true,
+	"on-recovered":           true,
+	"on-drift-detected":      true,
+	"on-paused":              true,
+}
+
+// watcher runs the watch polling loop
+type watcher struct {
+	cli *CLI
+	cmd *WatchCmd
+	// args is the command line parsed again on SIGHUP, together with the environment and --config
+	args []string
+	// flags holds the current value of every flag by name, to log what a reload changes
+	flags map[string]any
+	// password is the database password from --db-password, --db-password-file or --db-password-secret-arn,
+	// resolved again on every reload
+	password  string
+	syncers   []*Syncer
+	readiness *atomic.Pointer[readinessConfig]
+	// triggers receives sync requests from SQS and POST /sync; the loop only receives while it waits
+	triggers chan *syncRequest
+	// newTimer starts the waits of the loop; nil means time.NewTimer
+	newTimer func(d time.Duration) *time.Timer
+}
+
+// hooks returns the lifecycle hooks run by the syncers
+func (cmd *WatchCmd) hooks() Hooks {
+	hooks := cmd.SyncOptions.hooks()
+	hooks.OnS3FetchError = cmd.OnS3FetchError
+	hooks.OnDriftDetected = cmd.OnDriftDetected
+	return hooks
+}
+
+// readinessConfig returns the /ready and /health settings
+func (cmd *WatchCmd) readinessConfig() *readinessConfig {
+	return &readinessConfig{
+		RequireApply:     cmd.ReadyRequiresApply,
+		MaxFailures:      cmd.ReadyMaxFailures,
+		MaxStaleness:     cmd.MaxStaleness,
+		MaxSyncStaleness: cmd.MaxSyncStaleness,
+	}
+}
+
+// pollInterval returns the delay between syncs; with SQS, polling is only a safety net
+func (cmd *WatchCmd) pollInterval() time.Duration {
+	if cmd.SQSQueueURL != "" {
+		return cmd.SQSFallbackInterval
+	}
+	return cmd.Interval
+}
+
+// initialDelay returns how long to wait before the first sync, with up to the poll interval added by
+// --initial-delay-jitter (jitter is a value in [0, 1))
+func (cmd *WatchCmd) initialDelay(jitter float64) time.Duration {
+	delay := cmd.InitialDelay
+	if cmd.InitialDelayJitter {
+		delay += time.Duration(float64(cmd.pollInterval()) * jitter)
+	}
+	return delay
+}
+
+// flagValues returns the value of every flag parsed by ctx, keyed by flag name
+func flagValues(ctx *kong.Context) map[string]any {
+	values := make(map[string]any)
+	for _, flag := range ctx.Flags() {
+		if flag.Name != "help" {
+			values[flag.Name] = ctx.FlagValue(flag)
+		}
+	}
+	return values
+}
+
+// run syncs every target, then waits for the poll interval or an SQS trigger, until ctx is done or,
+// with --exit-after-success, every target is at the latest version.
+// A signal on reloads re-reads the configuration; one received during a sync is handled once it finishes.
+func (w *watcher) run(ctx context.Context, reloads <-chan os.Signal) error {
+	var pending *syncRequest
+	var recovery recoveryTracker
+	if delay := w.cmd.initialDelay(rand.Float64()); delay > 0 {
+		slog.Info("Delaying the first sync", "delay", delay)
+		timer := w.timer(delay)
+		select {
+		case <-timer.C:
+		case req := <-w.triggers:
+			// A requested sync does not wait for the delay
+			timer.Stop()
+			pending = req
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+	for {
+		cycleStart := time.Now()
+		err := forEachTarget(w.syncers, func(s *Syncer) error { return s.Run(ctx) })
+		if err != nil {
+			slog.Error("Error in sync", "error", err)
+		}
+		cycle := time.Since(cycleStart)
+		recordSyncCycleDuration(cycle)
+		if interval := w.cmd.pollInterval(); cycle > interval {
+			slog.Warn("Sync took longer than the polling interval", "duration", cycle, "interval", interval)
+		}
+		recovered, failed, outage := recovery.observe(err, time.Now())
+		if recovered {
+			slog.Info("Sync recovered after consecutive failures", "failures", failed, "outage", outage)
+			w.syncers[0].HookRunner.run(ctx, "on-recovered", w.cmd.OnRecovered, &HookEnv{
+				S3Bucket:      w.cli.S3Bucket,
+				PathPrefix:    w.cli.PathPrefix,
+				SchemaFile:    w.cli.SchemaFile,
+				CompletedFile: w.cli.CompletedFile,
+				AppVersion:    Version,
+				Version:       w.syncers[0].LastAppliedVersion(),
+				FailureCount:  strconv.Itoa(failed),
+				OutageSeconds: strconv.FormatFloat(outage.Seconds(), 'f', 0, 64),
+			})
+		}
+		if pending != nil {
+			pending.err = err
+			close(pending.done)
+			pending = nil
+		}
+		// Leave restarts and their backoff to the orchestrator
+		if err != nil && w.cmd.ExitAfterFailures > 0 && failed >= w.cmd.ExitAfterFailures {
+			return fmt.Errorf("exiting after %d consecutive failed syncs (--exit-after-failures): %w", failed, err)
+		}
+		if err == nil && w.cmd.ExitAfterSuccess && w.synced() {
+			slog.Info("Every target is at the latest version, exiting (--exit-after-success)")
+			return nil
+		}
+
+		failures := backoffFailures(w.syncers)
+		for waiting := true; waiting; {
+			interval := w.cmd.pollInterval()
+			wait := backoffInterval(interval, failures, rand.Float64())
+			recordBackoffDelay(wait - interval)
+			if wait > interval {
+				slog.Warn("Backing off after consecutive failures", "consecutive_failures", failures, "delay", wait)
+			}
+			slog.Debug("Waiting before next poll", "interval", wait)
+			timer := w.timer(wait)
+			select {
+			case <-timer.C:
+				waiting = false
+			case req := <-w.triggers:
+				timer.Stop()
+				pending = req
+				waiting = false
+			case <-reloads:
+				// Restart the wait so a new interval takes effect immediately
+				timer.Stop()
+				if err := w.reload(ctx); err != nil {
+					slog.Error("Configuration reload rejected, keeping the current configuration", "error", err)
+				}
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			}
+		}
+	}
+}
+
+// timer starts a wait of the loop
+func (w *watcher) timer(d time.Duration) *time.Timer {
+	if w.newTimer != nil {
+		return w.newTimer(d)
+	}
+	return time.NewTimer(d)
+}
+
+// synced reports whether every target applied the latest version in this process, which includes a version
+// completed because its dry-run found nothing to change. With --exit-if-up-to-date, a latest version that was
+// already completed counts too.
+func (w *watcher) synced() bool {
+	for _, s := range w.syncers {
+		st := s.State().get()
+		if st.LatestVersion == "" || st.LastAppliedVersion != st.LatestVersion {
+			return false
+		}
+		if st.LastApplyTime.IsZero() && !w.cmd.ExitIfUpToDate {
+			return false
+		}
+	}
+	return true
+}
+
+// reload parses the command line, environment and --config again and applies the changed settings.
+// It also reads the password file or fetches the password secret again, which can change without the flags.
+// It fails without applying anything when a setting outside reloadableFlags changed.
+func (w *watcher) reload(ctx context.Context) error {
+	slog.Info("Reloading configuration")
+	var fresh CLI
+	parser, err := newParser(&fresh)
+	if err != nil {
+		return err
+	}
+	kctx, err := parser.Parse(w.args)
+	if err != nil {
+		return err
+	}
+	fresh.normalizePathPrefix()
+	flags := flagValues(kctx)
+
+	var changed, fixed []string
+	for name, value := range flags {
+		if !reflect.DeepEqual(w.flags[name], value) {
+			changed = append(changed, name)
+			if !reloadableFlags[name] {
+				fixed = append(fixed, "--"+name)
+			}
+		}
+	}
+	if len(fixed) > 0 {
+		slices.Sort(fixed)
+		return fmt.Errorf("%s cannot change at runtime; restart to apply", strings.Join(fixed, ", "))
+	}
+	cmd := &fresh.Watch
+	password, err := cmd.passwordSource().resolve(ctx, w.cli)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 && password == w.password {
+		slog.Info("Configuration unchanged")
+		return nil
+	}
+
+	if err := checkMaxVersion(cmd.MaxVersion, w.cli.VersionOrder, w.cli.versioning); err != nil {
+		return err
+	}
+	var denyDDL []*regexp.Regexp
+	if !cmd.AllowDestructive {
+		denyDDL, err = compileDenyDDL(cmd.DenyDDL)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, toolPath := w.cli.sqldefTool()
+	for _, s := range w.syncers {
+		s.reconfigure(func(s *Syncer) {
+			s.Hooks = cmd.hooks()
+			s.DenyDDL = denyDDL
+			s.MaxVersion = cmd.MaxVersion
+			s.MinApplyInterval = cmd.MinApplyInterval
+			s.AllowDowngrade = cmd.AllowDowngrade
+			if cmd.MaxVersion == "" {
+				s.heldBack = 0
+				recordVersionsHeldBack(s.Target, 0)
+			}
+			// A --prefix-file entry with its own db_password keeps it
+			if password != w.password && s.DB.Password == w.password {
+				s.DB.Password = password
+				s.Applier, s.NewLocker = newEngine(w.cli.Engine, toolPath, w.cli.sqldefArgs, w.cli.applyArgs, s.DB)
+			}
+		})
+	}
+	w.readiness.Store(cmd.readinessConfig())
+	if password != w.password {
+		slog.Info("Database password changed")
+	}
+
+	slices.Sort(changed)
+	for _, name := range changed {
+		old, value := w.flags[name], flags[name]
+		if isSecretKey(strings.ReplaceAll(name, "-", "_")) {
+			old, value = redactedValue, redactedValue
+		}
+		slog.Info("Configuration changed", "flag", name, "old", fmt.Sprint(old), "new", fmt.Sprint(value))
+	}
+	w.cmd = cmd
+	w.flags = flags
+	w.password = password
+	return nil
+}
@@ -0,0 +1,355 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// newTestWatcher parses watch with a --config file holding content and returns the watcher and the file path
+func newTestWatcher(t *testing.T, client *mockS3Client, content string) (*watcher, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--config", path, "watch"}
+
+	var cli CLI
+	parser, err := newParser(&cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kctx, err := parser.Parse(args)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	syncer := NewSyncer(client, &cli, DBConfig{Host: "localhost", Port: "5432", User: "app", Password: cli.Watch.DBPassword, Name: "app"})
+	syncer.SkipLock = true
+	syncer.MaxVersion = cli.Watch.MaxVersion
+
+	readiness := &atomic.Pointer[readinessConfig]{}
+	readiness.Store(cli.Watch.readinessConfig())
+	return &watcher{cli: &cli, cmd: &cli.Watch, args: args, flags: flagValues(kctx), password: cli.Watch.DBPassword, syncers: []*Syncer{syncer}, readiness: readiness}, path
+}
+
+func TestWatchReloadsIntervalOnSIGHUP(t *testing.T) {
+	var polls atomic.Int32
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			polls.Add(1)
+			return nil, errors.New("unavailable")
+		},
+	}
+	w, path := newTestWatcher(t, client, "s3_bucket: test-bucket\ninterval: 1h\n")
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	defer signal.Stop(reloads)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.run(ctx, reloads)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(want int32) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if polls.Load() >= want {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !waitFor(1) {
+		t.Fatal("expected the first sync")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := polls.Load(); got != 1 {
+		t.Fatalf("polls = %d before the reload, want 1", got)
+	}
+
+	if err := os.WriteFile(path, []byte("s3_bucket: test-bucket\ninterval: 10ms\non_apply_failed: echo failed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(3) {
+		t.Fatalf("polls = %d after the reload, want the 10ms interval to take effect", polls.Load())
+	}
+
+	cancel()
+	<-done
+	if w.syncers[0].Hooks.OnApplyFailed != "echo failed" {
+		t.Errorf("OnApplyFailed = %q, want the reloaded hook", w.syncers[0].Hooks.OnApplyFailed)
+	}
+}
+
+func TestWatchReload(t *testing.T) {
+	base := "s3_bucket: test-bucket\npath_prefix: schemas/\ndb_password: old\n"
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"bucket", "s3_bucket: other-bucket\npath_prefix: schemas/\ndb_password: old\n", "--s3-bucket cannot change at runtime"},
+		{"prefix and engine", "s3_bucket: test-bucket\npath_prefix: other/\nengine: mysql\ndb_password: old\n", "--engine, --path-prefix cannot change at runtime"},
+		{"on-start", base + "on_start: echo started\n", "--on-start cannot change at runtime"},
+		{"invalid deny-ddl", base + "deny_ddl: ['(']\n", "invalid --deny-ddl pattern"},
+		{"unknown key", base + "intervall: 1m\n", "unknown keys in config file: intervall"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, path := newTestWatcher(t, &mockS3Client{}, base)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := w.reload(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("reload() error = %v, want containing %q", err, tt.wantErr)
+			}
+			if w.cli.S3Bucket != "test-bucket" || w.syncers[0].DB.Password != "old" {
+				t.Errorf("rejected reload changed the configuration")
+			}
+		})
+	}
+
+	t.Run("password and readiness", func(t *testing.T) {
+		w, path := newTestWatcher(t, &mockS3Client{}, base)
+		applier := w.syncers[0].Applier
+		if err := os.WriteFile(path, []byte("s3_bucket: test-bucket\npath_prefix: schemas/\ndb_password: new\nmax_staleness: 10m\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.reload(context.Background()); err != nil {
+			t.Fatalf("reload() error = %v", err)
+		}
+		if w.syncers[0].DB.Password != "new" || w.syncers[0].Applier == applier {
+			t.Errorf("expected the database password and sqldef applier to be replaced")
+		}
+		if got := w.readiness.Load().MaxStaleness; got != 10*time.Minute {
+			t.Errorf("MaxStaleness = %v, want 10m", got)
+		}
+	})
+
+	t.Run("password file", func(t *testing.T) {
+		passwordFile := filepath.Join(t.TempDir(), "password")
+		if err := os.WriteFile(passwordFile, []byte("old\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		content := "s3_bucket: test-bucket\npath_prefix: schemas/\ndb_password_file: " + passwordFile + "\n"
+		w, _ := newTestWatcher(t, &mockS3Client{}, content)
+		w.password = "old"
+		w.syncers[0].DB.Password = "old"
+
+		// The flags stay the same; only the file changes, as when a mounted secret is rotated
+		if err := os.WriteFile(passwordFile, []byte("rotated\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.reload(context.Background()); err != nil {
+			t.Fatalf("reload() error = %v", err)
+		}
+		if w.syncers[0].DB.Password != "rotated" || w.password != "rotated" {
+			t.Errorf("password = %q, want the rotated file contents", w.syncers[0].DB.Password)
+		}
+
+		if err := os.WriteFile(passwordFile, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.reload(context.Background()); err == nil || !strings.Contains(err.Error(), "is empty") {
+			t.Errorf("reload() error = %v, want the empty file rejected", err)
+		}
+		if w.syncers[0].DB.Password != "rotated" {
+			t.Errorf("rejected reload changed the password to %q", w.syncers[0].DB.Password)
+		}
+	})
+
+	t.Run("max version", func(t *testing.T) {
+		// target_version is the old name of max_version
+		w, path := newTestWatcher(t, &mockS3Client{}, base+"target_version: v1\n")
+		if w.syncers[0].MaxVersion != "v1" {
+			t.Fatalf("MaxVersion = %q, want v1 from target_version", w.syncers[0].MaxVersion)
+		}
+		for _, tt := range []struct{ content, want string }{
+			{base + "max_version: v3\n", "v3"},
+			{base, ""},
+		} {
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.reload(context.Background()); err != nil {
+				t.Fatalf("reload() error = %v", err)
+			}
+			if w.syncers[0].MaxVersion != tt.want {
+				t.Errorf("MaxVersion = %q after reload, want %q", w.syncers[0].MaxVersion, tt.want)
+			}
+		}
+	})
+}
+
+func TestWatchExitsAfterFailures(t *testing.T) {
+	var polls atomic.Int32
+	client := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			polls.Add(1)
+			return nil, errors.New("unavailable")
+		},
+	}
+	w, _ := newTestWatcher(t, client, "s3_bucket: test-bucket\ninterval: 1ms\nexit_after_failures: 3\n")
+
+	done := make(chan error, 1)
+	go func() { done <- w.run(context.Background(), nil) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "exiting after 3 consecutive failed syncs") {
+			t.Errorf("run() error = %v, want exit after 3 failures", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("watch did not exit")
+	}
+	if got := polls.Load(); got != 3 {
+		t.Errorf("polls = %d, want 3", got)
+	}
+}
+
+func TestWatchInitialDelay(t *testing.T) {
+	cmd := &WatchCmd{Interval: time.Hour, InitialDelay: 5 * time.Minute}
+	if got := cmd.initialDelay(0.5); got != 5*time.Minute {
+		t.Errorf("initialDelay() = %v, want 5m without jitter", got)
+	}
+	cmd.InitialDelayJitter = true
+	if got := cmd.initialDelay(0.5); got != 35*time.Minute {
+		t.Errorf("initialDelay() = %v, want 5m plus half the interval", got)
+	}
+	cmd.SQSQueueURL, cmd.SQSFallbackInterval = "https://sqs.example.com/queue", 10*time.Minute
+	if got := cmd.initialDelay(0.5); got != 10*time.Minute {
+		t.Errorf("initialDelay() = %v, want jitter up to the SQS fallback interval", got)
+	}
+
+	bucket := newMemoryBucket("schemas/v1/schema.sql", "schemas/v1/completed")
+	var polls atomic.Int32
+	client := bucket.client()
+	list := client.listObjectsFunc
+	client.listObjectsFunc = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		polls.Add(1)
+		return list(ctx, params, optFns...)
+	}
+	w, _ := newTestWatcher(t, client, "s3_bucket: test-bucket\npath_prefix: schemas/\ninterval: 1h\ninitial_delay: 2m\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var delays []time.Duration
+	var pollsBefore []int32
+	w.newTimer = func(d time.Duration) *time.Timer {
+		delays = append(delays, d)
+		pollsBefore = append(pollsBefore, polls.Load())
+		if len(delays) == 2 {
+			cancel()
+		}
+		return time.NewTimer(0)
+	}
+
+	if err := w.run(ctx, nil); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(delays) < 2 || delays[0] != 2*time.Minute || delays[1] != time.Hour {
+		t.Fatalf("waits = %v, want the initial delay, then the interval", delays)
+	}
+	if pollsBefore[0] != 0 || pollsBefore[1] != 1 {
+		t.Errorf("polls before each wait = %v, want the first sync after the initial delay", pollsBefore)
+	}
+}
+
+func TestWatchExitAfterSuccess(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      []string
+		config    string
+		publishAt int
+		wantExit  bool
+		wantWaits int
+	}{
+		{
+			name:     "applies and exits",
+			keys:     []string{"schemas/v1/schema.sql"},
+			config:   "exit_after_success: true\n",
+			wantExit: true,
+		},
+		{
+			name:      "waits for a version to be published",
+			config:    "exit_after_success: true\n",
+			publishAt: 2,
+			wantExit:  true,
+			wantWaits: 2,
+		},
+		{
+			name:      "already completed keeps watching",
+			keys:      []string{"schemas/v1/schema.sql", "schemas/v1/completed"},
+			config:    "exit_after_success: true\n",
+			wantWaits: 3,
+		},
+		{
+			name:     "already completed exits if up to date",
+			keys:     []string{"schemas/v1/schema.sql", "schemas/v1/completed"},
+			config:   "exit_after_success: true\nexit_if_up_to_date: true\n",
+			wantExit: true,
+		},
+		{
+			name:      "disabled",
+			keys:      []string{"schemas/v1/schema.sql"},
+			wantWaits: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newMemoryBucket(tt.keys...)
+			w, _ := newTestWatcher(t, bucket.client(), "s3_bucket: test-bucket\npath_prefix: schemas/\ninterval: 1h\n"+tt.config)
+			applier := &fakeApplier{dryRun: "CREATE TABLE users (id integer);\n"}
+			w.syncers[0].Applier = applier
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			waits := 0
+			w.newTimer = func(d time.Duration) *time.Timer {
+				waits++
+				if waits == tt.publishAt {
+					bucket.put("schemas/v1/schema.sql")
+				}
+				if waits == 3 {
+					cancel()
+				}
+				return time.NewTimer(0)
+			}
+
+			if err := w.run(ctx, nil); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if exited := ctx.Err() == nil; exited != tt.wantExit {
+				t.Errorf("exited on its own = %v, want %v", exited, tt.wantExit)
+			}
+			if tt.wantExit && waits != tt.wantWaits {
+				t.Errorf("waited %d times before exiting, want %d", waits, tt.wantWaits)
+			}
+			if !tt.wantExit && waits < tt.wantWaits {
+				t.Errorf("waited %d times, want watching to go on", waits)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the request body when a secret is configured
+const webhookSignatureHeader = "X-DB-Schema-Sync-Signature"
+
+// webhookEvents lists the lifecycle events that can be delivered by webhook
+var webhookEvents = []string{"s3-fetch-error", "plan", "before-apply", "apply-failed", "apply-succeeded", "no-change", "recovered", "drift-detected", "paused"}
+
+// HookPayload is the JSON body POSTed to the webhook URL, and the document hook commands get on stdin.
+// It carries every HookEnv field without the truncation applied to the environment variables.
+type HookPayload struct {
+	Event            string    `json:"event"`
+	Timestamp        time.Time `json:"timestamp"`
+	S3Bucket         string    `json:"s3_bucket,omitempty"`
+	PathPrefix       string    `json:"path_prefix,omitempty"`
+	SchemaFile       string    `json:"schema_file,omitempty"`
+	CompletedFile    string    `json:"completed_file,omitempty"`
+	Version          string    `json:"version,omitempty"`
+	AppVersion       string    `json:"app_version,omitempty"`
+	Error            string    `json:"error,omitempty"`
+	Stdout           string    `json:"stdout,omitempty"`
+	Stderr           string    `json:"stderr,omitempty"`
+	DryRun           string    `json:"dry_run,omitempty"`
+	PlanEmpty        *bool     `json:"plan_empty,omitempty"`
+	BlockedDDL       string    `json:"blocked_ddl,omitempty"`
+	Drift            string    `json:"drift,omitempty"`
+	PauseReason      string    `json:"pause_reason,omitempty"`
+	DDLSummary       string    `json:"ddl_summary,omitempty"`
+	FailureReason    string    `json:"failure_reason,omitempty"`
+	Target           string    `json:"target,omitempty"`
+	FailureCount     int       `json:"failure_count,omitempty"`
+	FailureThreshold int       `json:"failure_threshold,omitempty"`
+	OutageSeconds    int64     `json:"outage_seconds,omitempty"`
+	DBHost           string    `json:"db_host,omitempty"`
+	DBPort           string    `json:"db_port,omitempty"`
+	DBName           string    `json:"db_name,omitempty"`
+	Hostname         string    `json:"hostname,omitempty"`
+	SyncAttempt      int64     `json:"sync_attempt,omitempty"`
+	StartedAt        string    `json:"started_at,omitempty"`
+	FinishedAt       string    `json:"finished_at,omitempty"`
+	ApplyDurationMs  int64     `json:"apply_duration_ms,omitempty"`
+}
+
+// WebhookNotifier POSTs lifecycle events as JSON to an HTTP endpoint
+type WebhookNotifier struct {
+	url          string
+	secret       string
+	events       map[string]bool
+	maxRetries   int
+	retryBackoff time.Duration
+	client       *http.Client
+}
+
+// NewWebhookNotifier creates a notifier. An empty events list delivers every event.
+func NewWebhookNotifier(url, secret string, events []string, timeout time.Duration, maxRetries int) (*WebhookNotifier, error) {
+	filter := make(map[string]bool)
+	for _, event := range events {
+		event = strings.TrimPrefix(strings.TrimSpace(event), "on-")
+		if event == "" {
+			continue
+		}
+		if !isWebhookEvent(event) {
+			return nil, fmt.Errorf("unknown webhook event %q (valid: %s)", event, strings.Join(webhookEvents, ", "))
+		}
+		filter[event] = true
+	}
+
+	return &WebhookNotifier{
+		url:          url,
+		secret:       secret,
+		events:       filter,
+		maxRetries:   maxRetries,
+		retryBackoff: time.Second,
+		client:       &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify delivers a lifecycle event. hookName is the shell hook name (e.g. "on-apply-failed").
+// Failures are logged and counted but never returned, mirroring hook commands.
+func (n *WebhookNotifier) Notify(ctx context.Context, hookName string, hookEnv *HookEnv) {
+	event := strings.TrimPrefix(hookName, "on-")
+	if len(n.events) > 0 && !n.events[event] {
+		return
+	}
+
+	body, err := json.Marshal(newHookPayload(event, time.Now().UTC(), hookEnv))
+	if err != nil {
+		recordWebhookError(event)
+		slog.Error("Failed to encode webhook payload", "event", event, "error", err)
+		return
+	}
+
+	if err := n.send(ctx, body); err != nil {
+		recordWebhookError(event)
+		slog.Error("Webhook delivery failed", "event", event, "error", err)
+		return
+	}
+	slog.Info("Webhook delivered", "event", event)
+}
+
+// send POSTs the body, retrying with exponential backoff on network errors and 5xx responses
+func (n *WebhookNotifier) send(ctx context.Context, body []byte) error {
+	backoff := n.retryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= n.maxRetries; attempt++ {
+		if attempt > 0 {
+			slog.Warn("Retrying webhook", "attempt", attempt, "backoff", backoff, "error", lastErr)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		retry, err := n.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			return err
+		}
+	}
+	return fmt.Errorf("giving up after %d retries: %w", n.maxRetries, lastErr)
+}
+
+// post makes a single delivery attempt and reports whether a failure is worth retrying
+func (n *WebhookNotifier) post(ctx context.Context, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "db-schema-sync/"+Version)
+	if n.secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhookBody(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send webhook: %w", err)
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// signWebhookBody returns the signature header value: "sha256=" followed by the hex HMAC-SHA256 of body
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newHookPayload(event string, timestamp time.Time, hookEnv *HookEnv) HookPayload {
+	payload := HookPayload{
+		Event:         event,
+		Timestamp:     timestamp,
+		S3Bucket:      hookEnv.S3Bucket,
+		PathPrefix:    hookEnv.PathPrefix,
+		SchemaFile:    hookEnv.SchemaFile,
+		CompletedFile: hookEnv.CompletedFile,
+		Version:       hookEnv.Version,
+		AppVersion:    hookEnv.AppVersion,
+		Error:         hookEnv.Error,
+		Stdout:        hookEnv.Stdout,
+		Stderr:        hookEnv.Stderr,
+		DryRun:        hookEnv.DryRun,
+		BlockedDDL:    hookEnv.BlockedDDL,
+		Drift:         hookEnv.Drift,
+		PauseReason:   hookEnv.PauseReason,
+		DDLSummary:    hookEnv.DDLSummary,
+		FailureReason: hookEnv.FailureReason,
+		Target:        hookEnv.Target,
+		DBHost:        hookEnv.DBHost,
+		DBPort:        hookEnv.DBPort,
+		DBName:        hookEnv.DBName,
+		Hostname:      hookEnv.Hostname,
+		StartedAt:     hookEnv.StartedAt,
+		FinishedAt:    hookEnv.FinishedAt,
+	}
+	payload.FailureCount, _ = strconv.Atoi(hookEnv.FailureCount)
+	payload.FailureThreshold, _ = strconv.Atoi(hookEnv.FailureThreshold)
+	payload.OutageSeconds, _ = strconv.ParseInt(hookEnv.OutageSeconds, 10, 64)
+	payload.SyncAttempt, _ = strconv.ParseInt(hookEnv.SyncAttempt, 10, 64)
+	payload.ApplyDurationMs, _ = strconv.ParseInt(hookEnv.ApplyDurationMs, 10, 64)
+	if hookEnv.PlanEmpty != "" {
+		planEmpty := hookEnv.PlanEmpty == "true"
+		payload.PlanEmpty = &planEmpty
+	}
+	return payload
+}
@@ -0,0 +1,183 @@
+//go:build !integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestWebhookNotifier(t *testing.T, url, secret string, events []string, maxRetries int) *WebhookNotifier {
+	t.Helper()
+	n, err := NewWebhookNotifier(url, secret, events, time.Second, maxRetries)
+	if err != nil {
+		t.Fatalf("NewWebhookNotifier failed: %v", err)
+	}
+	n.retryBackoff = time.Millisecond
+	return n
+}
+
+func TestWebhookNotifier_Payload(t *testing.T) {
+	var got HookPayload
+	var signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expected POST, got %s", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected Content-Type application/json, got %s", ct)
+		}
+		signature = r.Header.Get(webhookSignatureHeader)
+		body, _ = io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("invalid JSON payload: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	n := newTestWebhookNotifier(t, server.URL, "s3cret", nil, 0)
+	n.Notify(context.Background(), "on-apply-failed", &HookEnv{
+		S3Bucket:   "my-bucket",
+		PathPrefix: "schemas/",
+		SchemaFile: "schema.sql",
+		Version:    "v2",
+		Error:      "exit status 1",
+		Stdout:     "out",
+		Stderr:     "ERROR: syntax error",
+		AppVersion: "v0.1.0",
+	})
+
+	if got.Event != "apply-failed" {
+		t.Errorf("expected event apply-failed, got %q", got.Event)
+	}
+	if got.Timestamp.IsZero() {
+		t.Error("expected timestamp to be set")
+	}
+	if got.Version != "v2" || got.Error != "exit status 1" || got.Stderr != "ERROR: syntax error" || got.S3Bucket != "my-bucket" || got.AppVersion != "v0.1.0" {
+		t.Errorf("unexpected payload: %+v", got)
+	}
+	if want := signWebhookBody("s3cret", body); signature != want {
+		t.Errorf("expected signature %s, got %s", want, signature)
+	}
+}
+
+func TestWebhookNotifier_NoSignatureWithoutSecret(t *testing.T) {
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(webhookSignatureHeader)
+	}))
+	defer server.Close()
+
+	n := newTestWebhookNotifier(t, server.URL, "", nil, 0)
+	n.Notify(context.Background(), "on-apply-succeeded", &HookEnv{Version: "v1"})
+
+	if signature != "" {
+		t.Errorf("expected no signature header, got %s", signature)
+	}
+}
+
+func TestWebhookNotifier_Retry(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		maxRetries   int
+		wantRequests int32
+		wantErr      bool
+	}{
+		{"success on first attempt", []int{200}, 3, 1, false},
+		{"retries 5xx until success", []int{503, 500, 200}, 3, 3, false},
+		{"gives up after max retries", []int{500, 500, 500}, 2, 3, true},
+		{"does not retry 4xx", []int{400, 200}, 3, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := requests.Add(1) - 1
+				w.WriteHeader(tt.statuses[min(int(i), len(tt.statuses)-1)])
+			}))
+			defer server.Close()
+
+			n := newTestWebhookNotifier(t, server.URL, "", nil, tt.maxRetries)
+			err := n.send(context.Background(), []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("send() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("expected %d requests, got %d", tt.wantRequests, got)
+			}
+		})
+	}
+}
+
+func TestHookRunnerNotifyTimeout(t *testing.T) {
+	// The endpoint hangs past every request timeout, so each attempt fails and is retried
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	runner := defaultHookRunner()
+	runner.Timeout = 200 * time.Millisecond
+	runner.Webhook = newTestWebhookNotifier(t, server.URL, "", nil, 3)
+	runner.Webhook.client.Timeout = time.Minute
+
+	start := time.Now()
+	runner.run(context.Background(), "on-apply-failed", "", &HookEnv{})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("run() took %v, want the delivery abandoned after %v", elapsed, runner.Timeout)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("expected 1 request before giving up, got %d", got)
+	}
+}
+
+func TestWebhookNotifier_EventFilter(t *testing.T) {
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p HookPayload
+		_ = json.NewDecoder(r.Body).Decode(&p)
+		events = append(events, p.Event)
+	}))
+	defer server.Close()
+
+	n := newTestWebhookNotifier(t, server.URL, "", []string{"apply-failed", "on-recovered"}, 0)
+	for _, hook := range []string{"on-before-apply", "on-apply-failed", "on-apply-succeeded", "on-recovered"} {
+		n.Notify(context.Background(), hook, &HookEnv{})
+	}
+
+	if len(events) != 2 || events[0] != "apply-failed" || events[1] != "recovered" {
+		t.Errorf("expected [apply-failed recovered], got %v", events)
+	}
+}
+
+func TestNewWebhookNotifier_UnknownEvent(t *testing.T) {
+	if _, err := NewWebhookNotifier("http://example.com", "", []string{"apply-exploded"}, time.Second, 0); err == nil {
+		t.Error("expected error for unknown event, got nil")
+	}
+}
+
+func TestSignWebhookBody(t *testing.T) {
+	// echo -n '{"event":"test"}' | openssl dgst -sha256 -hmac secret
+	got := signWebhookBody("secret", []byte(`{"event":"test"}`))
+	want := "sha256=8419ab361b37d61b696d008ef7549a18325132dae5da84c7424e8e1c590d0498"
+	if got != want {
+		t.Errorf("signWebhookBody() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package schemastore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ClientOptions configures the S3 client for AWS or an S3-compatible store such as MinIO or Ceph RGW
+type ClientOptions struct {
+	// Endpoint replaces the AWS endpoint (empty uses AWS)
+	Endpoint string
+	// UsePathStyle sends bucket names in the path (https://host/bucket/key) instead of the host name
+	UsePathStyle bool
+	// CABundle is a PEM file whose certificates are trusted in addition to the system roots
+	CABundle string
+	// InsecureSkipVerify disables TLS certificate verification
+	InsecureSkipVerify bool
+	// RequestTimeout bounds each HTTP request, including reading the response body (0 disables)
+	RequestTimeout time.Duration
+}
+
+// NewClient creates an S3 client from cfg with the given options
+func NewClient(cfg aws.Config, opts ClientOptions) (*s3.Client, error) {
+	var httpClient aws.HTTPClient
+	if opts.CABundle != "" || opts.InsecureSkipVerify || opts.RequestTimeout > 0 {
+		tlsConfig, err := opts.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		httpClient = awshttp.NewBuildableClient().
+			WithTimeout(opts.RequestTimeout).
+			WithTransportOptions(func(tr *http.Transport) {
+				if tlsConfig != nil {
+					tr.TLSClientConfig = tlsConfig
+				}
+			})
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.UsePathStyle
+		if httpClient != nil {
+			o.HTTPClient = httpClient
+		}
+	}), nil
+}
+
+// tlsConfig returns the TLS configuration for the CA bundle and InsecureSkipVerify, or nil to keep the default
+func (o ClientOptions) tlsConfig() (*tls.Config, error) {
+	if o.CABundle == "" && !o.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CABundle != "" {
+		pem, err := os.ReadFile(o.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// Encryption is the server-side encryption requested for every object the tool writes
+type Encryption struct {
+	// SSE is the algorithm, AES256 or aws:kms (empty leaves it to the bucket default)
+	SSE types.ServerSideEncryption
+	// KMSKeyID is the KMS key for aws:kms (empty uses the AWS managed key)
+	KMSKeyID string
+}
+
+// encryptingClient sets the server-side encryption parameters on every PutObject
+type encryptingClient struct {
+	S3Client
+	enc Encryption
+}
+
+// WithEncryption returns a client that writes every object with enc; a zero Encryption returns client unchanged
+func WithEncryption(client S3Client, enc Encryption) S3Client {
+	if enc == (Encryption{}) {
+		return client
+	}
+	return &encryptingClient{S3Client: client, enc: enc}
+}
+
+func (c *encryptingClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	input := *params
+	input.ServerSideEncryption = c.enc.SSE
+	if c.enc.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.enc.KMSKeyID)
+	}
+	return c.S3Client.PutObject(ctx, &input, optFns...)
+}
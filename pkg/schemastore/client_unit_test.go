@@ -0,0 +1,196 @@
+//go:build !integration
+
+package schemastore
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// newTLSStore starts an HTTPS server answering every request with an empty bucket listing
+// and returns it with the path of a PEM file holding its self-signed certificate
+func newTLSStore(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, string) {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler != nil {
+			handler(w, r)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write([]byte(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></ListBucketResult>`))
+	}))
+	// Silence the handshake errors of the untrusted-certificate case
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return server, bundle
+}
+
+// testAWSConfig returns a config with static credentials and no retries, so failing calls return at once
+func testAWSConfig() aws.Config {
+	return aws.Config{
+		Region:           "us-east-1",
+		Credentials:      credentials.NewStaticCredentialsProvider("test", "test", ""),
+		RetryMaxAttempts: 1,
+	}
+}
+
+func listBucket(client *s3.Client) error {
+	_, err := client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String("schemas")})
+	return err
+}
+
+func TestNewClientTLS(t *testing.T) {
+	var paths []string
+	server, bundle := newTLSStore(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Host+r.URL.Path)
+	})
+
+	tests := []struct {
+		name    string
+		opts    ClientOptions
+		wantErr bool
+	}{
+		{name: "untrusted certificate", opts: ClientOptions{}, wantErr: true},
+		{name: "CA bundle", opts: ClientOptions{CABundle: bundle}},
+		{name: "insecure skip verify", opts: ClientOptions{InsecureSkipVerify: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Endpoint = server.URL
+			tt.opts.UsePathStyle = true
+			client, err := NewClient(testAWSConfig(), tt.opts)
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			err = listBucket(client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ListObjectsV2() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	for _, p := range paths {
+		if p != host+"/schemas" {
+			t.Errorf("request to %q, want the path-style %q", p, host+"/schemas")
+		}
+	}
+}
+
+func TestNewClientCABundleErrors(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bundle := range []string{invalid, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := NewClient(testAWSConfig(), ClientOptions{CABundle: bundle}); err == nil {
+			t.Errorf("NewClient(CABundle: %s) should fail", bundle)
+		}
+	}
+}
+
+func TestNewClientRequestTimeout(t *testing.T) {
+	server, bundle := newTLSStore(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	client, err := NewClient(testAWSConfig(), ClientOptions{
+		Endpoint:       server.URL,
+		UsePathStyle:   true,
+		CABundle:       bundle,
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	start := time.Now()
+	if err := listBucket(client); err == nil {
+		t.Fatal("ListObjectsV2() should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ListObjectsV2() took %v, want it bounded by the request timeout", elapsed)
+	}
+}
+
+func TestWithEncryption(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     Encryption
+		wantSSE types.ServerSideEncryption
+		wantKey string
+	}{
+		{name: "unset", enc: Encryption{}},
+		{name: "AES256", enc: Encryption{SSE: types.ServerSideEncryptionAes256}, wantSSE: types.ServerSideEncryptionAes256},
+		{name: "aws:kms with key", enc: Encryption{SSE: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/schemas"}, wantSSE: types.ServerSideEncryptionAwsKms, wantKey: "alias/schemas"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inputs []*s3.PutObjectInput
+			mock := &mockS3Client{
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					return nil, &types.NotFound{}
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					inputs = append(inputs, params)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+			client := WithEncryption(mock, tt.enc)
+			ctx := context.Background()
+
+			if _, err := PushSchema(ctx, client, "bucket", "schemas/", "schema.sql", "1.0.0", []byte("CREATE TABLE t (id int);"), false, true, Versioning{}); err != nil {
+				t.Fatalf("PushSchema() error = %v", err)
+			}
+			if err := UploadCompressedSchema(ctx, client, "bucket", "schemas/1.0.0/exported.sql", []byte("x")); err != nil {
+				t.Fatalf("UploadCompressedSchema() error = %v", err)
+			}
+			if err := CreateCompletionMarker(ctx, client, "bucket", "schemas/1.0.0/schema.sql", "completed", &CompletionMetadata{}, true); err != nil {
+				t.Fatalf("CreateCompletionMarker() error = %v", err)
+			}
+			if err := CreateRolledBackMarker(ctx, client, "bucket", "schemas/1.0.0/schema.sql", &RollbackMetadata{}); err != nil {
+				t.Fatalf("CreateRolledBackMarker() error = %v", err)
+			}
+
+			if len(inputs) != 5 {
+				t.Fatalf("PutObject called %d times, want 5", len(inputs))
+			}
+			for _, input := range inputs {
+				key := aws.ToString(input.Key)
+				if input.ServerSideEncryption != tt.wantSSE {
+					t.Errorf("%s: ServerSideEncryption = %q, want %q", key, input.ServerSideEncryption, tt.wantSSE)
+				}
+				if got := aws.ToString(input.SSEKMSKeyId); got != tt.wantKey {
+					t.Errorf("%s: SSEKMSKeyId = %q, want %q", key, got, tt.wantKey)
+				}
+			}
+			// Conditional writes keep their precondition
+			if aws.ToString(inputs[3].IfNoneMatch) != "*" {
+				t.Errorf("completion marker IfNoneMatch = %q, want *", aws.ToString(inputs[3].IfNoneMatch))
+			}
+		})
+	}
+}
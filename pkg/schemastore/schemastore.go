@@ -0,0 +1,926 @@
+// Package schemastore implements the S3 layout used by db-schema-sync:
+// schemas are stored as <prefix><version>/<schema-file>, with a completion
+// marker and an optional exported schema next to each one.
+package schemastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3Client defines the interface for S3 operations
+type S3Client interface {
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+}
+
+// ErrSchemaExists is returned by PushSchema when the schema file is already present
+var ErrSchemaExists = errors.New("schema already exists")
+
+// ErrSchemaNotFound is returned by FindSchema when the requested version has no schema file,
+// and by FindLatestVersion, FindLatestCompletedSchema and NewestSchema when no schema file qualifies
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// ErrMarkerExists is returned by a conditional CreateCompletionMarker when another writer created the marker first
+var ErrMarkerExists = errors.New("completion marker already exists")
+
+// ErrConditionalWriteUnsupported is returned by a conditional CreateCompletionMarker
+// when the S3-compatible store rejects the If-None-Match header
+var ErrConditionalWriteUnsupported = errors.New("conditional writes are not supported by this S3 store")
+
+// ErrNotModified is returned by DownloadSchemaWithETag when the object still has the ETag of a previous download
+var ErrNotModified = errors.New("object not modified")
+
+// maxDecompressedSize limits the size of a gzip-compressed schema once decompressed,
+// to protect against decompression bombs
+var maxDecompressedSize int64 = 1 << 30
+
+// ErrChecksumMismatch is returned by VerifyChecksum when the schema does not match its sha256 sidecar
+var ErrChecksumMismatch = errors.New("schema does not match its sha256 checksum")
+
+// PushSchema uploads schema as <prefix>/<version>/<schema-file> and returns the key.
+// It refuses to overwrite an existing schema file unless force is set, and a version invalid under versioning.
+func PushSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, ver string, schema []byte, force, checksum bool, versioning Versioning) (string, error) {
+	if strings.Contains(ver, "/") {
+		return "", fmt.Errorf("invalid version %q: must not contain '/'", ver)
+	}
+	if err := versioning.ValidateVersion(ver); err != nil {
+		return "", fmt.Errorf("invalid version %q: %w", ver, err)
+	}
+
+	schemaKey := SchemaKey(prefix, ver, schemaFileName)
+
+	if !force {
+		_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(schemaKey),
+		})
+		if err == nil {
+			return "", fmt.Errorf("%w at %s", ErrSchemaExists, schemaKey)
+		}
+		if !IsNotFoundError(err) {
+			return "", fmt.Errorf("failed to check existing schema: %w", err)
+		}
+	}
+
+	if err := UploadSchema(ctx, client, bucket, schemaKey, schema); err != nil {
+		return "", fmt.Errorf("failed to upload schema: %w", err)
+	}
+
+	if checksum {
+		// The checksum covers the SQL, which is what watch and apply verify after decompressing
+		h := sha256.New()
+		if err := copyObject(h, bytes.NewReader(schema), schemaKey, isGzipKey(schemaKey)); err != nil {
+			return "", err
+		}
+		checksumKey := ChecksumKey(schemaKey)
+		body := []byte(hex.EncodeToString(h.Sum(nil)) + "  " + schemaFileName + "\n")
+		if err := UploadSchema(ctx, client, bucket, checksumKey, body); err != nil {
+			return "", fmt.Errorf("failed to upload checksum: %w", err)
+		}
+		slog.Info("Checksum uploaded to S3", "key", checksumKey)
+	}
+
+	return schemaKey, nil
+}
+
+// ListAllObjects lists every object under the prefix, following continuation tokens
+// so that prefixes with more than 1000 keys are fully enumerated.
+func ListAllObjects(ctx context.Context, client S3Client, bucket, prefix string) ([]types.Object, error) {
+	var objects []types.Object
+	var continuationToken *string
+	for {
+		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, resp.Contents...)
+
+		if !aws.ToBool(resp.IsTruncated) || resp.NextContinuationToken == nil {
+			return objects, nil
+		}
+		continuationToken = resp.NextContinuationToken
+	}
+}
+
+// FindLatestSchema finds the latest schema under the prefix and returns its key and version
+func FindLatestSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName string, versioning Versioning) (string, string, error) {
+	// List objects with the specified prefix
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Extract keys from response
+	var keys []string
+	for _, obj := range objects {
+		keys = append(keys, *obj.Key)
+	}
+
+	return FindLatestVersion(keys, prefix, schemaFileName, versioning)
+}
+
+// FindLatestSchemaUpTo finds the latest schema whose version is not newer than ceiling
+func FindLatestSchemaUpTo(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, ceiling string, versioning Versioning) (string, string, error) {
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return "", "", err
+	}
+	schemaKey, ver, _, err := LatestSchemaUpTo(objects, prefix, schemaFileName, ceiling, versioning)
+	return schemaKey, ver, err
+}
+
+// LatestSchemaUpTo finds the latest schema among objects whose version is not newer than ceiling.
+// It also returns how many schema versions above ceiling it held back.
+func LatestSchemaUpTo(objects []types.Object, prefix, schemaFileName, ceiling string, versioning Versioning) (string, string, int, error) {
+	var keys []string
+	heldBack := 0
+	for _, obj := range objects {
+		key := *obj.Key
+		ver := path.Base(path.Dir(key))
+		if versioning.CompareVersions(ver, ceiling) <= 0 {
+			keys = append(keys, key)
+		} else if path.Base(key) == schemaFileName && versioning.isVersionCandidate(ver) && versioning.ValidateVersion(ver) == nil {
+			heldBack++
+		}
+	}
+
+	schemaKey, ver, err := FindLatestVersion(keys, prefix, schemaFileName, versioning)
+	if err != nil {
+		return "", "", heldBack, fmt.Errorf("no schema at or below version %s: %w", ceiling, err)
+	}
+	return schemaKey, ver, heldBack, nil
+}
+
+// FindSchema returns the key of the schema file of ver, or ErrSchemaNotFound if it does not exist.
+// versioning orders the versions the not-found error suggests instead.
+func FindSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, ver string, versioning Versioning) (string, error) {
+	schemaKey := SchemaKey(prefix, ver, schemaFileName)
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(schemaKey),
+	})
+	if err != nil {
+		if IsNotFoundError(err) {
+			return "", fmt.Errorf("%w: s3://%s/%s%s", ErrSchemaNotFound, bucket, schemaKey, nearbyVersionsHint(ctx, client, bucket, prefix, schemaFileName, ver, versioning))
+		}
+		return "", fmt.Errorf("failed to check schema %s: %w", schemaKey, err)
+	}
+	return schemaKey, nil
+}
+
+// nearbyVersionsHint lists the versions around ver that do have a schema file, for FindSchema's
+// not-found error. It returns an empty string if the listing fails or finds nothing.
+func nearbyVersionsHint(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, ver string, versioning Versioning) string {
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return ""
+	}
+	var versions []string
+	for _, info := range CollectVersions(objects, prefix, schemaFileName, "", versioning) {
+		if info.Schema {
+			versions = append(versions, info.Version)
+		}
+	}
+	nearby := versioning.NearbyVersions(versions, ver, 3)
+	if len(nearby) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (nearby versions: %s)", strings.Join(nearby, ", "))
+}
+
+// FindLatestCompletedSchema finds the latest schema that has a completion marker
+func FindLatestCompletedSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, completedFileName string, versioning Versioning) (string, string, error) {
+	// List objects with the specified prefix
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Build a set of keys for quick lookup
+	keySet := make(map[string]bool)
+	for _, obj := range objects {
+		keySet[*obj.Key] = true
+	}
+
+	// Extract versions that have both schema file and completion marker
+	var versionStrings []string
+	for _, obj := range objects {
+		key := *obj.Key
+		if path.Base(key) == schemaFileName {
+			// Check if completion marker exists
+			// Rolled-back versions no longer describe the database
+			markerKey := CompletionMarkerKey(key, completedFileName)
+			if keySet[markerKey] && !keySet[RolledBackMarkerKey(key)] {
+				dir := path.Dir(key)
+				ver := path.Base(dir)
+				if ver != "." && ver != "/" {
+					versionStrings = append(versionStrings, ver)
+				}
+			}
+		}
+	}
+
+	versionStrings = versioning.filterVersionCandidates(versionStrings)
+	if len(versionStrings) == 0 {
+		return "", "", fmt.Errorf("%w: no completed schema files found with prefix %s", ErrSchemaNotFound, prefix)
+	}
+
+	// Find the latest version
+	latestVersion, err := versioning.FindMaxVersion(versionStrings)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse versions: %w", err)
+	}
+
+	latestSchemaKey := SchemaKey(prefix, latestVersion, schemaFileName)
+	return latestSchemaKey, latestVersion, nil
+}
+
+// FindNewestSchema finds the schema file with the newest LastModified under the prefix and returns its key,
+// its version directory name and its LastModified. It picks the latest schema when version names have
+// no order of their own, such as git commit SHAs. Only the Include and Ignore patterns of versioning apply.
+func FindNewestSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName string, versioning Versioning) (string, string, time.Time, error) {
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return NewestSchema(objects, prefix, schemaFileName, "", versioning)
+}
+
+// FindNewestCompletedSchema is FindNewestSchema limited to versions with a completion marker that have not been rolled back
+func FindNewestCompletedSchema(ctx context.Context, client S3Client, bucket, prefix, schemaFileName, completedFileName string, versioning Versioning) (string, string, time.Time, error) {
+	objects, err := ListAllObjects(ctx, client, bucket, prefix)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return NewestSchema(objects, prefix, schemaFileName, completedFileName, versioning)
+}
+
+// NewestSchema returns the key, version and LastModified of the most recently modified schema file in objects.
+// When completedFileName is set, only completed versions that have not been rolled back are considered.
+// Schemas modified at the same time are ordered by key. It returns ErrSchemaNotFound if there is none.
+func NewestSchema(objects []types.Object, prefix, schemaFileName, completedFileName string, versioning Versioning) (string, string, time.Time, error) {
+	keySet := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keySet[*obj.Key] = true
+	}
+
+	var newest *types.Object
+	var excluded int
+	for i, obj := range objects {
+		key := *obj.Key
+		if path.Base(key) != schemaFileName || obj.LastModified == nil {
+			continue
+		}
+		if ver := path.Base(path.Dir(key)); ver == "." || ver == "/" {
+			continue
+		} else if !versioning.isVersionCandidate(ver) {
+			excluded++
+			continue
+		}
+		if completedFileName != "" && (!keySet[CompletionMarkerKey(key, completedFileName)] || keySet[RolledBackMarkerKey(key)]) {
+			continue
+		}
+		if newest == nil || obj.LastModified.After(*newest.LastModified) ||
+			(obj.LastModified.Equal(*newest.LastModified) && key > *newest.Key) {
+			newest = &objects[i]
+		}
+	}
+
+	if excluded > 0 {
+		slog.Debug("Excluded version directories by pattern", "excluded", excluded)
+	}
+
+	if newest == nil {
+		if completedFileName != "" {
+			return "", "", time.Time{}, fmt.Errorf("%w: no completed schema files with prefix %s", ErrSchemaNotFound, prefix)
+		}
+		return "", "", time.Time{}, fmt.Errorf("%w: no schema files with prefix %s and file name %s", ErrSchemaNotFound, prefix, schemaFileName)
+	}
+	return *newest.Key, path.Base(path.Dir(*newest.Key)), *newest.LastModified, nil
+}
+
+// FindLatestVersion extracts versions from S3 keys and returns the latest one under versioning
+func FindLatestVersion(keys []string, prefix, schemaFileName string, versioning Versioning) (string, string, error) {
+	var versionStrings []string
+	for _, key := range keys {
+		// Check if the object key ends with the schema file name
+		if path.Base(key) == schemaFileName {
+			// Extract the version part (directory name)
+			dir := path.Dir(key)
+			ver := path.Base(dir)
+			// Only consider non-empty versions
+			if ver != "." && ver != "/" {
+				versionStrings = append(versionStrings, ver)
+			}
+		}
+	}
+
+	versionStrings = versioning.filterVersionCandidates(versionStrings)
+	if len(versionStrings) == 0 {
+		return "", "", fmt.Errorf("%w: no schema files found with prefix %s and file name %s", ErrSchemaNotFound, prefix, schemaFileName)
+	}
+
+	// Sort versions using semantic versioning
+	latestVersion, err := versioning.FindMaxVersion(versionStrings)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse versions: %w", err)
+	}
+
+	// Construct the full key for the latest schema
+	latestSchemaKey := SchemaKey(prefix, latestVersion, schemaFileName)
+	return latestSchemaKey, latestVersion, nil
+}
+
+// DownloadSchema downloads the object at key and returns its contents
+func DownloadSchema(ctx context.Context, client S3Client, bucket, key string) ([]byte, error) {
+	body, _, err := DownloadSchemaWithETag(ctx, client, bucket, key, "")
+	return body, err
+}
+
+// DownloadSchemaWithETag downloads the object at key and returns its contents and ETag.
+// With ifNoneMatch set to the ETag of a previous download, the download is conditional and
+// ErrNotModified is returned when the object has not changed.
+func DownloadSchemaWithETag(ctx context.Context, client S3Client, bucket, key, ifNoneMatch string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	etag, err := DownloadSchemaTo(ctx, client, bucket, key, ifNoneMatch, &buf)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), etag, nil
+}
+
+// DownloadSchemaTo streams the object at key into w and returns its ETag, so a large schema is never
+// held in memory. The object is decompressed and ifNoneMatch is handled as by DownloadSchemaWithETag;
+// on an error w may have received part of the object.
+func DownloadSchemaTo(ctx context.Context, client S3Client, bucket, key, ifNoneMatch string, w io.Writer) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	result, err := client.GetObject(ctx, input)
+	if err != nil {
+		if ifNoneMatch != "" && hasErrorCode(err, http.StatusNotModified, "NotModified") {
+			return "", fmt.Errorf("%w: %s", ErrNotModified, key)
+		}
+		return "", err
+	}
+	defer func() { _ = result.Body.Close() }()
+
+	if err := copyObject(w, result.Body, key, isGzipKey(key) || aws.ToString(result.ContentEncoding) == "gzip"); err != nil {
+		return "", err
+	}
+	return aws.ToString(result.ETag), nil
+}
+
+// isGzipKey reports whether key names a gzip-compressed object (schema.sql.gz)
+func isGzipKey(key string) bool {
+	return strings.HasSuffix(key, ".gz")
+}
+
+// copyObject copies r, the contents of the object at key, to w. With compressed set it is gunzipped,
+// up to maxDecompressedSize bytes.
+func copyObject(w io.Writer, r io.Reader, key string, compressed bool) error {
+	if !compressed {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", key, err)
+	}
+	defer func() { _ = zr.Close() }()
+
+	n, err := io.Copy(w, io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", key, err)
+	}
+	if n > maxDecompressedSize {
+		return fmt.Errorf("%s exceeds %d bytes when decompressed", key, maxDecompressedSize)
+	}
+	return nil
+}
+
+// SchemaETag returns the current ETag of the object at key without downloading it
+func SchemaETag(ctx context.Context, client S3Client, bucket, key string) (string, error) {
+	result, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(result.ETag), nil
+}
+
+// SchemaKey constructs the S3 key for the schema file of a version
+func SchemaKey(prefix, ver, schemaFileName string) string {
+	return path.Join(prefix, ver, schemaFileName)
+}
+
+// ChecksumKey constructs the S3 key for the sha256 sidecar of a schema file
+func ChecksumKey(schemaKey string) string {
+	return schemaKey + ".sha256"
+}
+
+// VerifyChecksum compares schema, decompressed for a .gz schema, with the sha256 sidecar of schemaKey, in sha256sum format
+// ("<hex digest>  <file name>"; the name is optional). It reports false without an error when
+// there is no sidecar, and wraps ErrChecksumMismatch when the digests differ.
+func VerifyChecksum(ctx context.Context, client S3Client, bucket, schemaKey string, schema []byte) (bool, error) {
+	sum := sha256.Sum256(schema)
+	return VerifyDigest(ctx, client, bucket, schemaKey, sum[:])
+}
+
+// VerifyDigest is VerifyChecksum for a schema whose sha256 digest was computed while streaming it
+func VerifyDigest(ctx context.Context, client S3Client, bucket, schemaKey string, digest []byte) (bool, error) {
+	checksumKey := ChecksumKey(schemaKey)
+	body, err := DownloadSchema(ctx, client, bucket, checksumKey)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to download checksum %s: %w", checksumKey, err)
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return true, fmt.Errorf("%w: %s is empty", ErrChecksumMismatch, checksumKey)
+	}
+	if got := hex.EncodeToString(digest); !strings.EqualFold(fields[0], got) {
+		return true, fmt.Errorf("%w: %s has sha256 %s, %s expects %s", ErrChecksumMismatch, schemaKey, got, checksumKey, fields[0])
+	}
+	return true, nil
+}
+
+// CompletionMarkerKey constructs the S3 key for the completion marker
+func CompletionMarkerKey(schemaKey, completedFileName string) string {
+	schemaDir := path.Dir(schemaKey)
+	return path.Join(schemaDir, completedFileName)
+}
+
+// CheckCompletionMarker reports whether the completion marker exists next to the schema file
+func CheckCompletionMarker(ctx context.Context, client S3Client, bucket, schemaKey, completedFileName string) (bool, error) {
+	markerKey := CompletionMarkerKey(schemaKey, completedFileName)
+
+	// Check if the object exists
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(markerKey),
+	})
+
+	if err != nil {
+		if IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// IsNotFoundError reports whether err indicates that the requested S3 object does not exist.
+// It relies on typed errors and HTTP status codes rather than error strings so that
+// S3-compatible stores (MinIO, Ceph) and wrapped errors are classified correctly.
+func IsNotFoundError(err error) bool {
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return true
+	}
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return true
+		}
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound {
+		return true
+	}
+
+	return false
+}
+
+// hasErrorCode reports whether err is an S3 API error with one of codes or the given HTTP status
+func hasErrorCode(err error, status int, codes ...string) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		for _, code := range codes {
+			if apiErr.ErrorCode() == code {
+				return true
+			}
+		}
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == status
+}
+
+// CompletionMetadata is the JSON body of a completion marker.
+// Markers written by older releases are empty and have no metadata.
+type CompletionMetadata struct {
+	Version           string    `json:"version"`
+	AppliedAt         time.Time `json:"applied_at"`
+	Hostname          string    `json:"hostname,omitempty"`
+	AppVersion        string    `json:"app_version,omitempty"`
+	DurationMs        int64     `json:"duration_ms"`
+	DDLStatementCount int       `json:"ddl_statement_count"`
+	// SchemaETag is the ETag of the applied schema file, to notice when it is overwritten in place
+	SchemaETag string `json:"schema_etag,omitempty"`
+}
+
+// CreateCompletionMarker uploads the completion marker next to the schema file.
+// The body is meta as JSON, or empty when meta is nil. With conditional set the
+// upload uses If-None-Match: * so that only the first writer succeeds; later writers
+// get ErrMarkerExists, and stores without conditional writes ErrConditionalWriteUnsupported.
+func CreateCompletionMarker(ctx context.Context, client S3Client, bucket, schemaKey, completedFileName string, meta *CompletionMetadata, conditional bool) error {
+	markerKey := CompletionMarkerKey(schemaKey, completedFileName)
+
+	var body []byte
+	if meta != nil {
+		var err error
+		body, err = json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("failed to encode completion metadata: %w", err)
+		}
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(markerKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}
+	if conditional {
+		input.IfNoneMatch = aws.String("*")
+	}
+
+	_, err := client.PutObject(ctx, input)
+	if err != nil && conditional {
+		// 409 ConditionalRequestConflict means a concurrent conditional write to the same key is in progress
+		if hasErrorCode(err, http.StatusPreconditionFailed, "PreconditionFailed") || hasErrorCode(err, http.StatusConflict, "ConditionalRequestConflict") {
+			return fmt.Errorf("%w: %s", ErrMarkerExists, markerKey)
+		}
+		if hasErrorCode(err, http.StatusNotImplemented, "NotImplemented") {
+			return fmt.Errorf("%w: %w", ErrConditionalWriteUnsupported, err)
+		}
+	}
+	return err
+}
+
+// ReadCompletionMarker downloads and parses the completion marker of schemaKey.
+// It returns nil metadata for an empty marker written by an older release.
+func ReadCompletionMarker(ctx context.Context, client S3Client, bucket, schemaKey, completedFileName string) (*CompletionMetadata, error) {
+	body, err := DownloadSchema(ctx, client, bucket, CompletionMarkerKey(schemaKey, completedFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+
+	var meta CompletionMetadata
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse completion marker: %w", err)
+	}
+	return &meta, nil
+}
+
+// ExportedSchemaKey constructs the S3 key for the exported schema (same directory as schema.sql, named exported.sql)
+func ExportedSchemaKey(schemaKey string) string {
+	schemaDir := path.Dir(schemaKey)
+	return path.Join(schemaDir, "exported.sql")
+}
+
+// ExportedHistoryKey constructs the S3 key for a timestamped copy of the exported schema, such as
+// exported-20240115T120000Z.sql, so later exports of the same version do not overwrite it
+func ExportedHistoryKey(schemaKey string, exportedAt time.Time) string {
+	return path.Join(path.Dir(schemaKey), "exported-"+exportedAt.UTC().Format("20060102T150405Z")+".sql")
+}
+
+// ExportMetadata records where an exported schema came from. It is stored as the user metadata
+// x-amz-meta-app-version, x-amz-meta-source-database and x-amz-meta-exported-at.
+type ExportMetadata struct {
+	AppVersion string
+	// SourceDatabase identifies the exported database, such as host:port/dbname
+	SourceDatabase string
+	ExportedAt     time.Time
+}
+
+// objectMetadata returns meta as S3 user metadata, leaving out empty values
+func (m ExportMetadata) objectMetadata() map[string]string {
+	metadata := map[string]string{"exported-at": m.ExportedAt.UTC().Format(time.RFC3339)}
+	if m.AppVersion != "" {
+		metadata["app-version"] = m.AppVersion
+	}
+	if m.SourceDatabase != "" {
+		metadata["source-database"] = m.SourceDatabase
+	}
+	return metadata
+}
+
+// UploadExportedSchema uploads an exported schema as text/plain with meta as user metadata.
+// With compress it is gzip-compressed with Content-Encoding: gzip, like UploadCompressedSchema.
+func UploadExportedSchema(ctx context.Context, client S3Client, bucket, key string, schema []byte, compress bool, meta ExportMetadata) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("text/plain; charset=utf-8"),
+		Metadata:    meta.objectMetadata(),
+	}
+	if compress {
+		compressed, err := gzipBytes(key, schema)
+		if err != nil {
+			return err
+		}
+		input.Body = bytes.NewReader(compressed)
+		input.ContentEncoding = aws.String("gzip")
+	} else {
+		input.Body = bytes.NewReader(schema)
+	}
+	_, err := client.PutObject(ctx, input)
+	return err
+}
+
+// RolledBackFileName is the marker written next to a schema by the rollback subcommand.
+// Versions with this marker are skipped by watch mode and by FindLatestCompletedSchema.
+const RolledBackFileName = "rolled-back"
+
+// RollbackMetadata is the JSON body of a rolled-back marker
+type RollbackMetadata struct {
+	RolledBackTo string    `json:"rolled_back_to"`
+	RolledBackAt time.Time `json:"rolled_back_at"`
+	Hostname     string    `json:"hostname,omitempty"`
+	AppVersion   string    `json:"app_version,omitempty"`
+}
+
+// RolledBackMarkerKey constructs the S3 key for the rolled-back marker of schemaKey
+func RolledBackMarkerKey(schemaKey string) string {
+	return path.Join(path.Dir(schemaKey), RolledBackFileName)
+}
+
+// CreateRolledBackMarker marks the version of schemaKey as rolled back
+func CreateRolledBackMarker(ctx context.Context, client S3Client, bucket, schemaKey string, meta *RollbackMetadata) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode rollback metadata: %w", err)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(RolledBackMarkerKey(schemaKey)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// CheckRolledBackMarker reports whether the version of schemaKey has been rolled back
+func CheckRolledBackMarker(ctx context.Context, client S3Client, bucket, schemaKey string) (bool, error) {
+	return CheckCompletionMarker(ctx, client, bucket, schemaKey, RolledBackFileName)
+}
+
+// FailureMetadata is the JSON body of a failed marker
+type FailureMetadata struct {
+	Version  string    `json:"version"`
+	FailedAt time.Time `json:"failed_at"`
+	Hostname string    `json:"hostname,omitempty"`
+	// Database identifies the database the apply failed on, such as host:port/dbname
+	Database      string `json:"database,omitempty"`
+	AppVersion    string `json:"app_version,omitempty"`
+	Error         string `json:"error"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	// Stderr is the end of the sqldef error output
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// FailedMarkerKey constructs the S3 key for the failed marker of schemaKey
+func FailedMarkerKey(schemaKey, failedFileName string) string {
+	return path.Join(path.Dir(schemaKey), failedFileName)
+}
+
+// CreateFailedMarker records that applying the version of schemaKey failed, replacing an earlier failed marker
+func CreateFailedMarker(ctx context.Context, client S3Client, bucket, schemaKey, failedFileName string, meta *FailureMetadata) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode failure metadata: %w", err)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(FailedMarkerKey(schemaKey, failedFileName)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// CheckFailedMarker reports whether the version of schemaKey has a failed marker
+func CheckFailedMarker(ctx context.Context, client S3Client, bucket, schemaKey, failedFileName string) (bool, error) {
+	return CheckCompletionMarker(ctx, client, bucket, schemaKey, failedFileName)
+}
+
+// ReadFailedMarker downloads and parses the failed marker of schemaKey
+func ReadFailedMarker(ctx context.Context, client S3Client, bucket, schemaKey, failedFileName string) (*FailureMetadata, error) {
+	body, err := DownloadSchema(ctx, client, bucket, FailedMarkerKey(schemaKey, failedFileName))
+	if err != nil {
+		return nil, err
+	}
+	var meta FailureMetadata
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse failed marker: %w", err)
+	}
+	return &meta, nil
+}
+
+// ApprovedTagKey and ApprovedTagValue are the object tag that approves a schema file for the tag approval method
+const (
+	ApprovedTagKey   = "approved"
+	ApprovedTagValue = "true"
+)
+
+// ApprovalMetadata is the JSON body of an approval marker
+type ApprovalMetadata struct {
+	ApprovedAt time.Time `json:"approved_at"`
+	Hostname   string    `json:"hostname,omitempty"`
+	AppVersion string    `json:"app_version,omitempty"`
+}
+
+// ApprovedMarkerKey constructs the S3 key for the approval marker of schemaKey
+func ApprovedMarkerKey(schemaKey, approvedFileName string) string {
+	return path.Join(path.Dir(schemaKey), approvedFileName)
+}
+
+// CreateApprovedMarker approves the version of schemaKey by uploading an approval marker next to the schema file
+func CreateApprovedMarker(ctx context.Context, client S3Client, bucket, schemaKey, approvedFileName string, meta *ApprovalMetadata) error {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode approval metadata: %w", err)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(ApprovedMarkerKey(schemaKey, approvedFileName)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// CheckApprovedMarker reports whether the version of schemaKey has an approval marker
+func CheckApprovedMarker(ctx context.Context, client S3Client, bucket, schemaKey, approvedFileName string) (bool, error) {
+	return CheckCompletionMarker(ctx, client, bucket, schemaKey, approvedFileName)
+}
+
+// CheckApprovedTag reports whether the schema file has the approved=true object tag
+func CheckApprovedTag(ctx context.Context, client S3Client, bucket, schemaKey string) (bool, error) {
+	out, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(schemaKey),
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, tag := range out.TagSet {
+		if aws.ToString(tag.Key) == ApprovedTagKey {
+			return aws.ToString(tag.Value) == ApprovedTagValue, nil
+		}
+	}
+	return false, nil
+}
+
+// TagApproved adds the approved=true tag to the schema file, keeping its other tags
+func TagApproved(ctx context.Context, client S3Client, bucket, schemaKey string) error {
+	out, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(schemaKey),
+	})
+	if err != nil {
+		return err
+	}
+	// PutObjectTagging replaces the whole tag set
+	tags := []types.Tag{{Key: aws.String(ApprovedTagKey), Value: aws.String(ApprovedTagValue)}}
+	for _, tag := range out.TagSet {
+		if aws.ToString(tag.Key) != ApprovedTagKey {
+			tags = append(tags, tag)
+		}
+	}
+	_, err = client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(schemaKey),
+		Tagging: &types.Tagging{TagSet: tags},
+	})
+	return err
+}
+
+// AppliedDDLKey constructs the S3 key for the DDL executed for a version (same directory as schema.sql)
+func AppliedDDLKey(schemaKey, appliedDDLFileName string) string {
+	return path.Join(path.Dir(schemaKey), appliedDDLFileName)
+}
+
+// PreApplyBackupKey constructs the S3 key for the database schema exported before a version was applied
+// (same directory as schema.sql)
+func PreApplyBackupKey(schemaKey, backupFileName string) string {
+	return path.Join(path.Dir(schemaKey), backupFileName)
+}
+
+// UploadSchema uploads the exported schema to S3
+func UploadSchema(ctx context.Context, client S3Client, bucket, key string, schema []byte) error {
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(string(schema)),
+	})
+	return err
+}
+
+// UploadCompressedSchema uploads schema gzip-compressed with Content-Encoding: gzip.
+// DownloadSchema decompresses it again, so the key keeps its name.
+func UploadCompressedSchema(ctx context.Context, client S3Client, bucket, key string, schema []byte) error {
+	compressed, err := gzipBytes(key, schema)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(compressed),
+		ContentEncoding: aws.String("gzip"),
+	})
+	return err
+}
+
+// gzipBytes compresses data to be uploaded to key
+func gzipBytes(key string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %w", key, err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %w", key, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// deleteBatchSize is the most keys a single DeleteObjects request accepts
+const deleteBatchSize = 1000
+
+// DeleteObjects deletes keys in batches of up to 1000 per request. It stops at the first batch
+// with a failed key, so keys in later batches are left in place.
+func DeleteObjects(ctx context.Context, client S3Client, bucket string, keys []string) error {
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		batch := keys[start:min(start+deleteBatchSize, len(keys))]
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			ids[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+
+		resp, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		if len(resp.Errors) > 0 {
+			first := resp.Errors[0]
+			return fmt.Errorf("failed to delete %d objects, first %s: %s", len(resp.Errors), aws.ToString(first.Key), aws.ToString(first.Message))
+		}
+	}
+	return nil
+}
@@ -1,11 +1,13 @@
 //go:build integration
 
-package main
+package schemastore
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -37,10 +39,10 @@ func setupLocalStack(t *testing.T) (*s3.Client, func()) {
 		t.Fatalf("failed to load config: %v", err)
 	}
 
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(endpoint)
-		o.UsePathStyle = true
-	})
+	client, err := NewClient(cfg, ClientOptions{Endpoint: endpoint, UsePathStyle: true, RequestTimeout: 30 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
 
 	cleanup := func() {
 		if err := testcontainers.TerminateContainer(container); err != nil {
@@ -87,7 +89,7 @@ func TestFindLatestSchema(t *testing.T) {
 	putObject(t, ctx, client, bucket, "schemas/v3/schema.sql", "CREATE TABLE t3;")
 
 	t.Run("finds latest version", func(t *testing.T) {
-		key, version, err := findLatestSchema(ctx, client, bucket, "schemas/", "schema.sql")
+		key, version, err := FindLatestSchema(ctx, client, bucket, "schemas/", "schema.sql", Versioning{})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -100,9 +102,9 @@ func TestFindLatestSchema(t *testing.T) {
 	})
 
 	t.Run("returns error when no schema files", func(t *testing.T) {
-		_, _, err := findLatestSchema(ctx, client, bucket, "nonexistent/", "schema.sql")
-		if err == nil {
-			t.Error("expected error, got nil")
+		_, _, err := FindLatestSchema(ctx, client, bucket, "nonexistent/", "schema.sql", Versioning{})
+		if !errors.Is(err, ErrSchemaExists) {
+			t.Errorf("expected ErrSchemaExists, got %v", err)
 		}
 	})
 }
@@ -119,7 +121,7 @@ func TestDownloadSchemaFromS3(t *testing.T) {
 	putObject(t, ctx, client, bucket, "schemas/v1/schema.sql", expectedContent)
 
 	t.Run("downloads schema successfully", func(t *testing.T) {
-		content, err := downloadSchemaFromS3(ctx, client, bucket, "schemas/v1/schema.sql")
+		content, err := DownloadSchema(ctx, client, bucket, "schemas/v1/schema.sql")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -129,9 +131,9 @@ func TestDownloadSchemaFromS3(t *testing.T) {
 	})
 
 	t.Run("returns error for non-existent key", func(t *testing.T) {
-		_, err := downloadSchemaFromS3(ctx, client, bucket, "nonexistent/schema.sql")
-		if err == nil {
-			t.Error("expected error, got nil")
+		_, err := DownloadSchema(ctx, client, bucket, "nonexistent/schema.sql")
+		if !errors.Is(err, ErrSchemaExists) {
+			t.Errorf("expected ErrSchemaExists, got %v", err)
 		}
 	})
 }
@@ -148,7 +150,7 @@ func TestCheckCompletionMarker(t *testing.T) {
 	putObject(t, ctx, client, bucket, "schemas/v1/completed", "")
 
 	t.Run("returns true when marker exists", func(t *testing.T) {
-		exists, err := checkCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed")
+		exists, err := CheckCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -158,7 +160,7 @@ func TestCheckCompletionMarker(t *testing.T) {
 	})
 
 	t.Run("returns false when marker does not exist", func(t *testing.T) {
-		exists, err := checkCompletionMarker(ctx, client, bucket, "schemas/v2/schema.sql", "completed")
+		exists, err := CheckCompletionMarker(ctx, client, bucket, "schemas/v2/schema.sql", "completed")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -179,13 +181,13 @@ func TestCreateCompletionMarker(t *testing.T) {
 	putObject(t, ctx, client, bucket, "schemas/v1/schema.sql", "CREATE TABLE t1;")
 
 	t.Run("creates marker successfully", func(t *testing.T) {
-		err := createCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed")
+		err := CreateCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed", nil, false)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
 
 		// Verify marker exists
-		exists, err := checkCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed")
+		exists, err := CheckCompletionMarker(ctx, client, bucket, "schemas/v1/schema.sql", "completed")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -194,3 +196,82 @@ func TestCreateCompletionMarker(t *testing.T) {
 		}
 	})
 }
+
+func TestApproval(t *testing.T) {
+	client, cleanup := setupLocalStack(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bucket := "test-bucket"
+	createBucket(t, ctx, client, bucket)
+
+	putObject(t, ctx, client, bucket, "schemas/v1/schema.sql", "CREATE TABLE t1;")
+
+	t.Run("marker", func(t *testing.T) {
+		approved, err := CheckApprovedMarker(ctx, client, bucket, "schemas/v1/schema.sql", "approved")
+		if err != nil || approved {
+			t.Fatalf("CheckApprovedMarker() = %v, %v, want not approved", approved, err)
+		}
+		if err := CreateApprovedMarker(ctx, client, bucket, "schemas/v1/schema.sql", "approved", &ApprovalMetadata{ApprovedAt: time.Now().UTC()}); err != nil {
+			t.Fatalf("CreateApprovedMarker() error = %v", err)
+		}
+		approved, err = CheckApprovedMarker(ctx, client, bucket, "schemas/v1/schema.sql", "approved")
+		if err != nil || !approved {
+			t.Errorf("CheckApprovedMarker() = %v, %v, want approved", approved, err)
+		}
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		approved, err := CheckApprovedTag(ctx, client, bucket, "schemas/v1/schema.sql")
+		if err != nil || approved {
+			t.Fatalf("CheckApprovedTag() = %v, %v, want not approved", approved, err)
+		}
+		if err := TagApproved(ctx, client, bucket, "schemas/v1/schema.sql"); err != nil {
+			t.Fatalf("TagApproved() error = %v", err)
+		}
+		approved, err = CheckApprovedTag(ctx, client, bucket, "schemas/v1/schema.sql")
+		if err != nil || !approved {
+			t.Errorf("CheckApprovedTag() = %v, %v, want approved", approved, err)
+		}
+	})
+}
+
+func TestPushSchema(t *testing.T) {
+	client, cleanup := setupLocalStack(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	bucket := "test-bucket"
+	createBucket(t, ctx, client, bucket)
+
+	putObject(t, ctx, client, bucket, "schemas/v1/schema.sql", "CREATE TABLE t1;")
+
+	t.Run("pushes new version that becomes latest", func(t *testing.T) {
+		key, err := PushSchema(ctx, client, bucket, "schemas/", "schema.sql", "v2", []byte("CREATE TABLE t2;"), false, true, Versioning{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if key != "schemas/v2/schema.sql" {
+			t.Errorf("expected key schemas/v2/schema.sql, got %s", key)
+		}
+
+		_, version, err := FindLatestSchema(ctx, client, bucket, "schemas/", "schema.sql", Versioning{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if version != "v2" {
+			t.Errorf("expected latest version v2, got %s", version)
+		}
+
+		if _, err := DownloadSchema(ctx, client, bucket, "schemas/v2/schema.sql.sha256"); err != nil {
+			t.Errorf("expected checksum sidecar to exist: %v", err)
+		}
+	})
+
+	t.Run("refuses to overwrite existing version", func(t *testing.T) {
+		_, err := PushSchema(ctx, client, bucket, "schemas/", "schema.sql", "v1", []byte("CREATE TABLE other;"), false, false, Versioning{})
+		if !errors.Is(err, ErrSchemaExists) {
+			t.Errorf("expected ErrSchemaExists, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,1902 @@
+//go:build !integration
+
+package schemastore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// mockS3Client implements S3Client interface for testing
+type mockS3Client struct {
+	listObjectsFunc   func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	getObjectFunc     func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	headObjectFunc    func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	putObjectFunc     func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	deleteObjectsFunc func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	getTaggingFunc    func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	putTaggingFunc    func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+}
+
+func (m *mockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if m.listObjectsFunc != nil {
+		return m.listObjectsFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if m.getObjectFunc != nil {
+		return m.getObjectFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if m.headObjectFunc != nil {
+		return m.headObjectFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if m.putObjectFunc != nil {
+		return m.putObjectFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if m.deleteObjectsFunc != nil {
+		return m.deleteObjectsFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if m.getTaggingFunc != nil {
+		return m.getTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *mockS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if m.putTaggingFunc != nil {
+		return m.putTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, fmt.Errorf("not implemented")
+}
+
+// Ensure mockS3Client implements S3Client interface
+var _ S3Client = (*mockS3Client)(nil)
+
+func TestFindLatestVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		keys           []string
+		prefix         string
+		schemaFileName string
+		wantKey        string
+		wantVersion    string
+		wantErr        bool
+	}{
+		{
+			name: "finds latest version from multiple versions",
+			keys: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v2/schema.sql",
+				"schemas/v3/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/v3/schema.sql",
+			wantVersion:    "v3",
+			wantErr:        false,
+		},
+		{
+			name: "handles v10 correctly (semver sorting)",
+			keys: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v2/schema.sql",
+				"schemas/v10/schema.sql",
+				"schemas/v9/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/v10/schema.sql",
+			wantVersion:    "v10",
+			wantErr:        false,
+		},
+		{
+			name: "matches compressed schema file name",
+			keys: []string{
+				"schemas/v1/schema.sql.gz",
+				"schemas/v2/schema.sql.gz",
+				"schemas/v3/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql.gz",
+			wantKey:        "schemas/v2/schema.sql.gz",
+			wantVersion:    "v2",
+			wantErr:        false,
+		},
+		{
+			name: "handles full semver versions",
+			keys: []string{
+				"schemas/1.0.0/schema.sql",
+				"schemas/1.1.0/schema.sql",
+				"schemas/2.0.0/schema.sql",
+				"schemas/1.10.0/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/2.0.0/schema.sql",
+			wantVersion:    "2.0.0",
+			wantErr:        false,
+		},
+		{
+			name: "handles semver with v prefix",
+			keys: []string{
+				"schemas/v1.0.0/schema.sql",
+				"schemas/v1.1.0/schema.sql",
+				"schemas/v2.0.0/schema.sql",
+				"schemas/v1.10.0/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/v2.0.0/schema.sql",
+			wantVersion:    "v2.0.0",
+			wantErr:        false,
+		},
+		{
+			name: "handles patch versions correctly",
+			keys: []string{
+				"schemas/v1.0.0/schema.sql",
+				"schemas/v1.0.1/schema.sql",
+				"schemas/v1.0.10/schema.sql",
+				"schemas/v1.0.2/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/v1.0.10/schema.sql",
+			wantVersion:    "v1.0.10",
+			wantErr:        false,
+		},
+		{
+			name: "handles timestamp versions",
+			keys: []string{
+				"schemas/20240101120000/schema.sql",
+				"schemas/20240102120000/schema.sql",
+				"schemas/20240103120000/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/20240103120000/schema.sql",
+			wantVersion:    "20240103120000",
+			wantErr:        false,
+		},
+		{
+			name: "ignores non-matching files",
+			keys: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v2/other.sql",
+				"schemas/v3/schema.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "schemas/v3/schema.sql",
+			wantVersion:    "v3",
+			wantErr:        false,
+		},
+		{
+			name:           "returns error when no schema files found",
+			keys:           []string{},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantErr:        true,
+		},
+		{
+			name: "returns error when no matching schema files",
+			keys: []string{
+				"schemas/v1/other.sql",
+				"schemas/v2/other.sql",
+			},
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			wantErr:        true,
+		},
+		{
+			name: "handles single version",
+			keys: []string{
+				"prod/schemas/v1/schema.sql",
+			},
+			prefix:         "prod/schemas/",
+			schemaFileName: "schema.sql",
+			wantKey:        "prod/schemas/v1/schema.sql",
+			wantVersion:    "v1",
+			wantErr:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotKey, gotVersion, err := FindLatestVersion(tt.keys, tt.prefix, tt.schemaFileName, Versioning{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindLatestVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				if gotKey != tt.wantKey {
+					t.Errorf("FindLatestVersion() gotKey = %v, want %v", gotKey, tt.wantKey)
+				}
+				if gotVersion != tt.wantVersion {
+					t.Errorf("FindLatestVersion() gotVersion = %v, want %v", gotVersion, tt.wantVersion)
+				}
+			}
+		})
+	}
+}
+
+func TestFindMaxVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		scheme   VersionScheme
+		strict   bool
+		versions []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "simple versions",
+			versions: []string{"v1", "v2", "v3"},
+			want:     "v3",
+			wantErr:  false,
+		},
+		{
+			name:     "v10 is greater than v9",
+			versions: []string{"v1", "v9", "v10", "v2"},
+			want:     "v10",
+			wantErr:  false,
+		},
+		{
+			name:     "semver without v prefix",
+			versions: []string{"1.0.0", "1.1.0", "2.0.0", "1.10.0"},
+			want:     "2.0.0",
+			wantErr:  false,
+		},
+		{
+			name:     "semver with v prefix",
+			versions: []string{"v1.0.0", "v1.1.0", "v2.0.0", "v1.10.0"},
+			want:     "v2.0.0",
+			wantErr:  false,
+		},
+		{
+			name:     "patch versions",
+			versions: []string{"v1.0.1", "v1.0.10", "v1.0.2", "v1.0.9"},
+			want:     "v1.0.10",
+			wantErr:  false,
+		},
+		{
+			name:     "mixed major versions",
+			versions: []string{"v1.9.9", "v2.0.0", "v1.10.0"},
+			want:     "v2.0.0",
+			wantErr:  false,
+		},
+		{
+			name:     "timestamp format YYYYMMDDHHMMSS",
+			versions: []string{"20240101120000", "20240115093000", "20240102120000"},
+			want:     "20240115093000",
+			wantErr:  false,
+		},
+		{
+			name:     "timestamp format with different days",
+			versions: []string{"20240101000000", "20240131235959", "20240115120000"},
+			want:     "20240131235959",
+			wantErr:  false,
+		},
+		{
+			name:     "empty list",
+			versions: []string{},
+			wantErr:  true,
+		},
+		{
+			name:     "semver skips unparsable names",
+			versions: []string{"v1", "a1b2c3d", "v2"},
+			want:     "v2",
+		},
+		{
+			name:     "strict semver fails on unparsable names",
+			strict:   true,
+			versions: []string{"v1", "a1b2c3d", "v2"},
+			wantErr:  true,
+		},
+		{
+			name:     "numeric compares digits only",
+			scheme:   SchemeNumeric,
+			versions: []string{"release-9", "release-10", "release-2"},
+			want:     "release-10",
+		},
+		{
+			name:     "numeric ignores leading zeros",
+			scheme:   SchemeNumeric,
+			versions: []string{"build-0099", "build-100", "build-98"},
+			want:     "build-100",
+		},
+		{
+			name:     "numeric skips names without digits",
+			scheme:   SchemeNumeric,
+			versions: []string{"r1", "latest", "r3"},
+			want:     "r3",
+		},
+		{
+			name:     "lexical sorts strings",
+			scheme:   SchemeLexical,
+			versions: []string{"v9", "v10", "apple"},
+			want:     "v9",
+		},
+		{
+			name:     "lexical accepts git SHAs",
+			scheme:   SchemeLexical,
+			versions: []string{"0a1b2c3", "f00baa5", "9e8d7c6"},
+			want:     "f00baa5",
+		},
+		{
+			name:     "timestamp orders by time",
+			scheme:   SchemeTimestamp,
+			versions: []string{"20240101120000", "20241231235959", "20240615000000"},
+			want:     "20241231235959",
+		},
+		{
+			name:     "timestamp skips other formats",
+			scheme:   SchemeTimestamp,
+			versions: []string{"20240101120000", "99999999999999", "202401011200", "v2"},
+			want:     "20240101120000",
+		},
+		{
+			name:     "strict timestamp fails on an invalid date",
+			scheme:   SchemeTimestamp,
+			strict:   true,
+			versions: []string{"20240101120000", "20241301000000"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Versioning{Scheme: tt.scheme, Strict: tt.strict}.FindMaxVersion(tt.versions)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindMaxVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("FindMaxVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		v1   string
+		v2   string
+		want int
+	}{
+		{
+			name: "v1 < v2",
+			v1:   "v1",
+			v2:   "v2",
+			want: -1,
+		},
+		{
+			name: "v2 > v1",
+			v1:   "v2",
+			v2:   "v1",
+			want: 1,
+		},
+		{
+			name: "v1 == v1",
+			v1:   "v1",
+			v2:   "v1",
+			want: 0,
+		},
+		{
+			name: "v9 < v10",
+			v1:   "v9",
+			v2:   "v10",
+			want: -1,
+		},
+		{
+			name: "v10 > v9",
+			v1:   "v10",
+			v2:   "v9",
+			want: 1,
+		},
+		{
+			name: "1.0.0 < 2.0.0",
+			v1:   "1.0.0",
+			v2:   "2.0.0",
+			want: -1,
+		},
+		{
+			name: "1.9.0 < 1.10.0",
+			v1:   "1.9.0",
+			v2:   "1.10.0",
+			want: -1,
+		},
+		{
+			name: "1.0.9 < 1.0.10",
+			v1:   "1.0.9",
+			v2:   "1.0.10",
+			want: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Versioning{}.CompareVersions(tt.v1, tt.v2)
+			if got != tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %v, want %v", tt.v1, tt.v2, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSemverPartsAndVersionTimestamp(t *testing.T) {
+	tests := []struct {
+		ver                 string
+		wantOK              bool
+		major, minor, patch int64
+		wantTime            string
+	}{
+		{ver: "v1.2.3", wantOK: true, major: 1, minor: 2, patch: 3},
+		{ver: "2.5", wantOK: true, major: 2, minor: 5},
+		{ver: "v1.2.3-rc1", wantOK: true, major: 1, minor: 2, patch: 3},
+		{ver: "20240115120000", wantOK: true, major: 20240115120000, wantTime: "2024-01-15T12:00:00Z"},
+		{ver: "20241315120000", wantOK: true, major: 20241315120000},
+		{ver: "release-10"},
+		{ver: "archive"},
+		{ver: "3f2a9c1"},
+	}
+	for _, tt := range tests {
+		major, minor, patch, ok := SemverParts(tt.ver)
+		if ok != tt.wantOK || major != tt.major || minor != tt.minor || patch != tt.patch {
+			t.Errorf("SemverParts(%q) = %d, %d, %d, %v, want %d, %d, %d, %v", tt.ver, major, minor, patch, ok, tt.major, tt.minor, tt.patch, tt.wantOK)
+		}
+		ts, ok := VersionTimestamp(tt.ver)
+		if ok != (tt.wantTime != "") || ok && ts.Format(time.RFC3339) != tt.wantTime {
+			t.Errorf("VersionTimestamp(%q) = %s, %v, want %q", tt.ver, ts, ok, tt.wantTime)
+		}
+	}
+}
+
+func TestBuildCompletionMarkerKey(t *testing.T) {
+	tests := []struct {
+		name              string
+		schemaKey         string
+		completedFileName string
+		want              string
+	}{
+		{
+			name:              "builds marker key",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			want:              "schemas/v1/completed",
+		},
+		{
+			name:              "handles nested path",
+			schemaKey:         "prod/schemas/20240101/schema.sql",
+			completedFileName: ".done",
+			want:              "prod/schemas/20240101/.done",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CompletionMarkerKey(tt.schemaKey, tt.completedFileName)
+			if got != tt.want {
+				t.Errorf("CompletionMarkerKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildExportedSchemaKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		schemaKey string
+		want      string
+	}{
+		{
+			name:      "basic schema key",
+			schemaKey: "schemas/v1/schema.sql",
+			want:      "schemas/v1/exported.sql",
+		},
+		{
+			name:      "nested path",
+			schemaKey: "prod/schemas/v2.0.0/schema.sql",
+			want:      "prod/schemas/v2.0.0/exported.sql",
+		},
+		{
+			name:      "timestamp version",
+			schemaKey: "db/20240101120000/schema.sql",
+			want:      "db/20240101120000/exported.sql",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExportedSchemaKey(tt.schemaKey)
+			if got != tt.want {
+				t.Errorf("ExportedSchemaKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppliedDDLKey(t *testing.T) {
+	if got := AppliedDDLKey("prod/schemas/v2.0.0/schema.sql", "applied.sql"); got != "prod/schemas/v2.0.0/applied.sql" {
+		t.Errorf("AppliedDDLKey() = %v, want prod/schemas/v2.0.0/applied.sql", got)
+	}
+}
+
+func TestPreApplyBackupKey(t *testing.T) {
+	if got := PreApplyBackupKey("prod/schemas/v2.0.0/schema.sql", "pre-apply-backup.sql"); got != "prod/schemas/v2.0.0/pre-apply-backup.sql" {
+		t.Errorf("PreApplyBackupKey() = %v, want prod/schemas/v2.0.0/pre-apply-backup.sql", got)
+	}
+}
+
+func TestDownloadSchemaFromS3(t *testing.T) {
+	tests := []struct {
+		name        string
+		bucket      string
+		key         string
+		mockContent string
+		mockErr     error
+		wantContent string
+		wantErr     bool
+	}{
+		{
+			name:        "successful download",
+			bucket:      "test-bucket",
+			key:         "schemas/v1/schema.sql",
+			mockContent: "CREATE TABLE users (id INT);",
+			wantContent: "CREATE TABLE users (id INT);",
+			wantErr:     false,
+		},
+		{
+			name:    "download error",
+			bucket:  "test-bucket",
+			key:     "schemas/v1/schema.sql",
+			mockErr: fmt.Errorf("access denied"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockS3Client{
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if tt.mockErr != nil {
+						return nil, tt.mockErr
+					}
+					return &s3.GetObjectOutput{
+						Body: io.NopCloser(strings.NewReader(tt.mockContent)),
+					}, nil
+				},
+			}
+
+			got, err := DownloadSchema(context.Background(), mock, tt.bucket, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DownloadSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && string(got) != tt.wantContent {
+				t.Errorf("DownloadSchema() = %v, want %v", string(got), tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestDownloadSchemaWithETag(t *testing.T) {
+	mock := &mockS3Client{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			if aws.ToString(params.IfNoneMatch) == `"etag-1"` {
+				return nil, newHTTPResponseError(http.StatusNotModified, &smithy.GenericAPIError{Code: "NotModified"})
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("CREATE TABLE users (id INT);")), ETag: aws.String(`"etag-1"`)}, nil
+		},
+	}
+	ctx := context.Background()
+
+	body, etag, err := DownloadSchemaWithETag(ctx, mock, "test-bucket", "schemas/v1/schema.sql", "")
+	if err != nil || string(body) != "CREATE TABLE users (id INT);" || etag != `"etag-1"` {
+		t.Fatalf("DownloadSchemaWithETag() = %q, %q, %v", body, etag, err)
+	}
+	if _, _, err := DownloadSchemaWithETag(ctx, mock, "test-bucket", "schemas/v1/schema.sql", etag); !errors.Is(err, ErrNotModified) {
+		t.Errorf("DownloadSchemaWithETag() with the same ETag error = %v, want ErrNotModified", err)
+	}
+	if body, _, err := DownloadSchemaWithETag(ctx, mock, "test-bucket", "schemas/v1/schema.sql", `"etag-0"`); err != nil || len(body) == 0 {
+		t.Errorf("DownloadSchemaWithETag() with another ETag = %q, %v, want the schema", body, err)
+	}
+}
+
+func TestGzipSchema(t *testing.T) {
+	type object struct {
+		body     []byte
+		encoding string
+	}
+	objects := make(map[string]object)
+	mock := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			objects[*params.Key] = object{body, aws.ToString(params.ContentEncoding)}
+			return &s3.PutObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			obj, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			out := &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(obj.body))}
+			if obj.encoding != "" {
+				out.ContentEncoding = aws.String(obj.encoding)
+			}
+			return out, nil
+		},
+	}
+	ctx := context.Background()
+	schema := []byte(strings.Repeat("CREATE TABLE users (id INT);\n", 100))
+	compress := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(data)
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+
+	t.Run("content encoding", func(t *testing.T) {
+		if err := UploadCompressedSchema(ctx, mock, "test-bucket", "schemas/v1/exported.sql", schema); err != nil {
+			t.Fatalf("UploadCompressedSchema() error = %v", err)
+		}
+		if obj := objects["schemas/v1/exported.sql"]; obj.encoding != "gzip" || len(obj.body) >= len(schema) {
+			t.Errorf("uploaded %d bytes with encoding %q, want gzip", len(obj.body), obj.encoding)
+		}
+		got, err := DownloadSchema(ctx, mock, "test-bucket", "schemas/v1/exported.sql")
+		if err != nil || !bytes.Equal(got, schema) {
+			t.Errorf("DownloadSchema() = %d bytes, %v, want the uncompressed schema", len(got), err)
+		}
+	})
+
+	t.Run("gz key", func(t *testing.T) {
+		if _, err := PushSchema(ctx, mock, "test-bucket", "schemas/", "schema.sql.gz", "v2", compress(schema), true, true, Versioning{}); err != nil {
+			t.Fatalf("PushSchema() error = %v", err)
+		}
+		got, err := DownloadSchema(ctx, mock, "test-bucket", "schemas/v2/schema.sql.gz")
+		if err != nil || !bytes.Equal(got, schema) {
+			t.Fatalf("DownloadSchema() = %d bytes, %v, want the uncompressed schema", len(got), err)
+		}
+		// The sidecar pushed for a compressed schema covers the SQL
+		if found, err := VerifyChecksum(ctx, mock, "test-bucket", "schemas/v2/schema.sql.gz", got); !found || err != nil {
+			t.Errorf("VerifyChecksum() = %v, %v, want a matching sidecar", found, err)
+		}
+	})
+
+	t.Run("invalid gzip", func(t *testing.T) {
+		objects["schemas/v3/schema.sql.gz"] = object{body: schema}
+		if _, err := DownloadSchema(ctx, mock, "test-bucket", "schemas/v3/schema.sql.gz"); err == nil || !strings.Contains(err.Error(), "failed to decompress") {
+			t.Errorf("DownloadSchema() error = %v, want a decompression error", err)
+		}
+	})
+
+	t.Run("decompression bomb", func(t *testing.T) {
+		defer func(size int64) { maxDecompressedSize = size }(maxDecompressedSize)
+		maxDecompressedSize = int64(len(schema)) - 1
+		objects["schemas/v4/schema.sql.gz"] = object{body: compress(schema)}
+		if _, err := DownloadSchema(ctx, mock, "test-bucket", "schemas/v4/schema.sql.gz"); err == nil || !strings.Contains(err.Error(), "exceeds") {
+			t.Errorf("DownloadSchema() error = %v, want the size limit", err)
+		}
+	})
+}
+
+func TestCheckCompletionMarker(t *testing.T) {
+	tests := []struct {
+		name              string
+		bucket            string
+		schemaKey         string
+		completedFileName string
+		headErr           error
+		wantExists        bool
+		wantErr           bool
+	}{
+		{
+			name:              "marker exists",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           nil,
+			wantExists:        true,
+			wantErr:           false,
+		},
+		{
+			name:              "marker not found",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           &types.NotFound{Message: aws.String("The specified key does not exist")},
+			wantExists:        false,
+			wantErr:           false,
+		},
+		{
+			name:              "wrapped typed not found",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           fmt.Errorf("operation error S3: HeadObject: %w", &types.NotFound{}),
+			wantExists:        false,
+			wantErr:           false,
+		},
+		{
+			name:              "generic API error with NoSuchKey code",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           &smithy.GenericAPIError{Code: "NoSuchKey", Message: "no such key"},
+			wantExists:        false,
+			wantErr:           false,
+		},
+		{
+			name:              "HTTP 404 without NotFound text",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           newHTTPResponseError(http.StatusNotFound, &smithy.GenericAPIError{Code: "404", Message: "object missing"}),
+			wantExists:        false,
+			wantErr:           false,
+		},
+		{
+			name:              "HTTP 403 access denied is surfaced",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           newHTTPResponseError(http.StatusForbidden, &smithy.GenericAPIError{Code: "Forbidden", Message: "access denied"}),
+			wantExists:        false,
+			wantErr:           true,
+		},
+		{
+			name:              "error string mentioning NotFound is not treated as absent",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           fmt.Errorf("NotFound: The specified key does not exist"),
+			wantExists:        false,
+			wantErr:           true,
+		},
+		{
+			name:              "other error",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			headErr:           fmt.Errorf("access denied"),
+			wantExists:        false,
+			wantErr:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockS3Client{
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					if tt.headErr != nil {
+						return nil, tt.headErr
+					}
+					return &s3.HeadObjectOutput{}, nil
+				},
+			}
+
+			exists, err := CheckCompletionMarker(context.Background(), mock, tt.bucket, tt.schemaKey, tt.completedFileName)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckCompletionMarker() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if exists != tt.wantExists {
+				t.Errorf("CheckCompletionMarker() = %v, want %v", exists, tt.wantExists)
+			}
+		})
+	}
+}
+
+// newHTTPResponseError builds an error as returned by the AWS SDK for a failed HTTP response
+func newHTTPResponseError(statusCode int, err error) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: statusCode}},
+		Err:      err,
+	}
+}
+
+func TestCreateCompletionMarker(t *testing.T) {
+	tests := []struct {
+		name              string
+		bucket            string
+		schemaKey         string
+		completedFileName string
+		putErr            error
+		wantKey           string
+		wantErr           bool
+	}{
+		{
+			name:              "successful creation",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			putErr:            nil,
+			wantKey:           "schemas/v1/completed",
+			wantErr:           false,
+		},
+		{
+			name:              "put error",
+			bucket:            "test-bucket",
+			schemaKey:         "schemas/v1/schema.sql",
+			completedFileName: "completed",
+			putErr:            fmt.Errorf("access denied"),
+			wantErr:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotKey string
+			mock := &mockS3Client{
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					if tt.putErr != nil {
+						return nil, tt.putErr
+					}
+					gotKey = *params.Key
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			err := CreateCompletionMarker(context.Background(), mock, tt.bucket, tt.schemaKey, tt.completedFileName, nil, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateCompletionMarker() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && gotKey != tt.wantKey {
+				t.Errorf("CreateCompletionMarker() put key = %v, want %v", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestCreateCompletionMarkerConditional(t *testing.T) {
+	tests := []struct {
+		name    string
+		putErr  error
+		wantErr error
+	}{
+		{"first writer", nil, nil},
+		{"precondition failed", &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}, ErrMarkerExists},
+		{"precondition failed by status", newHTTPResponseError(http.StatusPreconditionFailed, &smithy.GenericAPIError{Code: "412"}), ErrMarkerExists},
+		{"concurrent conditional write", &smithy.GenericAPIError{Code: "ConditionalRequestConflict"}, ErrMarkerExists},
+		{"header not supported", newHTTPResponseError(http.StatusNotImplemented, &smithy.GenericAPIError{Code: "NotImplemented"}), ErrConditionalWriteUnsupported},
+		{"other error", &smithy.GenericAPIError{Code: "AccessDenied"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ifNoneMatch string
+			mock := &mockS3Client{
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					ifNoneMatch = aws.ToString(params.IfNoneMatch)
+					if tt.putErr != nil {
+						return nil, tt.putErr
+					}
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			err := CreateCompletionMarker(context.Background(), mock, "test-bucket", "schemas/v1/schema.sql", "completed", nil, true)
+			if ifNoneMatch != "*" {
+				t.Errorf("IfNoneMatch = %q, want *", ifNoneMatch)
+			}
+			switch {
+			case tt.putErr == nil && err != nil:
+				t.Errorf("CreateCompletionMarker() error = %v", err)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("CreateCompletionMarker() error = %v, want %v", err, tt.wantErr)
+			case tt.putErr != nil && tt.wantErr == nil && (err == nil || errors.Is(err, ErrMarkerExists) || errors.Is(err, ErrConditionalWriteUnsupported)):
+				t.Errorf("CreateCompletionMarker() error = %v, want the original error", err)
+			}
+		})
+	}
+}
+
+func TestCompletionMarkerMetadata(t *testing.T) {
+	objects := make(map[string]string)
+	contentTypes := make(map[string]string)
+	mock := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			objects[*params.Key] = string(body)
+			contentTypes[*params.Key] = aws.ToString(params.ContentType)
+			return &s3.PutObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	ctx := context.Background()
+
+	want := &CompletionMetadata{
+		Version:           "v2",
+		AppliedAt:         time.Date(2026, 1, 20, 15, 30, 45, 0, time.UTC),
+		Hostname:          "watch-1",
+		AppVersion:        "1.2.3",
+		DurationMs:        420,
+		DDLStatementCount: 3,
+		SchemaETag:        `"9b2cf535f27731c974343645a3985328"`,
+	}
+	if err := CreateCompletionMarker(ctx, mock, "test-bucket", "schemas/v2/schema.sql", "completed", want, false); err != nil {
+		t.Fatalf("CreateCompletionMarker() error = %v", err)
+	}
+	if body := objects["schemas/v2/completed"]; !strings.Contains(body, `"ddl_statement_count":3`) {
+		t.Errorf("marker body = %s, want JSON metadata", body)
+	}
+	if ct := contentTypes["schemas/v2/completed"]; ct != "application/json" {
+		t.Errorf("marker Content-Type = %q, want application/json", ct)
+	}
+
+	got, err := ReadCompletionMarker(ctx, mock, "test-bucket", "schemas/v2/schema.sql", "completed")
+	if err != nil {
+		t.Fatalf("ReadCompletionMarker() error = %v", err)
+	}
+	if got == nil || *got != *want {
+		t.Errorf("ReadCompletionMarker() = %+v, want %+v", got, want)
+	}
+
+	// Markers written by older releases are empty
+	if err := CreateCompletionMarker(ctx, mock, "test-bucket", "schemas/v1/schema.sql", "completed", nil, false); err != nil {
+		t.Fatalf("CreateCompletionMarker() error = %v", err)
+	}
+	got, err = ReadCompletionMarker(ctx, mock, "test-bucket", "schemas/v1/schema.sql", "completed")
+	if err != nil || got != nil {
+		t.Errorf("ReadCompletionMarker() on empty marker = %+v, %v, want nil, nil", got, err)
+	}
+
+	objects["schemas/v3/completed"] = "not json"
+	if _, err := ReadCompletionMarker(ctx, mock, "test-bucket", "schemas/v3/schema.sql", "completed"); err == nil {
+		t.Error("ReadCompletionMarker() expected error for invalid body")
+	}
+}
+
+func TestUploadSchemaToS3(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		key     string
+		schema  []byte
+		putErr  error
+		wantErr bool
+	}{
+		{
+			name:    "successful upload",
+			bucket:  "test-bucket",
+			key:     "schemas/v1/exported.sql",
+			schema:  []byte("CREATE TABLE users (id INT);"),
+			putErr:  nil,
+			wantErr: false,
+		},
+		{
+			name:    "upload error",
+			bucket:  "test-bucket",
+			key:     "schemas/v1/exported.sql",
+			schema:  []byte("CREATE TABLE users (id INT);"),
+			putErr:  fmt.Errorf("access denied"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBucket, gotKey string
+			mock := &mockS3Client{
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					if tt.putErr != nil {
+						return nil, tt.putErr
+					}
+					gotBucket = *params.Bucket
+					gotKey = *params.Key
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			err := UploadSchema(context.Background(), mock, tt.bucket, tt.key, tt.schema)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UploadSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				if gotBucket != tt.bucket {
+					t.Errorf("UploadSchema() bucket = %v, want %v", gotBucket, tt.bucket)
+				}
+				if gotKey != tt.key {
+					t.Errorf("UploadSchema() key = %v, want %v", gotKey, tt.key)
+				}
+			}
+		})
+	}
+}
+
+func TestFindLatestSchemaWithMock(t *testing.T) {
+	tests := []struct {
+		name           string
+		bucket         string
+		prefix         string
+		schemaFileName string
+		objects        []string
+		listErr        error
+		wantKey        string
+		wantVersion    string
+		wantErr        bool
+	}{
+		{
+			name:           "finds latest version",
+			bucket:         "test-bucket",
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			objects:        []string{"schemas/v1/schema.sql", "schemas/v2/schema.sql", "schemas/v3/schema.sql"},
+			wantKey:        "schemas/v3/schema.sql",
+			wantVersion:    "v3",
+			wantErr:        false,
+		},
+		{
+			name:           "handles semver correctly",
+			bucket:         "test-bucket",
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			objects:        []string{"schemas/v1.0.0/schema.sql", "schemas/v1.10.0/schema.sql", "schemas/v2.0.0/schema.sql"},
+			wantKey:        "schemas/v2.0.0/schema.sql",
+			wantVersion:    "v2.0.0",
+			wantErr:        false,
+		},
+		{
+			name:           "list error",
+			bucket:         "test-bucket",
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			listErr:        fmt.Errorf("access denied"),
+			wantErr:        true,
+		},
+		{
+			name:           "no schema files",
+			bucket:         "test-bucket",
+			prefix:         "schemas/",
+			schemaFileName: "schema.sql",
+			objects:        []string{"schemas/v1/other.sql"},
+			wantErr:        true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					if tt.listErr != nil {
+						return nil, tt.listErr
+					}
+					var contents []types.Object
+					for _, key := range tt.objects {
+						keyCopy := key
+						contents = append(contents, types.Object{Key: aws.String(keyCopy)})
+					}
+					return &s3.ListObjectsV2Output{Contents: contents}, nil
+				},
+			}
+
+			gotKey, gotVersion, err := FindLatestSchema(context.Background(), mock, tt.bucket, tt.prefix, tt.schemaFileName, Versioning{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindLatestSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				if gotKey != tt.wantKey {
+					t.Errorf("FindLatestSchema() key = %v, want %v", gotKey, tt.wantKey)
+				}
+				if gotVersion != tt.wantVersion {
+					t.Errorf("FindLatestSchema() version = %v, want %v", gotVersion, tt.wantVersion)
+				}
+			}
+		})
+	}
+}
+
+func TestFindLatestCompletedSchemaWithMock(t *testing.T) {
+	tests := []struct {
+		name              string
+		bucket            string
+		prefix            string
+		schemaFileName    string
+		completedFileName string
+		objects           []string
+		listErr           error
+		wantKey           string
+		wantVersion       string
+		wantErr           bool
+	}{
+		{
+			name:              "finds latest completed version",
+			bucket:            "test-bucket",
+			prefix:            "schemas/",
+			schemaFileName:    "schema.sql",
+			completedFileName: "completed",
+			objects: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v1/completed",
+				"schemas/v2/schema.sql",
+				"schemas/v2/completed",
+				"schemas/v3/schema.sql", // no completion marker
+			},
+			wantKey:     "schemas/v2/schema.sql",
+			wantVersion: "v2",
+			wantErr:     false,
+		},
+		{
+			name:              "skips rolled-back version",
+			bucket:            "test-bucket",
+			prefix:            "schemas/",
+			schemaFileName:    "schema.sql",
+			completedFileName: "completed",
+			objects: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v1/completed",
+				"schemas/v2/schema.sql",
+				"schemas/v2/completed",
+				"schemas/v2/rolled-back",
+			},
+			wantKey:     "schemas/v1/schema.sql",
+			wantVersion: "v1",
+			wantErr:     false,
+		},
+		{
+			name:              "no completed schemas",
+			bucket:            "test-bucket",
+			prefix:            "schemas/",
+			schemaFileName:    "schema.sql",
+			completedFileName: "completed",
+			objects: []string{
+				"schemas/v1/schema.sql",
+				"schemas/v2/schema.sql",
+			},
+			wantErr: true,
+		},
+		{
+			name:              "list error",
+			bucket:            "test-bucket",
+			prefix:            "schemas/",
+			schemaFileName:    "schema.sql",
+			completedFileName: "completed",
+			listErr:           fmt.Errorf("access denied"),
+			wantErr:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					if tt.listErr != nil {
+						return nil, tt.listErr
+					}
+					var contents []types.Object
+					for _, key := range tt.objects {
+						keyCopy := key
+						contents = append(contents, types.Object{Key: aws.String(keyCopy)})
+					}
+					return &s3.ListObjectsV2Output{Contents: contents}, nil
+				},
+			}
+
+			gotKey, gotVersion, err := FindLatestCompletedSchema(context.Background(), mock, tt.bucket, tt.prefix, tt.schemaFileName, tt.completedFileName, Versioning{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindLatestCompletedSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr {
+				if gotKey != tt.wantKey {
+					t.Errorf("FindLatestCompletedSchema() key = %v, want %v", gotKey, tt.wantKey)
+				}
+				if gotVersion != tt.wantVersion {
+					t.Errorf("FindLatestCompletedSchema() version = %v, want %v", gotVersion, tt.wantVersion)
+				}
+			}
+		})
+	}
+}
+
+// newPaginatedListFunc returns a listObjectsFunc that serves the given pages,
+// using the page index as the continuation token.
+func newPaginatedListFunc(t *testing.T, pages [][]string) func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	t.Helper()
+	return func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		page := 0
+		if params.ContinuationToken != nil {
+			if _, err := fmt.Sscanf(*params.ContinuationToken, "page-%d", &page); err != nil {
+				t.Fatalf("unexpected continuation token %q", *params.ContinuationToken)
+			}
+		}
+		var contents []types.Object
+		for _, key := range pages[page] {
+			contents = append(contents, types.Object{Key: aws.String(key)})
+		}
+		out := &s3.ListObjectsV2Output{Contents: contents}
+		if page+1 < len(pages) {
+			out.IsTruncated = aws.Bool(true)
+			out.NextContinuationToken = aws.String(fmt.Sprintf("page-%d", page+1))
+		}
+		return out, nil
+	}
+}
+
+func TestListAllObjects_Pagination(t *testing.T) {
+	var calls int
+	listFunc := newPaginatedListFunc(t, [][]string{
+		{"schemas/v1/schema.sql", "schemas/v1/completed"},
+		{"schemas/v2/schema.sql", "schemas/v2/completed"},
+		{"schemas/v3/schema.sql"},
+	})
+	mock := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			calls++
+			return listFunc(ctx, params, optFns...)
+		},
+	}
+
+	objects, err := ListAllObjects(context.Background(), mock, "test-bucket", "schemas/")
+	if err != nil {
+		t.Fatalf("ListAllObjects() error = %v", err)
+	}
+	if len(objects) != 5 {
+		t.Errorf("ListAllObjects() returned %d objects, want 5", len(objects))
+	}
+	if calls != 3 {
+		t.Errorf("ListObjectsV2 called %d times, want 3", calls)
+	}
+}
+
+func TestListAllObjects_ErrorOnLaterPage(t *testing.T) {
+	listFunc := newPaginatedListFunc(t, [][]string{
+		{"schemas/v1/schema.sql"},
+		{"schemas/v2/schema.sql"},
+	})
+	mock := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			if params.ContinuationToken != nil {
+				return nil, fmt.Errorf("access denied")
+			}
+			return listFunc(ctx, params, optFns...)
+		},
+	}
+
+	if _, err := ListAllObjects(context.Background(), mock, "test-bucket", "schemas/"); err == nil {
+		t.Error("ListAllObjects() expected error, got nil")
+	}
+}
+
+func TestFindLatestSchema_Paginated(t *testing.T) {
+	// The newest version only appears on the last page
+	mock := &mockS3Client{
+		listObjectsFunc: newPaginatedListFunc(t, [][]string{
+			{"schemas/v1/schema.sql", "schemas/v1/completed", "schemas/v1/exported.sql"},
+			{"schemas/v2/schema.sql", "schemas/v2/completed", "schemas/v2/exported.sql"},
+			{"schemas/v10/schema.sql"},
+		}),
+	}
+
+	gotKey, gotVersion, err := FindLatestSchema(context.Background(), mock, "test-bucket", "schemas/", "schema.sql", Versioning{})
+	if err != nil {
+		t.Fatalf("FindLatestSchema() error = %v", err)
+	}
+	if gotKey != "schemas/v10/schema.sql" {
+		t.Errorf("FindLatestSchema() key = %v, want schemas/v10/schema.sql", gotKey)
+	}
+	if gotVersion != "v10" {
+		t.Errorf("FindLatestSchema() version = %v, want v10", gotVersion)
+	}
+}
+
+func TestFindLatestCompletedSchema_Paginated(t *testing.T) {
+	// The completion marker for v3 is on a different page than its schema file
+	mock := &mockS3Client{
+		listObjectsFunc: newPaginatedListFunc(t, [][]string{
+			{"schemas/v1/schema.sql", "schemas/v1/completed"},
+			{"schemas/v2/schema.sql", "schemas/v2/completed", "schemas/v3/schema.sql"},
+			{"schemas/v3/completed", "schemas/v4/schema.sql"},
+		}),
+	}
+
+	gotKey, gotVersion, err := FindLatestCompletedSchema(context.Background(), mock, "test-bucket", "schemas/", "schema.sql", "completed", Versioning{})
+	if err != nil {
+		t.Fatalf("FindLatestCompletedSchema() error = %v", err)
+	}
+	if gotKey != "schemas/v3/schema.sql" {
+		t.Errorf("FindLatestCompletedSchema() key = %v, want schemas/v3/schema.sql", gotKey)
+	}
+	if gotVersion != "v3" {
+		t.Errorf("FindLatestCompletedSchema() version = %v, want v3", gotVersion)
+	}
+}
+
+func TestCompareVersions_EdgeCases(t *testing.T) {
+	tests := []struct {
+		name string
+		v1   string
+		v2   string
+		want int
+	}{
+		{
+			name: "invalid vs valid version - string comparison (i < v)",
+			v1:   "invalid",
+			v2:   "v1",
+			want: -1,
+		},
+		{
+			name: "valid vs invalid version - string comparison (v > i)",
+			v1:   "v1",
+			v2:   "invalid",
+			want: 1,
+		},
+		{
+			name: "both invalid - string comparison (abc < def)",
+			v1:   "abc",
+			v2:   "def",
+			want: -1,
+		},
+		{
+			name: "both invalid - equal",
+			v1:   "same",
+			v2:   "same",
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Versioning{}.CompareVersions(tt.v1, tt.v2)
+			if got != tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %v, want %v", tt.v1, tt.v2, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindMaxVersion_EdgeCases(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "all invalid versions",
+			versions: []string{"invalid1", "invalid2", "invalid3"},
+			wantErr:  true,
+		},
+		{
+			name:     "mixed valid and invalid",
+			versions: []string{"invalid", "v1", "v2"},
+			want:     "v2",
+			wantErr:  false,
+		},
+		{
+			name:     "single valid version",
+			versions: []string{"v1"},
+			want:     "v1",
+			wantErr:  false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Versioning{}.FindMaxVersion(tt.versions)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FindMaxVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("FindMaxVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPushSchema(t *testing.T) {
+	schema := []byte("CREATE TABLE users (id INT);")
+
+	tests := []struct {
+		name         string
+		version      string
+		force        bool
+		checksum     bool
+		headErr      error
+		wantErr      string
+		wantPutKeys  []string
+		wantChecksum string
+	}{
+		{
+			name:        "uploads new version",
+			version:     "v1.2.3",
+			headErr:     &types.NotFound{},
+			wantPutKeys: []string{"schemas/v1.2.3/schema.sql"},
+		},
+		{
+			name:         "uploads checksum sidecar",
+			version:      "20240101120000",
+			checksum:     true,
+			headErr:      &types.NotFound{},
+			wantPutKeys:  []string{"schemas/20240101120000/schema.sql", "schemas/20240101120000/schema.sql.sha256"},
+			wantChecksum: "5ea918fac5561634f4b577815b41483e5882b9c57dd3bd2351e3422d641af545  schema.sql\n",
+		},
+		{
+			name:    "refuses to overwrite existing version",
+			version: "v1",
+			headErr: nil,
+			wantErr: "already exists",
+		},
+		{
+			name:        "overwrites existing version with force",
+			version:     "v1",
+			force:       true,
+			wantPutKeys: []string{"schemas/v1/schema.sql"},
+		},
+		{
+			name:    "surfaces errors other than not found",
+			version: "v1",
+			headErr: newHTTPResponseError(http.StatusForbidden, &smithy.GenericAPIError{Code: "Forbidden"}),
+			wantErr: "failed to check existing schema",
+		},
+		{
+			name:    "rejects unparsable version",
+			version: "not-a-version",
+			wantErr: "invalid version",
+		},
+		{
+			name:    "rejects version containing a slash",
+			version: "v1/v2",
+			wantErr: "invalid version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var putKeys []string
+			bodies := map[string]string{}
+			mock := &mockS3Client{
+				headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+					if tt.force {
+						t.Error("HeadObject should not be called with force")
+					}
+					if tt.headErr != nil {
+						return nil, tt.headErr
+					}
+					return &s3.HeadObjectOutput{}, nil
+				},
+				putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+					body, _ := io.ReadAll(params.Body)
+					putKeys = append(putKeys, *params.Key)
+					bodies[*params.Key] = string(body)
+					return &s3.PutObjectOutput{}, nil
+				},
+			}
+
+			key, err := PushSchema(context.Background(), mock, "test-bucket", "schemas/", "schema.sql", tt.version, schema, tt.force, tt.checksum, Versioning{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("PushSchema() error = %v, want containing %q", err, tt.wantErr)
+				}
+				if len(putKeys) != 0 {
+					t.Errorf("PushSchema() uploaded %v on error", putKeys)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PushSchema() error = %v", err)
+			}
+			if key != tt.wantPutKeys[0] {
+				t.Errorf("PushSchema() key = %v, want %v", key, tt.wantPutKeys[0])
+			}
+			if strings.Join(putKeys, ",") != strings.Join(tt.wantPutKeys, ",") {
+				t.Errorf("PushSchema() uploaded %v, want %v", putKeys, tt.wantPutKeys)
+			}
+			if bodies[tt.wantPutKeys[0]] != string(schema) {
+				t.Errorf("PushSchema() schema body = %q", bodies[tt.wantPutKeys[0]])
+			}
+			if tt.wantChecksum != "" && bodies[tt.wantPutKeys[1]] != tt.wantChecksum {
+				t.Errorf("PushSchema() checksum body = %q, want %q", bodies[tt.wantPutKeys[1]], tt.wantChecksum)
+			}
+		})
+	}
+}
+
+func TestFindSchemaNotFoundListsNearbyVersions(t *testing.T) {
+	client := &mockS3Client{
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return nil, &types.NotFound{}
+		},
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []types.Object{
+				{Key: aws.String("schemas/20240101000000/schema.sql")},
+				{Key: aws.String("schemas/20240102000000/schema.sql")},
+				{Key: aws.String("schemas/20240104000000/schema.sql")},
+				{Key: aws.String("schemas/20240105000000/completed")},
+			}}, nil
+		},
+	}
+
+	_, err := FindSchema(context.Background(), client, "test-bucket", "schemas/", "schema.sql", "20240103000000", Versioning{})
+	if !errors.Is(err, ErrSchemaNotFound) {
+		t.Fatalf("FindSchema() error = %v, want ErrSchemaNotFound", err)
+	}
+	want := "schema not found: s3://test-bucket/schemas/20240103000000/schema.sql (nearby versions: 20240101000000, 20240102000000, 20240104000000)"
+	if err.Error() != want {
+		t.Errorf("FindSchema() error = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	schema := []byte("CREATE TABLE users (id INT);\n")
+	sum := sha256.Sum256(schema)
+	digest := hex.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("CREATE TABLE users (id BIGINT);\n"))
+
+	tests := []struct {
+		name      string
+		sidecar   string
+		getErr    error
+		wantFound bool
+		wantErr   string
+	}{
+		{"match", digest + "  schema.sql\n", nil, true, ""},
+		{"digest only, upper case", strings.ToUpper(digest), nil, true, ""},
+		{"mismatch", hex.EncodeToString(other[:]) + "  schema.sql\n", nil, true, "schema does not match its sha256 checksum"},
+		{"empty", "", nil, true, "schemas/v1/schema.sql.sha256 is empty"},
+		{"missing", "", &types.NoSuchKey{}, false, ""},
+		{"download error", "", errors.New("access denied"), false, "failed to download checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockS3Client{
+				getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					if *params.Key != "schemas/v1/schema.sql.sha256" {
+						t.Errorf("GetObject() key = %s", *params.Key)
+					}
+					if tt.getErr != nil {
+						return nil, tt.getErr
+					}
+					return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(tt.sidecar))}, nil
+				},
+			}
+
+			found, err := VerifyChecksum(context.Background(), client, "test-bucket", "schemas/v1/schema.sql", schema)
+			if found != tt.wantFound {
+				t.Errorf("VerifyChecksum() found = %v, want %v", found, tt.wantFound)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyChecksum() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyChecksum() error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindNewestSchema(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	object := func(key string, minutes int) types.Object {
+		return types.Object{Key: aws.String(key), LastModified: aws.Time(base.Add(time.Duration(minutes) * time.Minute))}
+	}
+	objects := []types.Object{
+		object("schemas/f00baa5/schema.sql", 30),
+		object("schemas/f00baa5/completed", 31),
+		object("schemas/0a1b2c3/schema.sql", 10),
+		object("schemas/0a1b2c3/completed", 11),
+		object("schemas/9e8d7c6/schema.sql", 40), // newest, not completed
+		object("schemas/c0ffee0/schema.sql", 50),
+		object("schemas/c0ffee0/completed", 51),
+		object("schemas/c0ffee0/rolled-back", 52),
+	}
+	mock := &mockS3Client{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: objects}, nil
+		},
+	}
+
+	key, ver, modified, err := FindNewestSchema(context.Background(), mock, "bucket", "schemas/", "schema.sql", Versioning{})
+	if err != nil {
+		t.Fatalf("FindNewestSchema() error = %v", err)
+	}
+	if key != "schemas/c0ffee0/schema.sql" || ver != "c0ffee0" || !modified.Equal(base.Add(50*time.Minute)) {
+		t.Errorf("FindNewestSchema() = %s, %s, %v", key, ver, modified)
+	}
+
+	key, ver, _, err = FindNewestCompletedSchema(context.Background(), mock, "bucket", "schemas/", "schema.sql", "completed", Versioning{})
+	if err != nil {
+		t.Fatalf("FindNewestCompletedSchema() error = %v", err)
+	}
+	if key != "schemas/f00baa5/schema.sql" || ver != "f00baa5" {
+		t.Errorf("FindNewestCompletedSchema() = %s, %s, want the newest completed version that is not rolled back", key, ver)
+	}
+
+	if _, _, _, err := NewestSchema(objects, "schemas/", "missing.sql", "", Versioning{}); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("NewestSchema() without schema files error = %v, want ErrSchemaNotFound", err)
+	}
+}
+
+func TestNewestSchemaTieBreaksByKey(t *testing.T) {
+	at := aws.Time(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	objects := []types.Object{
+		{Key: aws.String("schemas/bbb/schema.sql"), LastModified: at},
+		{Key: aws.String("schemas/ccc/schema.sql"), LastModified: at},
+		{Key: aws.String("schemas/aaa/schema.sql"), LastModified: at},
+	}
+	_, ver, _, err := NewestSchema(objects, "schemas/", "schema.sql", "", Versioning{})
+	if err != nil {
+		t.Fatalf("NewestSchema() error = %v", err)
+	}
+	if ver != "ccc" {
+		t.Errorf("NewestSchema() version = %s, want ccc", ver)
+	}
+}
+
+func TestLatestSchemaUpTo(t *testing.T) {
+	objects := []types.Object{
+		{Key: aws.String("schemas/v1/schema.sql")},
+		{Key: aws.String("schemas/v2/schema.sql")},
+		{Key: aws.String("schemas/v2/completed")},
+		{Key: aws.String("schemas/v3/schema.sql")},
+		{Key: aws.String("schemas/v3/completed")},
+	}
+
+	tests := []struct {
+		name         string
+		ceiling      string
+		wantVersion  string
+		wantHeldBack int
+		wantErr      bool
+	}{
+		{name: "ceiling equal to a version", ceiling: "v2", wantVersion: "v2", wantHeldBack: 1},
+		{name: "ceiling between versions", ceiling: "v2.5", wantVersion: "v2", wantHeldBack: 1},
+		{name: "ceiling below every version", ceiling: "v0.9", wantHeldBack: 3, wantErr: true},
+		{name: "ceiling above every version", ceiling: "v4", wantVersion: "v3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, ver, heldBack, err := LatestSchemaUpTo(objects, "schemas/", "schema.sql", tt.ceiling, Versioning{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LatestSchemaUpTo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if heldBack != tt.wantHeldBack {
+				t.Errorf("LatestSchemaUpTo() held back = %d, want %d", heldBack, tt.wantHeldBack)
+			}
+			if tt.wantErr {
+				return
+			}
+			if ver != tt.wantVersion || key != SchemaKey("schemas/", tt.wantVersion, "schema.sql") {
+				t.Errorf("LatestSchemaUpTo() = %s, %s, want version %s", key, ver, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestDeleteObjects(t *testing.T) {
+	keys := make([]string, 2500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("schemas/v%d/schema.sql", i)
+	}
+
+	var batches []int
+	mock := &mockS3Client{
+		deleteObjectsFunc: func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+			batches = append(batches, len(params.Delete.Objects))
+			if len(batches) == 1 && aws.ToString(params.Delete.Objects[0].Key) != keys[0] {
+				t.Errorf("first key = %s, want %s", aws.ToString(params.Delete.Objects[0].Key), keys[0])
+			}
+			return &s3.DeleteObjectsOutput{}, nil
+		},
+	}
+	if err := DeleteObjects(context.Background(), mock, "bucket", keys); err != nil {
+		t.Fatalf("DeleteObjects() error = %v", err)
+	}
+	if fmt.Sprint(batches) != "[1000 1000 500]" {
+		t.Errorf("batch sizes = %v, want [1000 1000 500]", batches)
+	}
+
+	// A key failing in the first batch stops before the second
+	batches = nil
+	mock.deleteObjectsFunc = func(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+		batches = append(batches, len(params.Delete.Objects))
+		return &s3.DeleteObjectsOutput{Errors: []types.Error{{Key: aws.String(keys[3]), Message: aws.String("Access Denied")}}}, nil
+	}
+	err := DeleteObjects(context.Background(), mock, "bucket", keys)
+	if err == nil || !strings.Contains(err.Error(), "schemas/v3/schema.sql: Access Denied") {
+		t.Errorf("DeleteObjects() error = %v, want the failed key", err)
+	}
+	if len(batches) != 1 {
+		t.Errorf("sent %d batches after a failure, want 1", len(batches))
+	}
+}
+
+func TestUploadExportedSchema(t *testing.T) {
+	var got []*s3.PutObjectInput
+	mock := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			got = append(got, params)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	exportedAt := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	meta := ExportMetadata{AppVersion: "v0.0.9", SourceDatabase: "db.internal:5432/app", ExportedAt: exportedAt}
+	ctx := context.Background()
+
+	if err := UploadExportedSchema(ctx, mock, "bucket", "schemas/v1/exported.sql", []byte("CREATE TABLE t (id int);"), false, meta); err != nil {
+		t.Fatalf("UploadExportedSchema() error = %v", err)
+	}
+	if err := UploadExportedSchema(ctx, mock, "bucket", "schemas/v1/exported.sql", []byte("CREATE TABLE t (id int);"), true, ExportMetadata{ExportedAt: exportedAt}); err != nil {
+		t.Fatalf("UploadExportedSchema(compress) error = %v", err)
+	}
+
+	plain, compressed := got[0], got[1]
+	if ct := aws.ToString(plain.ContentType); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain; charset=utf-8", ct)
+	}
+	wantMeta := map[string]string{"app-version": "v0.0.9", "source-database": "db.internal:5432/app", "exported-at": "2024-01-15T12:00:00Z"}
+	if !reflect.DeepEqual(plain.Metadata, wantMeta) {
+		t.Errorf("Metadata = %v, want %v", plain.Metadata, wantMeta)
+	}
+	if plain.ContentEncoding != nil {
+		t.Errorf("Content-Encoding = %q, want none", aws.ToString(plain.ContentEncoding))
+	}
+
+	if aws.ToString(compressed.ContentEncoding) != "gzip" || aws.ToString(compressed.ContentType) != "text/plain; charset=utf-8" {
+		t.Errorf("compressed upload has Content-Encoding %q and Content-Type %q", aws.ToString(compressed.ContentEncoding), aws.ToString(compressed.ContentType))
+	}
+	if !reflect.DeepEqual(compressed.Metadata, map[string]string{"exported-at": "2024-01-15T12:00:00Z"}) {
+		t.Errorf("Metadata = %v, want only exported-at", compressed.Metadata)
+	}
+
+	if key := ExportedHistoryKey("schemas/v1/schema.sql", exportedAt.In(time.FixedZone("JST", 9*3600))); key != "schemas/v1/exported-20240115T120000Z.sql" {
+		t.Errorf("ExportedHistoryKey() = %s", key)
+	}
+}
+
+func TestApprovedTag(t *testing.T) {
+	tags := map[string][]types.Tag{
+		"schemas/v1/schema.sql": nil,
+		"schemas/v2/schema.sql": {{Key: aws.String("team"), Value: aws.String("billing")}, {Key: aws.String(ApprovedTagKey), Value: aws.String("false")}},
+	}
+	mock := &mockS3Client{
+		getTaggingFunc: func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+			tagSet, ok := tags[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectTaggingOutput{TagSet: tagSet}, nil
+		},
+		putTaggingFunc: func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+			tags[*params.Key] = params.Tagging.TagSet
+			return &s3.PutObjectTaggingOutput{}, nil
+		},
+	}
+	ctx := context.Background()
+
+	for _, key := range []string{"schemas/v1/schema.sql", "schemas/v2/schema.sql"} {
+		if approved, err := CheckApprovedTag(ctx, mock, "bucket", key); err != nil || approved {
+			t.Errorf("CheckApprovedTag(%s) = %v, %v, want not approved", key, approved, err)
+		}
+		if err := TagApproved(ctx, mock, "bucket", key); err != nil {
+			t.Fatalf("TagApproved(%s) error = %v", key, err)
+		}
+		if approved, err := CheckApprovedTag(ctx, mock, "bucket", key); err != nil || !approved {
+			t.Errorf("CheckApprovedTag(%s) = %v, %v, want approved", key, approved, err)
+		}
+	}
+	if got := len(tags["schemas/v2/schema.sql"]); got != 2 {
+		t.Errorf("schemas/v2/schema.sql has %d tags, want the team tag kept and approved replaced", got)
+	}
+
+	if _, err := CheckApprovedTag(ctx, mock, "bucket", "schemas/v3/schema.sql"); !IsNotFoundError(err) {
+		t.Errorf("CheckApprovedTag() error = %v, want not found", err)
+	}
+}
+
+func TestCreateApprovedMarker(t *testing.T) {
+	var gotKey, gotBody string
+	mock := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			gotKey, gotBody = *params.Key, string(body)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	meta := &ApprovalMetadata{ApprovedAt: time.Date(2026, 1, 20, 15, 30, 45, 0, time.UTC), Hostname: "ci"}
+	if err := CreateApprovedMarker(context.Background(), mock, "bucket", "schemas/v1/schema.sql", "approved", meta); err != nil {
+		t.Fatalf("CreateApprovedMarker() error = %v", err)
+	}
+	if gotKey != "schemas/v1/approved" {
+		t.Errorf("CreateApprovedMarker() put key = %s, want schemas/v1/approved", gotKey)
+	}
+	if want := `{"approved_at":"2026-01-20T15:30:45Z","hostname":"ci"}`; gotBody != want {
+		t.Errorf("CreateApprovedMarker() body = %s, want %s", gotBody, want)
+	}
+}
+
+func TestFailedMarker(t *testing.T) {
+	objects := map[string]string{}
+	mock := &mockS3Client{
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			body, _ := io.ReadAll(params.Body)
+			objects[*params.Key] = string(body)
+			return &s3.PutObjectOutput{}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if _, ok := objects[*params.Key]; !ok {
+				return nil, &types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body, ok := objects[*params.Key]
+			if !ok {
+				return nil, &types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	ctx := context.Background()
+	if failed, err := CheckFailedMarker(ctx, mock, "bucket", "schemas/v1/schema.sql", "failed"); err != nil || failed {
+		t.Fatalf("CheckFailedMarker() = %v, %v before the marker was written", failed, err)
+	}
+
+	meta := &FailureMetadata{Version: "v1", FailedAt: time.Date(2026, 1, 20, 15, 30, 45, 0, time.UTC), Hostname: "db-1", Error: "exit status 1", Stderr: "ERROR: syntax error"}
+	if err := CreateFailedMarker(ctx, mock, "bucket", "schemas/v1/schema.sql", "failed", meta); err != nil {
+		t.Fatalf("CreateFailedMarker() error = %v", err)
+	}
+	want := `{"version":"v1","failed_at":"2026-01-20T15:30:45Z","hostname":"db-1","error":"exit status 1","stderr":"ERROR: syntax error"}`
+	if got := objects["schemas/v1/failed"]; got != want {
+		t.Errorf("CreateFailedMarker() body = %s, want %s", got, want)
+	}
+	if failed, err := CheckFailedMarker(ctx, mock, "bucket", "schemas/v1/schema.sql", "failed"); err != nil || !failed {
+		t.Errorf("CheckFailedMarker() = %v, %v, want the marker found", failed, err)
+	}
+	got, err := ReadFailedMarker(ctx, mock, "bucket", "schemas/v1/schema.sql", "failed")
+	if err != nil {
+		t.Fatalf("ReadFailedMarker() error = %v", err)
+	}
+	if *got != *meta {
+		t.Errorf("ReadFailedMarker() = %+v, want %+v", got, meta)
+	}
+}
@@ -0,0 +1,221 @@
+package schemastore
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
+)
+
+// VersionScheme decides which version directory names are valid and how they are ordered
+type VersionScheme string
+
+const (
+	// SchemeSemver orders versions as semantic versions (v1, 1.2.3, 20240101120000). It is the default.
+	SchemeSemver VersionScheme = "semver"
+	// SchemeNumeric orders versions by their digits alone, so release-10 follows release-9
+	SchemeNumeric VersionScheme = "numeric"
+	// SchemeLexical orders versions as plain strings; every name is valid
+	SchemeLexical VersionScheme = "lexical"
+	// SchemeTimestamp accepts only YYYYMMDDHHMMSS names and orders them by time
+	SchemeTimestamp VersionScheme = "timestamp"
+)
+
+// timestampLayout is the layout of SchemeTimestamp versions
+const timestampLayout = "20060102150405"
+
+// ErrInvalidVersion is returned by Versioning.FindMaxVersion in strict mode when a version does not parse under the scheme
+var ErrInvalidVersion = errors.New("invalid version")
+
+// Versioning decides which version directory names the lookups of this package consider and how they
+// are validated and ordered. The zero value considers every name, orders versions as semantic versions
+// and skips names that do not parse.
+type Versioning struct {
+	// Scheme validates and orders versions; empty means SchemeSemver
+	Scheme VersionScheme
+	// Strict makes FindMaxVersion fail on a version the scheme cannot parse instead of skipping it
+	Strict bool
+	// Include limits candidates to directory names that match one of these unanchored patterns; empty allows any name
+	Include []*regexp.Regexp
+	// Ignore drops directory names that match one of these unanchored patterns, such as archive/ or tmp-v99/
+	Ignore []*regexp.Regexp
+}
+
+// Check reports an unknown Scheme
+func (v Versioning) Check() error {
+	switch v.Scheme {
+	case "", SchemeSemver, SchemeNumeric, SchemeLexical, SchemeTimestamp:
+		return nil
+	}
+	return fmt.Errorf("unknown version scheme %q", v.Scheme)
+}
+
+// scheme returns Scheme, or SchemeSemver when it is empty
+func (v Versioning) scheme() VersionScheme {
+	if v.Scheme == "" {
+		return SchemeSemver
+	}
+	return v.Scheme
+}
+
+// parseSemver parses ver as a semantic version, the parse shared by validation, ordering and SemverParts
+func parseSemver(ver string) (*version.Version, error) {
+	return version.NewVersion(ver)
+}
+
+// isVersionCandidate reports whether the directory name ver passes Include and Ignore
+func (v Versioning) isVersionCandidate(ver string) bool {
+	for _, re := range v.Ignore {
+		if re.MatchString(ver) {
+			return false
+		}
+	}
+	if len(v.Include) == 0 {
+		return true
+	}
+	for _, re := range v.Include {
+		if re.MatchString(ver) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterVersionCandidates drops the names that do not pass Include and Ignore
+func (v Versioning) filterVersionCandidates(versionStrings []string) []string {
+	var kept []string
+	for _, ver := range versionStrings {
+		if v.isVersionCandidate(ver) {
+			kept = append(kept, ver)
+		}
+	}
+	if excluded := len(versionStrings) - len(kept); excluded > 0 {
+		slog.Debug("Excluded version directories by pattern", "excluded", excluded, "candidates", len(kept))
+	}
+	return kept
+}
+
+// ValidateVersion reports whether ver is a valid version under the scheme
+func (v Versioning) ValidateVersion(ver string) error {
+	switch v.scheme() {
+	case SchemeNumeric:
+		if numericDigits(ver) == "" {
+			return fmt.Errorf("%q has no digits", ver)
+		}
+	case SchemeLexical:
+		if ver == "" {
+			return fmt.Errorf("empty version")
+		}
+	case SchemeTimestamp:
+		if len(ver) != len(timestampLayout) {
+			return fmt.Errorf("%q is not a YYYYMMDDHHMMSS timestamp", ver)
+		}
+		if _, err := time.Parse(timestampLayout, ver); err != nil {
+			return fmt.Errorf("%q is not a YYYYMMDDHHMMSS timestamp: %w", ver, err)
+		}
+	default:
+		if _, err := parseSemver(ver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindMaxVersion finds the maximum version from a list of version strings under the scheme.
+// Versions the scheme cannot parse are skipped with a warning, or fail with ErrInvalidVersion in strict mode.
+func (v Versioning) FindMaxVersion(versionStrings []string) (string, error) {
+	if len(versionStrings) == 0 {
+		return "", fmt.Errorf("no versions provided")
+	}
+
+	var latest string
+	for _, vs := range versionStrings {
+		if err := v.ValidateVersion(vs); err != nil {
+			if v.Strict {
+				return "", fmt.Errorf("%w %q under the %s scheme: %w", ErrInvalidVersion, vs, v.scheme(), err)
+			}
+			slog.Warn("Failed to parse version, skipping", "version", vs, "scheme", v.scheme(), "error", err)
+			continue
+		}
+		if latest == "" || v.compareValid(vs, latest) > 0 {
+			latest = vs
+		}
+	}
+
+	if latest == "" {
+		return "", fmt.Errorf("no valid versions found")
+	}
+	return latest, nil
+}
+
+// CompareVersions compares two version strings under the scheme and returns:
+// -1 if v1 < v2, 0 if v1 == v2, 1 if v1 > v2
+func (v Versioning) CompareVersions(v1, v2 string) int {
+	// If either version fails to parse, fall back to string comparison
+	if v.ValidateVersion(v1) != nil || v.ValidateVersion(v2) != nil {
+		return strings.Compare(v1, v2)
+	}
+	return v.compareValid(v1, v2)
+}
+
+// SemverParts returns the major, minor and patch numbers of ver when it parses as a semantic version,
+// whatever the scheme. Missing parts are 0, so v2 is 2.0.0. A prerelease must follow a hyphen:
+// go-version also reads a git SHA such as 3f2a9c1 as 3 with the prerelease f2a9c1, which is not a version number.
+func SemverParts(ver string) (major, minor, patch int64, ok bool) {
+	v, err := parseSemver(ver)
+	if err != nil || v.Prerelease() != "" && !strings.Contains(ver, "-"+v.Prerelease()) {
+		return 0, 0, 0, false
+	}
+	segments := v.Segments64()
+	return segments[0], segments[1], segments[2], true
+}
+
+// VersionTimestamp returns the time of a YYYYMMDDHHMMSS version, read as UTC, whatever the scheme
+func VersionTimestamp(ver string) (time.Time, bool) {
+	if len(ver) != len(timestampLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timestampLayout, ver)
+	return t, err == nil
+}
+
+// compareValid compares two versions that are valid under the scheme
+func (v Versioning) compareValid(v1, v2 string) int {
+	switch v.scheme() {
+	case SchemeNumeric:
+		d1 := strings.TrimLeft(numericDigits(v1), "0")
+		d2 := strings.TrimLeft(numericDigits(v2), "0")
+		if len(d1) != len(d2) {
+			if len(d1) < len(d2) {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(d1, d2); c != 0 {
+			return c
+		}
+		// Equal numbers (v1 and 1) still need a stable order
+		return strings.Compare(v1, v2)
+	case SchemeLexical, SchemeTimestamp:
+		// Fixed-width timestamps sort chronologically as strings
+		return strings.Compare(v1, v2)
+	default:
+		ver1, _ := parseSemver(v1)
+		ver2, _ := parseSemver(v2)
+		return ver1.Compare(ver2)
+	}
+}
+
+// numericDigits returns the digits of ver, dropping every other character
+func numericDigits(ver string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, ver)
+}
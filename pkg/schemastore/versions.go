@@ -0,0 +1,178 @@
+package schemastore
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// VersionInfo describes the files present in a version directory
+type VersionInfo struct {
+	Version      string    `json:"version"`
+	Schema       bool      `json:"schema"`
+	Completed    bool      `json:"completed"`
+	Exported     bool      `json:"exported"`
+	RolledBack   bool      `json:"rolled_back"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// CollectVersions groups objects by version directory and returns them sorted from oldest to newest under versioning.
+// Directories excluded by its Include and Ignore patterns are left out.
+func CollectVersions(objects []types.Object, prefix, schemaFileName, completedFileName string, versioning Versioning) []VersionInfo {
+	exportedFileName := path.Base(ExportedSchemaKey(schemaFileName))
+
+	byVersion := make(map[string]*VersionInfo)
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(*obj.Key, prefix)
+		ver, fileName, ok := strings.Cut(rel, "/")
+		if !ok || ver == "" || fileName == "" || !versioning.isVersionCandidate(ver) {
+			continue
+		}
+
+		info, exists := byVersion[ver]
+		if !exists {
+			info = &VersionInfo{Version: ver}
+			byVersion[ver] = info
+		}
+
+		switch fileName {
+		case schemaFileName:
+			info.Schema = true
+		case completedFileName:
+			info.Completed = true
+		case exportedFileName:
+			info.Exported = true
+		case RolledBackFileName:
+			info.RolledBack = true
+		}
+
+		if obj.LastModified != nil && obj.LastModified.After(info.LastModified) {
+			info.LastModified = *obj.LastModified
+		}
+	}
+
+	versionStrings := make([]string, 0, len(byVersion))
+	for ver := range byVersion {
+		versionStrings = append(versionStrings, ver)
+	}
+	versioning.SortVersions(versionStrings)
+
+	result := make([]VersionInfo, 0, len(versionStrings))
+	for _, ver := range versionStrings {
+		result = append(result, *byVersion[ver])
+	}
+	return result
+}
+
+// FindRollbackTarget returns the version to roll back from (the newest completed version that
+// has not been rolled back) and the one to roll back to (the completed version before it).
+// versions must be sorted oldest first, as returned by CollectVersions.
+func FindRollbackTarget(versions []VersionInfo) (from, to VersionInfo, err error) {
+	var candidates []VersionInfo
+	for _, v := range versions {
+		if v.Schema && v.Completed && !v.RolledBack {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) < 2 {
+		return VersionInfo{}, VersionInfo{}, fmt.Errorf("need at least two completed versions to roll back, found %d", len(candidates))
+	}
+	return candidates[len(candidates)-1], candidates[len(candidates)-2], nil
+}
+
+// PruneOptions selects the versions PlanPrune deletes
+type PruneOptions struct {
+	// Keep is how many of the newest completed versions survive; the newest one is kept even when it is 0
+	Keep int
+	// Before, when set, limits pruning to versions whose directory was last modified before it
+	Before time.Time
+	// AnyName allows pruning directories whose names are not valid versions. Set it only when versions
+	// are ordered by upload time; by name such directories sort first and would always look oldest.
+	AnyName bool
+	// Versioning decides which names are valid versions
+	Versioning Versioning
+}
+
+// PlanPrune splits versions, sorted oldest first, into the ones to keep and the ones to delete.
+// The newest completed version that has not been rolled back is the applied one: it and everything
+// newer (pending and rolled-back versions) are always kept, as are the newest opts.Keep completed
+// versions. Without any completed version nothing is pruned.
+func PlanPrune(versions []VersionInfo, opts PruneOptions) (kept, pruned []VersionInfo) {
+	applied := -1
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Completed && !versions[i].RolledBack {
+			applied = i
+			break
+		}
+	}
+
+	keep := make([]bool, len(versions))
+	completed := 1 // the applied version
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		switch {
+		case i >= applied:
+			keep[i] = true
+		case !opts.AnyName && opts.Versioning.ValidateVersion(v.Version) != nil:
+			keep[i] = true
+		case v.Completed && !v.RolledBack && completed < opts.Keep:
+			completed++
+			keep[i] = true
+		case !opts.Before.IsZero() && !v.LastModified.Before(opts.Before):
+			keep[i] = true
+		}
+	}
+
+	for i, v := range versions {
+		if keep[i] {
+			kept = append(kept, v)
+		} else {
+			pruned = append(pruned, v)
+		}
+	}
+	return kept, pruned
+}
+
+// NearbyVersions returns up to n of versions on each side of ver, oldest first, to suggest
+// alternatives when ver does not exist. ver itself is never included.
+func (v Versioning) NearbyVersions(versions []string, ver string, n int) []string {
+	sorted := []string{ver}
+	for _, other := range versions {
+		if other != ver {
+			sorted = append(sorted, other)
+		}
+	}
+	v.SortVersions(sorted)
+
+	i := 0
+	for sorted[i] != ver {
+		i++
+	}
+	return append(append([]string{}, sorted[max(0, i-n):i]...), sorted[i+1:min(len(sorted), i+1+n)]...)
+}
+
+// SortVersions sorts version strings in ascending order using the same comparison as FindMaxVersion.
+// Unparsable versions sort before all valid ones.
+func (v Versioning) SortVersions(versionStrings []string) {
+	valid := make(map[string]bool, len(versionStrings))
+	for _, vs := range versionStrings {
+		valid[vs] = v.ValidateVersion(vs) == nil
+	}
+
+	sort.SliceStable(versionStrings, func(i, j int) bool {
+		vi, vj := valid[versionStrings[i]], valid[versionStrings[j]]
+		switch {
+		case !vi && !vj:
+			return versionStrings[i] < versionStrings[j]
+		case !vi:
+			return true
+		case !vj:
+			return false
+		}
+		return v.compareValid(versionStrings[i], versionStrings[j]) < 0
+	})
+}
@@ -0,0 +1,338 @@
+//go:build !integration
+
+package schemastore
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestCollectVersions(t *testing.T) {
+	t1 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	t2 := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	objects := []types.Object{
+		{Key: aws.String("schemas/v10/schema.sql"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/v2/schema.sql"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/v2/completed"), LastModified: aws.Time(t2)},
+		{Key: aws.String("schemas/v2/exported.sql"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/v9/completed"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/v9/rolled-back"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/archive/schema.sql"), LastModified: aws.Time(t1)},
+		{Key: aws.String("schemas/README"), LastModified: aws.Time(t1)},
+	}
+
+	got := CollectVersions(objects, "schemas/", "schema.sql", "completed", Versioning{})
+
+	want := []VersionInfo{
+		{Version: "archive", Schema: true, LastModified: t1},
+		{Version: "v2", Schema: true, Completed: true, Exported: true, LastModified: t2},
+		{Version: "v9", Completed: true, RolledBack: true, LastModified: t1},
+		{Version: "v10", Schema: true, LastModified: t1},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("CollectVersions() returned %d versions, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("CollectVersions()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	versions := []string{"v10", "v1.0.0", "zzz", "v9", "aaa", "20240101120000"}
+	Versioning{}.SortVersions(versions)
+
+	want := "aaa,zzz,v1.0.0,v9,v10,20240101120000"
+	if got := strings.Join(versions, ","); got != want {
+		t.Errorf("SortVersions() = %s, want %s", got, want)
+	}
+}
+
+func TestFindRollbackTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		versions []VersionInfo
+		wantFrom string
+		wantTo   string
+		wantErr  bool
+	}{
+		{
+			name: "two newest completed",
+			versions: []VersionInfo{
+				{Version: "v1", Schema: true, Completed: true},
+				{Version: "v2", Schema: true, Completed: true},
+				{Version: "v3", Schema: true, Completed: true},
+				{Version: "v4", Schema: true},
+			},
+			wantFrom: "v3",
+			wantTo:   "v2",
+		},
+		{
+			name: "skips rolled-back versions",
+			versions: []VersionInfo{
+				{Version: "v1", Schema: true, Completed: true},
+				{Version: "v2", Schema: true, Completed: true},
+				{Version: "v3", Schema: true, Completed: true, RolledBack: true},
+			},
+			wantFrom: "v2",
+			wantTo:   "v1",
+		},
+		{
+			name: "only one completed",
+			versions: []VersionInfo{
+				{Version: "v1", Schema: true, Completed: true},
+				{Version: "v2", Schema: true},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := FindRollbackTarget(tt.versions)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FindRollbackTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if from.Version != tt.wantFrom || to.Version != tt.wantTo {
+				t.Errorf("FindRollbackTarget() = %s -> %s, want %s -> %s", from.Version, to.Version, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestPlanPrune(t *testing.T) {
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	completed := func(ver string) VersionInfo {
+		return VersionInfo{Version: ver, Schema: true, Completed: true, LastModified: old}
+	}
+	pending := func(ver string) VersionInfo {
+		return VersionInfo{Version: ver, Schema: true, LastModified: old}
+	}
+	rolledBack := func(ver string) VersionInfo {
+		return VersionInfo{Version: ver, Schema: true, Completed: true, RolledBack: true, LastModified: old}
+	}
+	at := func(v VersionInfo, lastModified time.Time) VersionInfo {
+		v.LastModified = lastModified
+		return v
+	}
+
+	tests := []struct {
+		name       string
+		versions   []VersionInfo
+		opts       PruneOptions
+		wantPruned string
+	}{
+		{
+			name:       "keeps the newest completed and pending versions",
+			versions:   []VersionInfo{completed("v1"), completed("v2"), completed("v3"), completed("v4"), pending("v5")},
+			opts:       PruneOptions{Keep: 2},
+			wantPruned: "v1,v2",
+		},
+		{
+			name:       "keep larger than the completed versions",
+			versions:   []VersionInfo{completed("v1"), completed("v2")},
+			opts:       PruneOptions{Keep: 5},
+			wantPruned: "",
+		},
+		{
+			name:       "pending versions older than the applied one are pruned",
+			versions:   []VersionInfo{completed("v1"), pending("v2"), completed("v3"), pending("v4")},
+			opts:       PruneOptions{Keep: 1},
+			wantPruned: "v1,v2",
+		},
+		{
+			name:       "keep 0 still keeps the applied version",
+			versions:   []VersionInfo{completed("v1"), completed("v2")},
+			opts:       PruneOptions{Before: cutoff},
+			wantPruned: "v1",
+		},
+		{
+			name:       "rolled-back versions are kept when newer and not counted when older",
+			versions:   []VersionInfo{completed("v1"), rolledBack("v2"), completed("v3"), rolledBack("v4")},
+			opts:       PruneOptions{Keep: 2},
+			wantPruned: "v2",
+		},
+		{
+			name:       "nothing is pruned without a completed version",
+			versions:   []VersionInfo{pending("v1"), pending("v2"), rolledBack("v3")},
+			opts:       PruneOptions{Keep: 1},
+			wantPruned: "",
+		},
+		{
+			name:       "unparsable names sort first but are never pruned by name",
+			versions:   []VersionInfo{pending("archive"), completed("tmp-v99"), completed("v1"), completed("v2")},
+			opts:       PruneOptions{Keep: 1},
+			wantPruned: "v1",
+		},
+		{
+			name:       "unparsable names are pruned with AnyName",
+			versions:   []VersionInfo{pending("archive"), completed("tmp-v99"), completed("v1"), completed("v2")},
+			opts:       PruneOptions{Keep: 1, AnyName: true},
+			wantPruned: "archive,tmp-v99,v1",
+		},
+		{
+			name:       "older-than keeps recently modified versions",
+			versions:   []VersionInfo{completed("v1"), at(completed("v2"), recent), at(pending("v3"), recent), completed("v4")},
+			opts:       PruneOptions{Before: cutoff},
+			wantPruned: "v1",
+		},
+		{
+			name:       "keep and older-than both protect versions",
+			versions:   []VersionInfo{completed("v1"), at(pending("v2"), recent), completed("v3"), completed("v4"), completed("v5")},
+			opts:       PruneOptions{Keep: 2, Before: cutoff},
+			wantPruned: "v1,v3",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, pruned := PlanPrune(tt.versions, tt.opts)
+			if len(kept)+len(pruned) != len(tt.versions) {
+				t.Fatalf("PlanPrune() returned %d kept and %d pruned for %d versions", len(kept), len(pruned), len(tt.versions))
+			}
+			var names []string
+			for _, v := range pruned {
+				names = append(names, v.Version)
+			}
+			if got := strings.Join(names, ","); got != tt.wantPruned {
+				t.Errorf("PlanPrune() pruned %q, want %q", got, tt.wantPruned)
+			}
+		})
+	}
+}
+
+func TestNearbyVersions(t *testing.T) {
+	versions := []string{"v1", "v2", "v3", "v5", "v6", "v7", "v8"}
+	tests := []struct {
+		ver  string
+		n    int
+		want []string
+	}{
+		{"v4", 2, []string{"v2", "v3", "v5", "v6"}},
+		{"v0", 2, []string{"v1", "v2"}},
+		{"v9", 2, []string{"v7", "v8"}},
+		{"v5", 1, []string{"v3", "v6"}},
+	}
+
+	for _, tt := range tests {
+		got := Versioning{}.NearbyVersions(versions, tt.ver, tt.n)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("NearbyVersions(%s, %d) = %v, want %v", tt.ver, tt.n, got, tt.want)
+		}
+	}
+	if got := (Versioning{}).NearbyVersions(nil, "v1", 3); len(got) != 0 {
+		t.Errorf("NearbyVersions(nil) = %v, want empty", got)
+	}
+}
+
+func TestVersionFilter(t *testing.T) {
+	keys := []string{
+		"schemas/v1/schema.sql",
+		"schemas/v1/completed",
+		"schemas/v2/schema.sql",
+		"schemas/v2/completed",
+		"schemas/archive/schema.sql",
+		"schemas/archive/completed",
+		"schemas/v99-tmp/schema.sql",
+		"schemas/v99-tmp/completed",
+		"schemas/manual-backups/schema.sql",
+	}
+
+	tests := []struct {
+		name          string
+		include       []string
+		ignore        []string
+		wantLatest    string
+		wantCompleted string
+		wantVersions  []string
+	}{
+		{
+			name:          "no filter lets the v99-tmp pre-release win",
+			wantLatest:    "v99-tmp",
+			wantCompleted: "v99-tmp",
+			wantVersions:  []string{"archive", "manual-backups", "v1", "v2", "v99-tmp"},
+		},
+		{
+			name:          "ignore patterns",
+			ignore:        []string{"-tmp$", "^archive$", "backups"},
+			wantLatest:    "v2",
+			wantCompleted: "v2",
+			wantVersions:  []string{"v1", "v2"},
+		},
+		{
+			name:          "include allowlist",
+			include:       []string{`^v\d+$`},
+			wantLatest:    "v2",
+			wantCompleted: "v2",
+			wantVersions:  []string{"v1", "v2"},
+		},
+		{
+			name:          "ignore wins over include",
+			include:       []string{`^v\d+$`},
+			ignore:        []string{"^v2$"},
+			wantLatest:    "v1",
+			wantCompleted: "v1",
+			wantVersions:  []string{"v1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versioning := Versioning{Include: compilePatterns(t, tt.include), Ignore: compilePatterns(t, tt.ignore)}
+
+			_, latest, err := FindLatestVersion(keys, "schemas/", "schema.sql", versioning)
+			if err != nil {
+				t.Fatalf("FindLatestVersion() error = %v", err)
+			}
+			if latest != tt.wantLatest {
+				t.Errorf("FindLatestVersion() = %s, want %s", latest, tt.wantLatest)
+			}
+
+			var objects []types.Object
+			for _, key := range keys {
+				objects = append(objects, types.Object{Key: aws.String(key)})
+			}
+			mock := &mockS3Client{
+				listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return &s3.ListObjectsV2Output{Contents: objects}, nil
+				},
+			}
+			_, completed, err := FindLatestCompletedSchema(context.Background(), mock, "bucket", "schemas/", "schema.sql", "completed", versioning)
+			if err != nil {
+				t.Fatalf("FindLatestCompletedSchema() error = %v", err)
+			}
+			if completed != tt.wantCompleted {
+				t.Errorf("FindLatestCompletedSchema() = %s, want %s", completed, tt.wantCompleted)
+			}
+
+			var versions []string
+			for _, info := range CollectVersions(objects, "schemas/", "schema.sql", "completed", versioning) {
+				versions = append(versions, info.Version)
+			}
+			if !reflect.DeepEqual(versions, tt.wantVersions) {
+				t.Errorf("CollectVersions() = %v, want %v", versions, tt.wantVersions)
+			}
+		})
+	}
+}
+
+func compilePatterns(t *testing.T, patterns []string) []*regexp.Regexp {
+	t.Helper()
+	var compiled []*regexp.Regexp
+	for _, p := range patterns {
+		compiled = append(compiled, regexp.MustCompile(p))
+	}
+	return compiled
+}